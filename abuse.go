@@ -0,0 +1,210 @@
+package popgun
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Abuse signals recorded by the server, others like geo anomalies can be
+// reported with Client.ReportAbuse.
+const (
+	SIGNAL_AUTH_FAILURE    = "auth_failure"
+	SIGNAL_INVALID_COMMAND = "invalid_command"
+	// recorded for every command, so a high command rate adds up
+	SIGNAL_COMMAND     = "command"
+	SIGNAL_GEO_ANOMALY = "geo_anomaly"
+	// recorded for the use of a honeytoken command, see Server.Honeytokens
+	SIGNAL_HONEYTOKEN = "honeytoken"
+)
+
+// AbuseScorer combines abuse signals into scores per IP address and user.
+// Implementations must be safe for concurrent use.
+type AbuseScorer interface {
+	// Record adds a signal of a client, username may be empty.
+	Record(ip, username, signal string)
+	// Score returns the score of a client, the higher the more abusive.
+	Score(ip, username string) float64
+}
+
+// AbuseThresholds are the scores at which the server takes action against
+// a client, a threshold of 0 disables the action.
+type AbuseThresholds struct {
+	// delay every command of the client by ThrottleDelay, 1s by default
+	Throttle      float64
+	ThrottleDelay time.Duration
+	// refuse authentication over connections without TLS
+	RequireTLS float64
+	// close the session and refuse new connections from the IP address
+	Ban float64
+}
+
+// DefaultAbuseWeights are the signal weights of DecayingScorer.
+var DefaultAbuseWeights = map[string]float64{
+	SIGNAL_AUTH_FAILURE:    1,
+	SIGNAL_INVALID_COMMAND: 0.5,
+	SIGNAL_COMMAND:         0.01,
+	SIGNAL_GEO_ANOMALY:     3,
+	// enough to exceed any sensible ban threshold at once
+	SIGNAL_HONEYTOKEN: 100,
+}
+
+// DecayingScorer adds up the weights of signals per IP address and per user,
+// halving scores every HalfLife. The score of a client is the higher one of
+// its IP address and user.
+type DecayingScorer struct {
+	Weights  map[string]float64
+	HalfLife time.Duration
+	// Clock, if set, replaces the system clock
+	Clock Clock
+
+	mu       sync.Mutex
+	scores   map[string]decayingScore
+	records  int
+	counters map[string]abuseCount
+}
+
+type abuseCount struct {
+	value   int64
+	expires time.Time
+}
+
+type decayingScore struct {
+	value   float64
+	updated time.Time
+}
+
+func NewDecayingScorer(halfLife time.Duration) *DecayingScorer {
+	return &DecayingScorer{
+		Weights:  DefaultAbuseWeights,
+		HalfLife: halfLife,
+		scores:   make(map[string]decayingScore),
+	}
+}
+
+// decayed returns the score of key at now, it must be called with mu held.
+func (s *DecayingScorer) decayed(key string, now time.Time) float64 {
+	score, ok := s.scores[key]
+	if !ok {
+		return 0
+	}
+	elapsed := now.Sub(score.updated)
+	return score.value * math.Pow(0.5, float64(elapsed)/float64(s.HalfLife))
+}
+
+func (s *DecayingScorer) Record(ip, username, signal string) {
+	weight := s.Weights[signal]
+	if weight == 0 {
+		return
+	}
+	now := clockOrSystem(s.Clock).Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range abuseKeys(ip, username) {
+		s.scores[key] = decayingScore{value: s.decayed(key, now) + weight, updated: now}
+	}
+	// drop forgotten clients once in a while
+	s.records++
+	if s.records%1024 == 0 {
+		for key := range s.scores {
+			if s.decayed(key, now) < 0.01 {
+				delete(s.scores, key)
+			}
+		}
+	}
+}
+
+// Add implements AbuseCounter.
+func (s *DecayingScorer) Add(key string, delta int64, expires time.Time) (int64, error) {
+	now := clockOrSystem(s.Clock).Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[string]abuseCount)
+	}
+	count := s.counters[key]
+	if !now.Before(count.expires) {
+		count.value = 0
+	}
+	count.value += delta
+	count.expires = expires
+	s.counters[key] = count
+	// drop expired counters once in a while
+	s.records++
+	if s.records%1024 == 0 {
+		for key, count := range s.counters {
+			if !now.Before(count.expires) {
+				delete(s.counters, key)
+			}
+		}
+	}
+	return count.value, nil
+}
+
+func (s *DecayingScorer) Score(ip, username string) float64 {
+	now := clockOrSystem(s.Clock).Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score := 0.0
+	for _, key := range abuseKeys(ip, username) {
+		score = math.Max(score, s.decayed(key, now))
+	}
+	return score
+}
+
+func abuseKeys(ip, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+// abuseUsername returns the user the client authenticated or attempts to
+// authenticate as.
+func (c *Client) abuseUsername() string {
+	if c.user != nil {
+		return c.user.Username()
+	}
+	return c.username
+}
+
+// ReportAbuse records an abuse signal of the client and takes action if
+// its score exceeds a threshold. It returns false if the session has to
+// end.
+func (c *Client) ReportAbuse(signal string) bool {
+	scorer := c.server.AbuseScorer
+	if scorer == nil {
+		return true
+	}
+	ip, username := remoteIP(c.conn), c.abuseUsername()
+	scorer.Record(ip, username, signal)
+	score := scorer.Score(ip, username)
+	c.server.Metrics.Observe("abuse.score", score, signal)
+
+	thresholds := c.server.AbuseThresholds
+	if thresholds.Ban > 0 && score >= thresholds.Ban {
+		c.ErrorLog.Printf("Banning %s (user %q) with abuse score %.1f", ip, username, score)
+		c.server.Metrics.Inc("abuse.action", "ban")
+		return false
+	}
+	if thresholds.RequireTLS > 0 && score >= thresholds.RequireTLS && !c.requireTLS {
+		c.server.Metrics.Inc("abuse.action", "require_tls")
+		c.requireTLS = true
+	}
+	if thresholds.Throttle > 0 && score >= thresholds.Throttle {
+		c.server.Metrics.Inc("abuse.action", "throttle")
+		delay := thresholds.ThrottleDelay
+		if delay == 0 {
+			delay = time.Second
+		}
+		c.wait(delay)
+	}
+	return true
+}
+
+// banned reports whether new connections of the client are refused.
+func (c *Client) banned() bool {
+	scorer, ban := c.server.AbuseScorer, c.server.AbuseThresholds.Ban
+	return scorer != nil && ban > 0 && scorer.Score(remoteIP(c.conn), "") >= ban
+}
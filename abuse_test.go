@@ -0,0 +1,76 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+func TestDecayingScorer(t *testing.T) {
+	scorer := NewDecayingScorer(time.Hour)
+	scorer.Record("10.0.0.1", "john", SIGNAL_AUTH_FAILURE)
+	scorer.Record("10.0.0.2", "john", SIGNAL_AUTH_FAILURE)
+
+	if score := scorer.Score("10.0.0.1", ""); score < 0.99 || score > 1 {
+		t.Errorf("Expected IP score 1, but got %v", score)
+	}
+	if score := scorer.Score("10.0.0.3", "john"); score < 1.99 || score > 2 {
+		t.Errorf("Expected user score 2, but got %v", score)
+	}
+	if score := scorer.Score("10.0.0.3", ""); score != 0 {
+		t.Errorf("Expected score 0, but got %v", score)
+	}
+
+	scorer.HalfLife = time.Nanosecond
+	if score := scorer.Score("10.0.0.1", "john"); score > 0.01 {
+		t.Errorf("Expected decayed score, but got %v", score)
+	}
+}
+
+func TestClient_handleAbuseBan(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.AbuseScorer = NewDecayingScorer(time.Hour)
+	server.AbuseThresholds.Ban = 1.5
+	go server.Serve(listener)
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(conn, "BOGUS\r\n")
+		line, _ := reader.ReadString('\n')
+		if strings.Contains(line, "Too many errors") {
+			break
+		}
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected abusive session to be closed")
+	}
+
+	conn, err = net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	greeting, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.HasPrefix(greeting, "-ERR [SYS/TEMP]") {
+		t.Errorf("Expected banned client to be refused, but got '%s'", greeting)
+	}
+}
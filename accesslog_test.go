@@ -0,0 +1,110 @@
+package popgun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	disconnected := make(chan CloseReason, 1)
+	var lines bytes.Buffer
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.Clock = newFakeClock()
+	server.AccessLog = NewAccessLog(&syncWriter{w: &lines})
+	server.AccessLog.Commands = true
+	server.Hooks.OnDisconnect = func(c *Client, reason CloseReason) {
+		disconnected <- reason
+	}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\nRETR 1\r\nDELE 1\r\nLIST 1\r\nQUIT\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "+OK Goodbye") {
+			break
+		}
+	}
+	<-disconnected
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(lines.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid access log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 7 {
+		t.Fatalf("Expected 6 command lines and a session line, but got %d", len(entries))
+	}
+	for i, expected := range []struct{ command, status, user string }{
+		{"USER", "ok", ""},
+		{"PASS", "ok", "alice"},
+		{"RETR", "ok", "alice"},
+		{"DELE", "ok", "alice"},
+		{"LIST", "err", "alice"},
+	} {
+		entry := entries[i]
+		if entry["type"] != "command" || entry["command"] != expected.command || entry["status"] != expected.status || (entry["user"] != nil && entry["user"] != expected.user) {
+			t.Errorf("Unexpected command line %v, expected %v", entry, expected)
+		}
+	}
+	session := entries[6]
+	for key, expected := range map[string]interface{}{
+		"type":         "session",
+		"session":      float64(1),
+		"remote":       "pipe",
+		"user":         "alice",
+		"commands":     float64(6),
+		"retrieved":    float64(1),
+		"deleted":      float64(1),
+		"close_reason": "quit",
+	} {
+		if session[key] != expected {
+			t.Errorf("Expected %s to be %v, but got %v", key, expected, session[key])
+		}
+	}
+	if sent, _ := session["octets_sent"].(float64); sent < 100 {
+		t.Errorf("Expected octets sent to be counted, but got %v", session["octets_sent"])
+	}
+
+	rotated := &closingBuffer{}
+	server.AccessLog.Reopen(rotated)
+	server.AccessLog.Reopen(&bytes.Buffer{})
+	if !rotated.closed {
+		t.Error("Expected previous writer to be closed on reopen")
+	}
+}
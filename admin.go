@@ -0,0 +1,360 @@
+package popgun
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminHandler returns an http.Handler exposing server administration
+// endpoints. It has no authentication, so it should only be served on a
+// trusted interface.
+//
+//	GET  /sessions                           list live sessions
+//	POST /sessions/{id}/trace?enabled=true   toggle tracing of a live session
+//	POST /sessions/{id}/kick                 close a live session
+//	POST /trace-next?ip=1.2.3.4&enabled=true trace the next connection from ip
+//	GET  /health                             backend health state
+//	GET  /maintenance                        maintenance mode state
+//	POST /maintenance?enabled=true&message=  switch maintenance mode
+//	GET  /drain                              drain state and live sessions
+//	POST /drain                              stop accepting connections, see Drain
+//	GET  /expunged?user=alice                recoverable messages of a user
+//	POST /expunged/recover?user=alice&uid=   recover an expunged message
+//	GET  /reviews                            maildrops flagged for review
+//	POST /reviews/resolve?user=alice         remove the review flag
+//
+// The expunged endpoints require a backend implementing RecoveryBackend.
+// Requests changing the server state, kicking or tracing sessions or
+// accessing maildrops must name the admin acting in the X-Admin-User header, e.g. set by an authenticating
+// proxy, which is logged and exported with events.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.adminSessions)
+	mux.HandleFunc("/sessions/", s.adminSession)
+	mux.HandleFunc("/trace-next", s.adminTraceNext)
+	mux.HandleFunc("/health", s.adminHealth)
+	mux.HandleFunc("/maintenance", s.adminMaintenance)
+	mux.HandleFunc("/drain", s.adminDrain)
+	mux.HandleFunc("/expunged", s.adminExpunged)
+	mux.HandleFunc("/expunged/recover", s.adminRecover)
+	mux.HandleFunc("/reviews", s.adminReviews)
+	mux.HandleFunc("/reviews/resolve", s.adminResolveReview)
+	return mux
+}
+
+type adminSessionInfo struct {
+	ID          uint64 `json:"id"`
+	RemoteAddr  string `json:"remote_addr"`
+	User        string `json:"user,omitempty"`
+	Actor       string `json:"actor,omitempty"`
+	Trace       bool   `json:"trace"`
+	TLSVersion  string `json:"tls_version,omitempty"`
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+}
+
+func (s *Server) adminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infos := []adminSessionInfo{}
+	for _, c := range s.Sessions() {
+		info := adminSessionInfo{
+			ID:         c.ID(),
+			RemoteAddr: c.RemoteAddr().String(),
+			User:       c.Username(),
+			Actor:      c.Actor(),
+			Trace:      c.Tracing(),
+		}
+		if state, ok := c.TLSState(); ok {
+			info.TLSVersion = tlsVersionName(state.Version)
+			info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+			info.ALPN = state.NegotiatedProtocol
+		}
+		infos = append(infos, info)
+	}
+	writeAdminJSON(w, infos)
+}
+
+func (s *Server) adminSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	if len(parts) != 2 || (parts[1] != "trace" && parts[1] != "kick") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if parts[1] == "kick" {
+		s.adminKick(w, r, id)
+		return
+	}
+	enabled, err := adminEnabled(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// traces include the messages sent to the client
+	actor, ok := adminActor(w, r)
+	if !ok {
+		return
+	}
+	c, ok := s.Session(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c.SetTrace(enabled)
+	s.ErrorLog.Printf("Tracing of session %d of user %s set to %t by %s", c.ID(), c.Username(), enabled, actor)
+	writeAdminJSON(w, adminSessionInfo{ID: c.ID(), RemoteAddr: c.RemoteAddr().String(), Trace: enabled})
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request, id uint64) {
+	actor, ok := adminActor(w, r)
+	if !ok {
+		return
+	}
+	c, ok := s.Session(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c.Kick(actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminTraceNext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		http.Error(w, "missing ip", http.StatusBadRequest)
+		return
+	}
+	enabled, err := adminEnabled(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor, ok := adminActor(w, r)
+	if !ok {
+		return
+	}
+	s.TraceNext(ip, enabled)
+	s.ErrorLog.Printf("Tracing of the next connection from %s set to %t by %s", ip, enabled, actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminHealthInfo struct {
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked,omitempty"`
+}
+
+func (s *Server) adminHealth(w http.ResponseWriter, r *http.Request) {
+	state, _ := s.health.Load().(healthState)
+	info := adminHealthInfo{Healthy: state.err == nil, Checked: state.checked}
+	if state.err != nil {
+		info.Error = state.err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+	writeAdminJSON(w, info)
+}
+
+type adminMaintenanceInfo struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *Server) adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := adminEnabled(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		actor, ok := adminActor(w, r)
+		if !ok {
+			return
+		}
+		s.SetMaintenance(enabled, r.URL.Query().Get("message"))
+		s.ErrorLog.Printf("Maintenance mode set to %t by %s", enabled, actor)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enabled, message := s.Maintenance()
+	writeAdminJSON(w, adminMaintenanceInfo{Enabled: enabled, Message: message})
+}
+
+type adminDrainInfo struct {
+	Draining bool `json:"draining"`
+	Sessions int  `json:"sessions"`
+}
+
+func (s *Server) adminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		actor, ok := adminActor(w, r)
+		if !ok {
+			return
+		}
+		s.Drain()
+		s.ErrorLog.Printf("Draining started by %s", actor)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, adminDrainInfo{Draining: s.draining(), Sessions: len(s.Sessions())})
+}
+
+type adminExpungedInfo struct {
+	Uid      string    `json:"uid"`
+	Octets   int       `json:"octets"`
+	Expunged time.Time `json:"expunged"`
+	Expires  time.Time `json:"expires"`
+}
+
+// adminRecovery returns the recovery backend, the user and the acting admin
+// of a request, it writes an error response if there are none.
+func (s *Server) adminRecovery(w http.ResponseWriter, r *http.Request, method string) (RecoveryBackend, string, string, bool) {
+	if r.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, "", "", false
+	}
+	rb, ok := s.backend.(RecoveryBackend)
+	if !ok {
+		http.Error(w, "recovery not supported by backend", http.StatusNotImplemented)
+		return nil, "", "", false
+	}
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return nil, "", "", false
+	}
+	actor, ok := adminActor(w, r)
+	if !ok {
+		return nil, "", "", false
+	}
+	return rb, username, actor, true
+}
+
+func (s *Server) adminExpunged(w http.ResponseWriter, r *http.Request) {
+	rb, username, _, ok := s.adminRecovery(w, r, http.MethodGet)
+	if !ok {
+		return
+	}
+	messages, err := rb.Expunged(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	infos := []adminExpungedInfo{}
+	for _, msg := range messages {
+		infos = append(infos, adminExpungedInfo{Uid: msg.Uid, Octets: msg.Octets, Expunged: msg.Expunged, Expires: msg.Expires})
+	}
+	writeAdminJSON(w, infos)
+}
+
+func (s *Server) adminRecover(w http.ResponseWriter, r *http.Request) {
+	rb, username, actor, ok := s.adminRecovery(w, r, http.MethodPost)
+	if !ok {
+		return
+	}
+	uid := r.URL.Query().Get("uid")
+	if uid == "" {
+		http.Error(w, "missing uid", http.StatusBadRequest)
+		return
+	}
+	if err := rb.Recover(username, uid); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.ErrorLog.Printf("Recovered expunged message %s of user %s by %s", uid, username, actor)
+	s.exportEvent(Event{Type: EVENT_RECOVERED, User: username, Actor: actor, Uid: uid})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminReviewInfo struct {
+	User       string   `json:"user"`
+	FailedUids []string `json:"failed_uids"`
+}
+
+func (s *Server) adminReviews(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reviews := s.Reviews()
+	infos := []adminReviewInfo{}
+	for _, username := range reviewUsernames(reviews) {
+		infos = append(infos, adminReviewInfo{User: username, FailedUids: reviews[username]})
+	}
+	writeAdminJSON(w, infos)
+}
+
+func (s *Server) adminResolveReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return
+	}
+	actor, ok := adminActor(w, r)
+	if !ok {
+		return
+	}
+	if !s.ResolveReview(username) {
+		http.Error(w, "maildrop not flagged", http.StatusNotFound)
+		return
+	}
+	s.ErrorLog.Printf("Review of maildrop of user %s resolved by %s", username, actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminActor returns the admin acting in a request, it writes an error
+// response if there is none.
+func adminActor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	actor := r.Header.Get("X-Admin-User")
+	if actor == "" {
+		http.Error(w, "missing X-Admin-User", http.StatusForbidden)
+		return "", false
+	}
+	return actor, true
+}
+
+// adminEnabled parses the optional "enabled" query parameter, defaulting to true.
+func adminEnabled(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("enabled")
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,308 @@
+package popgun
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestServer_AdminHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(&syncWriter{w: &audit}, "", 0)
+	go server.Serve(listener)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	// traces include messages, so admins must identify themselves
+	resp, err := http.Post(admin.URL+"/trace-next?ip=127.0.0.1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected anonymous request to be refused, but got %d", resp.StatusCode)
+	}
+
+	resp, err = adminRequest(http.MethodPost, admin.URL+"/trace-next?ip=127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, but got %d", len(sessions))
+	}
+	if !sessions[0].Tracing() {
+		t.Error("Expected tracing to be enabled for the session")
+	}
+
+	url := fmt.Sprintf("%s/sessions/%d/trace?enabled=false", admin.URL, sessions[0].ID())
+	resp, err = http.Post(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected anonymous request to be refused, but got %d", resp.StatusCode)
+	}
+	resp, err = adminRequest(http.MethodPost, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"trace":false`) {
+		t.Errorf("Expected tracing to be disabled, but got '%s'", body)
+	}
+	if sessions[0].Tracing() {
+		t.Error("Expected tracing to be disabled for the session")
+	}
+	logged := audit.String()
+	if !strings.Contains(logged, "Tracing of the next connection from 127.0.0.1 set to true by root") || !strings.Contains(logged, "set to false by root") {
+		t.Errorf("Expected tracing changes to be logged, but got %q", logged)
+	}
+}
+
+func TestServer_AdminMaintenance(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(&syncWriter{w: &audit}, "", 0)
+	go server.Serve(listener)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Post(admin.URL+"/maintenance?enabled=true&message=Back+at+noon", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected anonymous request to be refused, but got %d", resp.StatusCode)
+	}
+	if on, _ := server.Maintenance(); on {
+		t.Fatal("Expected maintenance mode to be unchanged")
+	}
+
+	resp, err = adminRequest(http.MethodPost, admin.URL+"/maintenance?enabled=true&message=Back+at+noon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if on, _ := server.Maintenance(); !on {
+		t.Fatal("Expected maintenance mode to be enabled")
+	}
+	if logged := audit.String(); !strings.Contains(logged, "Maintenance mode set to true by root") {
+		t.Errorf("Expected maintenance change to be logged, but got %q", logged)
+	}
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	greeting, _ := bufio.NewReader(conn).ReadString('\n')
+	if greeting != "-ERR [SYS/TEMP] Back at noon\r\n" {
+		t.Errorf("Expected maintenance greeting, but got '%s'", greeting)
+	}
+}
+
+// adminRequest sends an admin request on behalf of the admin "root".
+func adminRequest(method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Admin-User", "root")
+	return http.DefaultClient.Do(req)
+}
+
+func TestServer_AdminRecovery(t *testing.T) {
+	backend := memory.New()
+	backend.RecoveryWindow = time.Hour
+	backend.Deliver("alice", "a", "Subject: one\n\nbody\n")
+	user := testUser("alice")
+	backend.Lock(user)
+	backend.Dele(user, 1)
+	backend.Update(user)
+	backend.Unlock(user)
+
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	// admins must identify themselves to access maildrops
+	resp, err := http.Get(admin.URL + "/expunged?user=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected anonymous request to be refused, but got %d", resp.StatusCode)
+	}
+
+	resp, err = adminRequest(http.MethodGet, admin.URL+"/expunged?user=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"uid":"a","octets":22`) {
+		t.Errorf("Expected expunged message a, but got '%s'", body)
+	}
+
+	resp, err = adminRequest(http.MethodPost, admin.URL+"/expunged/recover?user=alice&uid=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if uids := backend.Messages("alice"); len(uids) != 1 || uids[0] != "a" {
+		t.Errorf("Expected message a to be recovered, but got %v", uids)
+	}
+
+	resp, err = adminRequest(http.MethodPost, admin.URL+"/expunged/recover?user=alice&uid=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	server = NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/expunged?user=alice", nil)
+	req.Header.Set("X-Admin-User", "root")
+	server.AdminHandler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotImplemented, recorder.Code)
+	}
+}
+
+// lockRecordingBackend records the users maildrops are locked for.
+type lockRecordingBackend struct {
+	*memory.Backend
+	locked chan backends.User
+}
+
+func (b lockRecordingBackend) Lock(user backends.User) error {
+	b.locked <- user
+	return b.Backend.Lock(user)
+}
+
+func TestServer_AdminKick(t *testing.T) {
+	backend := lockRecordingBackend{Backend: memory.New(), locked: make(chan backends.User, 1)}
+	events := make(channelProducer, 10)
+	listener := newPipeListener()
+	server := NewServer(masterAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.MasterUserSeparator = "*"
+	server.Events = NewEventExporter(events)
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "USER alice*admin\r\nPASS admin-secret\r\n")
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+	// the backend is told who acts on behalf of the user
+	user, ok := (<-backend.locked).(backends.ActingUser)
+	if !ok || user.Username() != "alice" || user.Actor() != "admin" {
+		t.Errorf("Expected maildrop locked for alice by admin, but got %v", user)
+	}
+
+	resp, err := http.Get(admin.URL + "/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"user":"alice","actor":"admin"`) {
+		t.Errorf("Expected session of alice by admin, but got '%s'", body)
+	}
+
+	id := server.Sessions()[0].ID()
+	resp, err = http.Post(fmt.Sprintf("%s/sessions/%d/kick", admin.URL, id), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected anonymous kick to be refused, but got %d", resp.StatusCode)
+	}
+	resp, err = adminRequest(http.MethodPost, fmt.Sprintf("%s/sessions/%d/kick", admin.URL, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if event.Actor != "admin" || event.User != "alice" {
+				t.Errorf("Expected event of alice by admin, but got %+v", event)
+			}
+			if event.Type != EVENT_SESSION_CLOSED {
+				continue
+			}
+			if event.CloseReason != "policy" || event.KickedBy != "root" {
+				t.Errorf("Expected session kicked by root, but got %+v", event)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("Expected session_closed event")
+		}
+	}
+}
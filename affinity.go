@@ -0,0 +1,195 @@
+package popgun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// PROXY_TLV_AFFINITY is the default PROXY protocol TLV type carrying the
+// affinity token, the first type reserved for custom use.
+const PROXY_TLV_AFFINITY = 0xE0
+
+// proxySignature starts every PROXY protocol version 2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// AffinityConn can be implemented by connections carrying the affinity
+// token of the instance a fronting proxy meant to route them to, see
+// Server.AffinityToken and ProxyListener.
+type AffinityConn interface {
+	AffinityToken() string
+}
+
+// NewAffinityToken returns a random affinity token, e.g. for an instance
+// started without a configured one.
+func NewAffinityToken() (string, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// checkAffinity counts whether a connection carrying an affinity token was
+// routed to this instance, as "affinity.routed" labeled "hit" or "miss".
+// After a miss, e.g. because the instance was replaced, the proxy learns
+// the current token from the greeting.
+func (c *Client) checkAffinity() {
+	token := c.server.AffinityToken
+	if token == "" || c.routedToken == "" {
+		return
+	}
+	if c.routedToken == token {
+		c.server.Metrics.Inc("affinity.routed", "hit")
+		return
+	}
+	c.server.Metrics.Inc("affinity.routed", "miss")
+	c.DebugLog.Printf("[%d] Connection routed for affinity token %s to instance %s", c.id, c.routedToken, token)
+}
+
+// ProxyListener accepts connections from a load balancer sending the PROXY
+// protocol version 2 header. Its connections have the remote address of
+// the client and implement AffinityConn with the value of the
+// AffinityTLV. Connections with an invalid header are closed and logged.
+type ProxyListener struct {
+	net.Listener
+	// Timeout limits reading the header, 5 seconds by default.
+	Timeout time.Duration
+	// AffinityTLV is the TLV type of the affinity token,
+	// PROXY_TLV_AFFINITY by default.
+	AffinityTLV byte
+	ErrorLog    Logger
+
+	once  sync.Once
+	conns chan net.Conn
+	err   chan error
+}
+
+// NewProxyListener wraps l, whose connections must all come from trusted
+// load balancers.
+func NewProxyListener(l net.Listener) *ProxyListener {
+	return &ProxyListener{
+		Listener:    l,
+		Timeout:     5 * time.Second,
+		AffinityTLV: PROXY_TLV_AFFINITY,
+		conns:       make(chan net.Conn),
+		err:         make(chan error, 1),
+	}
+}
+
+// Accept returns the next connection whose header was read. Headers are
+// read concurrently, so slow load balancers don't hold up others.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// for later calls, the accept loop ended
+		l.err <- err
+		return nil, err
+	}
+}
+
+func (l *ProxyListener) acceptLoop() {
+	var backoff AcceptBackoff
+	for {
+		conn, err := l.Listener.Accept()
+		if delay, temporary := backoff.Next(err); err != nil {
+			if !temporary {
+				l.err <- err
+				return
+			}
+			time.Sleep(delay)
+			continue
+		}
+		go func() {
+			proxied, err := l.readHeader(conn)
+			if err != nil {
+				conn.Close()
+				if l.ErrorLog != nil {
+					l.ErrorLog.Printf("Invalid PROXY header from %s: %v", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			l.conns <- proxied
+		}()
+	}
+}
+
+// readHeader reads the PROXY protocol header of conn.
+func (l *ProxyListener) readHeader(conn net.Conn) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(l.Timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxySignature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("Not a PROXY protocol version 2 header")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	proxied := &proxyConn{Conn: conn, remote: conn.RemoteAddr()}
+	command, family := header[12]&0x0f, header[13]
+	if command == 0 {
+		// LOCAL, e.g. health checks of the balancer itself
+		return proxied, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("Unknown command %d", command)
+	}
+	var tlvs []byte
+	switch family {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("Short TCP over IPv4 addresses")
+		}
+		proxied.remote = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}
+		tlvs = payload[12:]
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("Short TCP over IPv6 addresses")
+		}
+		proxied.remote = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}
+		tlvs = payload[36:]
+	default:
+		// unspecified or unsupported family, keep the address of the balancer
+		return proxied, nil
+	}
+	for len(tlvs) >= 3 {
+		length := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+length {
+			return nil, fmt.Errorf("Truncated TLV %#x", tlvs[0])
+		}
+		if tlvs[0] == l.AffinityTLV {
+			proxied.token = string(tlvs[3 : 3+length])
+		}
+		tlvs = tlvs[3+length:]
+	}
+	return proxied, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+	token  string
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) AffinityToken() string {
+	return c.token
+}
@@ -0,0 +1,103 @@
+package popgun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// proxyHeader returns a PROXY protocol version 2 header of a TCP over IPv4
+// connection from 192.0.2.1:4711 with the affinity token.
+func proxyHeader(token string) []byte {
+	payload := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x12, 0x67, 0, 110}
+	if token != "" {
+		payload = append(payload, PROXY_TLV_AFFINITY, 0, byte(len(token)))
+		payload = append(payload, token...)
+	}
+	header := append([]byte(nil), proxySignature...)
+	header = append(header, 0x21, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := newCountingMetrics()
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.AffinityToken = "pop1"
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	listener := NewProxyListener(l)
+	listener.ErrorLog = server.ErrorLog
+	go server.Serve(listener)
+
+	// greet connects with header and returns the greeting
+	greet := func(header []byte) (string, error) {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		conn.Write(header)
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	greeting, err := greet(proxyHeader("pop1"))
+	if err != nil || greeting != "+OK POPgun POP3 server ready affinity=pop1\r\n" {
+		t.Errorf("Expected greeting with affinity token, but got %q, %v", greeting, err)
+	}
+	remotes := make(map[string]bool)
+	for _, c := range server.Sessions() {
+		remotes[c.RemoteAddr().String()] = true
+	}
+	if !remotes["192.0.2.1:4711"] {
+		t.Errorf("Expected the remote address of the client, but got %v", remotes)
+	}
+	if _, err := greet(proxyHeader("pop0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := greet(proxyHeader("")); err != nil {
+		t.Fatal(err)
+	}
+	if greeting, err := greet([]byte("USER alice\r\n\r\n\r\n\r\n")); err == nil {
+		t.Errorf("Expected connection without header closed, but got %q", greeting)
+	}
+
+	if hits, misses := metrics.count("affinity.routed:hit"), metrics.count("affinity.routed:miss"); hits != 1 || misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, but got %d and %d", hits, misses)
+	}
+}
+
+func TestNewAffinityToken(t *testing.T) {
+	first, err := NewAffinityToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := NewAffinityToken()
+	if len(first) != 16 || first == second || strings.Trim(first, "0123456789abcdef") != "" {
+		t.Errorf("Expected distinct random hex tokens, but got %s and %s", first, second)
+	}
+}
+
+func TestProxyListener_AcceptError(t *testing.T) {
+	permanent := fmt.Errorf("Listener broken")
+	l := NewProxyListener(&failingListener{pipeListener: newPipeListener(), errs: []error{temporaryError{}, permanent}})
+	for i := 0; i < 2; i++ {
+		if _, err := l.Accept(); err != permanent {
+			t.Errorf("Expected the permanent error, but got %v", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package popgun
+
+import (
+	"fmt"
+	"net"
+	"unicode/utf8"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// ReadOnlySASLServer can be implemented by SASL servers granting guest
+// access. Sessions of exchanges reporting ReadOnly are read-only like those
+// of master users, i.e. DELE is refused and QUIT leaves the maildrop as is.
+type ReadOnlySASLServer interface {
+	SASLServer
+	ReadOnly() bool
+}
+
+// maximum length of the trace information of ANONYMOUS in characters
+const maxAnonymousTrace = 255
+
+// SASLAnonymous returns the ANONYMOUS mechanism (RFC 4505), logging any
+// client in as guest in a read-only session, e.g. to serve a public
+// maildrop of announcements. The trace information sent by the client is
+// only checked to be at most 255 characters of UTF-8. The backend must let
+// concurrent sessions lock the maildrop of guest, otherwise guests are
+// served one at a time.
+func SASLAnonymous(guest backends.User) SASLMechanism {
+	return func(conn net.Conn, auth Authorizator) SASLServer {
+		return &anonymousServer{guest: guest}
+	}
+}
+
+type anonymousServer struct {
+	guest backends.User
+}
+
+func (s *anonymousServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		// ask for the trace information
+		return nil, false, nil
+	}
+	if !utf8.Valid(response) || utf8.RuneCount(response) > maxAnonymousTrace {
+		return nil, false, fmt.Errorf("Invalid trace information")
+	}
+	return nil, true, nil
+}
+
+func (s *anonymousServer) Username() string {
+	return s.guest.Username()
+}
+
+func (s *anonymousServer) Authorize(username string) (backends.User, error) {
+	return s.guest, nil
+}
+
+func (s *anonymousServer) ReadOnly() bool {
+	return true
+}
@@ -0,0 +1,55 @@
+package popgun
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestSASLAnonymous(t *testing.T) {
+	trace := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	tables := []struct {
+		lines    []string
+		expected []string
+	}{
+		{[]string{"AUTH ANONYMOUS " + trace("alice@example.com"), "DELE 1", "QUIT"}, []string{"+OK User Successfully Logged on", "-ERR DELE is not allowed for this account", "+OK Goodbye"}},
+		{[]string{"AUTH ANONYMOUS", "=", "STAT"}, []string{"+ ", "+OK User Successfully Logged on", "+OK 1 19"}},
+		{[]string{"AUTH ANONYMOUS " + trace(strings.Repeat("x", 256))}, []string{"-ERR [AUTH] Authentication failed: Invalid trace information"}},
+	}
+	for _, table := range tables {
+		backend := memory.New()
+		backend.Deliver("news", "1", "Subject: news\r\n\r\n\r\n")
+		listener := newPipeListener()
+		server := NewServer(secretAuthorizator{}, backend)
+		server.AllowInsecureAuth = true
+		server.SASL["ANONYMOUS"] = SASLAnonymous(testUser("news"))
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		for _, line := range table.lines {
+			fmt.Fprintf(conn, "%s\r\n", line)
+		}
+		for _, expected := range table.expected {
+			if line, _ := reader.ReadString('\n'); line != expected+"\r\n" {
+				t.Errorf("Expected %q for %q, but got %q", expected, table.lines, line)
+			}
+		}
+		conn.Close()
+		if messages := backend.Messages("news"); len(messages) != 1 {
+			t.Errorf("Expected public maildrop unchanged, but got %v", messages)
+		}
+	}
+}
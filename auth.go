@@ -0,0 +1,325 @@
+package popgun
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// AccountPolicy lets an external system drive account lockout. It is
+// consulted before credentials are checked and told about the outcome.
+type AccountPolicy interface {
+	// Locked reports whether username may not log in right now.
+	Locked(conn net.Conn, username string) (bool, error)
+	// RecordFailure is called after failed authentication of username.
+	RecordFailure(conn net.Conn, username string)
+	// RecordSuccess is called after successful authentication of username.
+	RecordSuccess(conn net.Conn, username string)
+}
+
+var ErrAccountLocked = fmt.Errorf("Account locked")
+
+// APOPAuthorizator is implemented by authorizators supporting the APOP
+// command. The greeting only advertises a timestamp if the authorizator
+// implements it.
+type APOPAuthorizator interface {
+	// AuthorizeAPOP checks digest, which should equal
+	// APOPDigest(timestamp, secret) for the shared secret of username.
+	AuthorizeAPOP(conn net.Conn, username, timestamp, digest string) (backends.User, error)
+}
+
+// MasterAuthorizator is implemented by authorizators supporting master
+// logins, which let support staff open the maildrop of a user with their
+// own credentials, see Server.MasterUserSeparator.
+type MasterAuthorizator interface {
+	// AuthorizeMaster checks the password of master and whether master
+	// may open the maildrop of username, and returns the user of it.
+	AuthorizeMaster(conn net.Conn, username, master, password string) (backends.User, error)
+}
+
+// PasswordChanger is implemented by authorizators letting users change
+// their password with the XPASSWD command, see Server.AllowPasswordChange.
+type PasswordChanger interface {
+	// ChangePassword changes the password of user to newPassword if
+	// oldPassword is the current one.
+	ChangePassword(conn net.Conn, user backends.User, oldPassword, newPassword string) error
+}
+
+// APOPDigest returns the APOP digest of the greeting timestamp and a shared
+// secret.
+func APOPDigest(timestamp, secret string) string {
+	sum := md5.Sum([]byte(timestamp + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apopTimestamp returns a unique msg-id for the greeting.
+func (c *Client) apopTimestamp() string {
+	hostname := c.hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("<%d.%d.%d@%s>", os.Getpid(), c.server.clock().Now().UnixNano(), rand.Int63(), hostname)
+}
+
+// authenticate checks the credentials with the authorizator. All
+// authentication mechanisms go through authenticateWith, so the account
+// policy and failure delay are applied consistently.
+func (c *Client) authenticate(username, password string) (backends.User, error) {
+	if target, master, ok := c.masterLogin(username); ok {
+		return c.authenticateMaster(target, master, password)
+	}
+	return c.authenticateWith(username, func(username string) (backends.User, error) {
+		return c.authorizator.Authorize(c.conn, username, password)
+	})
+}
+
+// masterLogin splits the username of a master login into the target user
+// and the master user, see Server.MasterUserSeparator.
+func (c *Client) masterLogin(username string) (target, master string, ok bool) {
+	if c.server == nil || c.server.MasterUserSeparator == "" {
+		return "", "", false
+	}
+	if _, ok := c.authorizator.(MasterAuthorizator); !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(username, c.server.MasterUserSeparator)
+	if i <= 0 || i+len(c.server.MasterUserSeparator) == len(username) {
+		return "", "", false
+	}
+	return username[:i], username[i+len(c.server.MasterUserSeparator):], true
+}
+
+// authenticateMaster authenticates master with password to open the
+// maildrop of target. Every attempt is logged.
+func (c *Client) authenticateMaster(target, master, password string) (backends.User, error) {
+	user, err := c.authenticateWith(target, func(target string) (backends.User, error) {
+		// set before checking, so failed logins are attributed too
+		c.setMaster(master)
+		return c.authorizator.(MasterAuthorizator).AuthorizeMaster(c.conn, target, master, password)
+	})
+	if err != nil {
+		c.setMaster("")
+		c.ErrorLog.Printf("Master user %s failed to log in as %s from %s: %v", master, target, c.RemoteAddr(), err)
+		return nil, err
+	}
+	c.ErrorLog.Printf("Master user %s logged in as %s from %s", master, user.Username(), c.RemoteAddr())
+	return actingUser{User: user, actor: master}, nil
+}
+
+// actingUser is passed to the backend for sessions of master users.
+type actingUser struct {
+	backends.User
+	actor string
+}
+
+func (u actingUser) Actor() string {
+	return u.actor
+}
+
+func (c *Client) setMaster(master string) {
+	c.mu.Lock()
+	c.master = master
+	c.mu.Unlock()
+}
+
+// Actor returns the identity acting on behalf of the logged in user, i.e.
+// the master user, empty if users act on their own.
+func (c *Client) Actor() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.master
+}
+
+// Username returns the name of the logged in user, empty before login.
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loggedIn
+}
+
+// authenticateWith authenticates username with check, which is passed the
+// canonical username.
+func (c *Client) authenticateWith(username string, check func(username string) (backends.User, error)) (backends.User, error) {
+	c.setMaster("")
+	var policy AccountPolicy
+	if c.server != nil {
+		policy = c.server.AccountPolicy
+		if c.server.Canonicalizer != nil {
+			canonical, err := c.server.Canonicalizer.Canonicalize(c.conn, username)
+			if err != nil {
+				c.ReportAbuse(SIGNAL_AUTH_FAILURE)
+				c.authFailureDelay()
+				return nil, err
+			}
+			username = canonical
+		}
+	}
+	if policy != nil {
+		locked, err := policy.Locked(c.conn, username)
+		if err == nil && locked {
+			err = ErrAccountLocked
+		}
+		if err != nil {
+			c.authFailureDelay()
+			return nil, err
+		}
+	}
+	user, err := check(username)
+	if err != nil {
+		if policy != nil {
+			policy.RecordFailure(c.conn, username)
+		}
+		c.ReportAbuse(SIGNAL_AUTH_FAILURE)
+		c.exportEvent(Event{Type: EVENT_LOGIN_FAILED, User: username})
+		c.authFailureDelay()
+		return nil, err
+	}
+	if policy != nil {
+		policy.RecordSuccess(c.conn, username)
+	}
+	return user, nil
+}
+
+// login completes authentication of user: it resolves the features of the
+// session and locks the maildrop. It returns the state of the session.
+func (c *Client) login(user backends.User) (int, error) {
+	features, err := c.server.resolveFeatures(c.conn, user)
+	if err != nil {
+		c.printer.Err("[SYS/TEMP] Unable to load account settings")
+		return 0, fmt.Errorf("Error resolving features of user %s: %v", user.Username(), err)
+	}
+	if _, ok := c.conn.(*tls.Conn); features.RequireTLS && !ok {
+		c.printer.Err("[AUTH] TLS is required for this account")
+		return STATE_AUTHORIZATION, nil
+	}
+	if c.master != "" || c.readOnly {
+		features.AllowDele = false
+	}
+	c.features = features
+
+	if !c.spendBudget(user.Username()) {
+		c.printer.Err("[LOGIN-DELAY] Daily session budget exhausted, try again tomorrow")
+		return STATE_AUTHORIZATION, nil
+	}
+	if !c.joinTenant(user.Username()) {
+		c.refundBudget(user.Username())
+		c.printer.Err("[SYS/TEMP] Too many sessions for your domain, try again later")
+		return STATE_AUTHORIZATION, nil
+	}
+	err = c.backend.Lock(user)
+	if err != nil {
+		c.refundBudget(user.Username())
+		c.leaveTenant()
+		c.printer.Err("Server was unable to lock maildrop")
+		return 0, fmt.Errorf("Error locking maildrop for user %s: %v", user.Username(), err)
+	}
+	c.user = user
+	if c.master != "" {
+		c.readOnly = true
+	}
+	c.mu.Lock()
+	c.loggedIn = user.Username()
+	c.mu.Unlock()
+	c.exportEvent(Event{Type: EVENT_LOGIN})
+	if notifier, ok := c.backend.(ChangeNotifier); ok {
+		c.changed = notifier.Changed(user)
+	}
+	c.retryDeletions(user)
+
+	banner := "User Successfully Logged on"
+	if bb, ok := c.backend.(BannerBackend); ok {
+		extra, err := bb.Banner(user)
+		if err != nil {
+			c.DebugLog.Printf("Error getting banner of user %s: %v", user.Username(), err)
+		} else if extra = sanitizeBanner(extra); extra != "" {
+			banner = extra
+		}
+	}
+	if qb, ok := c.backend.(QuotaBackend); ok {
+		quota, err := qb.Quota(user)
+		if err == nil && quota.Usage() >= 0 {
+			c.server.Metrics.Observe("session.quota.usage", quota.Usage())
+			banner = fmt.Sprintf("%s, %d%% of quota used", banner, int(quota.Usage()*100))
+		}
+	}
+	if notices := c.loginNotices(user); len(notices) > 0 {
+		banner = fmt.Sprintf("%s (%s)", banner, strings.Join(notices, "; "))
+	}
+	c.printer.Ok("%s", banner)
+	return STATE_TRANSACTION, nil
+}
+
+// loginNotices returns the notices of the authorizator and the backend for
+// user, see LoginNotifier.
+func (c *Client) loginNotices(user backends.User) []string {
+	var notices []string
+	for _, v := range []interface{}{c.authorizator, c.backend} {
+		notifier, ok := v.(LoginNotifier)
+		if !ok {
+			continue
+		}
+		notice, err := notifier.LoginNotice(user)
+		if err != nil {
+			c.DebugLog.Printf("Error getting login notice of user %s: %v", user.Username(), err)
+		} else if notice = sanitizeText(notice, maxNotice); notice != "" {
+			notices = append(notices, notice)
+		}
+	}
+	return notices
+}
+
+// maximum length of a banner of a BannerBackend, and of a notice of a
+// LoginNotifier, so the response to a login fits in a status line
+const (
+	maxBanner = 200
+	maxNotice = 100
+)
+
+// sanitizeBanner makes a banner of a BannerBackend safe to send in a
+// status line: control characters are replaced and long banners are cut.
+func sanitizeBanner(banner string) string {
+	return sanitizeText(banner, maxBanner)
+}
+
+// sanitizeText replaces control characters of text and cuts it to max
+// octets.
+func sanitizeText(text string, max int) string {
+	text = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, text)
+	if len(text) > max {
+		text = text[:max]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+// authFailureDelay waits the configured delay before a negative
+// authentication response. It returns early if the session ends.
+func (c *Client) authFailureDelay() {
+	if c.server == nil {
+		return
+	}
+	delay := c.server.AuthFailureDelay
+	if jitter := c.server.AuthFailureJitter; jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	if delay <= 0 {
+		return
+	}
+	c.wait(delay)
+}
@@ -9,6 +9,25 @@ type User interface {
   Username() string
 }
 
+// UpdateResult describes the outcome of committing deletions to the maildrop.
+type UpdateResult struct {
+	// number of messages removed from the maildrop
+	Removed int
+	// unique IDs of messages marked as deleted which could not be removed
+	FailedUids []string
+	// messages and octets left in the maildrop after the update
+	RemainingMessages int
+	RemainingOctets   int
+}
+
+// MessageInfo describes a single message of a maildrop listing.
+type MessageInfo struct {
+	// message number as used by the client, starting at 1
+	MsgId  int
+	Octets int
+	Uid    string
+}
+
 // DummyUser is a fake user interface implementation used for tests
 type DummyUser struct {
 }
@@ -84,8 +103,10 @@ func (b DummyBackend) UidlMessage(user User, msgId int) (exists bool, uid string
 }
 
 // Write all changes to persistent storage, i.e. delete all messages marked as deleted.
-func (b DummyBackend) Update(user User) error {
-	return nil
+// The result describes what was removed; messages which could not be removed
+// should be reported in FailedUids rather than as an error.
+func (b DummyBackend) Update(user User) (result UpdateResult, err error) {
+	return UpdateResult{RemainingMessages: 5, RemainingOctets: 50}, nil
 }
 
 // If the POP3 server issues a positive response, then the
@@ -0,0 +1,40 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// UidCounter allocates monotonically increasing numbers per maildrop, e.g.
+// the UIDs of a store written to by several servers at once. Numbers start
+// at 1 and are never handed out twice for a maildrop, but may have gaps
+// when an allocation isn't used. Shared implementations coordinate the
+// servers of a fleet, see popgun.RedisUidCounter and popgun.EtcdUidCounter.
+type UidCounter interface {
+	// Next reserves n numbers for the maildrop of username and returns the
+	// first of them.
+	Next(ctx context.Context, username string, n int) (uint64, error)
+}
+
+// MemoryUidCounter is a UidCounter local to the process, for stores with a
+// single writer and tests. Its counters start over with the process.
+type MemoryUidCounter struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+}
+
+func NewMemoryUidCounter() *MemoryUidCounter {
+	return &MemoryUidCounter{counters: make(map[string]uint64)}
+}
+
+func (c *MemoryUidCounter) Next(ctx context.Context, username string, n int) (uint64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("Invalid number of UIDs: %d", n)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first := c.counters[username] + 1
+	c.counters[username] += uint64(n)
+	return first, nil
+}
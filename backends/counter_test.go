@@ -0,0 +1,32 @@
+package backends
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryUidCounter(t *testing.T) {
+	counter := NewMemoryUidCounter()
+	ctx := context.Background()
+	for _, tc := range []struct {
+		username string
+		n        int
+		first    uint64
+	}{
+		{"alice", 1, 1},
+		{"alice", 3, 2},
+		{"bob", 2, 1},
+		{"alice", 1, 5},
+	} {
+		first, err := counter.Next(ctx, tc.username, tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != tc.first {
+			t.Errorf("Expected %d for %d UIDs of %s, but got %d", tc.first, tc.n, tc.username, first)
+		}
+	}
+	if _, err := counter.Next(ctx, "alice", 0); err == nil {
+		t.Errorf("Expected error reserving no UIDs")
+	}
+}
@@ -0,0 +1,306 @@
+// Package faulty implements a POP3 backend with programmable failures, for
+// exercising server behavior under backend errors.
+//
+// A Backend wraps another backend and passes calls through to it, unless a
+// Fault is injected for the operation:
+//
+//	b := faulty.New(backends.DummyBackend{})
+//	b.Inject(faulty.OP_LOCK, faulty.Fault{Err: faulty.ErrLocked})
+//	b.Inject(faulty.OP_RETR, faulty.Fault{Delay: 5 * time.Second})
+//	b.Inject(faulty.OP_UIDL, faulty.Fault{Err: faulty.ErrInjected, Every: 3})
+//	b.Inject(faulty.OP_UPDATE, faulty.Fault{FailUids: []string{"1"}})
+//
+// Faults apply deterministically by call count, so tests are repeatable.
+// Optional interfaces of the wrapped backend, e.g. popgun.MessageBackend,
+// are not passed through; the server uses the plain methods instead.
+package faulty
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Operations faults can be injected for, named after the Backend methods.
+const (
+	OP_STAT         = "Stat"
+	OP_LIST         = "List"
+	OP_LIST_MESSAGE = "ListMessage"
+	OP_RETR         = "Retr"
+	OP_DELE         = "Dele"
+	OP_RSET         = "Rset"
+	OP_UIDL         = "Uidl"
+	OP_UIDL_MESSAGE = "UidlMessage"
+	OP_TOP          = "Top"
+	OP_UPDATE       = "Update"
+	OP_LOCK         = "Lock"
+	OP_UNLOCK       = "Unlock"
+)
+
+var (
+	ErrInjected = fmt.Errorf("Injected failure")
+	ErrLocked   = fmt.Errorf("Maildrop already locked")
+)
+
+// Wrapped is the interface of the wrapped backend. It has the methods of
+// popgun.Backend, which is not imported so the server's own tests can use
+// this package.
+type Wrapped interface {
+	Stat(user backends.User) (messages, octets int, err error)
+	List(user backends.User) (octets []int, err error)
+	ListMessage(user backends.User, msgId int) (exists bool, octets int, err error)
+	Retr(user backends.User, msgId int) (message string, err error)
+	Dele(user backends.User, msgId int) error
+	Rset(user backends.User) error
+	Uidl(user backends.User) (uids []string, err error)
+	UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error)
+	Top(user backends.User, msgId int, n int) (lines []string, err error)
+	Update(user backends.User) (result backends.UpdateResult, err error)
+	Lock(user backends.User) error
+	Unlock(user backends.User) error
+}
+
+// Fault describes how calls of an operation fail.
+type Fault struct {
+	// Err, if set, is returned instead of calling the wrapped backend.
+	Err error
+	// Delay is waited before the call, e.g. to simulate slow storage.
+	Delay time.Duration
+	// After lets the first After calls pass without the fault.
+	After int
+	// Every, if greater than 1, applies the fault to every Every-th call
+	// only, to simulate flaky storage.
+	Every int
+	// Times, if set, limits how many calls the fault is applied to.
+	Times int
+	// FailUids applies to Update only: messages with these UIDs marked as
+	// deleted are kept and reported in UpdateResult.FailedUids.
+	FailUids []string
+}
+
+type Backend struct {
+	Wrapped Wrapped
+	// Sleep waits the Delay of faults, time.Sleep by default.
+	Sleep func(time.Duration)
+
+	mu      sync.Mutex
+	faults  map[string]Fault
+	calls   map[string]int
+	applied map[string]int
+	// UIDs of messages marked as deleted per user, for partial Update
+	// failures
+	deleted map[string]map[int]string
+}
+
+func New(wrapped Wrapped) *Backend {
+	return &Backend{
+		Wrapped: wrapped,
+		Sleep:   time.Sleep,
+		faults:  make(map[string]Fault),
+		calls:   make(map[string]int),
+		applied: make(map[string]int),
+		deleted: make(map[string]map[int]string),
+	}
+}
+
+// Inject sets the fault of op, replacing any previous one.
+func (b *Backend) Inject(op string, fault Fault) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults[op] = fault
+	b.applied[op] = 0
+}
+
+// Clear removes the fault of op.
+func (b *Backend) Clear(op string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.faults, op)
+}
+
+// Calls returns how many times op was called.
+func (b *Backend) Calls(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[op]
+}
+
+// call counts a call of op and returns the fault applying to it, if any.
+func (b *Backend) call(op string) (Fault, bool) {
+	b.mu.Lock()
+	b.calls[op]++
+	n := b.calls[op]
+	fault, ok := b.faults[op]
+	if ok {
+		ok = n > fault.After &&
+			(fault.Every <= 1 || (n-fault.After)%fault.Every == 0) &&
+			(fault.Times == 0 || b.applied[op] < fault.Times)
+	}
+	if ok {
+		b.applied[op]++
+	}
+	b.mu.Unlock()
+	if ok && fault.Delay > 0 {
+		b.Sleep(fault.Delay)
+	}
+	return fault, ok
+}
+
+// fail returns the error of the fault applying to a call of op.
+func (b *Backend) fail(op string) error {
+	fault, ok := b.call(op)
+	if !ok {
+		return nil
+	}
+	return fault.Err
+}
+
+func (b *Backend) Stat(user backends.User) (messages, octets int, err error) {
+	if err := b.fail(OP_STAT); err != nil {
+		return 0, 0, err
+	}
+	return b.Wrapped.Stat(user)
+}
+
+func (b *Backend) List(user backends.User) (octets []int, err error) {
+	if err := b.fail(OP_LIST); err != nil {
+		return nil, err
+	}
+	return b.Wrapped.List(user)
+}
+
+func (b *Backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	if err := b.fail(OP_LIST_MESSAGE); err != nil {
+		return false, 0, err
+	}
+	return b.Wrapped.ListMessage(user, msgId)
+}
+
+func (b *Backend) Retr(user backends.User, msgId int) (message string, err error) {
+	if err := b.fail(OP_RETR); err != nil {
+		return "", err
+	}
+	return b.Wrapped.Retr(user, msgId)
+}
+
+func (b *Backend) Dele(user backends.User, msgId int) error {
+	if err := b.fail(OP_DELE); err != nil {
+		return err
+	}
+	_, uid, err := b.Wrapped.UidlMessage(user, msgId)
+	if err != nil {
+		return err
+	}
+	if err := b.Wrapped.Dele(user, msgId); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	deleted := b.deleted[user.Username()]
+	if deleted == nil {
+		deleted = make(map[int]string)
+		b.deleted[user.Username()] = deleted
+	}
+	deleted[msgId] = uid
+	return nil
+}
+
+func (b *Backend) Rset(user backends.User) error {
+	if err := b.fail(OP_RSET); err != nil {
+		return err
+	}
+	if err := b.Wrapped.Rset(user); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	delete(b.deleted, user.Username())
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Backend) Uidl(user backends.User) (uids []string, err error) {
+	if err := b.fail(OP_UIDL); err != nil {
+		return nil, err
+	}
+	return b.Wrapped.Uidl(user)
+}
+
+func (b *Backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	if err := b.fail(OP_UIDL_MESSAGE); err != nil {
+		return false, "", err
+	}
+	return b.Wrapped.UidlMessage(user, msgId)
+}
+
+func (b *Backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	if err := b.fail(OP_TOP); err != nil {
+		return nil, err
+	}
+	return b.Wrapped.Top(user, msgId, n)
+}
+
+// Update removes the messages marked as deleted. Those with UIDs in the
+// FailUids of the fault are unmarked first, so the wrapped backend keeps
+// them, and reported as failed.
+func (b *Backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	fault, ok := b.call(OP_UPDATE)
+	if ok && fault.Err != nil {
+		return result, fault.Err
+	}
+	b.mu.Lock()
+	deleted := b.deleted[user.Username()]
+	delete(b.deleted, user.Username())
+	b.mu.Unlock()
+
+	var failed []string
+	if ok && len(fault.FailUids) > 0 && len(deleted) > 0 {
+		failing := make(map[string]bool)
+		for _, uid := range fault.FailUids {
+			failing[uid] = true
+		}
+		msgIds := make([]int, 0, len(deleted))
+		for msgId := range deleted {
+			msgIds = append(msgIds, msgId)
+		}
+		sort.Ints(msgIds)
+		var kept []int
+		for _, msgId := range msgIds {
+			uid := deleted[msgId]
+			if failing[uid] {
+				failed = append(failed, uid)
+			} else {
+				kept = append(kept, msgId)
+			}
+		}
+		if len(failed) > 0 {
+			if err := b.Wrapped.Rset(user); err != nil {
+				return result, err
+			}
+			for _, msgId := range kept {
+				if err := b.Wrapped.Dele(user, msgId); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+	result, err = b.Wrapped.Update(user)
+	result.FailedUids = append(result.FailedUids, failed...)
+	return result, err
+}
+
+func (b *Backend) Lock(user backends.User) error {
+	if err := b.fail(OP_LOCK); err != nil {
+		return err
+	}
+	return b.Wrapped.Lock(user)
+}
+
+func (b *Backend) Unlock(user backends.User) error {
+	if err := b.fail(OP_UNLOCK); err != nil {
+		return err
+	}
+	return b.Wrapped.Unlock(user)
+}
@@ -0,0 +1,95 @@
+package faulty
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/maildir"
+)
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func TestBackend_Faults(t *testing.T) {
+	user := testUser("john")
+	b := New(backends.DummyBackend{})
+	var slept time.Duration
+	b.Sleep = func(d time.Duration) { slept += d }
+
+	b.Inject(OP_LOCK, Fault{Err: ErrLocked, Times: 1})
+	if err := b.Lock(user); err != ErrLocked {
+		t.Errorf("Expected lock contention, but got %v", err)
+	}
+	if err := b.Lock(user); err != nil {
+		t.Errorf("Expected second lock to succeed, but got %v", err)
+	}
+
+	b.Inject(OP_UIDL, Fault{Err: ErrInjected, After: 1, Every: 2})
+	var failures []bool
+	for i := 0; i < 5; i++ {
+		_, err := b.Uidl(user)
+		failures = append(failures, err != nil)
+	}
+	if expected := []bool{false, false, true, false, true}; !reflect.DeepEqual(failures, expected) {
+		t.Errorf("Expected flaky Uidl failures %v, but got %v", expected, failures)
+	}
+	if calls := b.Calls(OP_UIDL); calls != 5 {
+		t.Errorf("Expected 5 Uidl calls, but got %d", calls)
+	}
+
+	b.Inject(OP_RETR, Fault{Delay: time.Minute})
+	if _, err := b.Retr(user, 1); err != nil || slept != time.Minute {
+		t.Errorf("Expected slow Retr, but got %v after %v", err, slept)
+	}
+	b.Clear(OP_RETR)
+	if _, err := b.Retr(user, 1); err != nil || slept != time.Minute {
+		t.Errorf("Expected fault cleared, but got %v after %v", err, slept)
+	}
+}
+
+func TestBackend_UpdatePartialFailure(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "john")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"1000.a.host", "1001.b.host", "1002.c.host"} {
+		ioutil.WriteFile(filepath.Join(dir, "new", name), []byte("Subject: test\n\nbody\n"), 0600)
+	}
+
+	user := testUser("john")
+	b := New(maildir.New(root))
+	b.Inject(OP_UPDATE, Fault{FailUids: []string{"1001.b.host"}})
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	for _, msgId := range []int{1, 2} {
+		if err := b.Dele(user, msgId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := b.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := backends.UpdateResult{
+		Removed:           1,
+		FailedUids:        []string{"1001.b.host"},
+		RemainingMessages: 2,
+		RemainingOctets:   46,
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, result)
+	}
+	b.Unlock(user)
+}
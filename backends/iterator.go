@@ -0,0 +1,41 @@
+package backends
+
+// MessageIterator iterates over a maildrop listing. Next advances to the next
+// message and returns false at the end of the listing or on error, which is
+// then returned by Err.
+type MessageIterator interface {
+	Next() bool
+	Message() MessageInfo
+	Err() error
+	Close() error
+}
+
+// SliceIterator is a MessageIterator over a listing held in memory.
+type SliceIterator struct {
+	infos []MessageInfo
+	pos   int
+}
+
+func NewSliceIterator(infos []MessageInfo) *SliceIterator {
+	return &SliceIterator{infos: infos}
+}
+
+func (it *SliceIterator) Next() bool {
+	if it.pos >= len(it.infos) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *SliceIterator) Message() MessageInfo {
+	return it.infos[it.pos-1]
+}
+
+func (it *SliceIterator) Err() error {
+	return nil
+}
+
+func (it *SliceIterator) Close() error {
+	return nil
+}
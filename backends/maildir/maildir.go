@@ -0,0 +1,540 @@
+// Package maildir implements a POP3 backend serving Maildir directories.
+//
+// Every user has a Maildir named after the username in Root. When the
+// maildrop is locked, new messages are moved to cur and the listing is
+// fixed for the rest of the session. Messages marked as deleted are removed
+// from disk on Update, or moved to the Trash folder of the Maildir if the
+// user has a trash retention, see Backend.Trash.
+package maildir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// name of the lock file created in a locked Maildir
+const lockFile = "popgun.lock"
+
+// Maildir++ folder messages removed on Update are moved to
+const trashFolder = ".Trash"
+
+type Backend struct {
+	Root string
+	// Template, if set, is the path template of the Maildir of a user,
+	// relative to Root unless absolute, see backends.ExpandPath. By default
+	// it is named after the username in Root.
+	Template string
+	// UidlStrategy, if set, computes the UIDs of messages, e.g. to keep
+	// the UIDs of the server the maildrop is migrated from. By default the
+	// file name without the info part is used.
+	UidlStrategy backends.UidlStrategy
+	// Trash, if set, returns how long messages of a user removed on Update
+	// are kept in the Trash folder before PurgeTrash deletes them. They
+	// are deleted right away if it returns 0.
+	Trash func(user backends.User) time.Duration
+	// Now, if set, replaces time.Now.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type message struct {
+	path string
+	uid  string
+	size int
+}
+
+type session struct {
+	dir      string
+	messages []message
+	deleted  map[int]bool
+	// number of messages moved from new when locking
+	fresh int
+}
+
+func New(root string) *Backend {
+	return &Backend{
+		Root:     root,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Path returns the Maildir of a user.
+func (b *Backend) Path(user backends.User) (string, error) {
+	template := b.Template
+	if template == "" {
+		template = "%u"
+	}
+	return backends.ExpandPath(b.Root, template, user.Username())
+}
+
+func (b *Backend) Lock(user backends.User) error {
+	dir, err := b.Path(user)
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"cur", "new"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("No maildir for user %s", user.Username())
+		}
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("Maildrop of user %s already locked", user.Username())
+		}
+		return err
+	}
+	lock.Close()
+
+	s := &session{dir: dir, deleted: make(map[int]bool)}
+	s.messages, s.fresh, err = scan(dir)
+	if err == nil && b.UidlStrategy != nil {
+		err = assignUids(dir, user.Username(), s.messages, b.UidlStrategy)
+	}
+	if err != nil {
+		os.Remove(filepath.Join(dir, lockFile))
+		return err
+	}
+	b.mu.Lock()
+	b.sessions[user.Username()] = s
+	b.mu.Unlock()
+	return nil
+}
+
+// Generation returns the modification times of new and cur in the
+// Maildir of user, which change whenever messages are delivered or
+// removed. Changes within the timestamp granularity of the file system
+// may go unnoticed.
+func (b *Backend) Generation(user backends.User) (string, error) {
+	dir, err := b.Path(user)
+	if err != nil {
+		return "", err
+	}
+	var generation []string
+	for _, sub := range []string{"cur", "new"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil {
+			return "", err
+		}
+		generation = append(generation, strconv.FormatInt(info.ModTime().UnixNano(), 10))
+	}
+	return strings.Join(generation, "."), nil
+}
+
+// scan moves new messages to cur and lists cur in delivery order. It
+// returns the number of messages moved.
+func scan(dir string) ([]message, int, error) {
+	news, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return nil, 0, err
+	}
+	fresh := 0
+	for _, info := range news {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		err = os.Rename(filepath.Join(dir, "new", info.Name()), filepath.Join(dir, "cur", info.Name()+":2,"))
+		if err != nil {
+			return nil, 0, err
+		}
+		fresh++
+	}
+
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if !infos[i].ModTime().Equal(infos[j].ModTime()) {
+			return infos[i].ModTime().Before(infos[j].ModTime())
+		}
+		return infos[i].Name() < infos[j].Name()
+	})
+	var messages []message
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		msg := message{
+			path: filepath.Join(dir, "cur", info.Name()),
+			uid:  uniqueName(info.Name()),
+			size: -1,
+		}
+		msg.size, err = messageSize(msg.path, info.Name())
+		if err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, fresh, nil
+}
+
+// assignUids computes the UIDs of messages with strategy, passing the IMAP
+// UIDs of dovecot-uidlist if the Maildir has one. Messages the strategy
+// fails for keep the default UID.
+func assignUids(dir, username string, messages []message, strategy backends.UidlStrategy) error {
+	uidValidity, imapUids, err := backends.ReadDovecotUidList(filepath.Join(dir, "dovecot-uidlist"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := range messages {
+		msg := &messages[i]
+		path := msg.path
+		uid, err := strategy.Uidl(backends.UidlInfo{
+			Username:    username,
+			Filename:    msg.uid,
+			ImapUid:     imapUids[msg.uid],
+			UidValidity: uidValidity,
+			Message: backends.NewLazyMessage(msg.uid, msg.size, func() (io.ReadCloser, error) {
+				return os.Open(path)
+			}),
+		})
+		if err == nil {
+			msg.uid = uid
+		}
+	}
+	return nil
+}
+
+// uniqueName strips the info part from a Maildir file name.
+func uniqueName(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// messageSize uses the S=<size> field of the file name written by most
+// delivery agents, reading the message only if it is missing.
+func messageSize(path, name string) (int, error) {
+	for _, field := range strings.Split(uniqueName(name), ",")[1:] {
+		if strings.HasPrefix(field, "S=") {
+			size, err := strconv.Atoi(field[2:])
+			if err == nil {
+				return size, nil
+			}
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return backends.MessageSize(f)
+}
+
+func (b *Backend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	s, ok := b.sessions[user.Username()]
+	delete(b.sessions, user.Username())
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return os.Remove(filepath.Join(s.dir, lockFile))
+}
+
+func (b *Backend) session(user backends.User) (*session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[user.Username()]
+	if !ok {
+		return nil, fmt.Errorf("Maildrop of user %s is not locked", user.Username())
+	}
+	return s, nil
+}
+
+// message returns a message which is not marked as deleted by its number.
+func (b *Backend) message(user backends.User, msgId int) (*session, *message, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgId < 1 || msgId > len(s.messages) || s.deleted[msgId] {
+		return s, nil, nil
+	}
+	return s, &s.messages[msgId-1], nil
+}
+
+func (b *Backend) Stat(user backends.User) (messages, octets int, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, msg := range s.messages {
+		if !s.deleted[i+1] {
+			messages++
+			octets += msg.size
+		}
+	}
+	return messages, octets, nil
+}
+
+// Banner returns the number and size of messages, and how many were
+// delivered since the last login, i.e. moved from new when locking.
+func (b *Backend) Banner(user backends.User) (string, error) {
+	messages, octets, err := b.Stat(user)
+	if err != nil {
+		return "", err
+	}
+	s, err := b.session(user)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d messages (%d octets), %d new since last login", messages, octets, s.fresh), nil
+}
+
+// List returns sizes of all messages in the session, including those marked
+// as deleted so message numbers stay stable. LIST uses ListIter instead.
+func (b *Backend) List(user backends.User) (octets []int, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range s.messages {
+		octets = append(octets, msg.size)
+	}
+	return octets, nil
+}
+
+// ListIter lists messages not marked as deleted.
+func (b *Backend) ListIter(user backends.User) (backends.MessageIterator, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	var infos []backends.MessageInfo
+	for i, msg := range s.messages {
+		if !s.deleted[i+1] {
+			infos = append(infos, backends.MessageInfo{MsgId: i + 1, Octets: msg.size, Uid: msg.uid})
+		}
+	}
+	return backends.NewSliceIterator(infos), nil
+}
+
+func (b *Backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	_, msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, 0, err
+	}
+	return true, msg.size, nil
+}
+
+func (b *Backend) Retr(user backends.User, msgId int) (message string, err error) {
+	_, msg, err := b.message(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	if msg == nil {
+		return "", fmt.Errorf("No such message: %d", msgId)
+	}
+	content, err := ioutil.ReadFile(msg.path)
+	return string(content), err
+}
+
+// Message gives access to a message without reading it whole.
+func (b *Backend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	_, msg, err := b.message(user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("No such message: %d", msgId)
+	}
+	path := msg.path
+	return backends.NewLazyMessage(msg.uid, msg.size, func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}), nil
+}
+
+// Top reads only the headers and the first n lines of the body.
+func (b *Backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	msg, err := b.Message(context.Background(), user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	return backends.TopLines(msg, n)
+}
+
+func (b *Backend) Dele(user backends.User, msgId int) error {
+	s, msg, err := b.message(user, msgId)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return fmt.Errorf("No such message: %d", msgId)
+	}
+	s.deleted[msgId] = true
+	return nil
+}
+
+func (b *Backend) Rset(user backends.User) error {
+	s, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	s.deleted = make(map[int]bool)
+	return nil
+}
+
+// Undele unmarks message msgId if it is marked as deleted.
+func (b *Backend) Undele(user backends.User, msgId int) (bool, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return false, err
+	}
+	if !s.deleted[msgId] {
+		return false, nil
+	}
+	delete(s.deleted, msgId)
+	return true, nil
+}
+
+func (b *Backend) Uidl(user backends.User) (uids []string, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range s.messages {
+		uids = append(uids, msg.uid)
+	}
+	return uids, nil
+}
+
+func (b *Backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	_, msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, "", err
+	}
+	return true, msg.uid, nil
+}
+
+// Quota reads the Maildir++ quota file maildirsize of the maildrop. Without
+// one, the usage is computed from the messages and there is no limit.
+func (b *Backend) Quota(user backends.User) (backends.Quota, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return backends.Quota{}, err
+	}
+	quota, err := backends.ReadMaildirSize(filepath.Join(s.dir, "maildirsize"))
+	if os.IsNotExist(err) {
+		quota = backends.Quota{}
+		for _, msg := range s.messages {
+			quota.UsedMessages++
+			quota.UsedOctets += int64(msg.size)
+		}
+	} else if err != nil {
+		return quota, err
+	}
+	quota.FreeOctets = backends.FreeSpace(s.dir)
+	return quota, nil
+}
+
+// Update removes the messages marked as deleted from disk, or moves them
+// to the Trash folder.
+func (b *Backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return result, err
+	}
+	trash := b.Trash != nil && b.Trash(user) > 0
+	var kept []message
+	for i, msg := range s.messages {
+		if !s.deleted[i+1] {
+			kept = append(kept, msg)
+			continue
+		}
+		var err error
+		if trash {
+			err = moveToTrash(s.dir, msg.path, b.now())
+		} else {
+			err = os.Remove(msg.path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			result.FailedUids = append(result.FailedUids, msg.uid)
+			kept = append(kept, msg)
+			continue
+		}
+		result.Removed++
+	}
+	for _, msg := range kept {
+		result.RemainingMessages++
+		result.RemainingOctets += msg.size
+	}
+	s.messages = kept
+	s.deleted = make(map[int]bool)
+	return result, nil
+}
+
+func (b *Backend) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// moveToTrash moves a message to cur of the Trash folder in dir. Its
+// modification time is set to now, the time it was moved, which
+// PurgeTrash compares with the retention.
+func moveToTrash(dir, path string, now time.Time) error {
+	cur := filepath.Join(dir, trashFolder, "cur")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, trashFolder, sub), 0700); err != nil {
+			return err
+		}
+	}
+	trashed := filepath.Join(cur, filepath.Base(path))
+	if err := os.Rename(path, trashed); err != nil {
+		return err
+	}
+	// the message is trashed anyway, at worst it is purged early
+	os.Chtimes(trashed, now, now)
+	return nil
+}
+
+// PurgeTrash deletes the messages of user kept in the Trash folder for
+// longer than the retention of the user, and returns how many were
+// deleted. It should be called periodically.
+func (b *Backend) PurgeTrash(user backends.User) (purged int, err error) {
+	if b.Trash == nil {
+		return 0, nil
+	}
+	dir, err := b.Path(user)
+	if err != nil {
+		return 0, err
+	}
+	cur := filepath.Join(dir, trashFolder, "cur")
+	infos, err := ioutil.ReadDir(cur)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	cutoff := b.now().Add(-b.Trash(user))
+	for _, info := range infos {
+		if info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		err := os.Remove(filepath.Join(cur, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
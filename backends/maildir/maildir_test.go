@@ -0,0 +1,179 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func TestBackend(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "john")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cur", "1000.a.host,S=40:2,S"), []byte("Subject: one\n\nbody 1\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "new", "1001.b.host"), []byte("Subject: two\n\nline 1\nline 2\n"), 0600)
+
+	user := testUser("john")
+	b := New(root)
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(user); err == nil {
+		t.Error("Expected locked maildrop not to be locked again")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "1001.b.host:2,")); err != nil {
+		t.Error("Expected new message to be moved to cur")
+	}
+
+	uids, _ := b.Uidl(user)
+	if !reflect.DeepEqual(uids, []string{"1000.a.host,S=40", "1001.b.host"}) {
+		t.Errorf("Unexpected uids '%v'", uids)
+	}
+	messages, octets, _ := b.Stat(user)
+	if messages != 2 || octets != 40+32 {
+		t.Errorf("Expected '2 72', but got '%d %d'", messages, octets)
+	}
+	if banner, _ := b.Banner(user); banner != "2 messages (72 octets), 1 new since last login" {
+		t.Errorf("Unexpected banner '%s'", banner)
+	}
+	lines, _ := b.Top(user, 2, 1)
+	if !reflect.DeepEqual(lines, []string{"Subject: two", "", "line 1"}) {
+		t.Errorf("Unexpected TOP lines '%v'", lines)
+	}
+
+	b.Dele(user, 1)
+	if exists, _, _ := b.ListMessage(user, 1); exists {
+		t.Error("Expected deleted message not to be listed")
+	}
+	result, err := b.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := backends.UpdateResult{Removed: 1, RemainingMessages: 1, RemainingOctets: 32}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected '%+v', but got '%+v'", expected, result)
+	}
+	b.Unlock(user)
+	if _, err := os.Stat(filepath.Join(dir, lockFile)); !os.IsNotExist(err) {
+		t.Error("Expected lock file to be removed")
+	}
+}
+
+func TestBackend_Quota(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "john")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "maildirsize"), []byte("1000S,10C\n400 3\n-100 -1\n"), 0600)
+
+	user := testUser("john")
+	b := New(root)
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Unlock(user)
+	quota, err := b.Quota(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.LimitOctets != 1000 || quota.LimitMessages != 10 || quota.UsedOctets != 300 || quota.UsedMessages != 2 {
+		t.Errorf("Unexpected quota '%+v'", quota)
+	}
+	if quota.Usage() != 0.3 {
+		t.Errorf("Expected usage 0.3, but got %v", quota.Usage())
+	}
+}
+
+func TestBackend_DovecotUidl(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "john")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cur", "1000.a.host:2,S"), []byte("Subject: one\n\nbody 1\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "new", "1001.b.host"), []byte("Subject: two\n\nbody 2\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "dovecot-uidlist"), []byte("3 V1500000000 N2\n1 :1000.a.host:2,S\n"), 0600)
+
+	user := testUser("john")
+	b := New(root)
+	b.UidlStrategy, _ = backends.DovecotUidl("%08Xu%08Xv")
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Unlock(user)
+	uids, _ := b.Uidl(user)
+	// the new message is unknown to Dovecot and keeps its file name
+	if !reflect.DeepEqual(uids, []string{"0000000159682F00", "1001.b.host"}) {
+		t.Errorf("Unexpected uids '%v'", uids)
+	}
+}
+
+func TestBackend_Trash(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "john")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cur", "1000.a.host:2,S"), []byte("Subject: one\n\nbody 1\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "cur", "1001.b.host:2,S"), []byte("Subject: two\n\nbody 2\n"), 0600)
+
+	user := testUser("john")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := New(root)
+	b.Trash = func(user backends.User) time.Duration { return 24 * time.Hour }
+	b.Now = func() time.Time { return now }
+	// the first message is trashed a day and a half before the second
+	trash := func() {
+		b.Lock(user)
+		b.Dele(user, 1)
+		if result, err := b.Update(user); err != nil || result.Removed != 1 {
+			t.Fatalf("Expected 1 message removed, but got %+v, %v", result, err)
+		}
+		b.Unlock(user)
+	}
+	trash()
+	now = now.Add(36 * time.Hour)
+	trash()
+
+	trashed := filepath.Join(dir, ".Trash", "cur")
+	for _, name := range []string{"1000.a.host:2,S", "1001.b.host:2,S"} {
+		if _, err := os.Stat(filepath.Join(trashed, name)); err != nil {
+			t.Errorf("Expected %s to be moved to the trash: %v", name, err)
+		}
+	}
+	now = now.Add(12 * time.Hour)
+	if purged, err := b.PurgeTrash(user); err != nil || purged != 1 {
+		t.Errorf("Expected 1 message purged, but got %d, %v", purged, err)
+	}
+	if _, err := os.Stat(filepath.Join(trashed, "1000.a.host:2,S")); !os.IsNotExist(err) {
+		t.Error("Expected message past retention to be purged")
+	}
+	if _, err := os.Stat(filepath.Join(trashed, "1001.b.host:2,S")); err != nil {
+		t.Error("Expected message within retention to be kept")
+	}
+	if purged, err := b.PurgeTrash(testUser("jane")); err != nil || purged != 0 {
+		t.Errorf("Expected nothing purged without trash, but got %d, %v", purged, err)
+	}
+}
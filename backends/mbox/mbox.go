@@ -0,0 +1,510 @@
+// Package mbox implements a POP3 backend serving mbox files.
+//
+// Every user has an mbox file named after the username in Root, which is
+// dot-locked (<file>.lock) while the maildrop is locked. The file is indexed
+// on Lock, so messages can be read by byte range without loading the whole
+// mailbox. Update rewrites the file without the messages marked as deleted.
+package mbox
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+type Backend struct {
+	Root string
+	// Template, if set, is the path template of the mbox file of a user,
+	// relative to Root unless absolute, see backends.ExpandPath. By default
+	// it is named after the username in Root.
+	Template string
+	// UidlStrategy, if set, computes the UIDs of messages, e.g. to keep
+	// the UIDs of the server the maildrop is migrated from. By default the
+	// X-UIDL header or the MD5 digest of the headers is used.
+	UidlStrategy backends.UidlStrategy
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type message struct {
+	// offset of the From_ line
+	from int64
+	// offsets of the message content, following the From_ line
+	start, end int64
+	uid        string
+	size       int
+	// IMAP UID from the X-UID header and UIDVALIDITY from X-IMAPbase
+	// written by Dovecot and UW IMAP
+	imapUid     uint32
+	uidValidity uint32
+}
+
+type session struct {
+	path     string
+	file     *os.File
+	messages []message
+	deleted  map[int]bool
+	username string
+	strategy backends.UidlStrategy
+}
+
+func New(root string) *Backend {
+	return &Backend{
+		Root:     root,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Path returns the mbox file of a user.
+func (b *Backend) Path(user backends.User) (string, error) {
+	template := b.Template
+	if template == "" {
+		template = "%u"
+	}
+	return backends.ExpandPath(b.Root, template, user.Username())
+}
+
+func (b *Backend) Lock(user backends.User) error {
+	path, err := b.Path(user)
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("Maildrop of user %s already locked", user.Username())
+		}
+		return err
+	}
+	lock.Close()
+
+	s := &session{
+		path:     path,
+		deleted:  make(map[int]bool),
+		username: user.Username(),
+		strategy: b.UidlStrategy,
+	}
+	s.file, err = os.Open(path)
+	if err == nil {
+		s.messages, err = index(s.file)
+		s.assignUids()
+	} else if os.IsNotExist(err) {
+		// an empty maildrop
+		err = nil
+	}
+	if err != nil {
+		if s.file != nil {
+			s.file.Close()
+		}
+		os.Remove(path + ".lock")
+		return err
+	}
+	b.mu.Lock()
+	b.sessions[user.Username()] = s
+	b.mu.Unlock()
+	return nil
+}
+
+// index finds the messages of an mbox file. Every message starts with a
+// "From " line at the beginning of the file or following an empty line, the
+// empty line before it belongs to the separator.
+func index(f *os.File) ([]message, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	var messages []message
+	reader := bufio.NewReader(f)
+	var offset int64
+	prevEmpty := true
+	var prevStart int64
+	var headers strings.Builder
+	inHeaders := false
+
+	finish := func(end int64) {
+		if len(messages) == 0 {
+			return
+		}
+		msg := &messages[len(messages)-1]
+		msg.end = end
+		if msg.uid == "" {
+			msg.uid = fmt.Sprintf("%x", md5.Sum([]byte(headers.String())))
+		}
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if prevEmpty && strings.HasPrefix(line, "From ") {
+			if len(messages) > 0 {
+				// the empty separator line is not part of the message
+				finish(prevStart)
+				messages[len(messages)-1].size -= 2
+			}
+			messages = append(messages, message{from: offset, start: offset + int64(len(line))})
+			headers.Reset()
+			inHeaders = true
+		} else if len(messages) > 0 {
+			msg := &messages[len(messages)-1]
+			if strings.HasSuffix(line, "\n") {
+				msg.size += len(trimmed) + 2
+			} else {
+				msg.size += len(line)
+			}
+			if inHeaders {
+				if trimmed == "" {
+					inHeaders = false
+				} else {
+					headers.WriteString(trimmed)
+					headers.WriteString("\n")
+					lower := strings.ToLower(trimmed)
+					if strings.HasPrefix(lower, "x-uidl:") {
+						msg.uid = strings.TrimSpace(trimmed[len("x-uidl:"):])
+					} else if strings.HasPrefix(lower, "x-uid:") {
+						msg.imapUid = parseUint32(trimmed[len("x-uid:"):])
+					} else if strings.HasPrefix(lower, "x-imapbase:") {
+						if fields := strings.Fields(trimmed[len("x-imapbase:"):]); len(fields) > 0 {
+							msg.uidValidity = parseUint32(fields[0])
+						}
+					}
+				}
+			}
+		}
+		prevEmpty = trimmed == ""
+		prevStart = offset
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+	if prevEmpty && len(messages) > 0 && prevStart >= messages[len(messages)-1].start {
+		// trailing empty line ending the file
+		finish(prevStart)
+		messages[len(messages)-1].size -= 2
+	} else {
+		finish(offset)
+	}
+	return messages, nil
+}
+
+func parseUint32(value string) uint32 {
+	n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+	return uint32(n)
+}
+
+// assignUids computes the UIDs of messages with the UIDL strategy. Messages
+// the strategy fails for keep the default UID.
+func (s *session) assignUids() {
+	if s.strategy == nil {
+		return
+	}
+	var uidValidity uint32
+	if len(s.messages) > 0 {
+		uidValidity = s.messages[0].uidValidity
+	}
+	for i := range s.messages {
+		msg := &s.messages[i]
+		file, start, length := s.file, msg.start, msg.end-msg.start
+		uid, err := s.strategy.Uidl(backends.UidlInfo{
+			Username:    s.username,
+			ImapUid:     msg.imapUid,
+			UidValidity: uidValidity,
+			Message: backends.NewLazyMessage(msg.uid, msg.size, func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(file, start, length)), nil
+			}),
+		})
+		if err == nil {
+			msg.uid = uid
+		}
+	}
+}
+
+func (b *Backend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	s, ok := b.sessions[user.Username()]
+	delete(b.sessions, user.Username())
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	return os.Remove(s.path + ".lock")
+}
+
+func (b *Backend) session(user backends.User) (*session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[user.Username()]
+	if !ok {
+		return nil, fmt.Errorf("Maildrop of user %s is not locked", user.Username())
+	}
+	return s, nil
+}
+
+// message returns a message which is not marked as deleted by its number.
+func (b *Backend) message(user backends.User, msgId int) (*session, *message, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgId < 1 || msgId > len(s.messages) || s.deleted[msgId] {
+		return s, nil, nil
+	}
+	return s, &s.messages[msgId-1], nil
+}
+
+func (b *Backend) Stat(user backends.User) (messages, octets int, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, msg := range s.messages {
+		if !s.deleted[i+1] {
+			messages++
+			octets += msg.size
+		}
+	}
+	return messages, octets, nil
+}
+
+// List returns sizes of all messages in the session, including those marked
+// as deleted so message numbers stay stable. LIST uses ListIter instead.
+func (b *Backend) List(user backends.User) (octets []int, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range s.messages {
+		octets = append(octets, msg.size)
+	}
+	return octets, nil
+}
+
+// ListIter lists messages not marked as deleted.
+func (b *Backend) ListIter(user backends.User) (backends.MessageIterator, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	var infos []backends.MessageInfo
+	for i, msg := range s.messages {
+		if !s.deleted[i+1] {
+			infos = append(infos, backends.MessageInfo{MsgId: i + 1, Octets: msg.size, Uid: msg.uid})
+		}
+	}
+	return backends.NewSliceIterator(infos), nil
+}
+
+func (b *Backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	_, msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, 0, err
+	}
+	return true, msg.size, nil
+}
+
+func (b *Backend) Retr(user backends.User, msgId int) (message string, err error) {
+	s, msg, err := b.message(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	if msg == nil {
+		return "", fmt.Errorf("No such message: %d", msgId)
+	}
+	content, err := ioutil.ReadAll(io.NewSectionReader(s.file, msg.start, msg.end-msg.start))
+	return string(content), err
+}
+
+// Message gives access to a message reading only the byte range needed.
+func (b *Backend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	s, msg, err := b.message(user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("No such message: %d", msgId)
+	}
+	file, start, length := s.file, msg.start, msg.end-msg.start
+	return backends.NewLazyMessage(msg.uid, msg.size, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(file, start, length)), nil
+	}), nil
+}
+
+// Top reads only the headers and the first n lines of the body.
+func (b *Backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	msg, err := b.Message(context.Background(), user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	return backends.TopLines(msg, n)
+}
+
+func (b *Backend) Dele(user backends.User, msgId int) error {
+	s, msg, err := b.message(user, msgId)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return fmt.Errorf("No such message: %d", msgId)
+	}
+	s.deleted[msgId] = true
+	return nil
+}
+
+func (b *Backend) Rset(user backends.User) error {
+	s, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	s.deleted = make(map[int]bool)
+	return nil
+}
+
+// Undele unmarks message msgId if it is marked as deleted.
+func (b *Backend) Undele(user backends.User, msgId int) (bool, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return false, err
+	}
+	if !s.deleted[msgId] {
+		return false, nil
+	}
+	delete(s.deleted, msgId)
+	return true, nil
+}
+
+func (b *Backend) Uidl(user backends.User) (uids []string, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range s.messages {
+		uids = append(uids, msg.uid)
+	}
+	return uids, nil
+}
+
+func (b *Backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	_, msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, "", err
+	}
+	return true, msg.uid, nil
+}
+
+// Quota reports the size of the mbox file and the free space of its file
+// system, mbox files have no quota limits of their own.
+func (b *Backend) Quota(user backends.User) (backends.Quota, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return backends.Quota{}, err
+	}
+	quota := backends.Quota{UsedMessages: int64(len(s.messages))}
+	if s.file != nil {
+		info, err := s.file.Stat()
+		if err != nil {
+			return quota, err
+		}
+		quota.UsedOctets = info.Size()
+	}
+	quota.FreeOctets = backends.FreeSpace(filepath.Dir(s.path))
+	return quota, nil
+}
+
+// Update rewrites the mbox file without the messages marked as deleted. If
+// rewriting fails, none of them is removed.
+func (b *Backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	s, err := b.session(user)
+	if err != nil {
+		return result, err
+	}
+	if len(s.deleted) == 0 {
+		result.RemainingMessages, result.RemainingOctets, _ = b.Stat(user)
+		return result, nil
+	}
+
+	total := len(s.messages)
+	kept, err := s.rewrite()
+	if err != nil {
+		for i, msg := range s.messages {
+			if s.deleted[i+1] {
+				result.FailedUids = append(result.FailedUids, msg.uid)
+			}
+			result.RemainingMessages++
+			result.RemainingOctets += msg.size
+		}
+		return result, nil
+	}
+	result.Removed = total - len(kept)
+	for _, msg := range kept {
+		result.RemainingMessages++
+		result.RemainingOctets += msg.size
+	}
+	return result, nil
+}
+
+// rewrite replaces the mbox file by a copy without deleted messages and
+// re-indexes it.
+func (s *session) rewrite() ([]message, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	writer := bufio.NewWriter(tmp)
+	first := true
+	for i, msg := range s.messages {
+		if s.deleted[i+1] {
+			continue
+		}
+		if !first {
+			writer.WriteString("\n")
+		}
+		first = false
+		_, err = io.Copy(writer, io.NewSectionReader(s.file, msg.from, msg.end-msg.from))
+		if err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if info, err := s.file.Stat(); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	s.file.Close()
+	s.file = tmp
+	s.messages, err = index(tmp)
+	s.assignUids()
+	s.deleted = make(map[int]bool)
+	return s.messages, err
+}
@@ -0,0 +1,91 @@
+package mbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testMbox = `From alice@example.com Mon Jan  1 00:00:00 2024
+Subject: first
+X-UIDL: uid-1
+
+body 1
+
+From bob@example.com Mon Jan  1 00:00:01 2024
+Subject: second
+
+line 1
+line 2
+line 3
+
+From carol@example.com Mon Jan  1 00:00:02 2024
+Subject: third
+X-UIDL: uid-3
+
+body 3
+
+`
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func TestBackend(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "john")
+	if err := ioutil.WriteFile(path, []byte(testMbox), 0600); err != nil {
+		t.Fatal(err)
+	}
+	user := testUser("john")
+	b := New(root)
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(user); err == nil {
+		t.Error("Expected locked maildrop not to be locked again")
+	}
+
+	messages, octets, _ := b.Stat(user)
+	if messages != 3 || octets != 125 {
+		t.Errorf("Expected '3 125', but got '%d %d'", messages, octets)
+	}
+	message, _ := b.Retr(user, 1)
+	if message != "Subject: first\nX-UIDL: uid-1\n\nbody 1\n" {
+		t.Errorf("Unexpected message '%s'", message)
+	}
+	lines, _ := b.Top(user, 2, 1)
+	if !reflect.DeepEqual(lines, []string{"Subject: second", "", "line 1"}) {
+		t.Errorf("Unexpected TOP lines '%v'", lines)
+	}
+	uids, _ := b.Uidl(user)
+	if uids[0] != "uid-1" || uids[2] != "uid-3" || uids[1] == "" {
+		t.Errorf("Unexpected uids '%v'", uids)
+	}
+
+	b.Dele(user, 2)
+	result, err := b.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 || result.RemainingMessages != 2 {
+		t.Errorf("Unexpected update result '%+v'", result)
+	}
+	b.Unlock(user)
+
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Unlock(user)
+	uids, _ = b.Uidl(user)
+	if !reflect.DeepEqual(uids, []string{"uid-1", "uid-3"}) {
+		t.Errorf("Expected '[uid-1 uid-3]', but got '%v'", uids)
+	}
+	message, _ = b.Retr(user, 2)
+	if message != "Subject: third\nX-UIDL: uid-3\n\nbody 3\n" {
+		t.Errorf("Unexpected message '%s'", message)
+	}
+}
@@ -0,0 +1,515 @@
+// Package memory implements a POP3 backend keeping maildrops in memory,
+// e.g. for tests and examples.
+//
+// Messages are added with Deliver. When the maildrop is locked, the listing
+// is fixed for the rest of the session, so messages delivered meanwhile
+// show up in the next one. Messages marked as deleted are dropped on
+// Update. Messages removed with Expunge while the maildrop is locked end
+// the session, see Changed. Messages removed on Update can be recovered
+// within the RecoveryWindow. Aliases of usernames are added with Alias.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+type message struct {
+	uid     string
+	content string
+	size    int
+}
+
+type expunged struct {
+	message
+	at time.Time
+}
+
+type maildrop struct {
+	messages []message
+	// session listing while locked, nil otherwise
+	session []message
+	deleted map[int]bool
+	// closed when the maildrop changes while locked
+	changed chan struct{}
+	// closed on the next delivery, see NewMail
+	waiters map[chan struct{}]bool
+	// incremented whenever messages are added or removed
+	generation int
+	// messages removed on Update, oldest first
+	expunged []expunged
+}
+
+type Backend struct {
+	// RecoveryWindow is how long messages removed on Update can be
+	// recovered, see Recover. They are dropped right away if it is 0.
+	RecoveryWindow time.Duration
+	// Now, if set, replaces time.Now.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	maildrops map[string]*maildrop
+	aliases   map[string]string
+}
+
+func New() *Backend {
+	return &Backend{maildrops: make(map[string]*maildrop), aliases: make(map[string]string)}
+}
+
+// Alias makes alias an alias of username, see ResolveAlias.
+func (b *Backend) Alias(alias, username string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.aliases[alias] = username
+}
+
+// ResolveAlias returns the username alias was added for with Alias.
+func (b *Backend) ResolveAlias(alias string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	username, ok := b.aliases[alias]
+	return username, ok, nil
+}
+
+// Deliver adds a message to the maildrop of username, creating it if
+// needed.
+func (b *Backend) Deliver(username, uid, content string) error {
+	size, err := backends.MessageSize(strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop := b.maildrops[username]
+	if drop == nil {
+		drop = &maildrop{}
+		b.maildrops[username] = drop
+	}
+	for _, msg := range drop.messages {
+		if msg.uid == uid {
+			return fmt.Errorf("Duplicate UID %s for user %s", uid, username)
+		}
+	}
+	drop.add(message{uid: uid, content: content, size: size})
+	return nil
+}
+
+// add adds msg to the maildrop and wakes up NewMail waiters.
+func (drop *maildrop) add(msg message) {
+	drop.messages = append(drop.messages, msg)
+	drop.generation++
+	for waiter := range drop.waiters {
+		close(waiter)
+		delete(drop.waiters, waiter)
+	}
+}
+
+// NewMail returns a channel closed on the next delivery to the maildrop of
+// user.
+func (b *Backend) NewMail(user backends.User) (<-chan struct{}, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop := b.maildrops[user.Username()]
+	if drop == nil {
+		drop = &maildrop{}
+		b.maildrops[user.Username()] = drop
+	}
+	if drop.waiters == nil {
+		drop.waiters = make(map[chan struct{}]bool)
+	}
+	waiter := make(chan struct{})
+	drop.waiters[waiter] = true
+	return waiter, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(drop.waiters, waiter)
+	}
+}
+
+// Expunge removes a message from the maildrop of username, as if by another
+// process. If the maildrop is locked, the session is notified through
+// Changed.
+func (b *Backend) Expunge(username, uid string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop := b.maildrops[username]
+	if drop != nil {
+		for i, msg := range drop.messages {
+			if msg.uid != uid {
+				continue
+			}
+			drop.messages = append(drop.messages[:i:i], drop.messages[i+1:]...)
+			drop.generation++
+			if drop.session != nil {
+				select {
+				case <-drop.changed:
+				default:
+					close(drop.changed)
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("No message %s for user %s", uid, username)
+}
+
+func (b *Backend) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// recoverable drops the expunged messages of drop past the recovery window
+// and returns the others. It must be called with mu held.
+func (b *Backend) recoverable(drop *maildrop) []expunged {
+	cutoff := b.now().Add(-b.RecoveryWindow)
+	for len(drop.expunged) > 0 && !drop.expunged[0].at.After(cutoff) {
+		drop.expunged = drop.expunged[1:]
+	}
+	return drop.expunged
+}
+
+// Expunged lists the messages of username removed on Update which can
+// still be recovered.
+func (b *Backend) Expunged(username string) ([]backends.ExpungedMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []backends.ExpungedMessage
+	if drop := b.maildrops[username]; drop != nil {
+		for _, msg := range b.recoverable(drop) {
+			messages = append(messages, backends.ExpungedMessage{
+				Uid:      msg.uid,
+				Octets:   msg.size,
+				Expunged: msg.at,
+				Expires:  msg.at.Add(b.RecoveryWindow),
+			})
+		}
+	}
+	return messages, nil
+}
+
+// Recover puts an expunged message back into the maildrop of username, as
+// if it was delivered again.
+func (b *Backend) Recover(username, uid string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if drop := b.maildrops[username]; drop != nil {
+		for i, msg := range b.recoverable(drop) {
+			if msg.uid != uid {
+				continue
+			}
+			drop.expunged = append(drop.expunged[:i:i], drop.expunged[i+1:]...)
+			drop.add(msg.message)
+			return nil
+		}
+	}
+	return fmt.Errorf("No recoverable message %s for user %s", uid, username)
+}
+
+// Changed returns a channel closed when a message of the locked maildrop
+// of user is expunged.
+func (b *Backend) Changed(user backends.User) <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if drop := b.maildrops[user.Username()]; drop != nil {
+		return drop.changed
+	}
+	return nil
+}
+
+// Generation returns the generation of the maildrop of user, which
+// changes whenever messages are delivered or removed.
+func (b *Backend) Generation(user backends.User) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if drop := b.maildrops[user.Username()]; drop != nil {
+		return strconv.Itoa(drop.generation), nil
+	}
+	return "0", nil
+}
+
+// Messages returns the UIDs of the messages of username.
+func (b *Backend) Messages(username string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var uids []string
+	if drop := b.maildrops[username]; drop != nil {
+		for _, msg := range drop.messages {
+			uids = append(uids, msg.uid)
+		}
+	}
+	return uids
+}
+
+func (b *Backend) Lock(user backends.User) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop := b.maildrops[user.Username()]
+	if drop == nil {
+		// users without messages have an empty maildrop
+		drop = &maildrop{}
+		b.maildrops[user.Username()] = drop
+	}
+	if drop.session != nil {
+		return fmt.Errorf("Maildrop of user %s already locked", user.Username())
+	}
+	drop.session = append(make([]message, 0, len(drop.messages)), drop.messages...)
+	drop.deleted = make(map[int]bool)
+	drop.changed = make(chan struct{})
+	return nil
+}
+
+func (b *Backend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if drop := b.maildrops[user.Username()]; drop != nil {
+		drop.session = nil
+		drop.deleted = nil
+		drop.changed = nil
+	}
+	return nil
+}
+
+// locked returns the locked maildrop of user, it must be called with mu
+// held.
+func (b *Backend) locked(user backends.User) (*maildrop, error) {
+	drop := b.maildrops[user.Username()]
+	if drop == nil || drop.session == nil {
+		return nil, fmt.Errorf("Maildrop of user %s is not locked", user.Username())
+	}
+	return drop, nil
+}
+
+// message returns a message which is not marked as deleted by its number,
+// nil if there is none.
+func (b *Backend) message(user backends.User, msgId int) (*message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	if msgId < 1 || msgId > len(drop.session) || drop.deleted[msgId] {
+		return nil, nil
+	}
+	msg := drop.session[msgId-1]
+	return &msg, nil
+}
+
+func (b *Backend) Stat(user backends.User) (messages, octets int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, msg := range drop.session {
+		if !drop.deleted[i+1] {
+			messages++
+			octets += msg.size
+		}
+	}
+	return messages, octets, nil
+}
+
+// List returns sizes of all messages in the session, including those marked
+// as deleted so message numbers stay stable. LIST uses ListIter instead.
+func (b *Backend) List(user backends.User) (octets []int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range drop.session {
+		octets = append(octets, msg.size)
+	}
+	return octets, nil
+}
+
+// ListIter lists messages not marked as deleted.
+func (b *Backend) ListIter(user backends.User) (backends.MessageIterator, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	var infos []backends.MessageInfo
+	for i, msg := range drop.session {
+		if !drop.deleted[i+1] {
+			infos = append(infos, backends.MessageInfo{MsgId: i + 1, Octets: msg.size, Uid: msg.uid})
+		}
+	}
+	return backends.NewSliceIterator(infos), nil
+}
+
+// UidlAfter returns the messages following the message with uid.
+func (b *Backend) UidlAfter(user backends.User, uid string) ([]backends.MessageInfo, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, msg := range drop.session {
+		if msg.uid != uid {
+			continue
+		}
+		var infos []backends.MessageInfo
+		for j := i + 1; j < len(drop.session); j++ {
+			if !drop.deleted[j+1] {
+				infos = append(infos, backends.MessageInfo{MsgId: j + 1, Octets: drop.session[j].size, Uid: drop.session[j].uid})
+			}
+		}
+		return infos, true, nil
+	}
+	return nil, false, nil
+}
+
+func (b *Backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, 0, err
+	}
+	return true, msg.size, nil
+}
+
+func (b *Backend) Retr(user backends.User, msgId int) (message string, err error) {
+	msg, err := b.message(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	if msg == nil {
+		return "", fmt.Errorf("No such message: %d", msgId)
+	}
+	return msg.content, nil
+}
+
+// Message gives access to a message without copying it.
+func (b *Backend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	msg, err := b.message(user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("No such message: %d", msgId)
+	}
+	return backends.NewStringMessage(msg.uid, msg.content), nil
+}
+
+func (b *Backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	msg, err := b.Message(context.Background(), user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	return backends.TopLines(msg, n)
+}
+
+func (b *Backend) Dele(user backends.User, msgId int) error {
+	msg, err := b.message(user, msgId)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return fmt.Errorf("No such message: %d", msgId)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maildrops[user.Username()].deleted[msgId] = true
+	return nil
+}
+
+func (b *Backend) Rset(user backends.User) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return err
+	}
+	drop.deleted = make(map[int]bool)
+	return nil
+}
+
+// Undele unmarks message msgId if it is marked as deleted.
+func (b *Backend) Undele(user backends.User, msgId int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return false, err
+	}
+	if !drop.deleted[msgId] {
+		return false, nil
+	}
+	delete(drop.deleted, msgId)
+	return true, nil
+}
+
+func (b *Backend) Uidl(user backends.User) (uids []string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range drop.session {
+		uids = append(uids, msg.uid)
+	}
+	return uids, nil
+}
+
+func (b *Backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, "", err
+	}
+	return true, msg.uid, nil
+}
+
+// Update drops the messages marked as deleted. Messages delivered during
+// the session are kept.
+func (b *Backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	drop, err := b.locked(user)
+	if err != nil {
+		return result, err
+	}
+	removed := make(map[string]bool)
+	var kept []message
+	now := b.now()
+	for i, msg := range drop.session {
+		if drop.deleted[i+1] {
+			removed[msg.uid] = true
+			result.Removed++
+			if b.RecoveryWindow > 0 {
+				drop.expunged = append(drop.expunged, expunged{msg, now})
+			}
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	var messages []message
+	for _, msg := range drop.messages {
+		if !removed[msg.uid] {
+			messages = append(messages, msg)
+			result.RemainingMessages++
+			result.RemainingOctets += msg.size
+		}
+	}
+	if result.Removed > 0 {
+		drop.generation++
+	}
+	drop.messages = messages
+	drop.session = append(make([]message, 0, len(kept)), kept...)
+	drop.deleted = make(map[int]bool)
+	return result, nil
+}
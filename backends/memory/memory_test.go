@@ -0,0 +1,132 @@
+package memory
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func TestBackend(t *testing.T) {
+	user := testUser("john")
+	b := New()
+	b.Deliver("john", "a", "Subject: one\n\nbody 1\n")
+	b.Deliver("john", "b", "Subject: two\n\nline 1\nline 2\n")
+	if err := b.Deliver("john", "a", ""); err == nil {
+		t.Error("Expected duplicate UID to be rejected")
+	}
+
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(user); err == nil {
+		t.Error("Expected locked maildrop not to be locked again")
+	}
+	// delivered during the session, listed in the next one
+	b.Deliver("john", "c", "Subject: three\n\n")
+
+	messages, octets, err := b.Stat(user)
+	if err != nil || messages != 2 || octets != 56 {
+		t.Errorf("Expected 2 messages of 56 octets, but got %d, %d, %v", messages, octets, err)
+	}
+	lines, err := b.Top(user, 2, 1)
+	if expected := []string{"Subject: two", "", "line 1"}; err != nil || !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, but got %v, %v", expected, lines, err)
+	}
+	if err := b.Dele(user, 1); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _, _ := b.ListMessage(user, 1); exists {
+		t.Error("Expected deleted message not to be listed")
+	}
+	result, err := b.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := backends.UpdateResult{Removed: 1, RemainingMessages: 2, RemainingOctets: 50}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, result)
+	}
+	b.Unlock(user)
+	if uids := b.Messages("john"); !reflect.DeepEqual(uids, []string{"b", "c"}) {
+		t.Errorf("Expected messages b and c left, but got %v", uids)
+	}
+
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	changed := b.Changed(user)
+	if err := b.Expunge("john", "x"); err == nil {
+		t.Error("Expected expunging a missing message to fail")
+	}
+	b.Expunge("john", "b")
+	select {
+	case <-changed:
+	default:
+		t.Error("Expected expunge to be signalled")
+	}
+	b.Unlock(user)
+
+	empty := testUser("jane")
+	if err := b.Lock(empty); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _, err := b.Stat(empty); err != nil || messages != 0 {
+		t.Errorf("Expected empty maildrop, but got %d, %v", messages, err)
+	}
+}
+
+func TestBackend_Recover(t *testing.T) {
+	user := testUser("john")
+	now := time.Unix(1000, 0)
+	b := New()
+	b.RecoveryWindow = time.Hour
+	b.Now = func() time.Time { return now }
+	b.Deliver("john", "a", "Subject: one\n\nbody 1\n")
+	b.Deliver("john", "b", "Subject: two\n\nbody 2\n")
+
+	b.Lock(user)
+	b.Dele(user, 1)
+	b.Dele(user, 2)
+	if undeleted, err := b.Undele(user, 2); err != nil || !undeleted {
+		t.Errorf("Expected message 2 to be undeleted, but got %v, %v", undeleted, err)
+	}
+	if undeleted, _ := b.Undele(user, 2); undeleted {
+		t.Error("Expected message 2 not to be undeleted twice")
+	}
+	b.Update(user)
+	b.Unlock(user)
+
+	expunged, err := b.Expunged("john")
+	if err != nil || len(expunged) != 1 || expunged[0].Uid != "a" || !expunged[0].Expires.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected message a to be recoverable, but got %+v, %v", expunged, err)
+	}
+	if err := b.Recover("john", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if uids := b.Messages("john"); !reflect.DeepEqual(uids, []string{"b", "a"}) {
+		t.Errorf("Expected messages b and a, but got %v", uids)
+	}
+	if err := b.Recover("john", "a"); err == nil {
+		t.Error("Expected recovered message not to be recovered again")
+	}
+
+	b.Lock(user)
+	b.Dele(user, 1)
+	b.Update(user)
+	b.Unlock(user)
+	now = now.Add(2 * time.Hour)
+	if expunged, _ := b.Expunged("john"); len(expunged) != 0 {
+		t.Errorf("Expected no recoverable messages after the window, but got %+v", expunged)
+	}
+	if err := b.Recover("john", "b"); err == nil {
+		t.Error("Expected expired message not to be recoverable")
+	}
+}
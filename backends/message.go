@@ -0,0 +1,204 @@
+package backends
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Message gives access to a single message of a maildrop. Headers are parsed
+// lazily and the body is read on demand, so e.g. TOP can be served without
+// reading the whole message.
+type Message interface {
+	// Unique ID of the message, as returned by UIDL.
+	Uid() string
+	// Size of the message in octets, as sent to the client, i.e. with CRLF
+	// line endings.
+	Size() (int, error)
+	// Header lines of the message as they are stored, without the blank line
+	// separating them from the body.
+	RawHeaders() ([]string, error)
+	// Parsed headers of the message.
+	Headers() (textproto.MIMEHeader, error)
+	// Body of the message following the blank line after the headers. The
+	// caller must close it.
+	Body() (io.ReadCloser, error)
+}
+
+// LazyMessage is a Message reading its content from a source which is
+// opened anew for every access, e.g. a file.
+type LazyMessage struct {
+	uid  string
+	size int
+	open func() (io.ReadCloser, error)
+
+	once       sync.Once
+	rawHeaders []string
+	headers    textproto.MIMEHeader
+	err        error
+}
+
+// NewLazyMessage creates a message whose content is read from open. If size
+// is negative, it is computed from the content on first use of Size.
+func NewLazyMessage(uid string, size int, open func() (io.ReadCloser, error)) *LazyMessage {
+	return &LazyMessage{uid: uid, size: size, open: open}
+}
+
+// NewStringMessage creates a message held in memory.
+func NewStringMessage(uid string, content string) *LazyMessage {
+	return NewLazyMessage(uid, -1, func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content)), nil
+	})
+}
+
+func (m *LazyMessage) Uid() string {
+	return m.uid
+}
+
+func (m *LazyMessage) Size() (int, error) {
+	if m.size >= 0 {
+		return m.size, nil
+	}
+	r, err := m.open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	size, err := MessageSize(r)
+	if err != nil {
+		return 0, err
+	}
+	m.size = size
+	return size, nil
+}
+
+func (m *LazyMessage) RawHeaders() ([]string, error) {
+	m.parseHeaders()
+	return m.rawHeaders, m.err
+}
+
+func (m *LazyMessage) Headers() (textproto.MIMEHeader, error) {
+	m.parseHeaders()
+	return m.headers, m.err
+}
+
+// parseHeaders reads only the header section of the message.
+func (m *LazyMessage) parseHeaders() {
+	m.once.Do(func() {
+		r, err := m.open()
+		if err != nil {
+			m.err = err
+			return
+		}
+		defer r.Close()
+		m.rawHeaders, m.err = readHeaderLines(bufio.NewReader(r))
+		if m.err != nil {
+			return
+		}
+		m.headers = make(textproto.MIMEHeader)
+		last := ""
+		for _, line := range m.rawHeaders {
+			if (line[0] == ' ' || line[0] == '\t') && last != "" {
+				values := m.headers[last]
+				values[len(values)-1] += " " + strings.TrimSpace(line)
+				continue
+			}
+			i := strings.Index(line, ":")
+			if i < 1 {
+				continue
+			}
+			last = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+			m.headers.Add(last, strings.TrimSpace(line[i+1:]))
+		}
+	})
+}
+
+func (m *LazyMessage) Body() (io.ReadCloser, error) {
+	r, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(r)
+	_, err = readHeaderLines(reader)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, r}, nil
+}
+
+// readHeaderLines reads lines up to and including the first empty one, which
+// is not returned, or up to the end of input.
+func readHeaderLines(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" {
+			return lines, nil
+		}
+		lines = append(lines, line)
+		if err == io.EOF {
+			return lines, nil
+		}
+	}
+}
+
+// MessageSize computes the size of a message in octets as sent to the
+// client, counting every line ending as CRLF.
+func MessageSize(r io.Reader) (int, error) {
+	reader := bufio.NewReader(r)
+	size := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if strings.HasSuffix(line, "\n") {
+			size += len(strings.TrimRight(line, "\r\n")) + 2
+		} else {
+			size += len(line)
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+	}
+}
+
+// TopLines returns the header lines of msg, the blank line separating them
+// from the body and the first n lines of the body, reading no further.
+func TopLines(msg Message, n int) ([]string, error) {
+	headers, err := msg.RawHeaders()
+	if err != nil {
+		return nil, err
+	}
+	body, err := msg.Body()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	lines := append(append([]string(nil), headers...), "")
+	reader := bufio.NewReader(body)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,87 @@
+package backends
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExpandPath expands a maildrop path template for username, so user
+// directories can be sharded across file systems. The template may contain
+//
+//	%u  the username
+//	%n  the local part of the username, before "@"
+//	%d  the domain of the username, after "@", empty if there is none
+//	%%  a literal "%"
+//
+// A decimal width after "%" takes only the first characters of the value,
+// e.g. %1u, and "H" uses the hex MD5 digest of the value instead, so with
+// %2Hu users are spread evenly over 256 directories. The template is
+// rooted at root unless it is absolute, e.g. "/var/mail/%d/%1n/%n".
+func ExpandPath(root, template, username string) (string, error) {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/\\\x00") {
+		return "", fmt.Errorf("Invalid username: %q", username)
+	}
+	local, domain := username, ""
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		local, domain = username[:i], username[i+1:]
+	}
+	for _, part := range []string{local, domain} {
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid username: %q", username)
+		}
+	}
+
+	var path strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			path.WriteByte(template[i])
+			continue
+		}
+		j := i + 1
+		for j < len(template) && template[j] >= '0' && template[j] <= '9' {
+			j++
+		}
+		width := 0
+		if j > i+1 {
+			width, _ = strconv.Atoi(template[i+1 : j])
+		}
+		hash := false
+		if j < len(template) && template[j] == 'H' {
+			hash = true
+			j++
+		}
+		if j >= len(template) {
+			return "", fmt.Errorf("Incomplete variable in path template %q", template)
+		}
+		var value string
+		switch template[j] {
+		case 'u':
+			value = username
+		case 'n':
+			value = local
+		case 'd':
+			value = domain
+		case '%':
+			value = "%"
+		default:
+			return "", fmt.Errorf("Unknown variable %%%c in path template %q", template[j], template)
+		}
+		if hash {
+			sum := md5.Sum([]byte(value))
+			value = hex.EncodeToString(sum[:])
+		}
+		if width > 0 && width < len(value) {
+			value = value[:width]
+		}
+		path.WriteString(value)
+		i = j
+	}
+	if filepath.IsAbs(path.String()) {
+		return filepath.Clean(path.String()), nil
+	}
+	return filepath.Join(root, path.String()), nil
+}
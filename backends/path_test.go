@@ -0,0 +1,31 @@
+package backends
+
+import "testing"
+
+func TestExpandPath(t *testing.T) {
+	tables := []struct {
+		template string
+		username string
+		expected string
+	}{
+		{"%u", "alice", "/var/mail/alice"},
+		{"%d/%1n/%n", "alice@example.org", "/var/mail/example.org/a/alice"},
+		{"/srv/%2Hu/%u", "alice", "/srv/63/alice"},
+		{"%n%%", "bob", "/var/mail/bob%"},
+	}
+	for _, table := range tables {
+		path, err := ExpandPath("/var/mail", table.template, table.username)
+		if err != nil || path != table.expected {
+			t.Errorf("Expected '%s', but got '%s' (%v)", table.expected, path, err)
+		}
+	}
+
+	for _, username := range []string{"", "..", "a/b", "a@.."} {
+		if _, err := ExpandPath("/var/mail", "%d/%n", username); err == nil {
+			t.Errorf("Expected error for username '%s'", username)
+		}
+	}
+	if _, err := ExpandPath("/var/mail", "%x", "alice"); err == nil {
+		t.Error("Expected error for unknown variable")
+	}
+}
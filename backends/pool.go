@@ -0,0 +1,227 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrPoolClosed = fmt.Errorf("Pool closed")
+
+// Pool shares upstream connections of a backend, e.g. to a database or an
+// IMAP server, between POP3 sessions instead of opening one per session.
+//
+// Connections are opened for a key, e.g. the username for upstream
+// connections authenticated as the user, or "" if any connection will do.
+// Get reuses an idle connection of the same key, so a user keeps talking
+// to the same upstream connection across sessions.
+type Pool struct {
+	// Open opens a connection for key.
+	Open func(ctx context.Context, key string) (io.Closer, error)
+	// Check, if set, tests an idle connection before it is reused.
+	// Connections failing it are closed.
+	Check func(conn io.Closer) error
+	// MaxOpen limits the number of open connections, unlimited if 0. Get
+	// waits for a connection to be released when it is reached.
+	MaxOpen int
+	// MaxIdle limits the number of idle connections kept, 2 by default.
+	MaxIdle int
+	// IdleTimeout, if set, closes connections idle for longer, see Reap.
+	IdleTimeout time.Duration
+	// Now, if set, replaces time.Now.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	idle     []*PoolConn
+	open     int
+	closed   bool
+	released chan struct{}
+}
+
+// PoolConn is a connection taken from a Pool. It must be given back with
+// Release, or Discard if it is broken.
+type PoolConn struct {
+	Conn io.Closer
+	Key  string
+
+	pool     *Pool
+	idleFrom time.Time
+}
+
+// PoolStats describes the connections of a pool.
+type PoolStats struct {
+	Open int
+	Idle int
+}
+
+func (p *Pool) now() time.Time {
+	if p.Now != nil {
+		return p.Now()
+	}
+	return time.Now()
+}
+
+// Get returns a connection for key, reusing an idle one if possible.
+func (p *Pool) Get(ctx context.Context, key string) (*PoolConn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if pc := p.takeIdle(key); pc != nil {
+			p.mu.Unlock()
+			if p.Check != nil {
+				if err := p.Check(pc.Conn); err != nil {
+					pc.Discard()
+					continue
+				}
+			}
+			return pc, nil
+		}
+		if p.MaxOpen > 0 && p.open >= p.MaxOpen && len(p.idle) > 0 {
+			// make room by closing the least recently used idle
+			// connection of another key
+			stale := p.idle[0]
+			p.idle = p.idle[1:]
+			p.open--
+			stale.Conn.Close()
+		}
+		if p.MaxOpen <= 0 || p.open < p.MaxOpen {
+			p.open++
+			p.mu.Unlock()
+			conn, err := p.Open(ctx, key)
+			if err != nil {
+				p.mu.Lock()
+				p.open--
+				p.notify()
+				p.mu.Unlock()
+				return nil, err
+			}
+			return &PoolConn{Conn: conn, Key: key, pool: p}, nil
+		}
+		if p.released == nil {
+			p.released = make(chan struct{})
+		}
+		released := p.released
+		p.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeIdle removes the most recently used idle connection of key from the
+// pool and returns it, nil if there is none. It must be called with mu held.
+func (p *Pool) takeIdle(key string) *PoolConn {
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		pc := p.idle[i]
+		if pc.Key != key {
+			continue
+		}
+		p.idle = append(p.idle[:i], p.idle[i+1:]...)
+		if p.IdleTimeout > 0 && p.now().Sub(pc.idleFrom) > p.IdleTimeout {
+			p.open--
+			pc.Conn.Close()
+			continue
+		}
+		return pc
+	}
+	return nil
+}
+
+// notify wakes up Gets waiting for a connection. It must be called with mu
+// held.
+func (p *Pool) notify() {
+	if p.released != nil {
+		close(p.released)
+		p.released = nil
+	}
+}
+
+// Release gives the connection back to the pool for reuse.
+func (pc *PoolConn) Release() {
+	p := pc.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	maxIdle := p.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 2
+	}
+	if p.closed || maxIdle < 0 {
+		p.open--
+		pc.Conn.Close()
+	} else {
+		pc.idleFrom = p.now()
+		p.idle = append(p.idle, pc)
+		if len(p.idle) > maxIdle {
+			p.idle[0].Conn.Close()
+			p.idle = p.idle[1:]
+			p.open--
+		}
+	}
+	p.notify()
+}
+
+// Discard closes the connection instead of giving it back to the pool.
+func (pc *PoolConn) Discard() error {
+	p := pc.pool
+	p.mu.Lock()
+	p.open--
+	p.notify()
+	p.mu.Unlock()
+	return pc.Conn.Close()
+}
+
+// Reap closes connections idle for longer than IdleTimeout and returns how
+// many were closed. It should be called periodically.
+func (p *Pool) Reap() int {
+	if p.IdleTimeout <= 0 {
+		return 0
+	}
+	now := p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var kept []*PoolConn
+	reaped := 0
+	for _, pc := range p.idle {
+		if now.Sub(pc.idleFrom) > p.IdleTimeout {
+			pc.Conn.Close()
+			p.open--
+			reaped++
+		} else {
+			kept = append(kept, pc)
+		}
+	}
+	p.idle = kept
+	if reaped > 0 {
+		p.notify()
+	}
+	return reaped
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{Open: p.open, Idle: len(p.idle)}
+}
+
+// Close closes the idle connections and makes Get fail. Connections in use
+// are closed when they are released.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.Conn.Close()
+		p.open--
+	}
+	p.idle = nil
+	p.notify()
+	return nil
+}
@@ -0,0 +1,144 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+type poolTestConn struct {
+	id     int
+	key    string
+	closed bool
+}
+
+func (c *poolTestConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newTestPool() (*Pool, *time.Time) {
+	now := time.Unix(1000, 0)
+	opened := 0
+	pool := &Pool{
+		Open: func(ctx context.Context, key string) (io.Closer, error) {
+			if key == "broken" {
+				return nil, fmt.Errorf("Connection refused")
+			}
+			opened++
+			return &poolTestConn{id: opened, key: key}, nil
+		},
+		Now: func() time.Time { return now },
+	}
+	return pool, &now
+}
+
+func TestPool_Affinity(t *testing.T) {
+	pool, _ := newTestPool()
+	alice, _ := pool.Get(context.Background(), "alice")
+	bob, _ := pool.Get(context.Background(), "bob")
+	alice.Release()
+	bob.Release()
+
+	pc, err := pool.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.Conn.(*poolTestConn).id != 1 {
+		t.Errorf("Expected connection 1 of alice to be reused, but got %d", pc.Conn.(*poolTestConn).id)
+	}
+	pc.Release()
+	if stats := pool.Stats(); stats.Open != 2 || stats.Idle != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if _, err := pool.Get(context.Background(), "broken"); err == nil {
+		t.Error("Expected error opening connection")
+	}
+	if stats := pool.Stats(); stats.Open != 2 {
+		t.Errorf("Expected failed connection not to count, but got %+v", stats)
+	}
+}
+
+func TestPool_Limits(t *testing.T) {
+	pool, _ := newTestPool()
+	pool.MaxOpen = 2
+	pool.MaxIdle = 1
+
+	alice, _ := pool.Get(context.Background(), "alice")
+	bob, _ := pool.Get(context.Background(), "bob")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx, "carol"); err != context.DeadlineExceeded {
+		t.Errorf("Expected Get to wait for a free connection, but got %v", err)
+	}
+
+	got := make(chan *PoolConn)
+	go func() {
+		pc, _ := pool.Get(context.Background(), "carol")
+		got <- pc
+	}()
+	alice.Release()
+	carol := <-got
+	if carol == nil || carol.Key != "carol" {
+		t.Fatalf("Expected connection of carol, but got %+v", carol)
+	}
+	if !alice.Conn.(*poolTestConn).closed {
+		t.Error("Expected idle connection of alice to make room")
+	}
+
+	bob.Release()
+	carol.Release()
+	if stats := pool.Stats(); stats.Open != 1 || stats.Idle != 1 {
+		t.Errorf("Expected idle connections limited to 1, but got %+v", stats)
+	}
+	if !bob.Conn.(*poolTestConn).closed {
+		t.Error("Expected oldest idle connection to be closed")
+	}
+}
+
+func TestPool_Health(t *testing.T) {
+	pool, now := newTestPool()
+	pool.IdleTimeout = time.Minute
+	healthy := true
+	pool.Check = func(conn io.Closer) error {
+		if !healthy {
+			return fmt.Errorf("Connection lost")
+		}
+		return nil
+	}
+
+	pc, _ := pool.Get(context.Background(), "alice")
+	pc.Release()
+	healthy = false
+	pc2, err := pool.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc2 == pc || !pc.Conn.(*poolTestConn).closed {
+		t.Error("Expected unhealthy connection to be replaced")
+	}
+	pc2.Release()
+
+	*now = now.Add(30 * time.Second)
+	if reaped := pool.Reap(); reaped != 0 {
+		t.Errorf("Expected no connections reaped, but got %d", reaped)
+	}
+	*now = now.Add(time.Minute)
+	if reaped := pool.Reap(); reaped != 1 || !pc2.Conn.(*poolTestConn).closed {
+		t.Errorf("Expected idle connection reaped, but got %d", reaped)
+	}
+
+	pc3, _ := pool.Get(context.Background(), "alice")
+	pool.Close()
+	if _, err := pool.Get(context.Background(), "alice"); err != ErrPoolClosed {
+		t.Errorf("Expected ErrPoolClosed, but got %v", err)
+	}
+	pc3.Release()
+	if stats := pool.Stats(); stats.Open != 0 || !pc3.Conn.(*poolTestConn).closed {
+		t.Errorf("Expected connection closed on release, but got %+v", stats)
+	}
+}
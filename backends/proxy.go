@@ -0,0 +1,245 @@
+package backends
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialer opens network connections, net.Dialer implements it. Gateway
+// backends connecting to upstream servers should dial through a Dialer, so
+// they can be routed through proxies in egress-restricted networks.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// SOCKS5Dialer connects through a SOCKS5 proxy, see RFC 1928, optionally
+// authenticating with username and password, see RFC 1929.
+type SOCKS5Dialer struct {
+	// address of the proxy
+	Addr     string
+	Username string
+	Password string
+	// Forward, if set, connects to the proxy instead of a net.Dialer
+	Forward Dialer
+}
+
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5 proxy doesn't support network %s", network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: %s", portStr)
+	}
+	conn, err := forward(d.Forward).DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := d.connect(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %v", d.Addr, err)
+	}
+	return conn, nil
+}
+
+func (d *SOCKS5Dialer) connect(conn net.Conn, host string, port uint16) error {
+	method := byte(0x00)
+	if d.Username != "" {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return fmt.Errorf("Authentication method not accepted")
+	}
+	if method == 0x02 {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return fmt.Errorf("Username or password too long")
+		}
+		auth := []byte{0x01, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("Authentication failed")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(append(request, 0x01), ip4...)
+		} else {
+			request = append(append(request, 0x04), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name too long: %s", host)
+		}
+		request = append(append(request, 0x03, byte(len(host))), host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("Connect failed with code %d", header[1])
+	}
+	// skip the bound address
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("Invalid address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// HTTPConnectDialer connects through an HTTP proxy using the CONNECT
+// method, optionally authenticating with basic authentication.
+type HTTPConnectDialer struct {
+	// address of the proxy
+	Addr     string
+	Username string
+	Password string
+	// Forward, if set, connects to the proxy instead of a net.Dialer
+	Forward Dialer
+}
+
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := forward(d.Forward).DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if d.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the reader must not buffer beyond the response, the tunnel follows
+	reader := bufio.NewReaderSize(conn, 1)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %v", d.Addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %s", d.Addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// RoutingDialer picks a dialer by the host connected to. Routes are keyed
+// by domain and apply to the domain and its subdomains, the most specific
+// one wins. Hosts without a route use Default, or connect directly.
+type RoutingDialer struct {
+	Routes  map[string]Dialer
+	Default Dialer
+}
+
+func (d *RoutingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	return d.route(host).DialContext(ctx, network, address)
+}
+
+func (d *RoutingDialer) route(host string) Dialer {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if dialer, ok := d.Routes[host]; ok {
+			return forward(dialer)
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return forward(d.Default)
+		}
+		host = host[i+1:]
+	}
+}
+
+// ParseProxy returns the dialer of a proxy URL: "socks5://[user:pass@]host:port",
+// "http://[user:pass@]host:port" or "direct".
+func ParseProxy(proxy string) (Dialer, error) {
+	if proxy == "direct" {
+		return &net.Dialer{}, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("Proxy address with port required: %s", proxy)
+	}
+	username := u.User.Username()
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case "socks5":
+		return &SOCKS5Dialer{Addr: u.Host, Username: username, Password: password}, nil
+	case "http":
+		return &HTTPConnectDialer{Addr: u.Host, Username: username, Password: password}, nil
+	}
+	return nil, fmt.Errorf("Unknown proxy scheme: %s", u.Scheme)
+}
+
+// forward returns d, or a net.Dialer if it is nil.
+func forward(d Dialer) Dialer {
+	if d == nil {
+		return &net.Dialer{}
+	}
+	return d
+}
@@ -0,0 +1,84 @@
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Quota describes the storage used by a maildrop and its limits.
+type Quota struct {
+	UsedOctets   int64
+	UsedMessages int64
+	// limits of the maildrop, 0 means unlimited
+	LimitOctets   int64
+	LimitMessages int64
+	// free space of the file system holding the maildrop, -1 if unknown
+	FreeOctets int64
+}
+
+// Usage returns the used fraction of the most exhausted limit, or -1 if
+// there is no limit.
+func (q Quota) Usage() float64 {
+	usage := -1.0
+	if q.LimitOctets > 0 {
+		usage = float64(q.UsedOctets) / float64(q.LimitOctets)
+	}
+	if q.LimitMessages > 0 {
+		if u := float64(q.UsedMessages) / float64(q.LimitMessages); u > usage {
+			usage = u
+		}
+	}
+	return usage
+}
+
+// ReadMaildirSize reads a Maildir++ quota file (maildirsize) as written by
+// Dovecot, Courier and others. Its first line holds the limits, e.g.
+// "1000000S,1000C", every following line the change of octets and messages
+// of a delivery or removal.
+func ReadMaildirSize(path string) (Quota, error) {
+	quota := Quota{FreeOctets: -1}
+	f, err := os.Open(path)
+	if err != nil {
+		return quota, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return quota, err
+		}
+		return quota, fmt.Errorf("Empty quota file %s", path)
+	}
+	for _, limit := range strings.Split(strings.TrimSpace(scanner.Text()), ",") {
+		if limit == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(limit[:len(limit)-1], 10, 64)
+		if err != nil {
+			return quota, fmt.Errorf("Invalid quota definition %q in %s", limit, path)
+		}
+		switch limit[len(limit)-1] {
+		case 'S':
+			quota.LimitOctets = value
+		case 'C':
+			quota.LimitMessages = value
+		}
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		octets, err1 := strconv.ParseInt(fields[0], 10, 64)
+		messages, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		quota.UsedOctets += octets
+		quota.UsedMessages += messages
+	}
+	return quota, scanner.Err()
+}
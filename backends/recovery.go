@@ -0,0 +1,14 @@
+package backends
+
+import "time"
+
+// ExpungedMessage describes a message removed from a maildrop on update,
+// which can still be recovered.
+type ExpungedMessage struct {
+	Uid    string
+	Octets int
+	// time the message was removed
+	Expunged time.Time
+	// time after which the message can't be recovered anymore
+	Expires time.Time
+}
@@ -0,0 +1,444 @@
+// Package rest implements a POP3 backend on top of a mail store exposing
+// the following HTTP API, relative to a base URL, where user is the path
+// escaped username:
+//
+//	POST   /maildrops/{user}/lock            lock the maildrop, 409 if locked
+//	DELETE /maildrops/{user}/lock            unlock it
+//	GET    /maildrops/{user}/messages        list the messages
+//	GET    /maildrops/{user}/messages/{uid}  the message, as message/rfc822
+//	DELETE /maildrops/{user}/messages/{uid}  remove the message
+//
+// Successful responses have a 2xx status. The listing is a JSON array of
+// objects with the unique ID and the size of the message in octets with
+// CRLF line endings, oldest first:
+//
+//	[{"uid": "1a2b", "size": 1024}, ...]
+//
+// The listing is fetched once when the maildrop is locked, messages marked
+// as deleted are removed on Update. Removing a message which is already
+// gone (404) is not an error. Messages are streamed from the response, so
+// the mail store may send them with chunked transfer encoding. RETR and
+// TOP request a message twice, the first response is only read up to the
+// end of the headers.
+//
+// GET and DELETE requests failing with a network error, 429 or a 5xx
+// status are retried with exponential backoff. Every request carries the
+// Header of the backend, e.g. an Authorization header, and can be changed
+// by Authorize, e.g. to add a short lived token.
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+const (
+	// DEFAULT_TIMEOUT is the default of Backend.Timeout.
+	DEFAULT_TIMEOUT = 30 * time.Second
+	// DEFAULT_RETRIES is the default of Backend.Retries.
+	DEFAULT_RETRIES = 2
+	// DEFAULT_RETRY_DELAY is the default of Backend.RetryDelay.
+	DEFAULT_RETRY_DELAY = 100 * time.Millisecond
+)
+
+type message struct {
+	Uid  string `json:"uid"`
+	Size int    `json:"size"`
+}
+
+type session struct {
+	messages []message
+	deleted  map[int]bool
+}
+
+type Backend struct {
+	// Client sends the requests, http.DefaultClient if nil. It should not
+	// have a Timeout, which would also cut off streamed messages.
+	Client *http.Client
+	// Header is added to every request.
+	Header http.Header
+	// Authorize, if set, is called on every request before it is sent,
+	// including retries.
+	Authorize func(req *http.Request) error
+	// Timeout limits every request except streaming a message,
+	// DEFAULT_TIMEOUT by default.
+	Timeout time.Duration
+	// Retries is the number of times failing GET and DELETE requests are
+	// retried, DEFAULT_RETRIES by default.
+	Retries int
+	// RetryDelay is the delay before the first retry, doubled on every
+	// further one, DEFAULT_RETRY_DELAY by default.
+	RetryDelay time.Duration
+
+	base     string
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// New creates a backend for the API at baseURL, e.g.
+// "https://store.example.com/api/v1".
+func New(baseURL string) (*Backend, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid base URL %s: scheme must be http or https", baseURL)
+	}
+	if base.RawQuery != "" || base.Fragment != "" {
+		return nil, fmt.Errorf("Invalid base URL %s: query or fragment not allowed", baseURL)
+	}
+	return &Backend{
+		Timeout:    DEFAULT_TIMEOUT,
+		Retries:    DEFAULT_RETRIES,
+		RetryDelay: DEFAULT_RETRY_DELAY,
+		base:       strings.TrimSuffix(base.String(), "/"),
+		sessions:   make(map[string]*session),
+	}, nil
+}
+
+// url returns the URL of path below the maildrop of user.
+func (b *Backend) url(user backends.User, path string) string {
+	return b.base + "/maildrops/" + url.PathEscape(user.Username()) + path
+}
+
+// messageURL returns the URL of a message.
+func (b *Backend) messageURL(user backends.User, uid string) string {
+	return b.url(user, "/messages/"+url.PathEscape(uid))
+}
+
+// do sends a request, retrying GET and DELETE requests, and returns the
+// response if its status is 2xx. The caller must close its body.
+func (b *Backend) do(ctx context.Context, method, target string) (*http.Response, error) {
+	retries := 0
+	if method == http.MethodGet || method == http.MethodDelete {
+		retries = b.Retries
+	}
+	delay := b.RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := b.send(ctx, method, target)
+		retry := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = statusError(method, target, resp)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		if !retry || attempt >= retries || ctx.Err() != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// send sends a single request.
+func (b *Backend) send(ctx context.Context, method, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range b.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	if b.Authorize != nil {
+		if err := b.Authorize(req); err != nil {
+			return nil, err
+		}
+	}
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// StatusError is returned for responses without a 2xx status.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// start of the response body
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	}
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// statusError closes the body of a failed response and describes it.
+func statusError(method, target string, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	return &StatusError{
+		Method:     method,
+		URL:        target,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+// request sends a request limited by Timeout and decodes the JSON response
+// into v, unless v is nil.
+func (b *Backend) request(method, target string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.Timeout)
+	defer cancel()
+	resp, err := b.do(ctx, method, target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s %s: %v", method, target, err)
+	}
+	return nil
+}
+
+// locked returns the session of user, it must be called with mu held.
+func (b *Backend) locked(user backends.User) (*session, error) {
+	s := b.sessions[user.Username()]
+	if s == nil {
+		return nil, fmt.Errorf("Maildrop of user %s is not locked", user.Username())
+	}
+	return s, nil
+}
+
+// message returns a message which is not marked as deleted by its number,
+// nil if there is none.
+func (b *Backend) message(user backends.User, msgId int) (*message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	if msgId < 1 || msgId > len(s.messages) || s.deleted[msgId] {
+		return nil, nil
+	}
+	msg := s.messages[msgId-1]
+	return &msg, nil
+}
+
+// Lock locks the maildrop and fetches its listing for the session.
+func (b *Backend) Lock(user backends.User) error {
+	if err := b.request(http.MethodPost, b.url(user, "/lock"), nil); err != nil {
+		return err
+	}
+	var messages []message
+	if err := b.request(http.MethodGet, b.url(user, "/messages"), &messages); err != nil {
+		b.request(http.MethodDelete, b.url(user, "/lock"), nil)
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[user.Username()] = &session{messages: messages, deleted: make(map[int]bool)}
+	return nil
+}
+
+func (b *Backend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	delete(b.sessions, user.Username())
+	b.mu.Unlock()
+	return b.request(http.MethodDelete, b.url(user, "/lock"), nil)
+}
+
+func (b *Backend) Stat(user backends.User) (messages, octets int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, err := b.locked(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, msg := range s.messages {
+		if !s.deleted[i+1] {
+			messages++
+			octets += msg.Size
+		}
+	}
+	return messages, octets, nil
+}
+
+// List returns sizes of all messages in the session, including those marked
+// as deleted so message numbers stay stable.
+func (b *Backend) List(user backends.User) (octets []int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range s.messages {
+		octets = append(octets, msg.Size)
+	}
+	return octets, nil
+}
+
+func (b *Backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, 0, err
+	}
+	return true, msg.Size, nil
+}
+
+// Message streams the message from the mail store on every access.
+func (b *Backend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	msg, err := b.message(user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("No such message: %d", msgId)
+	}
+	return backends.NewLazyMessage(msg.Uid, msg.Size, func() (io.ReadCloser, error) {
+		return b.open(ctx, user, msg.Uid)
+	}), nil
+}
+
+// open returns the body of the response to the request of a message.
+func (b *Backend) open(ctx context.Context, user backends.User, uid string) (io.ReadCloser, error) {
+	resp, err := b.do(ctx, http.MethodGet, b.messageURL(user, uid))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *Backend) Retr(user backends.User, msgId int) (message string, err error) {
+	msg, err := b.message(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	if msg == nil {
+		return "", fmt.Errorf("No such message: %d", msgId)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.Timeout)
+	defer cancel()
+	body, err := b.open(ctx, user, msg.Uid)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	return string(content), err
+}
+
+func (b *Backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.Timeout)
+	defer cancel()
+	msg, err := b.Message(ctx, user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	return backends.TopLines(msg, n)
+}
+
+func (b *Backend) Dele(user backends.User, msgId int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, err := b.locked(user)
+	if err != nil {
+		return err
+	}
+	if msgId < 1 || msgId > len(s.messages) || s.deleted[msgId] {
+		return fmt.Errorf("No such message: %d", msgId)
+	}
+	s.deleted[msgId] = true
+	return nil
+}
+
+func (b *Backend) Rset(user backends.User) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, err := b.locked(user)
+	if err != nil {
+		return err
+	}
+	s.deleted = make(map[int]bool)
+	return nil
+}
+
+func (b *Backend) Uidl(user backends.User) (uids []string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, err := b.locked(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range s.messages {
+		uids = append(uids, msg.Uid)
+	}
+	return uids, nil
+}
+
+func (b *Backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	msg, err := b.message(user, msgId)
+	if err != nil || msg == nil {
+		return false, "", err
+	}
+	return true, msg.Uid, nil
+}
+
+// Update removes the messages marked as deleted from the mail store.
+// Messages which could not be removed are reported in FailedUids and kept
+// in the session.
+func (b *Backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	b.mu.Lock()
+	s, err := b.locked(user)
+	var messages []message
+	var deleted map[int]bool
+	if err == nil {
+		messages, deleted = s.messages, s.deleted
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return result, err
+	}
+
+	var kept []message
+	for i, msg := range messages {
+		if deleted[i+1] {
+			err := b.request(http.MethodDelete, b.messageURL(user, msg.Uid), nil)
+			if status, ok := err.(*StatusError); err == nil || ok && status.StatusCode == http.StatusNotFound {
+				result.Removed++
+				continue
+			}
+			result.FailedUids = append(result.FailedUids, msg.Uid)
+		}
+		kept = append(kept, msg)
+		result.RemainingMessages++
+		result.RemainingOctets += msg.Size
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s := b.sessions[user.Username()]; s != nil {
+		s.messages = kept
+		s.deleted = make(map[int]bool)
+	}
+	return result, nil
+}
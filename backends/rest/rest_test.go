@@ -0,0 +1,200 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+// store serves the API for a single maildrop.
+type store struct {
+	mu       sync.Mutex
+	locked   bool
+	messages map[string]string
+	order    []string
+	// responses with 503 before the listing is served
+	unavailable int
+	requests    []string
+}
+
+func (s *store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.EscapedPath())
+	if r.Header.Get("Authorization") != "Bearer token-1" || r.Header.Get("X-Tenant") != "example" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/maildrops/alice@example.com")
+	switch {
+	case path == "/lock" && r.Method == http.MethodPost:
+		if s.locked {
+			http.Error(w, "maildrop locked", http.StatusConflict)
+			return
+		}
+		s.locked = true
+	case path == "/lock" && r.Method == http.MethodDelete:
+		s.locked = false
+	case path == "/messages" && r.Method == http.MethodGet:
+		if s.unavailable > 0 {
+			s.unavailable--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		type message struct {
+			Uid  string `json:"uid"`
+			Size int    `json:"size"`
+		}
+		listing := []message{}
+		for _, uid := range s.order {
+			listing = append(listing, message{uid, len(s.messages[uid])})
+		}
+		json.NewEncoder(w).Encode(listing)
+	case strings.HasPrefix(path, "/messages/") && r.Method == http.MethodGet:
+		uid, _ := url.PathUnescape(strings.TrimPrefix(path, "/messages/"))
+		content, ok := s.messages[uid]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// send the message in chunks
+		for _, line := range strings.SplitAfter(content, "\n") {
+			w.Write([]byte(line))
+			w.(http.Flusher).Flush()
+		}
+	case strings.HasPrefix(path, "/messages/") && r.Method == http.MethodDelete:
+		uid, _ := url.PathUnescape(strings.TrimPrefix(path, "/messages/"))
+		if _, ok := s.messages[uid]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.messages, uid)
+		for i, u := range s.order {
+			if u == uid {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *store) deliver(uid, content string) {
+	s.messages[uid] = content
+	s.order = append(s.order, uid)
+}
+
+func TestBackend(t *testing.T) {
+	s := &store{messages: make(map[string]string), unavailable: 1}
+	s.deliver("a/1", "Subject: one\r\n\r\nbody 1\r\n")
+	s.deliver("b", "Subject: two\r\n\r\nline 1\r\nline 2\r\n")
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	b, err := New(server.URL + "/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Header = http.Header{"Authorization": {"Bearer token-1"}}
+	b.Authorize = func(req *http.Request) error {
+		req.Header.Set("X-Tenant", "example")
+		return nil
+	}
+	b.RetryDelay = time.Millisecond
+	user := testUser("alice@example.com")
+
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(user); err == nil || !strings.Contains(err.Error(), "409 Conflict: maildrop locked") {
+		t.Errorf("Expected the maildrop to be locked, but got %v", err)
+	}
+	if messages, octets, err := b.Stat(user); err != nil || messages != 2 || octets != 56 {
+		t.Errorf("Expected 2 messages of 56 octets, but got %d, %d, %v", messages, octets, err)
+	}
+	if uids, err := b.Uidl(user); err != nil || !reflect.DeepEqual(uids, []string{"a/1", "b"}) {
+		t.Errorf("Expected UIDs [a/1 b], but got %v, %v", uids, err)
+	}
+	if message, err := b.Retr(user, 1); err != nil || message != "Subject: one\r\n\r\nbody 1\r\n" {
+		t.Errorf("Expected the first message, but got %q, %v", message, err)
+	}
+	if lines, err := b.Top(user, 2, 1); err != nil || strings.Join(lines, "|") != "Subject: two||line 1" {
+		t.Errorf("Expected headers and 1 line, but got %q, %v", lines, err)
+	}
+
+	b.Dele(user, 1)
+	b.Dele(user, 2)
+	// removed by someone else meanwhile
+	s.mu.Lock()
+	delete(s.messages, "b")
+	s.mu.Unlock()
+	result, err := b.Update(user)
+	if err != nil || result.Removed != 2 || result.RemainingMessages != 0 || len(result.FailedUids) != 0 {
+		t.Errorf("Expected 2 messages removed, but got %+v, %v", result, err)
+	}
+	if err := b.Unlock(user); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expected := []string{
+		"POST /api/maildrops/alice@example.com/lock",
+		"GET /api/maildrops/alice@example.com/messages",
+		"GET /api/maildrops/alice@example.com/messages",
+		"POST /api/maildrops/alice@example.com/lock",
+		"GET /api/maildrops/alice@example.com/messages/a%2F1",
+		// headers and body of TOP
+		"GET /api/maildrops/alice@example.com/messages/b",
+		"GET /api/maildrops/alice@example.com/messages/b",
+		"DELETE /api/maildrops/alice@example.com/messages/a%2F1",
+		"DELETE /api/maildrops/alice@example.com/messages/b",
+		"DELETE /api/maildrops/alice@example.com/lock",
+	}
+	if !reflect.DeepEqual(s.requests, expected) {
+		t.Errorf("Expected requests\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(s.requests, "\n"))
+	}
+}
+
+func TestBackend_retriesExhausted(t *testing.T) {
+	s := &store{messages: make(map[string]string), unavailable: 3}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	b, _ := New(server.URL + "/api")
+	b.Header = http.Header{"Authorization": {"Bearer token-1"}, "X-Tenant": {"example"}}
+	b.RetryDelay = time.Millisecond
+
+	err := b.Lock(testUser("alice@example.com"))
+	if status, ok := err.(*StatusError); !ok || status.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after retries, but got %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked {
+		t.Error("Expected the maildrop to be unlocked after a failed listing")
+	}
+	if len(s.requests) != 5 {
+		t.Errorf("Expected lock, 3 listings and unlock, but got %v", s.requests)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"ftp://store.example.com", "https://store.example.com/api?x=1", "::"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("Expected base URL %s to be refused", baseURL)
+		}
+	}
+}
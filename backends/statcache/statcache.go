@@ -0,0 +1,220 @@
+// Package statcache caches the STAT and LIST aggregates of maildrops, so
+// clients polling with STAT don't make the backend scan large maildrops
+// again when nothing changed.
+//
+// A Backend wraps another backend, which must tell the generation of a
+// maildrop: a value that changes whenever messages are delivered or
+// removed, e.g. a counter or modification times. Aggregates are cached
+// per generation and only reused while the session hasn't marked
+// messages as deleted:
+//
+//	b := statcache.New(maildir.New("/var/mail"))
+//
+// Like faulty, optional interfaces of the wrapped backend are not passed
+// through.
+package statcache
+
+import (
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Wrapped is the interface of the wrapped backend: the methods of
+// popgun.Backend and Generation.
+type Wrapped interface {
+	Stat(user backends.User) (messages, octets int, err error)
+	List(user backends.User) (octets []int, err error)
+	ListMessage(user backends.User, msgId int) (exists bool, octets int, err error)
+	Retr(user backends.User, msgId int) (message string, err error)
+	Dele(user backends.User, msgId int) error
+	Rset(user backends.User) error
+	Uidl(user backends.User) (uids []string, err error)
+	UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error)
+	Top(user backends.User, msgId int, n int) (lines []string, err error)
+	Update(user backends.User) (result backends.UpdateResult, err error)
+	Lock(user backends.User) error
+	Unlock(user backends.User) error
+	// Generation returns the generation of the maildrop of user. It must
+	// be cheap compared to Stat.
+	Generation(user backends.User) (string, error)
+}
+
+type entry struct {
+	generation string
+	stat       bool
+	messages   int
+	octets     int
+	sizes      []int
+}
+
+type session struct {
+	// generation when the maildrop was locked, "" if unknown
+	generation string
+	// whether messages are marked as deleted or were removed
+	dirty bool
+}
+
+type Backend struct {
+	Wrapped Wrapped
+
+	mu       sync.Mutex
+	entries  map[string]*entry
+	sessions map[string]*session
+	hits     int
+	misses   int
+}
+
+func New(wrapped Wrapped) *Backend {
+	return &Backend{
+		Wrapped:  wrapped,
+		entries:  make(map[string]*entry),
+		sessions: make(map[string]*session),
+	}
+}
+
+// Stats returns how many STAT and LIST calls were answered from the cache,
+// and how many were passed through.
+func (b *Backend) Stats() (hits, misses int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hits, b.misses
+}
+
+// cached returns the cache entry usable by the session of user, nil if
+// there is none. It must be called with mu held.
+func (b *Backend) cached(user backends.User) *entry {
+	s := b.sessions[user.Username()]
+	if s == nil || s.generation == "" || s.dirty {
+		return nil
+	}
+	e := b.entries[user.Username()]
+	if e == nil || e.generation != s.generation {
+		e = &entry{generation: s.generation}
+		b.entries[user.Username()] = e
+	}
+	return e
+}
+
+func (b *Backend) Stat(user backends.User) (messages, octets int, err error) {
+	b.mu.Lock()
+	e := b.cached(user)
+	if e != nil && e.stat {
+		b.hits++
+		b.mu.Unlock()
+		return e.messages, e.octets, nil
+	}
+	b.misses++
+	b.mu.Unlock()
+
+	messages, octets, err = b.Wrapped.Stat(user)
+	if err == nil && e != nil {
+		b.mu.Lock()
+		e.stat, e.messages, e.octets = true, messages, octets
+		b.mu.Unlock()
+	}
+	return messages, octets, err
+}
+
+func (b *Backend) List(user backends.User) (octets []int, err error) {
+	b.mu.Lock()
+	e := b.cached(user)
+	if e != nil && e.sizes != nil {
+		b.hits++
+		octets = append([]int{}, e.sizes...)
+		b.mu.Unlock()
+		return octets, nil
+	}
+	b.misses++
+	b.mu.Unlock()
+
+	octets, err = b.Wrapped.List(user)
+	if err == nil && e != nil {
+		b.mu.Lock()
+		e.sizes = append([]int{}, octets...)
+		b.mu.Unlock()
+	}
+	return octets, err
+}
+
+func (b *Backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	return b.Wrapped.ListMessage(user, msgId)
+}
+
+func (b *Backend) Retr(user backends.User, msgId int) (message string, err error) {
+	return b.Wrapped.Retr(user, msgId)
+}
+
+// setDirty records whether the session of user has messages marked as
+// deleted.
+func (b *Backend) setDirty(user backends.User, dirty bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s := b.sessions[user.Username()]; s != nil {
+		s.dirty = dirty
+	}
+}
+
+func (b *Backend) Dele(user backends.User, msgId int) error {
+	err := b.Wrapped.Dele(user, msgId)
+	if err == nil {
+		b.setDirty(user, true)
+	}
+	return err
+}
+
+func (b *Backend) Rset(user backends.User) error {
+	err := b.Wrapped.Rset(user)
+	if err == nil {
+		b.setDirty(user, false)
+	}
+	return err
+}
+
+func (b *Backend) Uidl(user backends.User) (uids []string, err error) {
+	return b.Wrapped.Uidl(user)
+}
+
+func (b *Backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	return b.Wrapped.UidlMessage(user, msgId)
+}
+
+func (b *Backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	return b.Wrapped.Top(user, msgId, n)
+}
+
+// Update drops the cached aggregates of user, the rest of the session
+// bypasses the cache.
+func (b *Backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	b.mu.Lock()
+	delete(b.entries, user.Username())
+	if s := b.sessions[user.Username()]; s != nil {
+		s.dirty = true
+	}
+	b.mu.Unlock()
+	return b.Wrapped.Update(user)
+}
+
+// Lock locks the maildrop of user. The generation is read first, so
+// messages delivered meanwhile change the generation of the next session.
+func (b *Backend) Lock(user backends.User) error {
+	generation, err := b.Wrapped.Generation(user)
+	if err != nil {
+		// not cached
+		generation = ""
+	}
+	if err := b.Wrapped.Lock(user); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.sessions[user.Username()] = &session{generation: generation}
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *Backend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	delete(b.sessions, user.Username())
+	b.mu.Unlock()
+	return b.Wrapped.Unlock(user)
+}
@@ -0,0 +1,79 @@
+package statcache
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func assertStat(t *testing.T, b *Backend, user testUser, messages, octets int) {
+	t.Helper()
+	m, o, err := b.Stat(user)
+	if err != nil || m != messages || o != octets {
+		t.Errorf("Expected %d messages of %d octets, but got %d, %d, %v", messages, octets, m, o, err)
+	}
+}
+
+func assertStats(t *testing.T, b *Backend, hits, misses int) {
+	t.Helper()
+	if h, m := b.Stats(); h != hits || m != misses {
+		t.Errorf("Expected %d hits and %d misses, but got %d and %d", hits, misses, h, m)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	user := testUser("john")
+	wrapped := memory.New()
+	wrapped.Deliver("john", "a", "Subject: one\n\nbody 1\n")
+	wrapped.Deliver("john", "b", "Subject: two\n\nline 1\nline 2\n")
+	b := New(wrapped)
+
+	// polling without changes is answered from the cache
+	for i := 0; i < 3; i++ {
+		if err := b.Lock(user); err != nil {
+			t.Fatal(err)
+		}
+		assertStat(t, b, user, 2, 56)
+		b.Unlock(user)
+	}
+	assertStats(t, b, 2, 1)
+
+	// delivery changes the generation
+	wrapped.Deliver("john", "c", "Subject: three\n\n")
+	b.Lock(user)
+	assertStat(t, b, user, 3, 74)
+	assertStats(t, b, 2, 2)
+	sizes, err := b.List(user)
+	if expected := []int{24, 32, 18}; err != nil || !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Expected %v, but got %v, %v", expected, sizes, err)
+	}
+	b.List(user)
+	assertStats(t, b, 3, 3)
+
+	// marking messages as deleted bypasses the cache
+	b.Dele(user, 1)
+	assertStat(t, b, user, 2, 50)
+	b.Rset(user)
+	assertStat(t, b, user, 3, 74)
+	assertStats(t, b, 4, 4)
+
+	b.Dele(user, 1)
+	if _, err := b.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	assertStat(t, b, user, 2, 50)
+	b.Unlock(user)
+
+	b.Lock(user)
+	assertStat(t, b, user, 2, 50)
+	assertStat(t, b, user, 2, 50)
+	b.Unlock(user)
+	assertStats(t, b, 5, 6)
+}
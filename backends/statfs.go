@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package backends
+
+import "syscall"
+
+// FreeSpace returns the octets available to unprivileged users on the file
+// system holding path, or -1 if unknown.
+func FreeSpace(path string) int64 {
+	var stat syscall.Statfs_t
+	if syscall.Statfs(path, &stat) != nil {
+		return -1
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package backends
+
+// FreeSpace returns the octets available on the file system holding path,
+// which is unknown on this platform.
+func FreeSpace(path string) int64 {
+	return -1
+}
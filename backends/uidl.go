@@ -0,0 +1,293 @@
+package backends
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UidlInfo describes a message to a UidlStrategy.
+type UidlInfo struct {
+	// owner of the maildrop
+	Username string
+	// file name of the message in a Maildir without the info part, empty
+	// for other stores
+	Filename string
+	// IMAP UID and UIDVALIDITY of the message, 0 if unknown
+	ImapUid     uint32
+	UidValidity uint32
+	// the message itself, for strategies deriving the UID from its content
+	Message Message
+}
+
+// UidlStrategy computes the unique ID of a message returned by UIDL. File
+// backends use one to stay compatible with the UIDs of the server they
+// replace, so clients don't download the whole maildrop again.
+type UidlStrategy interface {
+	Uidl(info UidlInfo) (string, error)
+}
+
+// UidlStrategyFunc adapts a function to the UidlStrategy interface.
+type UidlStrategyFunc func(info UidlInfo) (string, error)
+
+func (f UidlStrategyFunc) Uidl(info UidlInfo) (string, error) {
+	return f(info)
+}
+
+// DovecotUidl reproduces Dovecot's pop3_uidl_format, e.g. "%08Xu%08Xv".
+// Supported variables are
+//
+//	%u  IMAP UID
+//	%v  IMAP UIDVALIDITY
+//	%m  hex MD5 digest of the message headers
+//	%f  Maildir file name
+//	%g  Maildir file name, which Dovecot uses as GUID of Maildir messages
+//
+// Numbers may be zero-padded to a width and formatted as hexadecimal with
+// "X", as in "%08Xu". UIDs are known only if the maildrop was used by
+// Dovecot before, i.e. from dovecot-uidlist in a Maildir and from X-UID and
+// X-IMAPbase headers in an mbox file. Computing an UID which needs them
+// fails for other messages.
+func DovecotUidl(format string) (UidlStrategy, error) {
+	// validate the format once
+	_, err := expandDovecotUidl(format, UidlInfo{ImapUid: 1, UidValidity: 1}, true)
+	if err != nil {
+		return nil, err
+	}
+	return UidlStrategyFunc(func(info UidlInfo) (string, error) {
+		return expandDovecotUidl(format, info, false)
+	}), nil
+}
+
+func expandDovecotUidl(format string, info UidlInfo, dryRun bool) (string, error) {
+	var uid strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			uid.WriteByte(format[i])
+			continue
+		}
+		j := i + 1
+		for j < len(format) && format[j] >= '0' && format[j] <= '9' {
+			j++
+		}
+		width := format[i+1 : j]
+		hex := false
+		if j < len(format) && format[j] == 'X' {
+			hex = true
+			j++
+		}
+		if j >= len(format) {
+			return "", fmt.Errorf("Incomplete variable in UIDL format %q", format)
+		}
+		var number uint32
+		switch format[j] {
+		case 'u':
+			number = info.ImapUid
+		case 'v':
+			number = info.UidValidity
+		case 'm':
+			if !dryRun {
+				digest, err := HeaderDigest(info.Message)
+				if err != nil {
+					return "", err
+				}
+				uid.WriteString(digest)
+			}
+			i = j
+			continue
+		case 'f', 'g':
+			if !dryRun && info.Filename == "" {
+				return "", fmt.Errorf("No file name for UIDL format %q", format)
+			}
+			uid.WriteString(info.Filename)
+			i = j
+			continue
+		case '%':
+			uid.WriteByte('%')
+			i = j
+			continue
+		default:
+			return "", fmt.Errorf("Unknown variable %%%c in UIDL format %q", format[j], format)
+		}
+		if number == 0 {
+			return "", fmt.Errorf("No IMAP UID for UIDL format %q", format)
+		}
+		verb := "d"
+		if hex {
+			verb = "X"
+		}
+		fmt.Fprintf(&uid, "%"+width+verb, number)
+		i = j
+	}
+	return uid.String(), nil
+}
+
+// HeaderDigest returns the hex MD5 digest of the header lines of msg, each
+// terminated by a line feed.
+func HeaderDigest(msg Message) (string, error) {
+	if msg == nil {
+		return "", fmt.Errorf("No message to compute digest of")
+	}
+	headers, err := msg.RawHeaders()
+	if err != nil {
+		return "", err
+	}
+	sum := md5.New()
+	for _, line := range headers {
+		sum.Write([]byte(line))
+		sum.Write([]byte("\n"))
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), nil
+}
+
+// ReadDovecotUidList reads the IMAP UIDs of Maildir messages from a
+// dovecot-uidlist file, by the file name of the messages without the info
+// part.
+func ReadDovecotUidList(path string) (uidValidity uint32, uids map[string]uint32, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, nil, fmt.Errorf("Empty uid list %s", path)
+	}
+	// "1 <uidvalidity> <nextuid>" or "3 V<uidvalidity> N<nextuid> ..."
+	header := strings.Fields(scanner.Text())
+	if len(header) < 2 {
+		return 0, nil, fmt.Errorf("Invalid uid list header in %s", path)
+	}
+	version := header[0]
+	for _, field := range header[1:] {
+		if version == "1" {
+			field = "V" + field
+		}
+		if strings.HasPrefix(field, "V") {
+			value, err := strconv.ParseUint(field[1:], 10, 32)
+			if err != nil {
+				return 0, nil, fmt.Errorf("Invalid uid validity in %s", path)
+			}
+			uidValidity = uint32(value)
+			break
+		}
+	}
+
+	uids = make(map[string]uint32)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var name string
+		if i := strings.Index(line, " :"); i >= 0 {
+			name = line[i+2:]
+		} else if fields := strings.Fields(line); len(fields) >= 2 {
+			name = fields[len(fields)-1]
+		} else {
+			continue
+		}
+		uid, err := strconv.ParseUint(strings.Fields(line)[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[:i]
+		}
+		uids[name] = uint32(uid)
+	}
+	return uidValidity, uids, scanner.Err()
+}
+
+// CourierUidl reproduces the UIDs of Courier's pop3d, the Maildir file name
+// up to the info part. Non-printable characters and spaces, which UIDs must
+// not contain, are hex-escaped.
+func CourierUidl() UidlStrategy {
+	return UidlStrategyFunc(func(info UidlInfo) (string, error) {
+		if info.Filename == "" {
+			return "", fmt.Errorf("No file name for Courier UIDL")
+		}
+		var uid strings.Builder
+		for _, c := range []byte(info.Filename) {
+			if c < 0x21 || c > 0x7e {
+				fmt.Fprintf(&uid, "%%%02X", c)
+			} else {
+				uid.WriteByte(c)
+			}
+		}
+		return uid.String(), nil
+	})
+}
+
+// headers Qpopper derives UIDs from if a message has no X-UIDL header
+var qpopperHeaders = map[string]bool{
+	"Received":   true,
+	"Date":       true,
+	"Message-Id": true,
+	"Subject":    true,
+	"Sender":     true,
+	"From":       true,
+	"To":         true,
+	"Cc":         true,
+}
+
+// QpopperUidl reproduces the UIDs of Qpopper, the X-UIDL header it stores in
+// the mbox file, or the hex MD5 digest of the Received, Date, Message-Id,
+// Subject, Sender, From, To and Cc header lines for messages Qpopper hasn't
+// seen.
+func QpopperUidl() UidlStrategy {
+	return UidlStrategyFunc(func(info UidlInfo) (string, error) {
+		if info.Message == nil {
+			return "", fmt.Errorf("No message to compute Qpopper UIDL of")
+		}
+		headers, err := info.Message.Headers()
+		if err != nil {
+			return "", err
+		}
+		if uid := headers.Get("X-Uidl"); uid != "" {
+			return uid, nil
+		}
+		raw, err := info.Message.RawHeaders()
+		if err != nil {
+			return "", err
+		}
+		sum := md5.New()
+		include := false
+		for _, line := range raw {
+			if line[0] != ' ' && line[0] != '\t' {
+				include = false
+				if i := strings.IndexByte(line, ':'); i > 0 {
+					include = qpopperHeaders[textproto.CanonicalMIMEHeaderKey(line[:i])]
+				}
+			}
+			if include {
+				sum.Write([]byte(line))
+				sum.Write([]byte("\n"))
+			}
+		}
+		return fmt.Sprintf("%x", sum.Sum(nil)), nil
+	})
+}
+
+// DomainUidl selects the UIDL strategy by the domain of the username, so
+// maildrops migrated from different servers can be served side by side.
+// Users without a domain or of domains not in Domains use Default, which
+// may be nil to keep the default UIDs of the backend.
+type DomainUidl struct {
+	Default UidlStrategy
+	Domains map[string]UidlStrategy
+}
+
+func (d DomainUidl) Uidl(info UidlInfo) (string, error) {
+	strategy := d.Default
+	if i := strings.LastIndex(info.Username, "@"); i >= 0 {
+		if s, ok := d.Domains[strings.ToLower(info.Username[i+1:])]; ok {
+			strategy = s
+		}
+	}
+	if strategy == nil {
+		return "", fmt.Errorf("No UIDL strategy for user %s", info.Username)
+	}
+	return strategy.Uidl(info)
+}
@@ -0,0 +1,76 @@
+package backends
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDovecotUidl(t *testing.T) {
+	tables := []struct {
+		format   string
+		info     UidlInfo
+		expected string
+	}{
+		{"%08Xu%08Xv", UidlInfo{ImapUid: 26, UidValidity: 1234567890}, "0000001A499602D2"},
+		{"%v.%u", UidlInfo{ImapUid: 26, UidValidity: 1234567890}, "1234567890.26"},
+		{"%f", UidlInfo{Filename: "1000.a.host"}, "1000.a.host"},
+		{"%m", UidlInfo{Message: NewStringMessage("", "Subject: x\n\nbody\n")}, "817e763d06dbf423be9e2086a59d51e5"},
+	}
+	for _, table := range tables {
+		strategy, err := DovecotUidl(table.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uid, err := strategy.Uidl(table.info)
+		if err != nil || uid != table.expected {
+			t.Errorf("Expected '%s', but got '%s' (%v)", table.expected, uid, err)
+		}
+	}
+
+	if _, err := DovecotUidl("%08Xq"); err == nil {
+		t.Error("Expected error for unknown variable")
+	}
+	strategy, _ := DovecotUidl("%u")
+	if _, err := strategy.Uidl(UidlInfo{}); err == nil {
+		t.Error("Expected error for unknown IMAP UID")
+	}
+}
+
+func TestReadDovecotUidList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dovecot-uidlist")
+	ioutil.WriteFile(path, []byte("3 V1234567890 N3 G0123\n1 :1000.a.host:2,S\n2 W120 :1001.b.host\n"), 0600)
+
+	uidValidity, uids, err := ReadDovecotUidList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uidValidity != 1234567890 {
+		t.Errorf("Expected uid validity 1234567890, but got %d", uidValidity)
+	}
+	if !reflect.DeepEqual(uids, map[string]uint32{"1000.a.host": 1, "1001.b.host": 2}) {
+		t.Errorf("Unexpected uids '%v'", uids)
+	}
+}
+
+func TestDomainUidl(t *testing.T) {
+	strategy := DomainUidl{
+		Default: CourierUidl(),
+		Domains: map[string]UidlStrategy{"legacy.org": QpopperUidl()},
+	}
+	message := NewStringMessage("", "Subject: x\nX-UIDL: abc123\n\nbody\n")
+
+	uid, err := strategy.Uidl(UidlInfo{Username: "alice@example.org", Filename: "1000.a host", Message: message})
+	if err != nil || uid != "1000.a%20host" {
+		t.Errorf("Expected '1000.a%%20host', but got '%s' (%v)", uid, err)
+	}
+	uid, err = strategy.Uidl(UidlInfo{Username: "bob@Legacy.org", Message: message})
+	if err != nil || uid != "abc123" {
+		t.Errorf("Expected 'abc123', but got '%s' (%v)", uid, err)
+	}
+	uid, err = QpopperUidl().Uidl(UidlInfo{Message: NewStringMessage("", "Subject: x\nX-Mailer: y\n\nbody\n")})
+	if err != nil || uid != "817e763d06dbf423be9e2086a59d51e5" {
+		t.Errorf("Expected digest of Subject only, but got '%s' (%v)", uid, err)
+	}
+}
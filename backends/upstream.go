@@ -0,0 +1,233 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Certificate usages of TLSA records, see RFC 6698.
+const (
+	TLSA_PKIX_TA = 0
+	TLSA_PKIX_EE = 1
+	TLSA_DANE_TA = 2
+	TLSA_DANE_EE = 3
+)
+
+// TLSARecord is a TLSA record of an upstream server, see RFC 6698.
+type TLSARecord struct {
+	Usage uint8
+	// 0 matches the whole certificate, 1 its SubjectPublicKeyInfo
+	Selector uint8
+	// 0 compares Data with the selected content, 1 with its SHA-256 and 2
+	// with its SHA-512 digest
+	MatchingType uint8
+	Data         []byte
+}
+
+// TLSAResolver looks up the TLSA records of host and port, i.e. of
+// "_port._tcp.host". The standard library can't, so it is implemented with
+// a DNS client. Records must be validated with DNSSEC, otherwise they
+// can be spoofed as easily as the upstream host.
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, host string, port int) ([]TLSARecord, error)
+}
+
+// TLSDialer connects to upstream servers over TLS, so gateway backends
+// never relay credentials to a spoofed upstream host. Certificates are
+// verified against the TLSA records of the upstream host if there are
+// any, see TLSA, or by their chain and host name otherwise, and must
+// match one of the Pins if set.
+type TLSDialer struct {
+	// Config is cloned for every connection. Its ServerName defaults to
+	// the host connected to, its RootCAs to the system roots.
+	Config *tls.Config
+	// Pins, if set, are SPKIPin digests of certificates, one of which
+	// must be in the chain presented by the upstream server.
+	Pins []string
+	// TLSA, if set, looks up TLSA records of upstream hosts, which then
+	// take precedence over verification by the chain alone, so upstreams
+	// may use self-signed certificates (usage TLSA_DANE_EE).
+	TLSA TLSAResolver
+	// RequireTLSA refuses upstream hosts without TLSA records.
+	RequireTLSA bool
+	// Forward, if set, connects to the upstream instead of a net.Dialer
+	Forward Dialer
+}
+
+func (d *TLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: %s", portStr)
+	}
+	var records []TLSARecord
+	if d.TLSA != nil {
+		records, err = d.TLSA.LookupTLSA(ctx, host, port)
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up TLSA records of %s: %v", address, err)
+		}
+	}
+	if d.RequireTLSA && len(records) == 0 {
+		return nil, fmt.Errorf("No TLSA records for %s", address)
+	}
+
+	config := &tls.Config{}
+	if d.Config != nil {
+		config = d.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	// verified below, where TLSA records may replace the chain
+	config.InsecureSkipVerify = true
+
+	raw, err := forward(d.Forward).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := d.verify(conn.ConnectionState().PeerCertificates, config, records); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Upstream %s not verified: %v", address, err)
+	}
+	return conn, nil
+}
+
+// verify checks the certificate chain presented by the upstream server.
+func (d *TLSDialer) verify(certs []*x509.Certificate, config *tls.Config, records []TLSARecord) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("No certificate")
+	}
+	if len(records) > 0 {
+		if !verifyTLSA(certs, config, records) {
+			return fmt.Errorf("No TLSA record matches")
+		}
+	} else if _, err := verifyChain(certs, config, config.RootCAs); err != nil {
+		return err
+	}
+	if len(d.Pins) == 0 {
+		return nil
+	}
+	for _, cert := range certs {
+		pin := SPKIPin(cert)
+		for _, p := range d.Pins {
+			if p == pin {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("No pinned certificate")
+}
+
+// verifyTLSA reports whether a TLSA record matches the chain, see RFC 7671.
+func verifyTLSA(certs []*x509.Certificate, config *tls.Config, records []TLSARecord) bool {
+	for _, record := range records {
+		switch record.Usage {
+		case TLSA_DANE_EE:
+			// the host name isn't checked, the record binds the key to it
+			if record.matches(certs[0]) {
+				return true
+			}
+		case TLSA_PKIX_EE:
+			if record.matches(certs[0]) {
+				if _, err := verifyChain(certs, config, config.RootCAs); err == nil {
+					return true
+				}
+			}
+		case TLSA_PKIX_TA:
+			chains, err := verifyChain(certs, config, config.RootCAs)
+			if err != nil {
+				continue
+			}
+			for _, chain := range chains {
+				for _, cert := range chain[1:] {
+					if record.matches(cert) {
+						return true
+					}
+				}
+			}
+		case TLSA_DANE_TA:
+			for _, cert := range certs {
+				if !record.matches(cert) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				if _, err := verifyChain(certs, config, roots); err == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// verifyChain verifies the chain and host name of the leaf of certs.
+func verifyChain(certs []*x509.Certificate, config *tls.Config, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       config.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}
+	if config.Time != nil {
+		opts.CurrentTime = config.Time()
+	}
+	return certs[0].Verify(opts)
+}
+
+func (r TLSARecord) matches(cert *x509.Certificate) bool {
+	var content []byte
+	switch r.Selector {
+	case 0:
+		content = cert.Raw
+	case 1:
+		content = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(content)
+		content = sum[:]
+	case 2:
+		sum := sha512.Sum512(content)
+		content = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(content, r.Data)
+}
+
+// SPKIPin returns the pin of cert for TLSDialer.Pins, the base64 encoded
+// SHA-256 digest of its SubjectPublicKeyInfo, as used by HPKP and
+// "openssl x509 -pubkey | openssl pkey -pubin -outform der | openssl dgst
+// -sha256 -binary | base64".
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,81 @@
+package backends
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/kiwiz/popgun/testcert"
+)
+
+type tlsaResolverFunc func(host string, port int) []TLSARecord
+
+func (f tlsaResolverFunc) LookupTLSA(ctx context.Context, host string, port int) ([]TLSARecord, error) {
+	return f(host, port), nil
+}
+
+func TestTLSDialer(t *testing.T) {
+	cert, err := testcert.New("upstream.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cert.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	spki := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	records := func(records ...TLSARecord) TLSAResolver {
+		return tlsaResolverFunc(func(host string, port int) []TLSARecord {
+			if host != "127.0.0.1" || port != ln.Addr().(*net.TCPAddr).Port {
+				return nil
+			}
+			return records
+		})
+	}
+	trusted := cert.ClientConfig()
+	untrusted := &tls.Config{ServerName: "upstream.test"}
+	tables := []struct {
+		name   string
+		dialer *TLSDialer
+		ok     bool
+	}{
+		{"trusted chain", &TLSDialer{Config: trusted}, true},
+		{"untrusted chain", &TLSDialer{Config: untrusted}, false},
+		{"wrong name", &TLSDialer{Config: &tls.Config{RootCAs: trusted.RootCAs, ServerName: "spoofed.test"}}, false},
+		{"DANE-EE", &TLSDialer{Config: untrusted, TLSA: records(TLSARecord{TLSA_DANE_EE, 1, 1, spki[:]})}, true},
+		{"DANE-EE mismatch", &TLSDialer{Config: trusted, TLSA: records(TLSARecord{TLSA_DANE_EE, 1, 1, make([]byte, 32)})}, false},
+		{"DANE-TA", &TLSDialer{Config: untrusted, TLSA: records(TLSARecord{TLSA_DANE_TA, 0, 0, cert.Leaf.Raw})}, true},
+		{"PKIX-EE untrusted", &TLSDialer{Config: untrusted, TLSA: records(TLSARecord{TLSA_PKIX_EE, 1, 1, spki[:]})}, false},
+		{"TLSA required", &TLSDialer{Config: trusted, TLSA: records(), RequireTLSA: true}, false},
+		{"pinned", &TLSDialer{Config: trusted, Pins: []string{SPKIPin(cert.Leaf)}}, true},
+		{"pin mismatch", &TLSDialer{Config: trusted, Pins: []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}, false},
+	}
+	for _, table := range tables {
+		conn, err := table.dialer.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if table.ok && err != nil {
+			t.Errorf("%s: Expected connection, but got %v", table.name, err)
+		}
+		if !table.ok && err == nil {
+			t.Errorf("%s: Expected connection refused", table.name)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
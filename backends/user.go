@@ -0,0 +1,10 @@
+package backends
+
+// ActingUser is passed to backends instead of the user for sessions
+// opened on behalf of the user by someone else, e.g. a master user, so
+// backends can attribute access to the maildrop to both.
+type ActingUser interface {
+	User
+	// Actor returns the identity acting on behalf of the user.
+	Actor() string
+}
@@ -0,0 +1,118 @@
+package popgun
+
+import (
+	"time"
+)
+
+// AbuseCounter can be implemented by abuse scorers keeping plain counters,
+// e.g. shared ones in a database, so SessionBudget is enforced across
+// servers. DecayingScorer keeps them in memory.
+type AbuseCounter interface {
+	// Add adds delta to the counter key, which is dropped after expires,
+	// and returns its new value.
+	Add(key string, delta int64, expires time.Time) (int64, error)
+}
+
+// SessionBudget limits the sessions of every user per day, to tame clients
+// misconfigured to poll every few seconds. Zero values mean no limit.
+// Logins of users who exhausted their budget are refused with
+// -ERR [LOGIN-DELAY] until the next day, in UTC.
+//
+// The budget is counted in Counter, or in the AbuseScorer of the server if
+// it implements AbuseCounter. Refused logins are counted as
+// "budget.refused", labeled with the exhausted limit.
+type SessionBudget struct {
+	// MaxSessions limits the number of sessions per day.
+	MaxSessions int
+	// MaxSeconds limits the cumulative time sessions are connected per
+	// day, from connecting to disconnecting.
+	MaxSeconds int
+	Counter    AbuseCounter
+}
+
+// budget returns the budget and counter of the server, nil if there is no
+// budget to enforce.
+func (s *Server) budget() (*SessionBudget, AbuseCounter) {
+	budget := s.SessionBudget
+	if budget == nil || (budget.MaxSessions <= 0 && budget.MaxSeconds <= 0) {
+		return nil, nil
+	}
+	if budget.Counter != nil {
+		return budget, budget.Counter
+	}
+	if counter, ok := s.AbuseScorer.(AbuseCounter); ok {
+		return budget, counter
+	}
+	return nil, nil
+}
+
+// budgetKeys returns the counter keys of the sessions and seconds of
+// username today, and when they expire.
+func budgetKeys(username string, now time.Time) (sessions, seconds string, expires time.Time) {
+	now = now.UTC()
+	day := now.Format("2006-01-02")
+	expires = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return "budget:sessions:" + day + ":" + username, "budget:seconds:" + day + ":" + username, expires
+}
+
+// spendBudget counts a session of username against its budget. It returns
+// false if the budget is exhausted. The session is counted and checked
+// against the limit in a single step of the counter, so parallel logins
+// can't exceed it, and taken back if it is over the limit. Errors of the
+// counter are logged and the session allowed.
+func (c *Client) spendBudget(username string) bool {
+	budget, counter := c.server.budget()
+	if budget == nil {
+		return true
+	}
+	sessionsKey, secondsKey, expires := budgetKeys(username, c.server.clock().Now())
+	seconds, err := counter.Add(secondsKey, 0, expires)
+	if err == nil && budget.MaxSeconds > 0 && seconds >= int64(budget.MaxSeconds) {
+		c.server.Metrics.Inc("budget.refused", "seconds")
+		return false
+	}
+	var sessions int64
+	if err == nil {
+		sessions, err = counter.Add(sessionsKey, 1, expires)
+	}
+	if err != nil {
+		c.ErrorLog.Printf("Error counting session budget of user %s: %v", username, err)
+		return true
+	}
+	c.budgetSpent = true
+	if budget.MaxSessions > 0 && sessions > int64(budget.MaxSessions) {
+		c.refundBudget(username)
+		c.server.Metrics.Inc("budget.refused", "sessions")
+		return false
+	}
+	return true
+}
+
+// refundBudget takes back the session counted by spendBudget, for logins
+// which fail after it.
+func (c *Client) refundBudget(username string) {
+	budget, counter := c.server.budget()
+	if budget == nil || !c.budgetSpent {
+		return
+	}
+	c.budgetSpent = false
+	sessionsKey, _, expires := budgetKeys(username, c.server.clock().Now())
+	if _, err := counter.Add(sessionsKey, -1, expires); err != nil {
+		c.ErrorLog.Printf("Error counting session budget of user %s: %v", username, err)
+	}
+}
+
+// chargeBudget adds the time the session was connected to the budget of
+// its user, if it logged in.
+func (c *Client) chargeBudget() {
+	budget, counter := c.server.budget()
+	if budget == nil || c.loggedIn == "" {
+		return
+	}
+	now := c.server.clock().Now()
+	_, secondsKey, expires := budgetKeys(c.loggedIn, now)
+	seconds := int64(now.Sub(c.started) / time.Second)
+	if _, err := counter.Add(secondsKey, seconds, expires); err != nil {
+		c.ErrorLog.Printf("Error counting session budget of user %s: %v", c.loggedIn, err)
+	}
+}
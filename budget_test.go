@@ -0,0 +1,138 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestClient_handleSessionBudget(t *testing.T) {
+	clock := newFakeClock()
+	scorer := NewDecayingScorer(time.Hour)
+	scorer.Clock = clock
+	metrics := newCountingMetrics()
+	disconnected := make(chan CloseReason, 1)
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.AllowInsecureAuth = true
+	server.Clock = clock
+	server.Metrics = metrics
+	server.AbuseScorer = scorer
+	server.SessionBudget = &SessionBudget{MaxSessions: 3, MaxSeconds: 60}
+	server.Hooks.OnDisconnect = func(c *Client, reason CloseReason) {
+		disconnected <- reason
+	}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	// session logs in as username, waits for d on the clock and quits
+	session := func(username string, d time.Duration) string {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		fmt.Fprintf(conn, "USER %s\r\nPASS secret\r\n", username)
+		reader.ReadString('\n')
+		line, _ := reader.ReadString('\n')
+		clock.Advance(d)
+		fmt.Fprintf(conn, "QUIT\r\n")
+		reader.ReadString('\n')
+		<-disconnected
+		return line
+	}
+
+	const loggedOn = "+OK User Successfully Logged on\r\n"
+	const exhausted = "-ERR [LOGIN-DELAY] Daily session budget exhausted, try again tomorrow\r\n"
+	for i, expected := range []string{loggedOn, loggedOn, loggedOn, exhausted} {
+		if line := session("alice", time.Second); line != expected {
+			t.Errorf("Expected %q for session %d of alice, but got %q", expected, i+1, line)
+		}
+	}
+	if line := session("bob", time.Minute); line != loggedOn {
+		t.Errorf("Expected login of bob, but got %q", line)
+	}
+	if line := session("bob", 0); line != exhausted {
+		t.Errorf("Expected the seconds of bob to be exhausted, but got %q", line)
+	}
+	// budgets are renewed every day
+	clock.Advance(24 * time.Hour)
+	if line := session("alice", 0); line != loggedOn {
+		t.Errorf("Expected login of alice the next day, but got %q", line)
+	}
+
+	if refused := metrics.count("budget.refused:sessions"); refused != 1 {
+		t.Errorf("Expected 1 login refused for sessions, but got %d", refused)
+	}
+	if refused := metrics.count("budget.refused:seconds"); refused != 1 {
+		t.Errorf("Expected 1 login refused for seconds, but got %d", refused)
+	}
+}
+
+func TestClient_spendBudget(t *testing.T) {
+	backend := memory.New()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.AbuseScorer = NewDecayingScorer(time.Hour)
+	server.SessionBudget = &SessionBudget{MaxSessions: 5}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	// parallel logins can't exceed the budget
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	spent := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &Client{server: server, ErrorLog: server.ErrorLog}
+			if c.spendBudget("carol") {
+				mu.Lock()
+				spent++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if spent != 5 {
+		t.Errorf("Expected 5 sessions within the budget, but got %d", spent)
+	}
+
+	// failed logins don't use up the budget
+	server.SessionBudget.MaxSessions = 1
+	listener := newPipeListener()
+	go server.Serve(listener)
+	login := func() string {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\n")
+		reader.ReadString('\n')
+		line, _ := reader.ReadString('\n')
+		return line
+	}
+	alice := testUser("alice")
+	backend.Lock(alice)
+	if line := login(); !strings.HasPrefix(line, "-ERR Server was unable to lock maildrop") {
+		t.Fatalf("Expected the locked maildrop to fail the login, but got %q", line)
+	}
+	backend.Unlock(alice)
+	if line := login(); line != "+OK User Successfully Logged on\r\n" {
+		t.Errorf("Expected login after the failed one, but got %q", line)
+	}
+}
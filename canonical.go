@@ -0,0 +1,100 @@
+package popgun
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Canonicalizer maps the username a client logs in with to the canonical
+// username of the account. It is applied before the Authorizator and the
+// backend see the username, so all spellings of an account share one
+// maildrop, lock and account policy.
+type Canonicalizer interface {
+	Canonicalize(conn net.Conn, username string) (string, error)
+}
+
+// AliasResolver resolves aliases of accounts, e.g. "postmaster@example.org"
+// to "alice@example.org". ok is false if username is not an alias.
+// Backends knowing the aliases of their accounts can implement it.
+type AliasResolver interface {
+	ResolveAlias(username string) (canonical string, ok bool, err error)
+}
+
+// Aliases resolves aliases from static configuration.
+type Aliases map[string]string
+
+func (a Aliases) ResolveAlias(username string) (string, bool, error) {
+	canonical, ok := a[username]
+	return canonical, ok, nil
+}
+
+// UsernameCanonicalizer canonicalizes usernames of the forms "user",
+// "user@domain", "user@REALM" and "REALM\user": Kerberos realms and NT
+// domains are mapped to mail domains, usernames without a domain get the
+// default domain, domains are lowercased and aliases are resolved last.
+// With DefaultDomain "example.com", "User@Example.COM", "user" and
+// "user@example.com" are all "user@example.com" if Lowercase is set.
+type UsernameCanonicalizer struct {
+	// Lowercase lowercases the local part too, domains are always
+	// lowercased
+	Lowercase bool
+	// DefaultDomain, if set, is the domain of usernames without one
+	DefaultDomain string
+	// Realms maps Kerberos realms and NT domains, matched case
+	// insensitively, to mail domains. Usernames of the form "REALM\user"
+	// are refused if the realm is not mapped.
+	Realms map[string]string
+	// Aliases, if set, resolves the canonical username to an account,
+	// e.g. the backend if it implements AliasResolver
+	Aliases AliasResolver
+}
+
+func (u UsernameCanonicalizer) Canonicalize(conn net.Conn, username string) (string, error) {
+	local, domain := username, ""
+	if i := strings.Index(username, "\\"); i >= 0 {
+		realm, ok := u.realm(username[:i])
+		if !ok {
+			return "", fmt.Errorf("Unknown realm %s", username[:i])
+		}
+		local, domain = username[i+1:], realm
+	} else if i := strings.LastIndex(username, "@"); i >= 0 {
+		local, domain = username[:i], username[i+1:]
+		if realm, ok := u.realm(domain); ok {
+			domain = realm
+		}
+	}
+	if local == "" {
+		return "", fmt.Errorf("Invalid username: %q", username)
+	}
+	if domain == "" {
+		domain = u.DefaultDomain
+	}
+	if u.Lowercase {
+		local = strings.ToLower(local)
+	}
+	canonical := local
+	if domain != "" {
+		canonical += "@" + strings.ToLower(domain)
+	}
+	if u.Aliases != nil {
+		resolved, ok, err := u.Aliases.ResolveAlias(canonical)
+		if err != nil {
+			return "", fmt.Errorf("Error resolving alias %s: %v", canonical, err)
+		}
+		if ok {
+			canonical = resolved
+		}
+	}
+	return canonical, nil
+}
+
+// realm returns the mail domain of realm.
+func (u UsernameCanonicalizer) realm(realm string) (string, bool) {
+	for name, domain := range u.Realms {
+		if strings.EqualFold(name, realm) {
+			return domain, true
+		}
+	}
+	return "", false
+}
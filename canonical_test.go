@@ -0,0 +1,78 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestUsernameCanonicalizer_Canonicalize(t *testing.T) {
+	canonicalizer := UsernameCanonicalizer{
+		Lowercase:     true,
+		DefaultDomain: "example.com",
+		Realms:        map[string]string{"CORP.EXAMPLE.COM": "example.com", "CORP": "example.com"},
+		Aliases:       Aliases{"postmaster@example.com": "alice@example.com"},
+	}
+	tables := []struct {
+		username, expected string
+	}{
+		{"User@Example.COM", "user@example.com"},
+		{"user", "user@example.com"},
+		{"user@example.com", "user@example.com"},
+		{"user@corp.example.com", "user@example.com"},
+		{"CORP\\User", "user@example.com"},
+		{"Postmaster", "alice@example.com"},
+		{"bob@example.org", "bob@example.org"},
+	}
+	for _, table := range tables {
+		canonical, err := canonicalizer.Canonicalize(nil, table.username)
+		if err != nil || canonical != table.expected {
+			t.Errorf("Expected %s to be %s, but got %s (%v)", table.username, table.expected, canonical, err)
+		}
+	}
+	for _, username := range []string{"OTHER\\user", "@example.com"} {
+		if _, err := canonicalizer.Canonicalize(nil, username); err == nil {
+			t.Errorf("Expected %s to be refused", username)
+		}
+	}
+	// the local part is kept as is without Lowercase
+	canonical, _ := UsernameCanonicalizer{}.Canonicalize(nil, "User@Example.COM")
+	if canonical != "User@example.com" {
+		t.Errorf("Expected local part to be kept, but got %s", canonical)
+	}
+}
+
+func TestClient_handleCanonicalUsername(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("user@example.com", "a", "Subject: a\r\n\r\nbody\r\n")
+	backend.Alias("info@example.com", "user@example.com")
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.Canonicalizer = UsernameCanonicalizer{Lowercase: true, DefaultDomain: "example.com", Aliases: backend}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	for _, username := range []string{"User@Example.COM", "user", "INFO"} {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		fmt.Fprintf(conn, "USER %s\r\nPASS secret\r\nSTAT\r\nQUIT\r\n", username)
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		line, _ := reader.ReadString('\n')
+		if line != "+OK 1 20\r\n" {
+			t.Errorf("Expected maildrop of user@example.com for %s, but got %q", username, line)
+		}
+		reader.ReadString('\n')
+		conn.Close()
+	}
+}
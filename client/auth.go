@@ -0,0 +1,263 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultMechanisms are the SASL mechanisms tried by Authenticate, in order
+// of preference.
+var DefaultMechanisms = []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN"}
+
+// saslClient is the client side of a SASL mechanism. Next is first called
+// with a nil challenge for the initial response.
+type saslClient interface {
+	Next(challenge []byte) (response []byte, err error)
+	// Verified reports whether the exchange authenticated the server, if
+	// the mechanism is able to.
+	Verified() bool
+}
+
+var saslClients = map[string]func(username, password string) saslClient{
+	"PLAIN": func(username, password string) saslClient {
+		return &plainClient{username: username, password: password}
+	},
+	"SCRAM-SHA-1": func(username, password string) saslClient {
+		return &scramClient{h: sha1.New, username: username, password: password}
+	},
+	"SCRAM-SHA-256": func(username, password string) saslClient {
+		return &scramClient{h: sha256.New, username: username, password: password}
+	},
+}
+
+// Authenticate logs in with the most secure method the server offers, so
+// it works with old servers as well as current ones:
+//
+//   - cleartext sessions are upgraded with STLS if TLSConfig is set and the
+//     server offers it, or refused with ErrTLSRequired if RequireTLS is set
+//   - the first of Mechanisms advertised with the SASL capability is used
+//   - otherwise APOP if the greeting has a timestamp
+//   - otherwise USER and PASS
+func (c *Client) Authenticate(username, password string) error {
+	caps, err := c.Capa()
+	if err != nil {
+		return err
+	}
+	if !c.TLS() {
+		if c.TLSConfig != nil && caps.Has("STLS") {
+			if err := c.StartTLS(c.TLSConfig); err != nil {
+				return err
+			}
+			if caps, err = c.Capa(); err != nil {
+				return err
+			}
+		} else if c.RequireTLS {
+			return ErrTLSRequired
+		}
+	}
+	// capabilities may change after login
+	defer func() {
+		c.probed = false
+	}()
+
+	mechanisms := c.Mechanisms
+	if mechanisms == nil {
+		mechanisms = DefaultMechanisms
+	}
+	for _, name := range mechanisms {
+		name = strings.ToUpper(name)
+		if mechanism, ok := saslClients[name]; ok && caps.Offers("SASL", name) {
+			return c.auth(name, mechanism(username, password))
+		}
+	}
+	if timestamp := apopTimestamp.FindString(c.Greeting); timestamp != "" {
+		return c.Apop(username, password, timestamp)
+	}
+	return c.Login(username, password)
+}
+
+// apopTimestamp matches the msg-id of the greeting of servers supporting
+// APOP, see RFC 1939.
+var apopTimestamp = regexp.MustCompile(`<[^<>]+@[^<>]+>`)
+
+// Apop authenticates with APOP, using the secret shared with the server
+// and the timestamp of the greeting.
+func (c *Client) Apop(username, secret, timestamp string) error {
+	sum := md5.Sum([]byte(timestamp + secret))
+	_, err := c.cmd("APOP %s %s", username, hex.EncodeToString(sum[:]))
+	return err
+}
+
+// auth runs a SASL exchange with AUTH, see RFC 5034.
+func (c *Client) auth(name string, mechanism saslClient) error {
+	initial, err := mechanism.Next(nil)
+	if err != nil {
+		return err
+	}
+	arg := "="
+	if len(initial) > 0 {
+		arg = base64.StdEncoding.EncodeToString(initial)
+	}
+	if _, err := fmt.Fprintf(c.conn, "AUTH %s %s\r\n", name, arg); err != nil {
+		return err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "+ ") && line != "+\r\n" {
+			if _, err := parseStatus(line); err != nil {
+				return err
+			}
+			if !mechanism.Verified() {
+				c.Close()
+				return fmt.Errorf("Server not verified by %s", name)
+			}
+			return nil
+		}
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "+")))
+		if err != nil {
+			return fmt.Errorf("Invalid SASL challenge: %v", err)
+		}
+		response, err := mechanism.Next(challenge)
+		if err != nil {
+			// cancel the exchange
+			fmt.Fprintf(c.conn, "*\r\n")
+			c.status()
+			return err
+		}
+		if _, err := fmt.Fprintf(c.conn, "%s\r\n", base64.StdEncoding.EncodeToString(response)); err != nil {
+			return err
+		}
+	}
+}
+
+type plainClient struct {
+	username, password string
+}
+
+func (m *plainClient) Next(challenge []byte) ([]byte, error) {
+	if len(challenge) > 0 {
+		return nil, fmt.Errorf("Unexpected PLAIN challenge")
+	}
+	return []byte("\x00" + m.username + "\x00" + m.password), nil
+}
+
+// Verified is true, PLAIN relies on TLS to authenticate the server.
+func (m *plainClient) Verified() bool {
+	return true
+}
+
+// scramClient is the client of SCRAM mechanisms without channel binding,
+// see RFC 5802. It verifies the signature of the server.
+type scramClient struct {
+	h                  func() hash.Hash
+	username, password string
+
+	nonce, clientFirst string
+	serverSignature    []byte
+	verified           bool
+}
+
+func (m *scramClient) Next(challenge []byte) ([]byte, error) {
+	switch {
+	case m.clientFirst == "":
+		nonce := make([]byte, 18)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		m.nonce = base64.StdEncoding.EncodeToString(nonce)
+		name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.username)
+		m.clientFirst = "n=" + name + ",r=" + m.nonce
+		return []byte("n,," + m.clientFirst), nil
+	case m.serverSignature == nil:
+		return m.final(string(challenge))
+	}
+	attrs := scramAttributes(string(challenge))
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || subtle.ConstantTimeCompare(signature, m.serverSignature) != 1 {
+		return nil, fmt.Errorf("Invalid SCRAM server signature")
+	}
+	m.verified = true
+	return []byte{}, nil
+}
+
+func (m *scramClient) final(serverFirst string) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SCRAM salt")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("Invalid SCRAM iteration count")
+	}
+	if !strings.HasPrefix(attrs["r"], m.nonce) {
+		return nil, fmt.Errorf("Invalid SCRAM nonce")
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + attrs["r"]
+	authMessage := m.clientFirst + "," + serverFirst + "," + withoutProof
+	salted := pbkdf2(m.h, []byte(m.password), salt, iterations)
+	clientKey := scramHMAC(m.h, salted, "Client Key")
+	storedKey := m.h()
+	storedKey.Write(clientKey)
+	proof := scramHMAC(m.h, storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	m.serverSignature = scramHMAC(m.h, scramHMAC(m.h, salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (m *scramClient) Verified() bool {
+	return m.verified
+}
+
+func scramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, message string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives the SaltedPassword of SCRAM, see RFC 8018.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	mac.Write(block)
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
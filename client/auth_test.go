@@ -0,0 +1,236 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+	"github.com/kiwiz/popgun/testcert"
+)
+
+// scriptedServer answers commands with the replies of a script, commands
+// missing from it with -ERR. STLS upgrades the connection with config.
+type scriptedServer struct {
+	greeting string
+	replies  map[string]string
+	config   *tls.Config
+	commands chan string
+}
+
+func (s *scriptedServer) serve(conn net.Conn) {
+	defer conn.Close()
+	defer close(s.commands)
+	fmt.Fprintf(conn, "%s\r\n", s.greeting)
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+		s.commands <- command
+		reply, ok := s.replies[command]
+		if !ok {
+			reply = "-ERR Unknown command"
+		}
+		fmt.Fprintf(conn, "%s\r\n", reply)
+		if command == "STLS" && ok {
+			tlsConn := tls.Server(conn, s.config)
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		}
+	}
+}
+
+// dialScript runs a scripted server and returns a client of it.
+func dialScript(t *testing.T, s *scriptedServer) *Client {
+	s.commands = make(chan string, 100)
+	server, conn := net.Pipe()
+	go s.serve(server)
+	c, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.host = "localhost"
+	return c
+}
+
+// sent returns the commands received by s once the client is closed.
+func (s *scriptedServer) sent(c *Client) string {
+	c.Close()
+	var commands []string
+	for command := range s.commands {
+		commands = append(commands, command)
+	}
+	return strings.Join(commands, "|")
+}
+
+func TestClient_Authenticate_fallback(t *testing.T) {
+	digest := md5.Sum([]byte("<1.2@example.test>secret"))
+	tables := []struct {
+		name     string
+		greeting string
+		replies  map[string]string
+		expected string
+	}{
+		{
+			"APOP without CAPA", "+OK ready <1.2@example.test>",
+			map[string]string{"APOP alice " + hex.EncodeToString(digest[:]): "+OK"},
+			"CAPA|APOP alice " + hex.EncodeToString(digest[:]),
+		},
+		{
+			"USER without CAPA", "+OK ready",
+			map[string]string{"USER alice": "+OK", "PASS secret": "+OK"},
+			"CAPA|USER alice|PASS secret",
+		},
+		{
+			"USER without common mechanism", "+OK ready",
+			map[string]string{"CAPA": "+OK\r\nUSER\r\nSASL CRAM-MD5\r\n.", "USER alice": "+OK", "PASS secret": "+OK"},
+			"CAPA|USER alice|PASS secret",
+		},
+		{
+			"PLAIN", "+OK ready",
+			map[string]string{"CAPA": "+OK\r\nSASL CRAM-MD5 PLAIN\r\n.", "AUTH PLAIN AGFsaWNlAHNlY3JldA==": "+OK"},
+			"CAPA|AUTH PLAIN AGFsaWNlAHNlY3JldA==",
+		},
+	}
+	for _, table := range tables {
+		s := &scriptedServer{greeting: table.greeting, replies: table.replies}
+		c := dialScript(t, s)
+		if err := c.Authenticate("alice", "secret"); err != nil {
+			t.Errorf("%s: %v", table.name, err)
+		}
+		if sent := s.sent(c); sent != table.expected {
+			t.Errorf("%s: Expected %s, but got %s", table.name, table.expected, sent)
+		}
+	}
+}
+
+func TestClient_Authenticate_tls(t *testing.T) {
+	cert, err := testcert.New("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scriptedServer{
+		greeting: "+OK ready",
+		replies: map[string]string{
+			"CAPA":        "+OK\r\nSTLS\r\nUSER\r\n.",
+			"STLS":        "+OK Begin TLS negotiation",
+			"USER alice":  "+OK",
+			"PASS secret": "+OK",
+		},
+		config: cert.ServerConfig(),
+	}
+	c := dialScript(t, s)
+	c.TLSConfig, c.RequireTLS = cert.ClientConfig(), true
+	if err := c.Authenticate("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.TLS() {
+		t.Errorf("Expected session upgraded to TLS")
+	}
+	if sent, expected := s.sent(c), "CAPA|STLS|CAPA|USER alice|PASS secret"; sent != expected {
+		t.Errorf("Expected %s, but got %s", expected, sent)
+	}
+
+	s = &scriptedServer{greeting: "+OK ready", replies: map[string]string{"CAPA": "+OK\r\nUSER\r\n."}}
+	c = dialScript(t, s)
+	c.TLSConfig, c.RequireTLS = cert.ClientConfig(), true
+	if err := c.Authenticate("alice", "secret"); err != ErrTLSRequired {
+		t.Errorf("Expected TLS required, but got %v", err)
+	}
+	if sent := s.sent(c); sent != "CAPA" {
+		t.Errorf("Expected no credentials sent, but got %s", sent)
+	}
+}
+
+// scramAuthorizator has SCRAM credentials for any user with password
+// "secret".
+type scramAuthorizator struct {
+	passwordAuthorizator
+}
+
+func (scramAuthorizator) SCRAMCredentials(conn net.Conn, username, hash string) (popgun.SCRAMCredentials, backends.User, error) {
+	credentials, err := popgun.NewSCRAMCredentials(hash, "secret", []byte("salt"), 4096)
+	return credentials, testUser(username), err
+}
+
+func TestClient_Authenticate_scram(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := popgun.NewServer(scramAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.SASL["SCRAM-SHA-1"] = popgun.SASLScramSHA1
+	server.SASL["SCRAM-SHA-256"] = popgun.SASLScramSHA256
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+
+	for _, mechanisms := range [][]string{nil, {"SCRAM-SHA-1"}, {"PLAIN"}} {
+		c, err := Dial(context.Background(), l.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Mechanisms = mechanisms
+		if err := c.Authenticate("alice", "secret"); err != nil {
+			t.Errorf("Expected login with %v, but got %v", mechanisms, err)
+		} else if messages, _, err := c.Stat(); err != nil || messages != 1 {
+			t.Errorf("Expected session of alice, but got %d, %v", messages, err)
+		}
+		c.Quit()
+
+		c, err = Dial(context.Background(), l.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Mechanisms = mechanisms
+		if err := c.Authenticate("alice", "wrong"); err == nil {
+			t.Errorf("Expected wrong password refused with %v", mechanisms)
+		}
+		c.Close()
+	}
+}
+
+func TestListUids_top(t *testing.T) {
+	s := &scriptedServer{
+		greeting: "+OK ready",
+		replies: map[string]string{
+			"LIST":    "+OK\r\n1 20\r\n2 30\r\n.",
+			"TOP 1 0": "+OK\r\nSubject: a\r\n\r\n.",
+			"TOP 2 0": "+OK\r\nSubject: b\r\n\r\n.",
+		},
+	}
+	c := dialScript(t, s)
+	messages, err := listUids(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].UID == messages[1].UID || len(messages[0].UID) != 32 {
+		t.Errorf("Expected messages identified by their headers, but got %v", messages)
+	}
+	if sent, expected := s.sent(c), "UIDL|CAPA|LIST|TOP 1 0|TOP 2 0"; sent != expected {
+		t.Errorf("Expected %s, but got %s", expected, sent)
+	}
+
+	s = &scriptedServer{greeting: "+OK ready", replies: map[string]string{"CAPA": "+OK\r\nUSER\r\n."}}
+	c = dialScript(t, s)
+	if _, err := listUids(c); err == nil {
+		t.Errorf("Expected error without UIDL and TOP")
+	}
+	s.sent(c)
+}
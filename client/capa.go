@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// ErrTLSRequired is returned by Authenticate for cleartext sessions if
+// RequireTLS is set and the server doesn't offer STLS.
+var ErrTLSRequired = fmt.Errorf("TLS required, but not offered by the server")
+
+// Capabilities are the capabilities advertised by CAPA, see RFC 2449,
+// mapping upper case names to their arguments.
+type Capabilities map[string][]string
+
+// Has reports whether the capability name is advertised.
+func (caps Capabilities) Has(name string) bool {
+	_, ok := caps[strings.ToUpper(name)]
+	return ok
+}
+
+// Offers reports whether the capability name is advertised with arg, e.g.
+// the SASL mechanism "PLAIN" of "SASL".
+func (caps Capabilities) Offers(name, arg string) bool {
+	for _, a := range caps[strings.ToUpper(name)] {
+		if strings.EqualFold(a, arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Capa returns the capabilities of the server, nil if it doesn't support
+// CAPA, i.e. it predates RFC 2449. They are probed once, and again after
+// StartTLS and Authenticate, which may change them.
+func (c *Client) Capa() (Capabilities, error) {
+	if c.probed {
+		return c.caps, nil
+	}
+	if _, err := c.cmd("CAPA"); err != nil {
+		if _, ok := err.(*Error); ok {
+			c.caps, c.probed = nil, true
+			return nil, nil
+		}
+		return nil, err
+	}
+	caps := Capabilities{}
+	err := c.readLines(func(line string) error {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			caps[strings.ToUpper(fields[0])] = fields[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.caps, c.probed = caps, true
+	return caps, nil
+}
+
+// supports reports whether the server may support the optional command
+// name: it is advertised, or the server doesn't support CAPA.
+func (c *Client) supports(name string) bool {
+	caps, err := c.Capa()
+	return err == nil && (caps == nil || caps.Has(name))
+}
+
+// TLS reports whether the session is encrypted.
+func (c *Client) TLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
+// StartTLS upgrades a cleartext session to TLS with STLS, see RFC 2595.
+// The ServerName of config defaults to the host dialed.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if c.TLS() {
+		return fmt.Errorf("Session already uses TLS")
+	}
+	if _, err := c.cmd("STLS"); err != nil {
+		return err
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = c.host
+	}
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	c.probed = false
+	return nil
+}
@@ -0,0 +1,306 @@
+// Package client is a POP3 client for pollers and synchronization tools.
+// Client speaks the protocol on a single connection:
+//
+//	c, err := client.Dial(ctx, "pop.example.com:995", &tls.Config{})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	if err := c.Login("alice", "secret"); err != nil {
+//		return err
+//	}
+//	messages, err := c.Uidl()
+//
+// Fetcher builds on it to download the new messages of many accounts
+// into a Store, see Fetcher.Sync.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Error is a negative response of the server.
+type Error struct {
+	// text of the -ERR response
+	Response string
+}
+
+func (e *Error) Error() string {
+	return "POP3 server: " + e.Response
+}
+
+// MessageInfo is a message listed by Uidl or List.
+type MessageInfo struct {
+	// message number of the session, starting at 1
+	ID  int
+	UID string
+	// size of the message, set by List
+	Octets int
+}
+
+// Client is a POP3 session. It isn't safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// host dialed, the default ServerName of StartTLS
+	host string
+	// capabilities, see Capa
+	caps   Capabilities
+	probed bool
+
+	// Greeting is the text of the +OK greeting of the server.
+	Greeting string
+	// TLSConfig, if set, upgrades cleartext sessions with STLS in
+	// Authenticate if the server offers it.
+	TLSConfig *tls.Config
+	// RequireTLS refuses to authenticate in cleartext sessions which
+	// can't be upgraded.
+	RequireTLS bool
+	// Mechanisms are the SASL mechanisms Authenticate tries in order of
+	// preference, DefaultMechanisms if nil.
+	Mechanisms []string
+}
+
+// Dial connects to the POP3 server at addr, over TLS if config is set,
+// and reads the greeting. The ServerName of config defaults to the host
+// of addr.
+func Dial(ctx context.Context, addr string, config *tls.Config) (*Client, error) {
+	return DialWith(ctx, nil, addr, config)
+}
+
+// DialWith is like Dial, connecting with dialer, e.g. a
+// backends.SOCKS5Dialer.
+func DialWith(ctx context.Context, dialer backends.Dialer, addr string, config *tls.Config) (*Client, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if config != nil {
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = host
+		}
+		conn = tls.Client(conn, config)
+	}
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.host = host
+	return c, nil
+}
+
+// NewClient starts a session on conn and reads the greeting.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.status()
+	if err != nil {
+		return nil, err
+	}
+	c.Greeting = greeting
+	return c, nil
+}
+
+// status reads a status line and returns its text, or an *Error for -ERR.
+func (c *Client) status() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return parseStatus(line)
+}
+
+// parseStatus returns the text of a status line, or an *Error for -ERR.
+func parseStatus(line string) (string, error) {
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case line == "+OK" || strings.HasPrefix(line, "+OK "):
+		return strings.TrimPrefix(strings.TrimPrefix(line, "+OK"), " "), nil
+	case line == "-ERR" || strings.HasPrefix(line, "-ERR "):
+		return "", &Error{Response: strings.TrimPrefix(strings.TrimPrefix(line, "-ERR"), " ")}
+	}
+	return "", fmt.Errorf("Invalid response: %q", line)
+}
+
+// cmd sends a command and reads its status line.
+func (c *Client) cmd(format string, a ...interface{}) (string, error) {
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", a...); err != nil {
+		return "", err
+	}
+	return c.status()
+}
+
+// readLines reads the lines of a multi-line response, removing the
+// byte-stuffing, until the terminating ".". It passes each line with its
+// CRLF to line.
+func (c *Client) readLines(line func(string) error) error {
+	for {
+		l, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if l == ".\r\n" || l == ".\n" {
+			return nil
+		}
+		if strings.HasPrefix(l, ".") {
+			l = l[1:]
+		}
+		if err := line(l); err != nil {
+			return err
+		}
+	}
+}
+
+// Login authenticates with USER and PASS.
+func (c *Client) Login(username, password string) error {
+	if _, err := c.cmd("USER %s", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", password)
+	return err
+}
+
+// Stat returns the number of messages and octets of the maildrop.
+func (c *Client) Stat() (messages, octets int, err error) {
+	text, err := c.cmd("STAT")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscanf(text, "%d %d", &messages, &octets); err != nil {
+		return 0, 0, fmt.Errorf("Invalid STAT response: %q", text)
+	}
+	return messages, octets, nil
+}
+
+// Uidl lists the unique IDs of the messages.
+func (c *Client) Uidl() ([]MessageInfo, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+	var messages []MessageInfo
+	err := c.readLines(func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid UIDL line: %q", line)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return fmt.Errorf("Invalid UIDL line: %q", line)
+		}
+		messages = append(messages, MessageInfo{ID: id, UID: fields[1]})
+		return nil
+	})
+	return messages, err
+}
+
+// List lists the sizes of the messages.
+func (c *Client) List() ([]MessageInfo, error) {
+	if _, err := c.cmd("LIST"); err != nil {
+		return nil, err
+	}
+	var messages []MessageInfo
+	err := c.readLines(func(line string) error {
+		var msg MessageInfo
+		if _, err := fmt.Sscanf(line, "%d %d", &msg.ID, &msg.Octets); err != nil {
+			return fmt.Errorf("Invalid LIST line: %q", line)
+		}
+		messages = append(messages, msg)
+		return nil
+	})
+	return messages, err
+}
+
+// Retr writes message id to w with CRLF line endings and returns the
+// number of bytes written.
+func (c *Client) Retr(id int, w io.Writer) (int64, error) {
+	if _, err := c.cmd("RETR %d", id); err != nil {
+		return 0, err
+	}
+	return c.copyLines(w)
+}
+
+// Top writes the headers and the first n lines of the body of message id
+// to w like Retr. TOP is optional, see Capa.
+func (c *Client) Top(id, n int, w io.Writer) (int64, error) {
+	if _, err := c.cmd("TOP %d %d", id, n); err != nil {
+		return 0, err
+	}
+	return c.copyLines(w)
+}
+
+// copyLines writes the lines of a multi-line response to w.
+func (c *Client) copyLines(w io.Writer) (int64, error) {
+	var n int64
+	var werr error
+	err := c.readLines(func(line string) error {
+		// read the message to its end even if w fails, so the session
+		// can continue
+		if werr == nil {
+			var m int
+			m, werr = io.WriteString(w, line)
+			n += int64(m)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, werr
+}
+
+// Dele marks message id as deleted, it is removed on Quit.
+func (c *Client) Dele(id int) error {
+	_, err := c.cmd("DELE %d", id)
+	return err
+}
+
+// SetDeadline sets the read and write deadline of the connection, see
+// net.Conn.
+func (c *Client) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Rset unmarks the messages marked as deleted.
+func (c *Client) Rset() error {
+	_, err := c.cmd("RSET")
+	return err
+}
+
+// Noop keeps the session alive.
+func (c *Client) Noop() error {
+	_, err := c.cmd("NOOP")
+	return err
+}
+
+// Quit ends the session, removing the messages marked as deleted, and
+// closes the connection.
+func (c *Client) Quit() error {
+	_, err := c.cmd("QUIT")
+	c.conn.Close()
+	return err
+}
+
+// Close closes the connection without QUIT, messages marked as deleted
+// are kept.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// testUser is a backends.User of the given name.
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+// passwordAuthorizator accepts any user with password "secret".
+type passwordAuthorizator struct{}
+
+func (passwordAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	if password != "secret" {
+		return nil, fmt.Errorf("Invalid password")
+	}
+	return testUser(username), nil
+}
+
+// serve runs a popgun server for backend and returns its address.
+func serve(t *testing.T, backend popgun.Backend) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := popgun.NewServer(passwordAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(l)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+	return l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\n.hidden\r\n")
+	backend.Deliver("alice", "b", "Subject: b\r\n\r\nbody\r\n")
+	c, err := Dial(context.Background(), serve(t, backend), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Greeting != "POPgun POP3 server ready" {
+		t.Errorf("Expected greeting, but got %q", c.Greeting)
+	}
+	if err := c.Login("alice", "wrong"); err == nil {
+		t.Errorf("Expected login failed")
+	} else if _, ok := err.(*Error); !ok {
+		t.Errorf("Expected negative response, but got %v", err)
+	}
+	if err := c.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if messages, octets, err := c.Stat(); err != nil || messages != 2 || octets != 43 {
+		t.Errorf("Expected 2 messages of 43 octets, but got %d, %d, %v", messages, octets, err)
+	}
+	messages, err := c.Uidl()
+	if err != nil || len(messages) != 2 || messages[0] != (MessageInfo{ID: 1, UID: "a"}) || messages[1] != (MessageInfo{ID: 2, UID: "b"}) {
+		t.Errorf("Expected messages a and b, but got %v, %v", messages, err)
+	}
+	var message strings.Builder
+	if n, err := c.Retr(1, &message); err != nil || n != 23 || message.String() != "Subject: a\r\n\r\n.hidden\r\n" {
+		t.Errorf("Expected message a, but got %q, %d, %v", message.String(), n, err)
+	}
+	if err := c.Dele(2); err != nil {
+		t.Error(err)
+	}
+	if err := c.Noop(); err != nil {
+		t.Error(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	if uids := backend.Messages("alice"); len(uids) != 1 || uids[0] != "a" {
+		t.Errorf("Expected message b removed, but got %v", uids)
+	}
+}
+
+// failingStore fails storing messages of uids.
+type failingStore struct {
+	DirStore
+	fail map[string]bool
+}
+
+func (s failingStore) Put(username, uid string, message []byte) error {
+	if s.fail[uid] {
+		return fmt.Errorf("Disk full")
+	}
+	return s.DirStore.Put(username, uid, message)
+}
+
+func TestFetcher_Sync(t *testing.T) {
+	backend := memory.New()
+	for _, username := range []string{"alice", "bob"} {
+		for _, uid := range []string{"1", "2", "3"} {
+			backend.Deliver(username, uid, fmt.Sprintf("Subject: %s %s\r\n\r\nbody\r\n", username, uid))
+		}
+	}
+	addr := serve(t, backend)
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var progress []string
+	fetcher := &Fetcher{
+		Store:       failingStore{DirStore{dir}, map[string]bool{"3": true}},
+		Concurrency: 1,
+		Delete:      true,
+		Progress: func(p Progress) {
+			mu.Lock()
+			defer mu.Unlock()
+			progress = append(progress, fmt.Sprintf("%s %s %d/%d %d", p.Username, p.UID, p.Fetched, p.Total, p.Bytes))
+		},
+	}
+	accounts := []Account{
+		{Addr: addr, Username: "alice", Password: "secret"},
+		{Addr: addr, Username: "bob", Password: "wrong"},
+	}
+
+	// the interrupted synchronization keeps the messages on the server
+	results := fetcher.Sync(context.Background(), accounts...)
+	if results[0].Username != "alice" || results[0].Fetched != 2 || results[0].Err == nil {
+		t.Errorf("Expected 2 messages fetched before failing, but got %+v", results[0])
+	}
+	if _, ok := results[1].Err.(*Error); !ok || results[1].Fetched != 0 {
+		t.Errorf("Expected login failed, but got %+v", results[1])
+	}
+	if uids := backend.Messages("alice"); len(uids) != 3 {
+		t.Errorf("Expected no messages removed, but got %v", uids)
+	}
+
+	fetcher.Store = DirStore{dir}
+	accounts[1].Password = "secret"
+	results = fetcher.Sync(context.Background(), accounts...)
+	for i, expected := range []Result{{Username: "alice", Fetched: 1, Deleted: 3}, {Username: "bob", Fetched: 3, Deleted: 3}} {
+		if results[i] != expected {
+			t.Errorf("Expected %+v, but got %+v", expected, results[i])
+		}
+		if uids := backend.Messages(expected.Username); len(uids) != 0 {
+			t.Errorf("Expected messages of %s removed, but got %v", expected.Username, uids)
+		}
+		for _, uid := range []string{"1", "2", "3"} {
+			message, err := ioutil.ReadFile(DirStore{dir}.path(expected.Username, uid))
+			if err != nil || string(message) != fmt.Sprintf("Subject: %s %s\r\n\r\nbody\r\n", expected.Username, uid) {
+				t.Errorf("Expected message %s of %s stored, but got %q, %v", uid, expected.Username, message, err)
+			}
+		}
+	}
+	sort.Strings(progress)
+	if expected := "alice 1 1/3 26|alice 2 2/3 26|alice 3 1/1 26|bob 1 1/3 24|bob 2 2/3 24|bob 3 3/3 24"; strings.Join(progress, "|") != expected {
+		t.Errorf("Expected progress %s, but got %s", expected, strings.Join(progress, "|"))
+	}
+}
+
+func TestFetcher_SyncCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fetcher := &Fetcher{Store: DirStore{t.TempDir()}}
+	results := fetcher.Sync(ctx, Account{Addr: serve(t, memory.New()), Username: "alice", Password: "secret"})
+	if results[0].Err != context.Canceled {
+		t.Errorf("Expected cancelled, but got %v", results[0].Err)
+	}
+}
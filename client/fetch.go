@@ -0,0 +1,259 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Store keeps the messages downloaded by a Fetcher by account and UID.
+type Store interface {
+	// Has reports whether the message uid of username was stored.
+	Has(username, uid string) (bool, error)
+	// Put stores the message uid of username.
+	Put(username, uid string, message []byte) error
+}
+
+// DirStore stores every message in a file named after its UID in a
+// directory per user under Root. Files are written atomically, so
+// interrupted downloads never leave partial messages.
+type DirStore struct {
+	Root string
+}
+
+func (s DirStore) path(username, uid string) string {
+	return filepath.Join(s.Root, url.PathEscape(username), url.PathEscape(uid))
+}
+
+func (s DirStore) Has(username, uid string) (bool, error) {
+	_, err := os.Stat(s.path(username, uid))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s DirStore) Put(username, uid string, message []byte) error {
+	path := s.path(username, uid)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(message)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Account is a maildrop synchronized by a Fetcher.
+type Account struct {
+	// address of the POP3 server, e.g. "pop.example.com:995"
+	Addr     string
+	Username string
+	Password string
+	// TLS, if set, connects over TLS
+	TLS *tls.Config
+	// StartTLS connects in cleartext and upgrades the session with STLS
+	// using TLS, servers not offering it are refused.
+	StartTLS bool
+}
+
+// Progress is reported by a Fetcher after storing a message.
+type Progress struct {
+	Username string
+	UID      string
+	// messages stored so far and new messages of the account
+	Fetched int
+	Total   int
+	// size of the message
+	Bytes int64
+}
+
+// Result is the outcome of synchronizing an account.
+type Result struct {
+	Username string
+	// messages stored and deleted from the server
+	Fetched int
+	Deleted int
+	Err     error
+}
+
+// Fetcher downloads the messages of accounts not in its Store yet, by
+// comparing the UIDL listing with the Store. Every message is stored as
+// soon as it is downloaded, so an interrupted synchronization resumes with
+// the messages still missing.
+type Fetcher struct {
+	Store Store
+	// Concurrency limits the accounts synchronized at once, 4 by default.
+	// Each account uses a single connection, since POP3 servers lock the
+	// maildrop for a session.
+	Concurrency int
+	// Delete removes the messages in the Store from the server, including
+	// those stored by an earlier, interrupted synchronization.
+	Delete bool
+	// Dialer, if set, connects instead of a net.Dialer
+	Dialer backends.Dialer
+	// Progress, if set, is called after storing every message. It is
+	// called concurrently for different accounts.
+	Progress func(p Progress)
+}
+
+// Sync synchronizes accounts and returns their results in the same order.
+// Cancelling ctx aborts the sessions, messages marked as deleted are then
+// kept on the server.
+func (f *Fetcher) Sync(ctx context.Context, accounts ...Account) []Result {
+	concurrency := f.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	results := make([]Result, len(accounts))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, account := range accounts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, account Account) {
+			defer wg.Done()
+			results[i] = f.SyncAccount(ctx, account)
+			<-slots
+		}(i, account)
+	}
+	wg.Wait()
+	return results
+}
+
+// SyncAccount synchronizes a single account.
+func (f *Fetcher) SyncAccount(ctx context.Context, account Account) Result {
+	result := Result{Username: account.Username}
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+	config := account.TLS
+	if account.StartTLS {
+		config = nil
+	}
+	c, err := DialWith(ctx, f.Dialer, account.Addr, config)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer c.Close()
+	// abort blocked reads and writes when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+
+	result.Err = f.sync(c, account, &result)
+	if result.Err == nil {
+		result.Err = c.Quit()
+	}
+	if result.Err != nil && ctx.Err() != nil {
+		result.Err = ctx.Err()
+		result.Deleted = 0
+	}
+	return result
+}
+
+func (f *Fetcher) sync(c *Client, account Account, result *Result) error {
+	if account.StartTLS {
+		c.TLSConfig, c.RequireTLS = account.TLS, true
+	}
+	if err := c.Authenticate(account.Username, account.Password); err != nil {
+		return err
+	}
+	messages, err := listUids(c)
+	if err != nil {
+		return err
+	}
+	var missing, stored []MessageInfo
+	for _, msg := range messages {
+		has, err := f.Store.Has(account.Username, msg.UID)
+		if err != nil {
+			return err
+		}
+		if has {
+			stored = append(stored, msg)
+		} else {
+			missing = append(missing, msg)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range missing {
+		buf.Reset()
+		n, err := c.Retr(msg.ID, &buf)
+		if err != nil {
+			return fmt.Errorf("Error retrieving message %s: %v", msg.UID, err)
+		}
+		if err := f.Store.Put(account.Username, msg.UID, buf.Bytes()); err != nil {
+			return fmt.Errorf("Error storing message %s: %v", msg.UID, err)
+		}
+		stored = append(stored, msg)
+		result.Fetched++
+		if f.Progress != nil {
+			f.Progress(Progress{Username: account.Username, UID: msg.UID, Fetched: result.Fetched, Total: len(missing), Bytes: n})
+		}
+	}
+
+	if !f.Delete {
+		return nil
+	}
+	for _, msg := range stored {
+		if err := c.Dele(msg.ID); err != nil {
+			return fmt.Errorf("Error deleting message %s: %v", msg.UID, err)
+		}
+		result.Deleted++
+	}
+	return nil
+}
+
+// listUids lists the messages with UIDL. Servers predating it are only
+// required to support the commands of RFC 1081, the messages are then
+// identified by a digest of their headers retrieved with TOP, if it is
+// supported.
+func listUids(c *Client) ([]MessageInfo, error) {
+	messages, err := c.Uidl()
+	if _, ok := err.(*Error); !ok || !c.supports("TOP") {
+		return messages, err
+	}
+	messages, err = c.List()
+	if err != nil {
+		return nil, err
+	}
+	for i, msg := range messages {
+		h := sha256.New()
+		if _, err := c.Top(msg.ID, 0, h); err != nil {
+			return nil, fmt.Errorf("Error identifying message %d without UIDL: %v", msg.ID, err)
+		}
+		messages[i].UID = hex.EncodeToString(h.Sum(nil)[:16])
+	}
+	return messages, nil
+}
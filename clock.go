@@ -0,0 +1,76 @@
+package popgun
+
+import (
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Clock tells the time and runs timers for login delays, throttling, ban
+// expiry and other timeouts. Tests replace the system clock with one they
+// advance by hand, so timing can be exercised without real sleeps.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a Clock, see time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the Clock used by default.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// clockOrSystem returns clock, or SystemClock if it is nil.
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+// Dialer opens network connections, net.Dialer implements it. Tests
+// replace it to connect to in-memory fakes, deployments to go through a
+// proxy, see backends.ParseProxy.
+type Dialer = backends.Dialer
+
+// clock returns the clock of the server.
+func (s *Server) clock() Clock {
+	if s == nil {
+		return SystemClock
+	}
+	return clockOrSystem(s.Clock)
+}
+
+// wait waits d on the server's clock. It returns false if the session
+// ended meanwhile.
+func (c *Client) wait(d time.Duration) bool {
+	timer := c.server.clock().NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-c.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,213 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// fakeClock is a Clock only advancing when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(map[*fakeTimer]bool),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.timers[t] = true
+	}
+	return t
+}
+
+// Advance moves the clock forward, firing the timers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.when.After(c.now) {
+			delete(c.timers, t)
+			t.c <- c.now
+		}
+	}
+}
+
+// waitTimers waits until n timers are pending, i.e. the code under test
+// is waiting on the clock.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	for i := 0; i < 1000; i++ {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d timers", n)
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+// pipeListener is an in-memory net.Listener handing out net.Pipe ends.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to the listener.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("Listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestClient_handleSessionTimeout(t *testing.T) {
+	clock := newFakeClock()
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.Clock = clock
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitTimers(t, 1)
+	clock.Advance(sessionTimeout - time.Second)
+	fmt.Fprintf(conn, "XYZZY\r\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "-ERR Invalid command XYZZY\r\n" {
+		t.Fatalf("Expected response, but got %q, %v", line, err)
+	}
+	clock.Advance(time.Second)
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected session closed, but got %v", err)
+	}
+}
+
+func TestPassCommand_RunFailureDelayClock(t *testing.T) {
+	clock := newFakeClock()
+	go func() {
+		clock.waitTimers(t, 1)
+		clock.Advance(time.Hour)
+	}()
+	commandTest(t, cmdTestCase{
+		cmd:            PassCommand{},
+		initialState:   STATE_AUTHORIZATION,
+		args:           []string{"secret"},
+		expectedState:  STATE_AUTHORIZATION,
+		expectedOutput: "^\\-ERR Invalid username or password",
+		setup: func(c *Client) {
+			c.lastCommand = "USER"
+			c.authorizator = failingAuthorizator{}
+			c.server.Clock = clock
+			c.server.AuthFailureDelay = time.Hour
+		},
+	})
+	if now := clock.Now(); now.Sub(newFakeClock().Now()) != time.Hour {
+		t.Errorf("Expected response after an hour, but got it at %v", now)
+	}
+}
+
+func TestDecayingScorer_Clock(t *testing.T) {
+	clock := newFakeClock()
+	scorer := NewDecayingScorer(time.Hour)
+	scorer.Clock = clock
+	scorer.Record("10.0.0.1", "", SIGNAL_AUTH_FAILURE)
+	scorer.Record("10.0.0.1", "", SIGNAL_AUTH_FAILURE)
+
+	for _, tc := range []struct {
+		advance time.Duration
+		score   float64
+	}{
+		{0, 2},
+		{time.Hour, 1},
+		{2 * time.Hour, 0.25},
+	} {
+		clock.Advance(tc.advance)
+		if score := scorer.Score("10.0.0.1", ""); score != tc.score {
+			t.Errorf("Expected score %v, but got %v", tc.score, score)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+)
+
+// checkResult is the outcome of a single check of --check mode.
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// check validates the configuration, TLS material, users file, backend and
+// listener addresses without accepting any client. The config itself is
+// reported as the first result, other checks are skipped if it is invalid.
+func check(path string) []checkResult {
+	var results []checkResult
+	add := func(name string, err error) bool {
+		result := checkResult{Name: name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		return err == nil
+	}
+
+	cfg, err := loadConfig(path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if !add("config", err) {
+		return results
+	}
+	if cfg.ListenTLS != "" {
+		_, err := cfg.loadTLS()
+		add("tls", err)
+	}
+	_, err = loadUsers(cfg.UsersFile)
+	add("users", err)
+	add("backend", cfg.checkBackend())
+	for _, addr := range []string{cfg.Listen, cfg.ListenTLS, cfg.Admin} {
+		if addr != "" {
+			add("listen "+addr, checkListen(addr))
+		}
+	}
+	return results
+}
+
+// checkListen binds addr and releases it right away.
+func checkListen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// printCheck writes the results as text or, with format "json", as a JSON
+// object for deployment pipelines. It returns whether all checks passed.
+func printCheck(w io.Writer, results []checkResult, format string) bool {
+	ok := true
+	for _, result := range results {
+		ok = ok && result.OK
+	}
+	if format == "json" {
+		json.NewEncoder(w).Encode(struct {
+			OK     bool          `json:"ok"`
+			Checks []checkResult `json:"checks"`
+		}{ok, results})
+		return ok
+	}
+	for _, result := range results {
+		if result.OK {
+			fmt.Fprintf(w, "ok   %s\n", result.Name)
+		} else {
+			fmt.Fprintf(w, "FAIL %s: %s\n", result.Name, result.Error)
+		}
+	}
+	return ok
+}
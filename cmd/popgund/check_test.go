@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "popgund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users")
+	ioutil.WriteFile(users, []byte("alice:secret\n"), 0600)
+	config := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(config, []byte(`{
+		"listen": "127.0.0.1:0",
+		"backend": "maildir",
+		"root": "`+dir+`",
+		"users_file": "`+users+`"
+	}`), 0600)
+
+	results := check(config)
+	if !printCheck(ioutil.Discard, results, "text") {
+		t.Errorf("Expected all checks to pass, but got '%v'", results)
+	}
+
+	ioutil.WriteFile(config, []byte(`{"listen": "127.0.0.1:0", "backend": "sql"}`), 0600)
+	results = check(config)
+	if len(results) != 1 || results[0].OK {
+		t.Errorf("Expected failed config check, but got '%v'", results)
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/maildir"
+	"github.com/kiwiz/popgun/backends/mbox"
+	"github.com/kiwiz/popgun/plugin"
+)
+
+// Config is the JSON configuration file of the daemon.
+type Config struct {
+	// address of the plain POP3 listener, e.g. ":110"
+	Listen string `json:"listen"`
+	// address of the POP3S listener, e.g. ":995", requires CertFile and
+	// KeyFile, or CertSecret and KeySecret loaded from Secrets
+	ListenTLS  string `json:"listen_tls"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	CertSecret string `json:"cert_secret"`
+	KeySecret  string `json:"key_secret"`
+	// store cert_secret, key_secret and the {SECRET} passwords of the
+	// users file are loaded from
+	Secrets *SecretsConfig `json:"secrets"`
+	// enable TCP Fast Open on the POP3 listeners where supported, see
+	// popgun.ListenOptions
+	FastOpen bool `json:"fast_open"`
+	// warn when the certificate expires within this many days, 30 by
+	// default
+	CertExpiryDays int `json:"cert_expiry_days"`
+	// "modern", "intermediate" (default) or "legacy", see
+	// popgun.ApplyTLSPolicy
+	TLSPolicy string `json:"tls_policy"`
+	// address of the admin HTTP endpoints, keep it on a trusted interface
+	Admin string `json:"admin"`
+	// file the JSON access log is appended to, reopened on reload so it
+	// can be rotated, see popgun.AccessLog
+	AccessLog string `json:"access_log"`
+	// log every command to the access log, not only sessions
+	AccessLogCommands bool `json:"access_log_commands"`
+
+	Hostname          string `json:"hostname"`
+	AllowInsecureAuth bool   `json:"allow_insecure_auth"`
+	// token identifying this instance in the greeting, so a fronting
+	// proxy can route reconnects of a user to it, see
+	// popgun.Server.AffinityToken
+	AffinityToken string `json:"affinity_token"`
+	// expect a PROXY protocol version 2 header on every connection of the
+	// POP3 listeners, which must then only be reachable by the balancer
+	ProxyProtocol bool `json:"proxy_protocol"`
+	// users of the users file who may open the maildrop of any user
+	// read-only by logging in as "user*master" with their own password
+	MasterUsers []string `json:"master_users"`
+	// let users change their password over TLS with XPASSWD, which
+	// rewrites the users file, so its directory must be writable
+	AllowPasswordChange bool `json:"allow_password_change"`
+	// what to do when deleted messages can't be removed on QUIT: "log"
+	// (default), "retry", "alert" or "review", see
+	// popgun.UpdateFailurePolicy
+	UpdateFailurePolicy string `json:"update_failure_policy"`
+	// limit of simultaneous sessions, beyond it connections are refused
+	// with -ERR [SYS/TEMP], or not accepted until a session ends if
+	// pause_accept_when_full is set; 0 means no limit
+	MaxConnections      int  `json:"max_connections"`
+	PauseAcceptWhenFull bool `json:"pause_accept_when_full"`
+	// limit of simultaneous sessions from a single IP address, 0 means no
+	// limit
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// greeting of new connections in maintenance mode
+	MaintenanceMessage string `json:"maintenance_message"`
+
+	// "maildir" or "mbox"
+	Backend string `json:"backend"`
+	// directory holding the maildrops of all users
+	Root string `json:"root"`
+	// path template of a user's maildrop relative to root, "%u" by default,
+	// see backends.ExpandPath
+	PathTemplate string `json:"path_template"`
+	// UIDL strategy to keep the UIDs of the server the maildrops are
+	// migrated from: "dovecot:<pop3_uidl_format>", e.g. "dovecot:%08Xu%08Xv",
+	// "courier" or "qpopper"
+	Uidl string `json:"uidl"`
+	// UIDL strategies by domain of the username, overriding uidl
+	UidlDomains map[string]string `json:"uidl_domains"`
+	// file with one "username:password" line per user, the password either
+	// plain, as {SHA256}<hex digest> or as {SECRET}<name> of a secret
+	// holding it
+	UsersFile string `json:"users_file"`
+
+	// feature flags of hosting plans, by domain and username
+	Features *FeaturesConfig `json:"features"`
+	// resource limits of tenants, i.e. domains, see popgun.Tenants
+	Tenants *TenantsConfig `json:"tenants"`
+	// sessions and connected seconds allowed per user per day, see
+	// popgun.SessionBudget
+	SessionBudget *SessionBudgetConfig `json:"session_budget"`
+	// canonicalization of usernames before authentication, see
+	// popgun.UsernameCanonicalizer
+	Usernames *UsernamesConfig `json:"usernames"`
+	// NATS server to stream session events to, see popgun.EventExporter
+	Events *EventsConfig `json:"events"`
+	// external process authorizing users instead of the users file and
+	// filtering the listing of maildrops, see the plugin package
+	Plugin *PluginConfig `json:"plugin"`
+	// days messages removed by clients are kept in the Trash folder of the
+	// maildir before they are purged, by default they are deleted right
+	// away; maildir only
+	Trash *TrashConfig `json:"trash"`
+	// cron schedules of maintenance jobs by name, see parseSchedule. The
+	// job trash_purge runs at 03:00 by default if trash is configured
+	Jobs map[string]string `json:"jobs"`
+
+	// directory to chroot to after binding the listeners, usually the
+	// spool directory
+	Chroot string `json:"chroot"`
+	// unprivileged user and optionally group to switch to after binding the
+	// listeners
+	User  string `json:"user"`
+	Group string `json:"group"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	cfg := &Config{}
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration without touching the filesystem or
+// network.
+func (cfg *Config) Validate() error {
+	if cfg.Listen == "" && cfg.ListenTLS == "" {
+		return fmt.Errorf("Neither listen nor listen_tls set")
+	}
+	if cfg.ListenTLS != "" && (cfg.CertFile == "" || cfg.KeyFile == "") && (cfg.CertSecret == "" || cfg.KeySecret == "") {
+		return fmt.Errorf("listen_tls requires cert_file and key_file, or cert_secret and key_secret")
+	}
+	if (cfg.CertSecret != "" || cfg.KeySecret != "") && cfg.Secrets == nil {
+		return fmt.Errorf("cert_secret and key_secret require secrets")
+	}
+	if err := cfg.Secrets.validate(); err != nil {
+		return err
+	}
+	for _, addr := range []string{cfg.Listen, cfg.ListenTLS, cfg.Admin} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Invalid address %s: %v", addr, err)
+		}
+	}
+	if err := popgun.ApplyTLSPolicy(&tls.Config{}, cfg.tlsPolicy()); err != nil {
+		return err
+	}
+	if _, err := cfg.updateFailurePolicy(); err != nil {
+		return err
+	}
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("max_connections and max_connections_per_ip must not be negative")
+	}
+	switch cfg.Backend {
+	case "maildir", "mbox":
+	default:
+		return fmt.Errorf("Unknown backend: %q", cfg.Backend)
+	}
+	if cfg.Root == "" {
+		return fmt.Errorf("root not set")
+	}
+	if cfg.UsersFile == "" {
+		return fmt.Errorf("users_file not set")
+	}
+	if _, err := cfg.uidlStrategy(); err != nil {
+		return err
+	}
+	if err := cfg.Trash.validate(cfg.Backend); err != nil {
+		return err
+	}
+	for name, spec := range cfg.Jobs {
+		switch name {
+		case "trash_purge":
+			if cfg.Trash == nil {
+				return fmt.Errorf("Job trash_purge requires trash")
+			}
+		default:
+			return fmt.Errorf("Unknown job: %q", name)
+		}
+		if _, err := parseSchedule(spec); err != nil {
+			return fmt.Errorf("Job %s: %v", name, err)
+		}
+	}
+	if cfg.Events != nil {
+		if _, _, err := net.SplitHostPort(cfg.Events.NATS); err != nil {
+			return fmt.Errorf("Invalid NATS address %s: %v", cfg.Events.NATS, err)
+		}
+	}
+	for _, r := range cfg.AffinityToken {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return fmt.Errorf("affinity_token must consist of letters and digits")
+		}
+	}
+	if cfg.Plugin != nil && len(cfg.Plugin.Command) == 0 {
+		return fmt.Errorf("plugin requires command")
+	}
+	if cfg.Chroot != "" && !filepath.IsAbs(cfg.Chroot) {
+		return fmt.Errorf("chroot must be an absolute path")
+	}
+	if cfg.Group != "" && cfg.User == "" {
+		return fmt.Errorf("group requires user")
+	}
+	return nil
+}
+
+// inChroot translates path to the file system seen after the chroot.
+func (cfg *Config) inChroot(path string) string {
+	if cfg.Chroot == "" {
+		return path
+	}
+	rel, err := filepath.Rel(cfg.Chroot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.Join(string(filepath.Separator), rel)
+}
+
+func (cfg *Config) loadTLS() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if cfg.CertSecret != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+		defer cancel()
+		cert, err = popgun.LoadKeyPair(ctx, cfg.Secrets.provider(cfg, false), cfg.CertSecret, cfg.KeySecret)
+	} else {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := popgun.ApplyTLSPolicy(config, cfg.tlsPolicy()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (cfg *Config) tlsPolicy() string {
+	if cfg.TLSPolicy == "" {
+		return popgun.TLS_POLICY_INTERMEDIATE
+	}
+	return cfg.TLSPolicy
+}
+
+func (cfg *Config) updateFailurePolicy() (popgun.UpdateFailurePolicy, error) {
+	if cfg.UpdateFailurePolicy == "" {
+		return popgun.UPDATE_FAILURE_LOG, nil
+	}
+	return popgun.ParseUpdateFailurePolicy(cfg.UpdateFailurePolicy)
+}
+
+func (cfg *Config) newBackend() popgun.Backend {
+	root := cfg.inChroot(cfg.Root)
+	// validated by Validate
+	strategy, _ := cfg.uidlStrategy()
+	if cfg.Backend == "mbox" {
+		backend := mbox.New(root)
+		backend.Template = cfg.PathTemplate
+		backend.UidlStrategy = strategy
+		return backend
+	}
+	backend := maildir.New(root)
+	backend.Template = cfg.PathTemplate
+	backend.UidlStrategy = strategy
+	if cfg.Trash != nil {
+		backend.Trash = cfg.Trash.retention
+	}
+	return backend
+}
+
+// jobSchedule returns the schedule of the job name.
+func (cfg *Config) jobSchedule(name, fallback string) string {
+	if spec, ok := cfg.Jobs[name]; ok {
+		return spec
+	}
+	return fallback
+}
+
+// TrashConfig configures the trash retention in days, by domain and
+// username.
+type TrashConfig struct {
+	Days    int            `json:"days"`
+	Domains map[string]int `json:"domains"`
+	Users   map[string]int `json:"users"`
+}
+
+func (t *TrashConfig) validate(backend string) error {
+	if t == nil {
+		return nil
+	}
+	if backend != "maildir" {
+		return fmt.Errorf("trash requires the maildir backend")
+	}
+	days := []int{t.Days}
+	for _, d := range t.Domains {
+		days = append(days, d)
+	}
+	for _, d := range t.Users {
+		days = append(days, d)
+	}
+	for _, d := range days {
+		if d < 0 {
+			return fmt.Errorf("Invalid trash days: %d", d)
+		}
+	}
+	return nil
+}
+
+// retention returns the trash retention of user, the most specific setting
+// wins.
+func (t *TrashConfig) retention(user backends.User) time.Duration {
+	username := user.Username()
+	days, ok := t.Users[username]
+	if !ok {
+		days = t.Days
+		if i := strings.LastIndexByte(username, '@'); i >= 0 {
+			for domain, d := range t.Domains {
+				if strings.EqualFold(domain, username[i+1:]) {
+					days = d
+				}
+			}
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// FeaturesConfig configures popgun.ConfigFeatures. Without a default, the
+// features of users not configured are popgun.DefaultFeatures.
+type FeaturesConfig struct {
+	Default *popgun.Features           `json:"default"`
+	Domains map[string]popgun.Features `json:"domains"`
+	Users   map[string]popgun.Features `json:"users"`
+}
+
+// TenantsConfig configures popgun.Tenants.
+type TenantsConfig struct {
+	Default popgun.TenantLimits            `json:"default"`
+	Domains map[string]popgun.TenantLimits `json:"domains"`
+}
+
+func (cfg *Config) tenants() *popgun.Tenants {
+	if cfg.Tenants == nil {
+		return nil
+	}
+	tenants := &popgun.Tenants{
+		Default: cfg.Tenants.Default,
+		Domains: make(map[string]popgun.TenantLimits),
+	}
+	for domain, limits := range cfg.Tenants.Domains {
+		tenants.Domains[strings.ToLower(domain)] = limits
+	}
+	return tenants
+}
+
+// SessionBudgetConfig configures popgun.SessionBudget.
+type SessionBudgetConfig struct {
+	MaxSessions int `json:"max_sessions"`
+	MaxSeconds  int `json:"max_seconds"`
+}
+
+// sessionBudget returns the session budget, counted in memory.
+func (cfg *Config) sessionBudget() *popgun.SessionBudget {
+	if cfg.SessionBudget == nil {
+		return nil
+	}
+	return &popgun.SessionBudget{
+		MaxSessions: cfg.SessionBudget.MaxSessions,
+		MaxSeconds:  cfg.SessionBudget.MaxSeconds,
+		Counter:     popgun.NewDecayingScorer(time.Hour),
+	}
+}
+
+// UsernamesConfig configures popgun.UsernameCanonicalizer.
+type UsernamesConfig struct {
+	Lowercase     bool              `json:"lowercase"`
+	DefaultDomain string            `json:"default_domain"`
+	Realms        map[string]string `json:"realms"`
+	// aliases by username, resolved to the canonical username
+	Aliases map[string]string `json:"aliases"`
+}
+
+func (cfg *Config) canonicalizer() popgun.Canonicalizer {
+	if cfg.Usernames == nil {
+		return nil
+	}
+	canonicalizer := popgun.UsernameCanonicalizer{
+		Lowercase:     cfg.Usernames.Lowercase,
+		DefaultDomain: cfg.Usernames.DefaultDomain,
+		Realms:        cfg.Usernames.Realms,
+	}
+	if len(cfg.Usernames.Aliases) > 0 {
+		canonicalizer.Aliases = popgun.Aliases(cfg.Usernames.Aliases)
+	}
+	return canonicalizer
+}
+
+// time loading a secret may take
+const secretsTimeout = 10 * time.Second
+
+// SecretsConfig configures the store secrets are loaded from, see
+// popgun.SecretsProvider.
+type SecretsConfig struct {
+	// "file" reads every secret from a file named after it in dir, "env"
+	// from the environment variable prefix+name, see popgun.EnvSecrets, and
+	// "vault" from a Vault KV version 2 engine authenticating with the
+	// token in the environment variable VAULT_TOKEN
+	Provider string `json:"provider"`
+	Dir      string `json:"dir"`
+	Prefix   string `json:"prefix"`
+	// address of the Vault server, and mount, path and field of the
+	// secrets, see popgun.VaultSecrets
+	VaultAddress string `json:"vault_address"`
+	VaultMount   string `json:"vault_mount"`
+	VaultPath    string `json:"vault_path"`
+	VaultField   string `json:"vault_field"`
+}
+
+func (s *SecretsConfig) validate() error {
+	if s == nil {
+		return nil
+	}
+	switch s.Provider {
+	case "file":
+		if s.Dir == "" {
+			return fmt.Errorf("Secrets provider file requires dir")
+		}
+	case "env":
+	case "vault":
+		if s.VaultAddress == "" {
+			return fmt.Errorf("Secrets provider vault requires vault_address")
+		}
+	default:
+		return fmt.Errorf("Unknown secrets provider: %q", s.Provider)
+	}
+	return nil
+}
+
+// provider returns the configured secrets provider, nil if there is none.
+// The directory of the file provider is looked up inside the chroot if
+// chrooted is set.
+func (s *SecretsConfig) provider(cfg *Config, chrooted bool) popgun.SecretsProvider {
+	if s == nil {
+		return nil
+	}
+	switch s.Provider {
+	case "file":
+		dir := s.Dir
+		if chrooted {
+			dir = cfg.inChroot(dir)
+		}
+		return popgun.FileSecrets{Dir: dir}
+	case "vault":
+		return popgun.VaultSecrets{
+			Address: s.VaultAddress,
+			Token:   os.Getenv("VAULT_TOKEN"),
+			Mount:   s.VaultMount,
+			Path:    s.VaultPath,
+			Field:   s.VaultField,
+		}
+	}
+	return popgun.EnvSecrets{Prefix: s.Prefix}
+}
+
+// EventsConfig configures a popgun.EventExporter publishing to NATS.
+type EventsConfig struct {
+	NATS     string `json:"nats"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// subject, "popgun.events" by default
+	Subject string `json:"subject"`
+}
+
+func (cfg *Config) events() *popgun.EventExporter {
+	if cfg.Events == nil {
+		return nil
+	}
+	exporter := popgun.NewEventExporter(&popgun.NATSProducer{
+		Addr:     cfg.Events.NATS,
+		User:     cfg.Events.User,
+		Password: cfg.Events.Password,
+	})
+	exporter.Subject = cfg.Events.Subject
+	return exporter
+}
+
+// PluginConfig configures a plugin process. It is started after dropping
+// privileges, so its command is looked up inside the chroot.
+type PluginConfig struct {
+	// path and arguments of the plugin
+	Command []string `json:"command"`
+}
+
+func (cfg *Config) startPlugin() (*plugin.Plugin, error) {
+	cmd := exec.Command(cfg.Plugin.Command[0], cfg.Plugin.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	return plugin.Start(cmd)
+}
+
+func (cfg *Config) features() popgun.FeatureResolver {
+	if cfg.Features == nil {
+		return nil
+	}
+	resolver := popgun.ConfigFeatures{
+		Default: popgun.DefaultFeatures,
+		Domains: make(map[string]popgun.Features),
+		Users:   cfg.Features.Users,
+	}
+	if cfg.Features.Default != nil {
+		resolver.Default = *cfg.Features.Default
+	}
+	for domain, features := range cfg.Features.Domains {
+		resolver.Domains[strings.ToLower(domain)] = features
+	}
+	return resolver
+}
+
+// uidlStrategy returns the configured UIDL strategy, nil for the default
+// UIDs of the backend.
+func (cfg *Config) uidlStrategy() (backends.UidlStrategy, error) {
+	strategy, err := parseUidl(cfg.Uidl)
+	if err != nil || len(cfg.UidlDomains) == 0 {
+		return strategy, err
+	}
+	domains := backends.DomainUidl{Default: strategy, Domains: make(map[string]backends.UidlStrategy)}
+	for domain, spec := range cfg.UidlDomains {
+		domains.Domains[strings.ToLower(domain)], err = parseUidl(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid uidl of domain %s: %v", domain, err)
+		}
+	}
+	return domains, nil
+}
+
+func parseUidl(spec string) (backends.UidlStrategy, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "courier":
+		return backends.CourierUidl(), nil
+	case spec == "qpopper":
+		return backends.QpopperUidl(), nil
+	case strings.HasPrefix(spec, "dovecot:"):
+		return backends.DovecotUidl(spec[len("dovecot:"):])
+	}
+	return nil, fmt.Errorf("Unknown uidl strategy: %q", spec)
+}
+
+// openAccessLog opens the access log file for appending.
+func (cfg *Config) openAccessLog() (*os.File, error) {
+	return os.OpenFile(cfg.inChroot(cfg.AccessLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+}
+
+// checkBackend verifies the maildrop root is an accessible directory.
+func (cfg *Config) checkBackend() error {
+	f, err := os.Open(cfg.Root)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", cfg.Root)
+	}
+	_, err = f.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+type fileUser struct {
+	name string
+}
+
+func (u fileUser) Username() string {
+	return u.name
+}
+
+// fileAuthorizator checks credentials against the users file.
+type fileAuthorizator struct {
+	path    string
+	masters map[string]bool
+	// store the {SECRET} passwords are loaded from
+	secrets popgun.SecretsProvider
+
+	mu        sync.RWMutex
+	passwords map[string]string
+}
+
+func loadUsers(path string) (*fileAuthorizator, error) {
+	a := &fileAuthorizator{path: path}
+	return a, a.reload()
+}
+
+// reload reads the users file again, keeping the previous users on error.
+func (a *fileAuthorizator) reload() error {
+	passwords, err := readUsers(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.passwords = passwords
+	a.mu.Unlock()
+	return nil
+}
+
+func readUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, n)
+		}
+		passwords[line[:i]] = line[i+1:]
+	}
+	return passwords, scanner.Err()
+}
+
+// usernames returns the names of all users, sorted.
+func (a *fileAuthorizator) usernames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.passwords))
+	for name := range a.passwords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *fileAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	a.mu.RLock()
+	stored, ok := a.passwords[username]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown user")
+	}
+	if strings.HasPrefix(stored, "{SECRET}") {
+		secret, err := a.secret(stored[len("{SECRET}"):])
+		if err != nil {
+			return nil, err
+		}
+		stored = secret
+	}
+	if strings.HasPrefix(stored, "{SHA256}") {
+		sum := sha256.Sum256([]byte(password))
+		password = hex.EncodeToString(sum[:])
+		stored = strings.ToLower(stored[len("{SHA256}"):])
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+		return nil, fmt.Errorf("Wrong password")
+	}
+	return fileUser{name: username}, nil
+}
+
+// secret loads a password stored in the secrets store.
+func (a *fileAuthorizator) secret(name string) (string, error) {
+	if a.secrets == nil {
+		return "", fmt.Errorf("Password secret %s requires secrets", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+	secret, err := a.secrets.Secret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("Error loading password secret %s: %v", name, err)
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// AuthorizeMaster checks the password of master, which must be one of the
+// configured master users, and that username exists.
+func (a *fileAuthorizator) AuthorizeMaster(conn net.Conn, username, master, password string) (backends.User, error) {
+	if !a.masters[master] {
+		return nil, fmt.Errorf("Not a master user")
+	}
+	if _, err := a.Authorize(conn, master, password); err != nil {
+		return nil, err
+	}
+	a.mu.RLock()
+	_, ok := a.passwords[username]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown user")
+	}
+	return fileUser{name: username}, nil
+}
+
+// ChangePassword stores the SHA-256 hash of the new password of user in
+// the users file, which is replaced atomically.
+func (a *fileAuthorizator) ChangePassword(conn net.Conn, user backends.User, oldPassword, newPassword string) error {
+	if newPassword == "" || strings.ContainsAny(newPassword, "\r\n") {
+		return fmt.Errorf("Invalid password")
+	}
+	if _, err := a.Authorize(conn, user.Username(), oldPassword); err != nil {
+		return err
+	}
+	a.mu.RLock()
+	stored := a.passwords[user.Username()]
+	a.mu.RUnlock()
+	if strings.HasPrefix(stored, "{SECRET}") {
+		return fmt.Errorf("Password is managed in the secrets store")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	content, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(newPassword))
+	stored = "{SHA256}" + hex.EncodeToString(sum[:])
+	lines := strings.SplitAfter(string(content), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), user.Username()+":") {
+			lines[i] = user.Username() + ":" + stored + "\n"
+		}
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	a.passwords[user.Username()] = stored
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/testcert"
+)
+
+func TestFileAuthorizator_ChangePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "popgund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users")
+	ioutil.WriteFile(users, []byte("# users\nalice:secret\nbob:other\n"), 0600)
+	auth, err := loadUsers(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := auth.ChangePassword(nil, fileUser{name: "alice"}, "wrong", "changed"); err == nil {
+		t.Error("Expected wrong old password to be refused")
+	}
+	if err := auth.ChangePassword(nil, fileUser{name: "alice"}, "secret", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authorize(nil, "alice", "changed"); err != nil {
+		t.Errorf("Expected new password to be accepted, but got %v", err)
+	}
+	// the change survives reloading the users file
+	if err := auth.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authorize(nil, "alice", "secret"); err == nil {
+		t.Error("Expected old password to be refused after reload")
+	}
+	if _, err := auth.Authorize(nil, "alice", "changed"); err != nil {
+		t.Errorf("Expected new password to be accepted after reload, but got %v", err)
+	}
+	content, _ := ioutil.ReadFile(users)
+	if !strings.HasPrefix(string(content), "# users\nalice:{SHA256}") || !strings.HasSuffix(string(content), "\nbob:other\n") {
+		t.Errorf("Unexpected users file %q", content)
+	}
+}
+
+func TestConfig_secrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "popgund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secrets := filepath.Join(dir, "secrets")
+	os.Mkdir(secrets, 0700)
+	cert, err := testcert.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cert.WriteFiles(secrets); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(secrets, "alice-password"), []byte("secret\n"), 0600)
+	users := filepath.Join(dir, "users")
+	ioutil.WriteFile(users, []byte("alice:{SECRET}alice-password\n"), 0600)
+
+	cfg := &Config{
+		ListenTLS:  ":995",
+		CertSecret: "cert.pem",
+		KeySecret:  "key.pem",
+		Secrets:    &SecretsConfig{Provider: "file", Dir: secrets},
+		Backend:    "maildir",
+		Root:       dir,
+		UsersFile:  users,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.loadTLS(); err != nil {
+		t.Errorf("Expected key pair loaded from secrets, but got %v", err)
+	}
+
+	auth, err := loadUsers(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authorize(nil, "alice", "secret"); err == nil {
+		t.Error("Expected secret password to be refused without secrets")
+	}
+	auth.secrets = cfg.Secrets.provider(cfg, false)
+	if _, err := auth.Authorize(nil, "alice", "secret"); err != nil {
+		t.Errorf("Expected password loaded from secrets, but got %v", err)
+	}
+	if err := auth.ChangePassword(nil, fileUser{name: "alice"}, "secret", "changed"); err == nil {
+		t.Error("Expected change of secret password to be refused")
+	}
+
+	cfg.Secrets = nil
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected cert_secret without secrets to be rejected")
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+// control is a request of the operating system to the daemon, delivered by
+// signals on Unix and by the service control manager on Windows.
+type control int
+
+const (
+	CONTROL_SHUTDOWN control = iota + 1
+	CONTROL_RELOAD
+	CONTROL_MAINTENANCE_ON
+	CONTROL_MAINTENANCE_OFF
+)
@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyControl delivers SIGINT and SIGTERM as CONTROL_SHUTDOWN, SIGHUP as
+// CONTROL_RELOAD and SIGUSR1 and SIGUSR2 as CONTROL_MAINTENANCE_ON and OFF. The returned function is called once the daemon stopped.
+func notifyControl(controls chan<- control, service bool) (func(), error) {
+	if service {
+		return nil, fmt.Errorf("Running as a service is only supported on Windows")
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGHUP:
+				controls <- CONTROL_RELOAD
+			case syscall.SIGUSR1:
+				controls <- CONTROL_MAINTENANCE_ON
+			case syscall.SIGUSR2:
+				controls <- CONTROL_MAINTENANCE_OFF
+			default:
+				controls <- CONTROL_SHUTDOWN
+			}
+		}
+	}()
+	return func() { signal.Stop(signals) }, nil
+}
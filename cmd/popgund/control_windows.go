@@ -0,0 +1,161 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+// constants of the Windows service API, see winsvc.h
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// windowsService connects the daemon to the service control manager. Stop
+// and shutdown requests are delivered as CONTROL_SHUTDOWN, parameter change
+// requests (sc control popgund paramchange) as CONTROL_RELOAD.
+type windowsService struct {
+	controls chan<- control
+	handle   uintptr
+	status   serviceStatus
+	started  chan struct{}
+	stopped  chan struct{}
+	exited   chan struct{}
+}
+
+var service *windowsService
+
+// notifyControl delivers Ctrl+C as CONTROL_SHUTDOWN. If service is set, the
+// daemon runs as a Windows service instead. The returned function is called
+// once the daemon stopped.
+func notifyControl(controls chan<- control, asService bool) (func(), error) {
+	if !asService {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		go func() {
+			for range signals {
+				controls <- CONTROL_SHUTDOWN
+			}
+		}()
+		return func() { signal.Stop(signals) }, nil
+	}
+
+	service = &windowsService{
+		controls: controls,
+		started:  make(chan struct{}),
+		stopped:  make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	name, err := syscall.UTF16PtrFromString("popgund")
+	if err != nil {
+		return nil, err
+	}
+	errs := make(chan error, 1)
+	go func() {
+		// the dispatcher blocks the calling thread until the service stops
+		runtime.LockOSThread()
+		defer close(service.exited)
+		table := []serviceTableEntry{{name, syscall.NewCallback(serviceMain)}, {}}
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			errs <- err
+		}
+	}()
+	select {
+	case err := <-errs:
+		return nil, err
+	case <-service.started:
+	}
+	return func() {
+		close(service.stopped)
+		select {
+		case <-service.exited:
+		case <-time.After(5 * time.Second):
+		}
+	}, nil
+}
+
+// serviceMain is called by the dispatcher on its own thread. It reports the
+// service running and returns once the daemon stopped.
+func serviceMain(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString("popgund")
+	service.handle, _, _ = procRegisterServiceCtrlHandlerEx.Call(
+		uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceHandler), 0)
+	if service.handle == 0 {
+		return 0
+	}
+	service.setStatus(serviceRunning)
+	close(service.started)
+	<-service.stopped
+	service.setStatus(serviceStopped)
+	return 0
+}
+
+func serviceHandler(ctrl, eventType, eventData, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		service.setStatus(serviceStopPending)
+		service.controls <- CONTROL_SHUTDOWN
+	case serviceControlParamChange:
+		service.controls <- CONTROL_RELOAD
+	case serviceControlInterrogate:
+		procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&service.status)))
+	}
+	return 0
+}
+
+func (s *windowsService) setStatus(state uint32) {
+	s.status = serviceStatus{
+		ServiceType:  serviceWin32OwnProcess,
+		CurrentState: state,
+	}
+	switch state {
+	case serviceRunning:
+		s.status.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+	case serviceStartPending, serviceStopPending:
+		s.status.WaitHint = 10000
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+}
@@ -0,0 +1,306 @@
+// Command popgund serves maildir or mbox maildrops over POP3.
+//
+// Usage:
+//
+//	popgund -config /etc/popgund.json
+//	popgund -config /etc/popgund.json -check [-format json]
+//	popgund -config /etc/popgund.json -selftest [-format json]
+//	popgund -proxy pop.example.com:110 -listen :110 -transcripts /var/lib/popgund [-record-all]
+//	popgund -replay session.transcript -target localhost:110 -user alice -password secret
+//
+// With -check, the configuration, TLS material, users file, backend and
+// listener addresses are validated without accepting clients, and the exit
+// status tells whether all checks passed.
+//
+// With -selftest, the configured backend serves a synthetic user on a
+// loopback listener, using TLS if listen_tls is set, and the conformance
+// suite of the poptest package runs against it. Its maildrop is created in
+// root and removed afterwards, so run it as the user serving the
+// maildrops.
+//
+// With -proxy, the daemon doesn't serve maildrops but relays sessions to
+// another POP3 server and saves sanitized transcripts of failing ones to
+// the -transcripts directory, see the transcript package. -replay sends
+// the commands of such a transcript to a popgun server to reproduce the
+// failure, the exit status tells whether it was answered as recorded.
+//
+// If chroot or user are configured, the daemon binds its listeners, then
+// changes its root directory and drops privileges before serving. Root and
+// users_file are then looked up inside the chroot, so both should be below
+// it.
+//
+// If plugin is configured, the plugin process is started after dropping
+// privileges. An Authorizator it serves replaces the users file for
+// logins, a ListFilter it serves filters the listings of maildrops.
+//
+// If trash is configured, messages removed by clients are kept in the
+// Trash folder of the maildir and purged after the retention by the
+// trash_purge job, which runs on the schedule configured in jobs.
+//
+// SIGHUP reloads the users file and reopens the access log, SIGUSR1 and
+// SIGUSR2 switch maintenance mode on and off, SIGINT and SIGTERM stop the
+// daemon, which waits up to 30 seconds for sessions to end. On Windows,
+// -service runs it under the service control manager, where stop requests
+// stop it and "sc control popgund paramchange" reloads the users.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kiwiz/popgun"
+)
+
+// time sessions are given to end when stopping
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	configPath := flag.String("config", "/etc/popgund.json", "path of the configuration file")
+	checkOnly := flag.Bool("check", false, "validate the configuration and exit")
+	selfTest := flag.Bool("selftest", false, "run the conformance suite against the configured backend and exit")
+	format := flag.String("format", "text", "output format of -check and -selftest, text or json")
+	asService := flag.Bool("service", false, "run as a Windows service")
+	proxyTo := flag.String("proxy", "", "relay sessions to this POP3 server, recording transcripts")
+	proxyListen := flag.String("listen", ":110", "address -proxy listens on")
+	transcripts := flag.String("transcripts", ".", "directory -proxy saves transcripts to")
+	recordAll := flag.Bool("record-all", false, "let -proxy save transcripts of all sessions, not only failing ones")
+	replayPath := flag.String("replay", "", "replay the transcript file against -target and exit")
+	target := flag.String("target", "localhost:110", "POP3 server -replay sends the commands to")
+	user := flag.String("user", "", "username -replay logs in with")
+	password := flag.String("password", "", "password -replay logs in with")
+	flag.Parse()
+
+	if *proxyTo != "" {
+		log.Fatal(runProxy(*proxyTo, *proxyListen, *transcripts, *recordAll))
+	}
+	if *replayPath != "" {
+		ok, err := runReplay(os.Stdout, *replayPath, *target, *user, *password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *checkOnly {
+		if !printCheck(os.Stdout, check(*configPath), *format) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *selfTest {
+		if !printCheck(os.Stdout, selftest(*configPath), *format) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth, err := loadUsers(cfg.UsersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsConfig *tls.Config
+	if cfg.ListenTLS != "" {
+		tlsConfig, err = cfg.loadTLS()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// bind all listeners while still privileged
+	var listener, tlsListener, adminListener net.Listener
+	for _, l := range []struct {
+		addr     string
+		listener *net.Listener
+		opts     *popgun.ListenOptions
+	}{
+		{cfg.Listen, &listener, &popgun.ListenOptions{FastOpen: cfg.FastOpen}},
+		{cfg.ListenTLS, &tlsListener, &popgun.ListenOptions{FastOpen: cfg.FastOpen}},
+		{cfg.Admin, &adminListener, nil},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		if l.opts != nil {
+			*l.listener, err = popgun.Listen(l.addr, *l.opts)
+		} else {
+			*l.listener, err = net.Listen("tcp", l.addr)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := dropPrivileges(cfg); err != nil {
+		log.Fatal(err)
+	}
+	auth.path = cfg.inChroot(auth.path)
+	auth.secrets = cfg.Secrets.provider(cfg, true)
+
+	backend := cfg.newBackend()
+	var authorizator popgun.Authorizator = auth
+	var served popgun.Backend = backend
+	if cfg.Plugin != nil {
+		p, err := cfg.startPlugin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer p.Close()
+		go func() {
+			<-p.Exited()
+			log.Printf("Plugin %s exited", cfg.Plugin.Command[0])
+		}()
+		if a := p.Authorizator(); a != nil {
+			authorizator = a
+		}
+		if filter := p.ListFilter(); filter != nil {
+			served = popgun.NewFilteredBackend(backend, filter)
+		}
+	}
+	server := popgun.NewServer(authorizator, served)
+	server.Hostname = cfg.Hostname
+	server.AffinityToken = cfg.AffinityToken
+	server.AllowInsecureAuth = cfg.AllowInsecureAuth
+	server.AllowPasswordChange = cfg.AllowPasswordChange
+	server.MaxConnections = cfg.MaxConnections
+	server.PauseAcceptWhenFull = cfg.PauseAcceptWhenFull
+	server.MaxConnectionsPerIP = cfg.MaxConnectionsPerIP
+	// validated by Validate
+	server.UpdateFailurePolicy, _ = cfg.updateFailurePolicy()
+	if len(cfg.MasterUsers) > 0 {
+		auth.masters = make(map[string]bool)
+		for _, master := range cfg.MasterUsers {
+			auth.masters[master] = true
+		}
+		server.MasterUserSeparator = "*"
+	}
+	server.TLSConfig = tlsConfig
+	server.Features = cfg.features()
+	server.Tenants = cfg.tenants()
+	server.Canonicalizer = cfg.canonicalizer()
+	server.SessionBudget = cfg.sessionBudget()
+	if server.Events = cfg.events(); server.Events != nil {
+		server.Events.ErrorLog = server.ErrorLog
+		server.Events.Metrics = server.Metrics
+	}
+	if cfg.AccessLog != "" {
+		f, err := cfg.openAccessLog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.AccessLog = popgun.NewAccessLog(f)
+		server.AccessLog.Commands = cfg.AccessLogCommands
+	}
+	if cfg.ProxyProtocol {
+		for _, l := range []*net.Listener{&listener, &tlsListener} {
+			if *l != nil {
+				proxied := popgun.NewProxyListener(*l)
+				proxied.ErrorLog = server.ErrorLog
+				*l = proxied
+			}
+		}
+	}
+	// serve runs a listener, the daemon can't continue without it
+	serve := func(serve func(net.Listener) error, l net.Listener) {
+		if err := serve(l); err != popgun.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	if listener != nil {
+		go serve(server.Serve, listener)
+	}
+	if tlsListener != nil {
+		go serve(server.ServeTLS, tlsListener)
+		days := cfg.CertExpiryDays
+		if days == 0 {
+			days = 30
+		}
+		monitor := popgun.NewCertExpiryMonitor(tlsConfig, time.Duration(days)*24*time.Hour, 24*time.Hour)
+		monitor.ErrorLog = server.ErrorLog
+		monitor.Metrics = server.Metrics
+		if err := monitor.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	jobs := &scheduler{clock: popgun.SystemClock, metrics: server.Metrics, errorLog: server.ErrorLog}
+	if trash, ok := backend.(popgun.TrashBackend); ok && cfg.Trash != nil {
+		err := jobs.add("trash_purge", cfg.jobSchedule("trash_purge", "0 3 * * *"), func(ctx context.Context) error {
+			return purgeTrash(ctx, trash, auth, server.ErrorLog)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	jobs.start(context.Background())
+	if adminListener != nil {
+		go func() {
+			log.Fatal(http.Serve(adminListener, server.AdminHandler()))
+		}()
+	}
+
+	controls := make(chan control, 1)
+	stopped, err := notifyControl(controls, *asService)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stopped()
+	for ctrl := range controls {
+		switch ctrl {
+		case CONTROL_SHUTDOWN:
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Sessions closed after shutdown timeout: %v", err)
+			}
+			cancel()
+			return
+		case CONTROL_RELOAD:
+			if err := auth.reload(); err != nil {
+				log.Printf("Error reloading users: %v", err)
+			}
+			if server.AccessLog != nil {
+				if f, err := cfg.openAccessLog(); err != nil {
+					log.Printf("Error reopening access log: %v", err)
+				} else {
+					server.AccessLog.Reopen(f)
+				}
+			}
+		case CONTROL_MAINTENANCE_ON, CONTROL_MAINTENANCE_OFF:
+			server.SetMaintenance(ctrl == CONTROL_MAINTENANCE_ON, cfg.MaintenanceMessage)
+		}
+	}
+}
+
+// purgeTrash purges the trash of all users.
+func purgeTrash(ctx context.Context, backend popgun.TrashBackend, auth *fileAuthorizator, logger popgun.Logger) error {
+	failed := 0
+	for _, username := range auth.usernames() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		purged, err := backend.PurgeTrash(fileUser{name: username})
+		if err != nil {
+			logger.Printf("Error purging trash of user %s: %v", username, err)
+			failed++
+		} else if purged > 0 {
+			logger.Printf("Purged %d messages from trash of user %s", purged, username)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Purging trash failed for %d users", failed)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges changes the root directory to cfg.Chroot and switches to
+// cfg.User and cfg.Group. Users are looked up before the chroot, as their
+// database usually isn't available inside it.
+func dropPrivileges(cfg *Config) error {
+	uid, gid := -1, -1
+	if cfg.User != "" {
+		u, err := user.Lookup(cfg.User)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+		if cfg.Group != "" {
+			g, err := user.LookupGroup(cfg.Group)
+			if err != nil {
+				return err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	if cfg.Chroot != "" {
+		if err := syscall.Chroot(cfg.Chroot); err != nil {
+			return fmt.Errorf("Error changing root to %s: %v", cfg.Chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if uid < 0 {
+		return nil
+	}
+	// the group has to be changed while still privileged
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("Error setting groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("Error changing group to %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("Error changing user to %s: %v", cfg.User, err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("Privileges could not be dropped")
+	}
+	return nil
+}
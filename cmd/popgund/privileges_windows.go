@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "fmt"
+
+// dropPrivileges is not supported on Windows, run the service under an
+// unprivileged account instead.
+func dropPrivileges(cfg *Config) error {
+	if cfg.Chroot != "" || cfg.User != "" {
+		return fmt.Errorf("chroot and user are not supported on Windows")
+	}
+	return nil
+}
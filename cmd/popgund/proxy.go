@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/kiwiz/popgun/transcript"
+)
+
+// time a replay may take
+const replayTimeout = time.Minute
+
+// runProxy relays sessions accepted on addr to upstream and saves the
+// transcripts of failing ones, or all if recordAll is set, to dir. It
+// returns only if accepting fails.
+func runProxy(upstream, addr, dir string, recordAll bool) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	proxy := &transcript.Proxy{
+		Upstream:  upstream,
+		Dir:       dir,
+		RecordAll: recordAll,
+		ErrorLog:  log.New(os.Stderr, "pop3/proxy: ", 0),
+	}
+	return proxy.Serve(l)
+}
+
+// runReplay replays the transcript file path against target and writes
+// the commands answered differently than recorded to w. It returns
+// whether there were none.
+func runReplay(w io.Writer, path, target, user, password string) (bool, error) {
+	t, err := transcript.Load(path)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+	mismatches, err := transcript.Replay(ctx, target, t, user, password)
+	for _, m := range mismatches {
+		fmt.Fprintf(w, "FAIL %s\n", m)
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(mismatches) == 0 {
+		fmt.Fprintf(w, "ok   %s\n", path)
+	}
+	return len(mismatches) == 0, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiwiz/popgun"
+)
+
+// schedule tells when a job runs next.
+type schedule interface {
+	// next returns the first time a job runs after t.
+	next(t time.Time) time.Time
+}
+
+// parseSchedule parses a cron expression with the fields minute, hour, day
+// of month, month and day of week, e.g. "30 3 * * 1-5", or one of the
+// descriptors @hourly, @daily, @weekly, @monthly and "@every <duration>".
+func parseSchedule(spec string) (schedule, error) {
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("Invalid interval in schedule %q", spec)
+		}
+		return everySchedule(interval), nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Schedule %q must have 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]map[int]bool
+	for i, field := range fields {
+		set, err := parseField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %q: %v", spec, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 or 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		minutes:  sets[0],
+		hours:    sets[1],
+		days:     sets[2],
+		months:   sets[3],
+		weekdays: sets[4],
+		anyDay:   fields[2] == "*",
+		anyWeek:  fields[4] == "*",
+	}, nil
+}
+
+// parseField parses a comma separated list of values, ranges "a-b" and
+// "*", each optionally with a step "/n".
+func parseField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	// whether the day of month or week is unrestricted
+	anyDay, anyWeek bool
+}
+
+// dayMatches follows cron: if both the day of month and the day of week
+// are restricted, either may match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[int(t.Weekday())]
+	if !s.anyDay && !s.anyWeek {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// every combination repeats within a few years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	// e.g. February 30th
+	return time.Time{}
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+type job struct {
+	name     string
+	schedule schedule
+	run      func(ctx context.Context) error
+	// 1 while running
+	running int32
+}
+
+// scheduler runs maintenance jobs of the backend on their schedules. A run
+// is skipped if the previous one of the job is still going.
+//
+// Every run is counted as "job.run" labeled with the job and its outcome,
+// "ok", "error" or "skipped", and its duration observed as
+// "job.duration_seconds".
+type scheduler struct {
+	clock    popgun.Clock
+	metrics  popgun.Metrics
+	errorLog popgun.Logger
+	jobs     []*job
+}
+
+func (s *scheduler) add(name, spec string, run func(ctx context.Context) error) error {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return fmt.Errorf("Job %s: %v", name, err)
+	}
+	s.jobs = append(s.jobs, &job{name: name, schedule: sched, run: run})
+	return nil
+}
+
+// start runs the jobs until ctx is done.
+func (s *scheduler) start(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+}
+
+func (s *scheduler) loop(ctx context.Context, j *job) {
+	for {
+		now := s.clock.Now()
+		next := j.schedule.next(now)
+		if next.IsZero() {
+			s.errorLog.Printf("Job %s is never scheduled", j.name)
+			return
+		}
+		timer := s.clock.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C():
+			go s.runJob(ctx, j)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runJob runs j unless it is already running.
+func (s *scheduler) runJob(ctx context.Context, j *job) {
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		s.errorLog.Printf("Job %s is still running, skipping this run", j.name)
+		s.metrics.Inc("job.run", j.name, "skipped")
+		return
+	}
+	defer atomic.StoreInt32(&j.running, 0)
+	start := s.clock.Now()
+	err := j.run(ctx)
+	s.metrics.Observe("job.duration_seconds", s.clock.Now().Sub(start).Seconds(), j.name)
+	if err != nil {
+		s.errorLog.Printf("Job %s failed: %v", j.name, err)
+		s.metrics.Inc("job.run", j.name, "error")
+		return
+	}
+	s.metrics.Inc("job.run", j.name, "ok")
+}
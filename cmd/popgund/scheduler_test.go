@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// a Saturday
+	now := time.Date(2024, 6, 15, 10, 20, 30, 0, time.UTC)
+	tables := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 6, 15, 10, 21, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 6, 16, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 6, 15, 10, 30, 0, 0, time.UTC)},
+		{"30 9-17 * * 1-5", time.Date(2024, 6, 17, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 1,7 *", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, 6, 16, 12, 0, 0, 0, time.UTC)},
+		// day of month or week
+		{"0 0 20 * 0", time.Date(2024, 6, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 6, 15, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2024, 6, 15, 11, 50, 30, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, table := range tables {
+		sched, err := parseSchedule(table.spec)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", table.spec, err)
+			continue
+		}
+		if next := sched.next(now); !next.Equal(table.expected) {
+			t.Errorf("Expected %q to run at %v, but got %v", table.spec, table.expected, next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@every 1ms", "@yearly"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+type jobMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *jobMetrics) Inc(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[fmt.Sprint(name, labels)]++
+}
+
+func (m *jobMetrics) Observe(name string, value float64, labels ...string) {}
+func (m *jobMetrics) Set(name string, value float64, labels ...string)     {}
+
+func TestScheduler_runJob(t *testing.T) {
+	metrics := &jobMetrics{counts: make(map[string]int)}
+	s := &scheduler{clock: popgun.SystemClock, metrics: metrics, errorLog: log.New(ioutil.Discard, "", 0)}
+
+	started, release := make(chan bool), make(chan error)
+	s.add("purge", "@daily", func(ctx context.Context) error {
+		started <- true
+		return <-release
+	})
+	j := s.jobs[0]
+	done := make(chan bool)
+	go func() {
+		s.runJob(context.Background(), j)
+		done <- true
+	}()
+	<-started
+	// overlapping run
+	s.runJob(context.Background(), j)
+	release <- fmt.Errorf("Disk full")
+	<-done
+
+	go func() {
+		<-started
+		release <- nil
+	}()
+	s.runJob(context.Background(), j)
+
+	for key, expected := range map[string]int{
+		"job.run[purge skipped]": 1,
+		"job.run[purge error]":   1,
+		"job.run[purge ok]":      1,
+	} {
+		if metrics.counts[key] != expected {
+			t.Errorf("Expected %s to be %d, but got %d", key, expected, metrics.counts[key])
+		}
+	}
+}
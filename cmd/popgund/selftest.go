@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/poptest"
+)
+
+// time the conformance suite of -selftest may take
+const selftestTimeout = 30 * time.Second
+
+// selftestMessages are delivered to the maildrop of the synthetic user.
+var selftestMessages = []string{
+	"From: popgund <selftest@localhost>\r\nSubject: selftest 1\r\n\r\nfirst\r\n",
+	"From: popgund <selftest@localhost>\r\nSubject: selftest 2\r\n\r\nsecond\r\n.leading dot\r\n",
+}
+
+// selftest boots the configured backend and runs the conformance suite of
+// poptest against a loopback listener, serving a synthetic user whose
+// maildrop is created in root and removed afterwards. The loopback
+// listener uses TLS with the configured certificate if listen_tls is set.
+func selftest(path string) (results []checkResult) {
+	add := func(name string, err error) bool {
+		result := checkResult{Name: name, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		return err == nil
+	}
+
+	cfg, err := loadConfig(path)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if !add("config", err) {
+		return results
+	}
+	var tlsConfig *tls.Config
+	if cfg.ListenTLS != "" {
+		tlsConfig, err = cfg.loadTLS()
+		if !add("tls", err) {
+			return results
+		}
+	}
+	// the daemon isn't chrooted, so root must not be looked up inside the
+	// chroot
+	unchrooted := *cfg
+	unchrooted.Chroot = ""
+	backend := unchrooted.newBackend()
+
+	user := selftestUser()
+	remove, err := deliverSelftest(cfg.Backend, backend, user)
+	if !add("deliver", err) {
+		return results
+	}
+	defer func() {
+		add("cleanup", remove())
+	}()
+
+	password := randomHex()
+	server := popgun.NewServer(selftestAuthorizator{user.Username(), password}, backend)
+	server.Hostname = cfg.Hostname
+	server.AffinityToken = cfg.AffinityToken
+	// the suite logs in over the loopback listener
+	server.AllowInsecureAuth = true
+	server.TLSConfig = tlsConfig
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !add("listen", err) {
+		return results
+	}
+	if tlsConfig != nil {
+		go server.ServeTLS(l)
+	} else {
+		go server.Serve(l)
+	}
+	defer server.Shutdown(context.Background())
+
+	var clientConfig *tls.Config
+	if tlsConfig != nil {
+		// the certificate is for the hostname of the daemon, not loopback
+		clientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	for _, step := range poptest.Conformance(ctx, l.Addr().String(), clientConfig, user.Username(), password, selftestMessages) {
+		add(step.Name, step.Err)
+	}
+	return results
+}
+
+// selftestUser returns a user with a random name, which is unlikely to
+// exist.
+func selftestUser() fileUser {
+	return fileUser{name: "popgund-selftest-" + randomHex()}
+}
+
+func randomHex() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deliverSelftest creates the maildrop of user with selftestMessages. It
+// returns a function removing it and the directories created for it.
+func deliverSelftest(kind string, backend popgun.Backend, user backends.User) (func() error, error) {
+	var path string
+	var err error
+	if pather, ok := backend.(interface {
+		Path(backends.User) (string, error)
+	}); ok {
+		path, err = pather.Path(user)
+	} else {
+		err = fmt.Errorf("Backend %s has no maildrop path", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	// the topmost directory created for the maildrop
+	created := path
+	for dir := filepath.Dir(path); dir != created; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		created = dir
+	}
+	remove := func() error {
+		if err := os.RemoveAll(created); err != nil {
+			return err
+		}
+		// mbox lock files are next to the maildrop
+		if err := os.Remove(path + ".lock"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if kind == "mbox" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			remove()
+			return nil, err
+		}
+		var b strings.Builder
+		for _, message := range selftestMessages {
+			b.WriteString("From selftest@localhost Thu Jan  1 00:00:00 1970\n")
+			b.WriteString(strings.Replace(message, "\r\n", "\n", -1))
+			b.WriteString("\n")
+		}
+		if err := ioutil.WriteFile(path, []byte(b.String()), 0600); err != nil {
+			remove()
+			return nil, err
+		}
+		return remove, nil
+	}
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			remove()
+			return nil, err
+		}
+	}
+	delivered := time.Now()
+	for i, message := range selftestMessages {
+		name := filepath.Join(path, "new", fmt.Sprintf("%d.%d.selftest", delivered.Unix(), i))
+		if err := ioutil.WriteFile(name, []byte(message), 0600); err != nil {
+			remove()
+			return nil, err
+		}
+		// listed in order of their names if delivered at the same time
+		if err := os.Chtimes(name, delivered, delivered); err != nil {
+			remove()
+			return nil, err
+		}
+	}
+	return remove, nil
+}
+
+// selftestAuthorizator accepts only the synthetic user of selftest.
+type selftestAuthorizator struct {
+	username, password string
+}
+
+func (a selftestAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	if username != a.username || password != a.password {
+		return nil, fmt.Errorf("Invalid credentials")
+	}
+	return fileUser{name: username}, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	for _, backend := range []string{"maildir", "mbox"} {
+		dir, err := ioutil.TempDir("", "popgund")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		root := filepath.Join(dir, "spool")
+		os.Mkdir(root, 0700)
+		users := filepath.Join(dir, "users")
+		ioutil.WriteFile(users, []byte("alice:secret\n"), 0600)
+		config := filepath.Join(dir, "config.json")
+		ioutil.WriteFile(config, []byte(`{
+			"listen": "127.0.0.1:0",
+			"backend": "`+backend+`",
+			"root": "`+root+`",
+			"path_template": "%1n/%n",
+			"users_file": "`+users+`"
+		}`), 0600)
+
+		results := selftest(config)
+		if !printCheck(ioutil.Discard, results, "text") {
+			t.Errorf("Expected selftest of %s to pass, but got '%v'", backend, results)
+		}
+		if last := results[len(results)-1]; last.Name != "cleanup" {
+			t.Errorf("Expected cleanup last, but got '%v'", last)
+		}
+		if names, _ := ioutil.ReadDir(root); len(names) != 0 {
+			t.Errorf("Expected maildrop of %s removed, but got %d files", backend, len(names))
+		}
+	}
+}
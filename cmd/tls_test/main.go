@@ -1,20 +1,25 @@
 package main
 
 import (
-	"sync"
+	"crypto/tls"
+	"log"
 
 	"github.com/kiwiz/popgun"
 	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/testcert"
 )
 
 func main() {
-	cfg := popgun.Config{
-		ListenInterface: "localhost:1443"}
+	cert, err := testcert.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "localhost:1443", cert.ServerConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
 	auth := backends.DummyAuthorizator{}
 	be := backends.DummyBackend{}
-	server := popgun.NewServer(cfg, auth, be)
-	server.StartTLS("../../cert/cert.pem", "../../cert/key.pem")
-	var wg sync.WaitGroup
-	wg.Add(1)
-	wg.Wait()
+	server := popgun.NewServer(auth, be)
+	log.Fatal(server.Serve(listener))
 }
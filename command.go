@@ -1,13 +1,21 @@
 package popgun
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+
+	"github.com/kiwiz/popgun/backends"
 )
 
 // https://datatracker.ietf.org/doc/html/rfc1939
 
+// approximate memory used per line of a materialized LIST/UIDL listing
+const listingSize = 32
+
 type Executable interface {
 	Run(c *Client, args []string) (int, error)
 }
@@ -70,16 +78,40 @@ func (cmd QuitCommand) Run(c *Client, args []string) (int, error) {
 	if c.currentState == STATE_TRANSACTION {
 		// According to the RFC, we should enter UPDATE state regardless of the success of the operation.
 		newState = STATE_UPDATE
-		err := c.backend.Update(c.user)
-		if err != nil {
-			return 0, fmt.Errorf("Error updating maildrop for user %s: %v", c.user.Username(), err)
+		user := c.user
+		if c.readOnly {
+			// sessions of master users and guests are read-only
+			c.user = nil
+			if err := c.backend.Unlock(user); err != nil {
+				c.printer.Err("Server was unable to unlock maildrop")
+				return 0, fmt.Errorf("Error unlocking maildrop for user %s: %v", user.Username(), err)
+			}
+			c.printer.Ok("Goodbye")
+			return newState, nil
 		}
-		err = c.backend.Unlock(c.user)
+		result, updateErr := c.backend.Update(user)
+		// The lock is released whether the removal was successful or not.
+		err := c.backend.Unlock(user)
 		c.user = nil
 		if err != nil {
 			c.printer.Err("Server was unable to unlock maildrop")
-			return 0, fmt.Errorf("Error unlocking maildrop for user %s: %v", c.user.Username(), err)
+			return 0, fmt.Errorf("Error unlocking maildrop for user %s: %v", user.Username(), err)
+		}
+		if updateErr != nil {
+			return 0, fmt.Errorf("Error updating maildrop for user %s: %v", user.Username(), updateErr)
+		}
+		c.server.updated(c, user, result)
+		if len(result.FailedUids) > 0 {
+			c.server.updateFailed(c, user, result)
+			c.printer.Err("some deleted messages not removed")
+			return newState, nil
 		}
+		if result.RemainingMessages == 0 {
+			c.printer.Ok("Goodbye (maildrop empty)")
+		} else {
+			c.printer.Ok("Goodbye (%d messages left)", result.RemainingMessages)
+		}
+		return newState, nil
 	}
 
 	c.printer.Ok("Goodbye")
@@ -139,6 +171,10 @@ func (cmd UserCommand) Run(c *Client, args []string) (int, error) {
 	if len(args) != 1 {
 		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
 	}
+	if !c.checkCleartextAuth() {
+		c.printer.Err("[AUTH] Cleartext authentication refused, use TLS")
+		return STATE_AUTHORIZATION, nil
+	}
 	c.username = args[0]
 	c.printer.Ok("")
 	return STATE_AUTHORIZATION, nil
@@ -197,24 +233,19 @@ func (cmd PassCommand) Run(c *Client, args []string) (int, error) {
 	if len(args) != 1 {
 		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
 	}
+	if !c.server.isHealthy() {
+		c.username = ""
+		c.printer.Err("[SYS/TEMP] Maildrop temporarily unavailable, try again later")
+		return STATE_AUTHORIZATION, nil
+	}
 	password := args[0]
-	user, err := c.authorizator.Authorize(c.conn, c.username, password)
-	c.user = user
+	user, err := c.authenticate(c.username, password)
 	c.username = ""
 	if err != nil {
 		c.printer.Err("Invalid username or password: %v", err)
 		return STATE_AUTHORIZATION, nil
 	}
-
-	err = c.backend.Lock(user)
-	if err != nil {
-		c.printer.Err("Server was unable to lock maildrop")
-		return 0, fmt.Errorf("Error locking maildrop for user %s: %v", c.user.Username(), err)
-	}
-
-	c.printer.Ok("User Successfully Logged on")
-
-	return STATE_TRANSACTION, nil
+	return c.login(user)
 }
 
 /*
@@ -360,22 +391,59 @@ func (cmd ListCommand) Run(c *Client, args []string) (int, error) {
 			return STATE_TRANSACTION, nil
 		}
 		c.printer.Ok("%d %d", msgId, octets)
-	} else {
+	} else if iterBackend, ok := c.backend.(ListIterBackend); ok {
+		err := streamListing(c, iterBackend, func(info backends.MessageInfo) string {
+			return fmt.Sprintf("%d %d", info.MsgId, info.Octets)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Error calling LIST for user %s: %v", c.user.Username(), err)
+		}
+	} else if !c.writeCachedListing("LIST") {
 		octets, err := c.backend.List(c.user)
 		if err != nil {
 			return 0, fmt.Errorf("Error calling LIST for user %s: %v", c.user.Username(), err)
 		}
-		c.printer.Ok("%d messages", len(octets))
+		size := listingSize * len(octets)
+		if !c.reserve(size) {
+			return STATE_TRANSACTION, nil
+		}
+		defer c.release(size)
 		messagesList := make([]string, len(octets))
 		for i, octet := range octets {
 			messagesList[i] = fmt.Sprintf("%d %d", i+1, octet)
 		}
-		c.printer.MultiLine(messagesList)
+		c.writeListing("LIST", fmt.Sprintf("%d messages", len(octets)), messagesList)
 	}
 
 	return STATE_TRANSACTION, nil
 }
 
+// streamListing writes a multi-line listing with a line per message produced
+// by the backend's iterator. An error before the first message is returned,
+// since the response hasn't started yet. Errors in the middle of the listing
+// can't be reported to the client, so the session is terminated instead.
+func streamListing(c *Client, b ListIterBackend, format func(info backends.MessageInfo) string) error {
+	it, err := b.ListIter(c.user)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	more := it.Next()
+	if !more && it.Err() != nil {
+		return it.Err()
+	}
+	c.printer.Ok("scan listing follows")
+	for ; more; more = it.Next() {
+		c.printer.Line(format(it.Message()))
+	}
+	c.printer.End()
+	if err := it.Err(); err != nil {
+		c.ErrorLog.Printf("Listing for user %s interrupted, closing session: %v", c.user.Username(), err)
+		c.end(CLOSE_BACKEND_ERROR)
+	}
+	return nil
+}
+
 /*
 
 RETR msg
@@ -423,16 +491,123 @@ func (cmd RetrCommand) Run(c *Client, args []string) (int, error) {
 		return 0, fmt.Errorf("Invalid argument for RETR given by user %s: %v", c.user.Username(), err)
 	}
 
-	message, err := c.backend.Retr(c.user, msgId)
+	if max := c.server.MaxRetrievedMessages; max > 0 && c.retrCount >= max {
+		c.printer.Err("Too many messages retrieved in this session")
+		return STATE_TRANSACTION, nil
+	}
+	if max := c.features.MaxMessageSize; max > 0 {
+		exists, octets, err := c.backend.ListMessage(c.user, msgId)
+		if err != nil {
+			return 0, fmt.Errorf("Error calling 'LIST %d' for user %s: %v", msgId, c.user.Username(), err)
+		}
+		if exists && octets > max {
+			c.printer.Err("Message too large, limit is %d octets", max)
+			return STATE_TRANSACTION, nil
+		}
+	}
+	answered, err := c.checkArchived(msgId)
+	if err != nil {
+		return 0, fmt.Errorf("Error checking whether message %d of user %s is archived: %v", msgId, c.user.Username(), err)
+	}
+	if answered {
+		return STATE_TRANSACTION, nil
+	}
+
+	if msgBackend, ok := c.backend.(MessageBackend); ok {
+		err = retrMessage(c, msgBackend, msgId, -1)
+		if err != nil {
+			return 0, fmt.Errorf("Error calling 'RETR %d' for user %s: %v", msgId, c.user.Username(), err)
+		}
+		c.retrCount++
+		return STATE_TRANSACTION, nil
+	}
+
+	var message string
+	if ctxBackend, ok := c.backend.(ContextRetrBackend); ok {
+		message, err = ctxBackend.RetrContext(c.Context(), c.user, msgId)
+	} else {
+		message, err = c.backend.Retr(c.user, msgId)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("Error calling 'RETR %d' for user %s: %v", msgId, c.user.Username(), err)
 	}
+	c.retrCount++
+	// the message is held both as a string and split into lines
+	size := 2 * len(message)
+	if !c.reserve(size) {
+		return STATE_TRANSACTION, nil
+	}
+	defer c.release(size)
 	lines := strings.Split(message, "\n")
 	c.printer.Ok("")
 	c.printer.MultiLine(lines)
 	return STATE_TRANSACTION, nil
 }
 
+// retrMessage streams a message from the backend to the client: the headers,
+// the blank line and bodyLines lines of the body, or the whole body if
+// bodyLines is negative. Only the required part of the message is read.
+func retrMessage(c *Client, b MessageBackend, msgId int, bodyLines int) error {
+	msg, err := b.Message(c.Context(), c.user, msgId)
+	if err != nil {
+		return err
+	}
+	headers, err := msg.RawHeaders()
+	if err != nil {
+		return err
+	}
+	body, err := msg.Body()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if bodyLines < 0 {
+		size, err := msg.Size()
+		if err != nil {
+			return err
+		}
+		c.printer.Ok("%d octets", size)
+	} else {
+		c.printer.Ok("")
+	}
+	for _, line := range headers {
+		c.printer.Line(line)
+	}
+	c.printer.Line("")
+	reader := bufio.NewReader(body)
+	for i := 0; bodyLines < 0 || i < bodyLines; i++ {
+		if err := c.Context().Err(); err != nil && c.printer.StreamErr() == nil {
+			// the client is gone, the message must not end as if it
+			// was complete
+			c.mu.Lock()
+			if c.closeReason == 0 {
+				c.closeReason = CLOSE_CLIENT_GONE
+			}
+			c.mu.Unlock()
+			c.printer.Abort(err)
+		}
+		if c.printer.StreamErr() != nil {
+			// stop pulling the message from the backend
+			break
+		}
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			c.printer.Line(strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.ErrorLog.Printf("Reading message %d of user %s failed, closing session: %v", msgId, c.user.Username(), err)
+			c.end(CLOSE_BACKEND_ERROR)
+			break
+		}
+	}
+	c.printer.End()
+	return nil
+}
+
 /*
 
 DELE msg
@@ -469,6 +644,7 @@ func (cmd DeleCommand) Run(c *Client, args []string) (int, error) {
 	if c.currentState != STATE_TRANSACTION {
 		return 0, ErrInvalidState
 	}
+	c.listingChanged()
 	if len(args) == 0 {
 		c.printer.Err("Missing argument for DELE command")
 		return 0, fmt.Errorf("Missing argument for DELE called by user %s", c.user.Username())
@@ -479,10 +655,19 @@ func (cmd DeleCommand) Run(c *Client, args []string) (int, error) {
 		c.printer.Err("Invalid argument: %s", args[0])
 		return 0, fmt.Errorf("Invalid argument for DELE given by user %s: %v", c.user.Username(), err)
 	}
+	if !c.features.AllowDele {
+		c.printer.Err("DELE is not allowed for this account")
+		return STATE_TRANSACTION, nil
+	}
+	if max := c.server.MaxDeletedMessages; max > 0 && c.deleCount >= max {
+		c.printer.Err("Too many messages deleted in this session")
+		return STATE_TRANSACTION, nil
+	}
 	err = c.backend.Dele(c.user, msgId)
 	if err != nil {
 		return 0, fmt.Errorf("Error calling 'DELE %d' for user %s: %v", msgId, c.user.Username(), err)
 	}
+	c.deleCount++
 
 	c.printer.Ok("Message %d deleted", msgId)
 
@@ -566,10 +751,12 @@ func (cmd RsetCommand) Run(c *Client, args []string) (int, error) {
 	if c.currentState != STATE_TRANSACTION {
 		return 0, ErrInvalidState
 	}
+	c.listingChanged()
 	err := c.backend.Rset(c.user)
 	if err != nil {
 		return 0, fmt.Errorf("Error calling 'RSET' for user %s: %v", c.user.Username(), err)
 	}
+	c.deleCount = 0
 
 	c.printer.Ok("")
 
@@ -661,17 +848,31 @@ func (cmd UidlCommand) Run(c *Client, args []string) (int, error) {
 			return STATE_TRANSACTION, nil
 		}
 		c.printer.Ok("%d %s", msgId, uid)
-	} else {
+	} else if iterBackend, ok := c.backend.(ListIterBackend); ok {
+		err := streamListing(c, iterBackend, func(info backends.MessageInfo) string {
+			return fmt.Sprintf("%d %s", info.MsgId, info.Uid)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Error calling UIDL for user %s: %v", c.user.Username(), err)
+		}
+	} else if !c.writeCachedListing("UIDL") {
 		uids, err := c.backend.Uidl(c.user)
 		if err != nil {
 			return 0, fmt.Errorf("Error calling UIDL for user %s: %v", c.user.Username(), err)
 		}
-		c.printer.Ok("%d messages", len(uids))
+		size := listingSize * len(uids)
+		for _, uid := range uids {
+			size += len(uid)
+		}
+		if !c.reserve(size) {
+			return STATE_TRANSACTION, nil
+		}
+		defer c.release(size)
 		uidsList := make([]string, len(uids))
 		for i, uid := range uids {
 			uidsList[i] = fmt.Sprintf("%d %s", i+1, uid)
 		}
-		c.printer.MultiLine(uidsList)
+		c.writeListing("UIDL", fmt.Sprintf("%d messages", len(uids)), uidsList)
 	}
 
 	return STATE_TRANSACTION, nil
@@ -723,7 +924,34 @@ type CapaCommand struct{}
 func (cmd CapaCommand) Run(c *Client, args []string) (int, error) {
 	c.printer.Ok("")
 	var commands []string
-	commands = []string{"USER", "UIDL", "TOP"}
+	commands = []string{"USER", "UIDL"}
+	if mechanisms := c.saslMechanisms(); len(mechanisms) > 0 {
+		commands = append(commands, "SASL "+strings.Join(mechanisms, " "))
+	}
+	if c.features.AllowTop {
+		commands = append(commands, "TOP")
+	}
+	if _, ok := c.backend.(NewMailNotifier); ok && c.server.AllowIdle {
+		commands = append(commands, "XIDLE")
+	}
+	if _, ok := c.backend.(UndeleBackend); ok {
+		commands = append(commands, "XUNDELE")
+	}
+	if c.allowPasswordChange() {
+		commands = append(commands, "XPASSWD")
+	}
+	commands = append(commands, "XNEWUIDL")
+	if c.server.AdvertiseLimits {
+		if limits := c.limits(); len(limits) > 0 {
+			commands = append(commands, "XLIMITS "+strings.Join(limits, " "))
+		}
+	}
+	if c.server.Hooks.OnCapa != nil {
+		commands = append(commands, c.server.Hooks.OnCapa(c)...)
+	}
+	if c.hostname != "" {
+		commands = append(commands, fmt.Sprintf("IMPLEMENTATION POPgun %s", c.hostname))
+	}
 
 	c.printer.MultiLine(commands)
 
@@ -793,11 +1021,514 @@ func (cmd TopCommand) Run(c *Client, args []string) (int, error) {
 		return 0, fmt.Errorf("Invalid argument for TOP given by user %s: %v", c.user.Username(), err)
 	}
 
+	if !c.features.AllowTop {
+		c.printer.Err("TOP is not allowed for this account")
+		return STATE_TRANSACTION, nil
+	}
+	answered, err := c.checkArchived(msgId)
+	if err != nil {
+		return 0, fmt.Errorf("Error checking whether message %d of user %s is archived: %v", msgId, c.user.Username(), err)
+	}
+	if answered {
+		return STATE_TRANSACTION, nil
+	}
+
+	if msgBackend, ok := c.backend.(MessageBackend); ok {
+		if n < 0 {
+			c.printer.Err("Invalid argument: %s", args[1])
+			return 0, fmt.Errorf("Negative line count for TOP given by user %s", c.user.Username())
+		}
+		err = retrMessage(c, msgBackend, msgId, n)
+		if err != nil {
+			return 0, fmt.Errorf("Error calling 'TOP %d %d' for user %s: %v", msgId, n, c.user.Username(), err)
+		}
+		return STATE_TRANSACTION, nil
+	}
+
 	lines, err := c.backend.Top(c.user, msgId, n)
 	if err != nil {
 		return 0, fmt.Errorf("Error calling 'TOP %d %d' for user %s: %v", msgId, n, c.user.Username(), err)
 	}
+	size := 0
+	for _, line := range lines {
+		size += len(line)
+	}
+	if !c.reserve(size) {
+		return STATE_TRANSACTION, nil
+	}
+	defer c.release(size)
 	c.printer.Ok("")
 	c.printer.MultiLine(lines)
 	return STATE_TRANSACTION, nil
 }
+
+/*
+APOP name digest
+
+	Arguments:
+		a string identifying a mailbox and a MD5 digest string
+		(both required)
+
+	Restrictions:
+		may only be given in the AUTHORIZATION state after the POP3
+		greeting or after an unsuccessful USER or PASS command
+
+	Discussion:
+		Normally, each POP3 session starts with a USER/PASS
+		exchange.  This results in a server/user-id specific
+		password being sent in the clear on the network.  For
+		intermittent use of POP3, this may not introduce a sizable
+		risk.  However, many POP3 client implementations connect to
+		the POP3 server on a regular basis -- to check for new
+		mail.  Further the interval of session initiation may be on
+		the order of five minutes.  Hence, the risk of password
+		capture is greatly enhanced.
+
+		An alternate method of authentication is required which
+		provides for both origin authentication and replay
+		protection, but which does not involve sending a password
+		in the clear over the network.  The APOP command provides
+		this functionality.
+
+	Possible Responses:
+		+OK maildrop locked and ready
+		-ERR permission denied
+
+	Examples:
+		S: +OK POP3 server ready <1896.697170952@dbc.mtview.ca.us>
+		C: APOP mrose c4c9334bac560ecc979e58001b3e22fb
+		S: +OK maildrop has 1 message (369 octets)
+*/
+
+type ApopCommand struct{}
+
+func (cmd ApopCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_AUTHORIZATION {
+		return 0, ErrInvalidState
+	}
+	if len(args) != 2 {
+		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
+	}
+	apop, ok := c.authorizator.(APOPAuthorizator)
+	if !ok || c.timestamp == "" {
+		c.printer.Err("APOP is not supported")
+		return STATE_AUTHORIZATION, nil
+	}
+	if !c.server.isHealthy() {
+		c.printer.Err("[SYS/TEMP] Maildrop temporarily unavailable, try again later")
+		return STATE_AUTHORIZATION, nil
+	}
+	name, digest := args[0], strings.ToLower(args[1])
+	if !c.checkReplay("apop", digest) {
+		c.ReportAbuse(SIGNAL_AUTH_FAILURE)
+		c.authFailureDelay()
+		c.printer.Err("[AUTH] Replayed authentication rejected")
+		return STATE_AUTHORIZATION, nil
+	}
+	user, err := c.authenticateWith(name, func(name string) (backends.User, error) {
+		return apop.AuthorizeAPOP(c.conn, name, c.timestamp, digest)
+	})
+	if err != nil {
+		c.printer.Err("Invalid username or password: %v", err)
+		return STATE_AUTHORIZATION, nil
+	}
+	return c.login(user)
+}
+
+/*
+AUTH mechanism [initial-response]
+
+	Arguments:
+		a string identifying a SASL authentication mechanism
+		(required), an optional initial client response
+
+	Restrictions:
+		may only be given in the AUTHORIZATION state
+
+	Discussion:
+		Authenticates the client with a SASL mechanism (RFC 5034).
+		The server sends challenges as "+" and base64 encoded data,
+		which the client answers with base64 encoded responses. The
+		client may cancel the exchange with "*". An empty initial
+		response is sent as "=". Initial responses making the
+		command line longer than the 255 octets of RFC 5034 are
+		accepted as well. The mechanisms are configured by
+		Server.SASL and advertised by CAPA.
+
+	Possible Responses:
+		+OK maildrop locked and ready
+		-ERR [AUTH] authentication failed
+
+	Examples:
+		C: AUTH PLAIN
+		S: +
+		C: AGFsaWNlAHNlY3JldA==
+		S: +OK User Successfully Logged on
+		  ...
+		C: AUTH PLAIN AGFsaWNlAHNlY3JldA==
+		S: +OK User Successfully Logged on
+*/
+
+type AuthCommand struct{}
+
+func (cmd AuthCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_AUTHORIZATION {
+		return 0, ErrInvalidState
+	}
+	if !c.AllowAuth() {
+		return 0, fmt.Errorf("Authentication disabled")
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
+	}
+	mechanism, ok := c.server.SASL[strings.ToUpper(args[0])]
+	if !ok {
+		c.printer.Err("Unsupported authentication mechanism %s", args[0])
+		return STATE_AUTHORIZATION, nil
+	}
+	if !c.checkCleartextAuth() {
+		c.printer.Err("[AUTH] Cleartext authentication refused, use TLS")
+		return STATE_AUTHORIZATION, nil
+	}
+	if !c.server.isHealthy() {
+		c.printer.Err("[SYS/TEMP] Maildrop temporarily unavailable, try again later")
+		return STATE_AUTHORIZATION, nil
+	}
+	var response []byte
+	if len(args) == 2 {
+		initial, err := decodeSASL(args[1])
+		if err != nil {
+			c.printer.Err("%v", err)
+			return STATE_AUTHORIZATION, nil
+		}
+		response = initial
+	}
+	exchange := mechanism(c.conn, c.authorizator)
+	for {
+		challenge, done, err := exchange.Next(response)
+		if err != nil {
+			c.ReportAbuse(SIGNAL_AUTH_FAILURE)
+			c.authFailureDelay()
+			c.printer.Err("[AUTH] Authentication failed: %v", err)
+			return STATE_AUTHORIZATION, nil
+		}
+		if done {
+			break
+		}
+		response, err = c.saslResponse(challenge)
+		if err != nil {
+			if c.pending == nil {
+				c.printer.Err("%v", err)
+			}
+			return STATE_AUTHORIZATION, nil
+		}
+	}
+	user, err := c.authenticateWith(exchange.Username(), exchange.Authorize)
+	if err != nil {
+		c.printer.Err("[AUTH] Invalid username or password: %v", err)
+		return STATE_AUTHORIZATION, nil
+	}
+	if ro, ok := exchange.(ReadOnlySASLServer); ok && ro.ReadOnly() {
+		c.readOnly = true
+	}
+	state, err := c.login(user)
+	if state != STATE_TRANSACTION {
+		c.readOnly = false
+	}
+	return state, err
+}
+
+/*
+XIDLE
+
+	Arguments: none
+
+	Restrictions:
+		may only be given in the TRANSACTION state, if enabled by
+		Server.AllowIdle and supported by the backend
+
+	Discussion:
+		Extension letting the client wait for new mail instead of
+		polling. The server responds with a multi-line response,
+		sending its status line right away and terminating it when
+		a message is delivered to the maildrop, the client sends
+		DONE, or the idle timeout passes. The line NEWMAIL is sent
+		before the termination octet if new mail arrived. The
+		listing of the session doesn't change, the client has to
+		start a new session to retrieve the new messages.
+
+	Possible Responses:
+		+OK idling
+		-ERR XIDLE is not supported
+
+	Examples:
+		C: XIDLE
+		S: +OK idling, send DONE to stop
+		S: NEWMAIL
+		S: .
+		  ...
+		C: XIDLE
+		S: +OK idling, send DONE to stop
+		C: DONE
+		S: .
+*/
+
+type XIdleCommand struct{}
+
+func (cmd XIdleCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_TRANSACTION {
+		return 0, ErrInvalidState
+	}
+	if len(args) > 0 {
+		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
+	}
+	notifier, ok := c.backend.(NewMailNotifier)
+	if !c.server.AllowIdle || !ok {
+		c.printer.Err("XIDLE is not supported")
+		return STATE_TRANSACTION, nil
+	}
+	newMail, stop := notifier.NewMail(c.user)
+	defer stop()
+	timeout := c.server.IdleTimeout
+	if timeout <= 0 {
+		timeout = c.server.sessionTimeout()
+	}
+	timer := c.server.clock().NewTimer(timeout)
+	defer timer.Stop()
+
+	c.printer.Ok("idling, send DONE to stop")
+	c.printer.Flush()
+	select {
+	case <-newMail:
+		c.printer.Line("NEWMAIL")
+	case result := <-c.inputs:
+		// anything but DONE is handled as the next command
+		if result.err != nil || !strings.EqualFold(strings.TrimSpace(result.line), "DONE") {
+			c.pending = &result
+		}
+	case <-timer.C():
+	case <-c.Context().Done():
+	}
+	c.printer.End()
+	return STATE_TRANSACTION, nil
+}
+
+/*
+XUNDELE msg
+
+	Arguments:
+		a message-number (required) which must refer to a message
+		marked as deleted
+
+	Restrictions:
+		may only be given in the TRANSACTION state, if supported by
+		the backend
+
+	Discussion:
+		Extension unmarking a single message marked as deleted,
+		leaving the other marks in place unlike RSET.
+
+	Possible Responses:
+		+OK message undeleted
+		-ERR no such message
+
+	Examples:
+		C: DELE 1
+		S: +OK Message 1 deleted
+		C: XUNDELE 1
+		S: +OK Message 1 undeleted
+*/
+
+type XUndeleCommand struct{}
+
+func (cmd XUndeleCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_TRANSACTION {
+		return 0, ErrInvalidState
+	}
+	c.listingChanged()
+	if len(args) == 0 {
+		c.printer.Err("Missing argument for XUNDELE command")
+		return 0, fmt.Errorf("Missing argument for XUNDELE called by user %s", c.user.Username())
+	}
+	msgId, err := strconv.Atoi(args[0])
+	if err != nil {
+		c.printer.Err("Invalid argument: %s", args[0])
+		return 0, fmt.Errorf("Invalid argument for XUNDELE given by user %s: %v", c.user.Username(), err)
+	}
+	ub, ok := c.backend.(UndeleBackend)
+	if !ok {
+		c.printer.Err("XUNDELE is not supported")
+		return STATE_TRANSACTION, nil
+	}
+	undeleted, err := ub.Undele(c.user, msgId)
+	if err != nil {
+		return 0, fmt.Errorf("Error calling 'XUNDELE %d' for user %s: %v", msgId, c.user.Username(), err)
+	}
+	if !undeleted {
+		c.printer.Err("No deleted message %d", msgId)
+		return STATE_TRANSACTION, nil
+	}
+	if c.deleCount > 0 {
+		c.deleCount--
+	}
+	c.printer.Ok("Message %d undeleted", msgId)
+	return STATE_TRANSACTION, nil
+}
+
+/*
+XPASSWD old new
+
+	Arguments:
+		the current password and the new password (both required)
+
+	Restrictions:
+		may only be given in the TRANSACTION state over TLS, if
+		enabled by the server
+
+	Discussion:
+		Extension changing the password of the logged in user, for
+		environments where users have no other way to rotate their
+		password. The session stays open.
+
+	Possible Responses:
+		+OK password changed
+		-ERR password not changed
+
+	Examples:
+		C: XPASSWD secret n3w-s3cret
+		S: +OK Password changed
+*/
+
+type XPasswdCommand struct{}
+
+func (cmd XPasswdCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_TRANSACTION {
+		return 0, ErrInvalidState
+	}
+	changer, ok := c.authorizator.(PasswordChanger)
+	if !ok || !c.server.AllowPasswordChange {
+		c.printer.Err("XPASSWD is not supported")
+		return STATE_TRANSACTION, nil
+	}
+	// sessions of master users and guests are read-only
+	if c.readOnly || c.master != "" {
+		c.printer.Err("XPASSWD is not allowed for this session")
+		return STATE_TRANSACTION, nil
+	}
+	if _, ok := c.conn.(*tls.Conn); !ok {
+		c.printer.Err("[AUTH] TLS is required to change the password")
+		return STATE_TRANSACTION, nil
+	}
+	if len(args) != 2 {
+		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
+	}
+	if err := changer.ChangePassword(c.conn, c.user, args[0], args[1]); err != nil {
+		c.authFailureDelay()
+		c.printer.Err("Password not changed: %v", err)
+		return STATE_TRANSACTION, nil
+	}
+	c.ErrorLog.Printf("Password of user %s changed", c.user.Username())
+	c.printer.Ok("Password changed")
+	return STATE_TRANSACTION, nil
+}
+
+// allowPasswordChange returns whether XPASSWD is available to the session.
+func (c *Client) allowPasswordChange() bool {
+	_, changer := c.authorizator.(PasswordChanger)
+	_, secure := c.conn.(*tls.Conn)
+	return changer && secure && c.server.AllowPasswordChange && !c.readOnly && c.master == ""
+}
+
+/*
+XNEWUIDL uid
+
+	Arguments:
+		the unique-id (required) of the last message seen by the
+		client
+
+	Restrictions:
+		may only be given in the TRANSACTION state
+
+	Discussion:
+		Extension listing the unique-id listing of the messages
+		following the given one in the maildrop, so clients polling
+		large maildrops only transfer the listing of new messages.
+		If the message is no longer in the maildrop, the server
+		issues a negative response and the client should fall back
+		to UIDL.
+
+	Possible Responses:
+		+OK unique-id listing follows
+		-ERR unknown unique-id
+
+	Examples:
+		C: XNEWUIDL QhdPYR:00WBw1Ph7x7
+		S: +OK 2 new messages
+		S: 3 QhdPYR:00WBw1Ph7x9
+		S: 4 QhdPYR:00WBw1Ph7xA
+		S: .
+*/
+
+type XNewUidlCommand struct{}
+
+func (cmd XNewUidlCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_TRANSACTION {
+		return 0, ErrInvalidState
+	}
+	if len(args) != 1 {
+		c.printer.Err("Missing argument for XNEWUIDL command")
+		return 0, fmt.Errorf("Invalid arguments count for XNEWUIDL called by user %s: %d", c.user.Username(), len(args))
+	}
+	messages, found, err := uidlAfter(c, args[0])
+	if err != nil {
+		return 0, fmt.Errorf("Error calling 'XNEWUIDL %s' for user %s: %v", args[0], c.user.Username(), err)
+	}
+	if !found {
+		c.printer.Err("Unknown unique-id %s", args[0])
+		return STATE_TRANSACTION, nil
+	}
+	c.printer.Ok("%d new messages", len(messages))
+	lines := make([]string, len(messages))
+	for i, info := range messages {
+		lines[i] = fmt.Sprintf("%d %s", info.MsgId, info.Uid)
+	}
+	c.printer.MultiLine(lines)
+	return STATE_TRANSACTION, nil
+}
+
+// uidlAfter returns the messages following the message with uid, from
+// the backend if it implements NewUidlBackend, otherwise from its listing.
+func uidlAfter(c *Client, uid string) ([]backends.MessageInfo, bool, error) {
+	if nb, ok := c.backend.(NewUidlBackend); ok {
+		return nb.UidlAfter(c.user, uid)
+	}
+	var messages []backends.MessageInfo
+	found := false
+	if iterBackend, ok := c.backend.(ListIterBackend); ok {
+		it, err := iterBackend.ListIter(c.user)
+		if err != nil {
+			return nil, false, err
+		}
+		defer it.Close()
+		for it.Next() {
+			if info := it.Message(); found {
+				messages = append(messages, info)
+			} else {
+				found = info.Uid == uid
+			}
+		}
+		return messages, found, it.Err()
+	}
+	uids, err := c.backend.Uidl(c.user)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, u := range uids {
+		if found {
+			messages = append(messages, backends.MessageInfo{MsgId: i + 1, Uid: u})
+		} else {
+			found = u == uid
+		}
+	}
+	return messages, found, nil
+}
@@ -1,12 +1,26 @@
 package popgun
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/faulty"
+	"github.com/kiwiz/popgun/backends/memory"
 )
 
 type cmdTestCase struct {
@@ -16,6 +30,10 @@ type cmdTestCase struct {
 	expectedState  int
 	expectedErr    bool
 	expectedOutput string
+	// optional, DummyBackend is used when nil
+	backend Backend
+	// optional, called on the client before the command is run
+	setup func(c *Client)
 }
 
 func commandTest(t *testing.T, tc cmdTestCase) {
@@ -24,14 +42,26 @@ func commandTest(t *testing.T, tc cmdTestCase) {
 
 	go func(t *testing.T) {
 		conn := &net.IPConn{}
-		backend := backends.DummyBackend{}
+		var backend Backend = backends.DummyBackend{}
+		if tc.backend != nil {
+			backend = tc.backend
+		}
 		authorizator := backends.DummyAuthorizator{}
-		insecure := true
-		client := newClient(conn, authorizator, backend, insecure)
+		server := NewServer(authorizator, backend)
+		server.AllowInsecureAuth = true
+		client := newClient(server, conn)
 		client.currentState = tc.initialState
+		if tc.initialState == STATE_TRANSACTION {
+			client.user = &backends.DummyUser{}
+		}
+		if tc.setup != nil {
+			tc.setup(client)
+		}
 
-		client.printer = NewPrinter(s)
+		client.out = NewPrinter(s)
+		client.printer = client.out
 		state, err := tc.cmd.Run(client, tc.args)
+		client.printer.Flush()
 		if state != tc.expectedState {
 			t.Errorf("Expected state '%d', but got '%d'", tc.expectedState, state)
 		}
@@ -57,6 +87,93 @@ func commandTest(t *testing.T, tc cmdTestCase) {
 	}
 }
 
+// responseRecorder is a ResponseWriter recording the responses of
+// commands.
+type responseRecorder struct {
+	responses []recordedResponse
+	streamErr error
+}
+
+type recordedResponse struct {
+	ok   bool
+	text string
+	// lines of a multi-line response, terminated unless aborted
+	lines      []string
+	terminated bool
+}
+
+func (r *responseRecorder) Ok(msg string, a ...interface{}) {
+	r.responses = append(r.responses, recordedResponse{ok: true, text: fmt.Sprintf(msg, a...)})
+}
+
+func (r *responseRecorder) Err(msg string, a ...interface{}) {
+	r.responses = append(r.responses, recordedResponse{text: fmt.Sprintf(msg, a...)})
+}
+
+func (r *responseRecorder) MultiLine(lines []string) {
+	for _, line := range lines {
+		r.Line(line)
+	}
+	r.End()
+}
+
+func (r *responseRecorder) Line(line string) {
+	last := &r.responses[len(r.responses)-1]
+	last.lines = append(last.lines, line)
+}
+
+func (r *responseRecorder) End() {
+	if r.streamErr == nil {
+		r.responses[len(r.responses)-1].terminated = true
+	}
+}
+
+func (r *responseRecorder) Abort(err error) {
+	r.streamErr = err
+}
+
+func (r *responseRecorder) StreamErr() error {
+	return r.streamErr
+}
+
+func (r *responseRecorder) Flush() error {
+	return nil
+}
+
+// recordCommand runs cmd in the TRANSACTION state of alice with the
+// memory backend and returns the recorded responses.
+func recordCommand(t *testing.T, backend *memory.Backend, cmd Executable, args ...string) []recordedResponse {
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	client := newClient(server, &net.IPConn{})
+	recorder := &responseRecorder{}
+	client.printer = recorder
+	client.currentState = STATE_TRANSACTION
+	client.user = testUser("alice")
+	if err := backend.Lock(client.user); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock(client.user)
+	if _, err := cmd.Run(client, args); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.responses
+}
+
+func TestUidlCommand_RunRecorded(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	backend.Deliver("alice", "b", "Subject: b\r\n\r\nbody\r\n")
+	responses := recordCommand(t, backend, UidlCommand{})
+	expected := []recordedResponse{{ok: true, text: "scan listing follows", lines: []string{"1 a", "2 b"}, terminated: true}}
+	if !reflect.DeepEqual(responses, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, responses)
+	}
+	responses = recordCommand(t, backend, UidlCommand{}, "3")
+	if len(responses) != 1 || responses[0].ok {
+		t.Errorf("Expected negative response for missing message, but got %+v", responses)
+	}
+}
+
 func TestQuitCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -73,7 +190,7 @@ func TestQuitCommand_Run(t *testing.T) {
 			args:           []string{},
 			expectedState:  STATE_UPDATE,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK Goodbye",
+			expectedOutput: "^\\+OK Goodbye \\(5 messages left\\)",
 		},
 	}
 
@@ -82,6 +199,26 @@ func TestQuitCommand_Run(t *testing.T) {
 	}
 }
 
+type partialUpdateBackend struct {
+	backends.DummyBackend
+}
+
+func (b partialUpdateBackend) Update(user backends.User) (backends.UpdateResult, error) {
+	return backends.UpdateResult{Removed: 1, FailedUids: []string{"3"}}, nil
+}
+
+func TestQuitCommand_RunPartialUpdate(t *testing.T) {
+	commandTest(t, cmdTestCase{
+		cmd:            QuitCommand{},
+		initialState:   STATE_TRANSACTION,
+		args:           []string{},
+		expectedState:  STATE_UPDATE,
+		expectedErr:    false,
+		expectedOutput: "^\\-ERR some deleted messages not removed",
+		backend:        partialUpdateBackend{},
+	})
+}
+
 func TestUserCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -140,6 +277,181 @@ func TestPassCommand_Run(t *testing.T) {
 	}
 }
 
+func TestPassCommand_RunUnhealthy(t *testing.T) {
+	commandTest(t, cmdTestCase{
+		cmd:            PassCommand{},
+		initialState:   STATE_AUTHORIZATION,
+		args:           []string{"secret"},
+		expectedState:  STATE_AUTHORIZATION,
+		expectedErr:    false,
+		expectedOutput: "^\\-ERR \\[SYS/TEMP\\]",
+		setup: func(c *Client) {
+			c.lastCommand = "USER"
+			c.server.health.Store(healthState{err: fmt.Errorf("database down")})
+		},
+	})
+}
+
+func TestUserCommand_RunCleartextRefused(t *testing.T) {
+	commandTest(t, cmdTestCase{
+		cmd:            UserCommand{},
+		initialState:   STATE_AUTHORIZATION,
+		args:           []string{"john"},
+		expectedState:  STATE_AUTHORIZATION,
+		expectedOutput: "^\\-ERR \\[AUTH\\]",
+		setup: func(c *Client) {
+			c.ErrorLog = log.New(ioutil.Discard, "", 0)
+			c.server.TLSConfig = &tls.Config{}
+			c.server.RefuseDowngrade = true
+		},
+	})
+}
+
+func TestCommands_RunFeatures(t *testing.T) {
+	features := func(f Features) func(c *Client) {
+		return func(c *Client) { c.features = f }
+	}
+	testCases := []cmdTestCase{
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1", "0"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\-ERR TOP is not allowed",
+			setup:          features(Features{AllowDele: true}),
+		},
+		{
+			cmd:            DeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\-ERR DELE is not allowed",
+			setup:          features(Features{AllowTop: true}),
+		},
+		{
+			cmd:            RetrCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\-ERR Message too large",
+			setup:          features(Features{MaxMessageSize: 5}),
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_TRANSACTION,
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\nXNEWUIDL\r\n\\.\r\n$",
+			setup:          features(Features{}),
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func TestConfigFeatures_Features(t *testing.T) {
+	f := ConfigFeatures{
+		Default: DefaultFeatures,
+		Domains: map[string]Features{"free.example": {AllowTop: true}},
+		Users:   map[string]Features{"vip@free.example": {AllowTop: true, AllowDele: true}},
+	}
+	tables := []struct {
+		username string
+		expected Features
+	}{
+		{"john", DefaultFeatures},
+		{"jane@Free.example", Features{AllowTop: true}},
+		{"vip@free.example", Features{AllowTop: true, AllowDele: true}},
+	}
+	for _, table := range tables {
+		features, _ := f.Features(nil, testUser(table.username))
+		if features != table.expected {
+			t.Errorf("Expected '%+v' for %s, but got '%+v'", table.expected, table.username, features)
+		}
+	}
+}
+
+type failingAuthorizator struct{}
+
+func (a failingAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	return nil, fmt.Errorf("bad password")
+}
+
+func TestPassCommand_RunFailureDelay(t *testing.T) {
+	start := time.Now()
+	commandTest(t, cmdTestCase{
+		cmd:            PassCommand{},
+		initialState:   STATE_AUTHORIZATION,
+		args:           []string{"secret"},
+		expectedState:  STATE_AUTHORIZATION,
+		expectedErr:    false,
+		expectedOutput: "^\\-ERR Invalid username or password",
+		setup: func(c *Client) {
+			c.lastCommand = "USER"
+			c.authorizator = failingAuthorizator{}
+			c.server.AuthFailureDelay = 50 * time.Millisecond
+		},
+	})
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected negative response delayed, but got it after %v", elapsed)
+	}
+}
+
+type lockoutPolicy struct {
+	locked   bool
+	failures []string
+}
+
+func (p *lockoutPolicy) Locked(conn net.Conn, username string) (bool, error) {
+	return p.locked, nil
+}
+
+func (p *lockoutPolicy) RecordFailure(conn net.Conn, username string) {
+	p.failures = append(p.failures, username)
+}
+
+func (p *lockoutPolicy) RecordSuccess(conn net.Conn, username string) {}
+
+func TestPassCommand_RunAccountPolicy(t *testing.T) {
+	policy := &lockoutPolicy{}
+	commandTest(t, cmdTestCase{
+		cmd:            PassCommand{},
+		initialState:   STATE_AUTHORIZATION,
+		args:           []string{"secret"},
+		expectedState:  STATE_AUTHORIZATION,
+		expectedOutput: "^\\-ERR Invalid username or password",
+		setup: func(c *Client) {
+			c.lastCommand = "USER"
+			c.username = "alice"
+			c.authorizator = failingAuthorizator{}
+			c.server.AccountPolicy = policy
+		},
+	})
+	if len(policy.failures) != 1 || policy.failures[0] != "alice" {
+		t.Errorf("Expected failure of alice recorded, but got '%v'", policy.failures)
+	}
+
+	policy.locked = true
+	commandTest(t, cmdTestCase{
+		cmd:            PassCommand{},
+		initialState:   STATE_AUTHORIZATION,
+		args:           []string{"secret"},
+		expectedState:  STATE_AUTHORIZATION,
+		expectedOutput: "^\\-ERR Invalid username or password: Account locked",
+		setup: func(c *Client) {
+			c.lastCommand = "USER"
+			c.server.AccountPolicy = policy
+		},
+	})
+}
+
 func TestStatCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -214,6 +526,126 @@ func TestListCommand_Run(t *testing.T) {
 	}
 }
 
+type iterBackend struct {
+	backends.DummyBackend
+}
+
+func (b iterBackend) ListIter(user backends.User) (MessageIterator, error) {
+	return backends.NewSliceIterator([]backends.MessageInfo{
+		{MsgId: 1, Octets: 120, Uid: "a"},
+		{MsgId: 2, Octets: 200, Uid: "b"},
+	}), nil
+}
+
+func TestListCommand_RunIter(t *testing.T) {
+	testCases := []cmdTestCase{
+		{
+			cmd:            ListCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK scan listing follows\r\n1 120\r\n2 200\r\n\\.\r\n$",
+			backend:        iterBackend{},
+		},
+		{
+			cmd:            UidlCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK scan listing follows\r\n1 a\r\n2 b\r\n\\.\r\n$",
+			backend:        iterBackend{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+// brokenIterator fails after the first message of the listing.
+type brokenIterator struct {
+	backends.MessageIterator
+}
+
+func (it brokenIterator) Next() bool {
+	if it.MessageIterator.Next() && it.Message().MsgId == 1 {
+		return true
+	}
+	return false
+}
+
+func (it brokenIterator) Err() error {
+	return faulty.ErrInjected
+}
+
+type brokenIterBackend struct {
+	backends.DummyBackend
+}
+
+func (b brokenIterBackend) ListIter(user backends.User) (MessageIterator, error) {
+	it, _ := iterBackend{}.ListIter(user)
+	return brokenIterator{it}, nil
+}
+
+// sessionCloseReason runs cmds after logging in to backend and returns the
+// reason the session was closed with.
+func sessionCloseReason(t *testing.T, backend Backend, cmds ...string) CloseReason {
+	reasons := make(chan CloseReason, 1)
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.Hooks.OnDisconnect = func(c *Client, reason CloseReason) {
+		reasons <- reason
+	}
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go ioutil.ReadAll(conn)
+	fmt.Fprintf(conn, "USER user\r\nPASS secret\r\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(conn, "%s\r\n", cmd)
+	}
+	select {
+	case reason := <-reasons:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the session to be closed")
+	}
+	return 0
+}
+
+func TestListCommand_RunIterError(t *testing.T) {
+	if reason := sessionCloseReason(t, brokenIterBackend{}, "LIST"); reason != CLOSE_BACKEND_ERROR {
+		t.Errorf("Expected close reason %s, but got %s", CLOSE_BACKEND_ERROR, reason)
+	}
+}
+
+// brokenBodyBackend serves a message whose body can't be read completely.
+type brokenBodyBackend struct {
+	backends.DummyBackend
+}
+
+func (b brokenBodyBackend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	return backends.NewLazyMessage("1", 100, func() (io.ReadCloser, error) {
+		content := strings.NewReader("Subject: broken\r\n\r\nfirst line\r\n")
+		return io.NopCloser(io.MultiReader(content, iotest.ErrReader(faulty.ErrInjected))), nil
+	}), nil
+}
+
+func TestRetrCommand_RunBodyError(t *testing.T) {
+	if reason := sessionCloseReason(t, brokenBodyBackend{}, "RETR 1"); reason != CLOSE_BACKEND_ERROR {
+		t.Errorf("Expected close reason %s, but got %s", CLOSE_BACKEND_ERROR, reason)
+	}
+}
+
 func TestRetrCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -255,6 +687,99 @@ func TestRetrCommand_Run(t *testing.T) {
 	}
 }
 
+func TestCommands_RunBackendFaults(t *testing.T) {
+	backend := faulty.New(backends.DummyBackend{})
+	backend.Inject(faulty.OP_LOCK, faulty.Fault{Err: faulty.ErrLocked})
+	backend.Inject(faulty.OP_RETR, faulty.Fault{Err: faulty.ErrInjected})
+	testCases := []cmdTestCase{
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "^\\-ERR Server was unable to lock maildrop\r\n$",
+			backend:        backend,
+			setup: func(c *Client) {
+				c.lastCommand = "USER"
+			},
+		},
+		{
+			cmd:           RetrCommand{},
+			initialState:  STATE_TRANSACTION,
+			args:          []string{"1"},
+			expectedState: 0,
+			expectedErr:   true,
+			backend:       backend,
+		},
+	}
+	for _, tc := range testCases {
+		commandTest(t, tc)
+	}
+}
+
+func TestRetrCommand_RunLimit(t *testing.T) {
+	commandTest(t, cmdTestCase{
+		cmd:            RetrCommand{},
+		initialState:   STATE_TRANSACTION,
+		args:           []string{"1"},
+		expectedState:  STATE_TRANSACTION,
+		expectedErr:    false,
+		expectedOutput: "^\\-ERR Too many messages retrieved",
+		setup: func(c *Client) {
+			c.server.MaxRetrievedMessages = 1
+			c.retrCount = 1
+		},
+	})
+}
+
+func TestRetrCommand_RunMemoryLimit(t *testing.T) {
+	commandTest(t, cmdTestCase{
+		cmd:            RetrCommand{},
+		initialState:   STATE_TRANSACTION,
+		args:           []string{"1"},
+		expectedState:  STATE_TRANSACTION,
+		expectedErr:    false,
+		expectedOutput: "^\\-ERR \\[SYS/TEMP\\] Session memory limit exceeded",
+		setup:          func(c *Client) { c.server.MaxSessionMemory = 10 },
+	})
+}
+
+type messageBackend struct {
+	backends.DummyBackend
+}
+
+func (b messageBackend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	return backends.NewStringMessage("1", "Subject: hi\nFrom: a@example.com\n\nline 1\n.line 2\nline 3\n"), nil
+}
+
+func TestRetrCommand_RunMessage(t *testing.T) {
+	testCases := []cmdTestCase{
+		{
+			cmd:            RetrCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK 61 octets\r\nSubject: hi\r\nFrom: a@example.com\r\n\r\nline 1\r\n\\.\\.line 2\r\nline 3\r\n\\.\r\n$",
+			backend:        messageBackend{},
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1", "1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nSubject: hi\r\nFrom: a@example.com\r\n\r\nline 1\r\n\\.\r\n$",
+			backend:        messageBackend{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
 func TestDeleCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -403,7 +928,15 @@ func TestCapaCommand_Run(t *testing.T) {
 			args:           []string{},
 			expectedState:  STATE_TRANSACTION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\nTOP\r\n\\.",
+			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\nTOP\r\nXNEWUIDL\r\n\\.",
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\nSASL PLAIN\r\nTOP\r\nXNEWUIDL\r\n\\.",
 		},
 		{
 			cmd:            CapaCommand{},
@@ -411,7 +944,8 @@ func TestCapaCommand_Run(t *testing.T) {
 			args:           []string{},
 			expectedState:  STATE_AUTHORIZATION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\nTOP\r\n\\.",
+			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\nSASL PLAIN\r\nTOP\r\nXNEWUIDL\r\nIMPLEMENTATION POPgun mail.example.com\r\n\\.",
+			setup:          func(c *Client) { c.hostname = "mail.example.com" },
 		},
 	}
 
@@ -419,3 +953,437 @@ func TestCapaCommand_Run(t *testing.T) {
 		commandTest(t, testCase)
 	}
 }
+
+func TestXUndeleCommand_Run(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("user", "a", "Subject: one\n\nbody\n")
+	backend.Deliver("user", "b", "Subject: two\n\nbody\n")
+	backend.Lock(backends.DummyUser{})
+	backend.Dele(backends.DummyUser{}, 1)
+	testCases := []cmdTestCase{
+		{
+			cmd:            XUndeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\-ERR XUNDELE is not supported\r\n$",
+		},
+		{
+			cmd:            XUndeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"2"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\-ERR No deleted message 2\r\n$",
+			backend:        backend,
+		},
+		{
+			cmd:            XUndeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\+OK Message 1 undeleted\r\n$",
+			backend:        backend,
+		},
+		{
+			cmd:            XUndeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"x"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "^\\-ERR Invalid argument: x\r\n$",
+			backend:        backend,
+		},
+		{
+			cmd:           XUndeleCommand{},
+			initialState:  STATE_AUTHORIZATION,
+			args:          []string{"1"},
+			expectedState: 0,
+			expectedErr:   true,
+			backend:       backend,
+		},
+	}
+	for _, tc := range testCases {
+		commandTest(t, tc)
+	}
+	if messages, _, _ := backend.Stat(backends.DummyUser{}); messages != 2 {
+		t.Errorf("Expected 2 messages after XUNDELE, but got %d", messages)
+	}
+}
+
+func TestXNewUidlCommand_Run(t *testing.T) {
+	backend := memory.New()
+	for _, uid := range []string{"a", "b", "c", "d"} {
+		backend.Deliver("user", uid, "Subject: "+uid+"\n\nbody\n")
+	}
+	backend.Lock(backends.DummyUser{})
+	backend.Dele(backends.DummyUser{}, 3)
+	// the listing of backends without NewUidlBackend is filtered
+	listed := struct{ Backend }{backend}
+	testCases := []cmdTestCase{
+		{
+			cmd:            XNewUidlCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"b"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\+OK 1 new messages\r\n4 d\r\n\\.\r\n$",
+			backend:        backend,
+		},
+		{
+			cmd:            XNewUidlCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"b"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\+OK 2 new messages\r\n3 c\r\n4 d\r\n\\.\r\n$",
+			backend:        listed,
+		},
+		{
+			cmd:            XNewUidlCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"d"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\+OK 0 new messages\r\n\\.\r\n$",
+			backend:        backend,
+		},
+		{
+			cmd:            XNewUidlCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"x"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\-ERR Unknown unique-id x\r\n$",
+			backend:        listed,
+		},
+		{
+			cmd:           XNewUidlCommand{},
+			initialState:  STATE_AUTHORIZATION,
+			args:          []string{"a"},
+			expectedState: 0,
+			expectedErr:   true,
+			backend:       backend,
+		},
+	}
+	for _, tc := range testCases {
+		commandTest(t, tc)
+	}
+}
+
+// passwordAuthorizator keeps passwords in memory and lets users change
+// them.
+type passwordAuthorizator struct {
+	mu        sync.Mutex
+	passwords map[string]string
+}
+
+func (a *passwordAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passwords[username] != password {
+		return nil, fmt.Errorf("Wrong password")
+	}
+	return testUser(username), nil
+}
+
+func (a *passwordAuthorizator) ChangePassword(conn net.Conn, user backends.User, oldPassword, newPassword string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passwords[user.Username()] != oldPassword {
+		return fmt.Errorf("Wrong password")
+	}
+	a.passwords[user.Username()] = newPassword
+	return nil
+}
+
+func TestXPasswdCommand_Run(t *testing.T) {
+	cert := newTestCert(t)
+	auth := &passwordAuthorizator{passwords: map[string]string{"alice": "secret"}}
+	plain, secure := newPipeListener(), newPipeListener()
+	server := NewServer(auth, memory.New())
+	server.AllowInsecureAuth = true
+	server.AllowPasswordChange = true
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(plain)
+	go server.ServeTLS(secure)
+
+	session := func(conn net.Conn, commands string) []string {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "USER alice\r\n%sQUIT\r\n", commands)
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+			if strings.HasPrefix(line, "+OK Goodbye") {
+				return lines
+			}
+		}
+	}
+
+	conn, _ := plain.Dial()
+	lines := session(conn, "PASS secret\r\nXPASSWD secret changed\r\n")
+	if lines[3] != "-ERR [AUTH] TLS is required to change the password" {
+		t.Errorf("Expected XPASSWD to require TLS, but got %q", lines[3])
+	}
+
+	conn, _ = secure.Dial()
+	lines = session(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), "PASS secret\r\nCAPA\r\nXPASSWD wrong changed\r\nXPASSWD secret changed\r\n")
+	if !strings.Contains(strings.Join(lines, "\n"), "\nXPASSWD\n") {
+		t.Errorf("Expected XPASSWD advertised over TLS, but got %q", lines)
+	}
+	n := len(lines)
+	if lines[n-3] != "-ERR Password not changed: Wrong password" || lines[n-2] != "+OK Password changed" {
+		t.Errorf("Unexpected responses %q", lines[n-3:n-1])
+	}
+	if auth.passwords["alice"] != "changed" {
+		t.Errorf("Expected password changed, but got %q", auth.passwords["alice"])
+	}
+}
+
+// masterPasswordAuthorizator is a passwordAuthorizator which lets the
+// master user admin open any maildrop.
+type masterPasswordAuthorizator struct {
+	*passwordAuthorizator
+}
+
+func (a masterPasswordAuthorizator) AuthorizeMaster(conn net.Conn, username, master, password string) (backends.User, error) {
+	if master != "admin" || password != "admin-secret" {
+		return nil, fmt.Errorf("Not a master user")
+	}
+	return testUser(username), nil
+}
+
+func TestXPasswdCommand_RunMaster(t *testing.T) {
+	cert := newTestCert(t)
+	auth := &passwordAuthorizator{passwords: map[string]string{"alice": "secret"}}
+	listener := newPipeListener()
+	server := NewServer(masterPasswordAuthorizator{auth}, memory.New())
+	server.AllowPasswordChange = true
+	server.MasterUserSeparator = "*"
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.ServeTLS(listener)
+
+	conn, _ := listener.Dial()
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	reader := bufio.NewReader(tlsConn)
+	fmt.Fprintf(tlsConn, "USER alice*admin\r\nPASS admin-secret\r\nCAPA\r\nXPASSWD secret changed\r\nQUIT\r\n")
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+		if strings.HasPrefix(line, "+OK Goodbye") {
+			break
+		}
+	}
+
+	if strings.Contains(strings.Join(lines, "\n"), "\nXPASSWD\n") {
+		t.Errorf("Expected XPASSWD not advertised to master sessions, but got %q", lines)
+	}
+	if n := len(lines); lines[n-2] != "-ERR XPASSWD is not allowed for this session" {
+		t.Errorf("Expected XPASSWD refused, but got %q", lines[n-2])
+	}
+	if auth.passwords["alice"] != "secret" {
+		t.Errorf("Expected password unchanged, but got %q", auth.passwords["alice"])
+	}
+}
+
+// masterAuthorizator lets the master user admin open any maildrop.
+type masterAuthorizator struct {
+	userAuthorizator
+}
+
+func (a masterAuthorizator) AuthorizeMaster(conn net.Conn, username, master, password string) (backends.User, error) {
+	if master != "admin" || password != "admin-secret" {
+		return nil, fmt.Errorf("Not a master user")
+	}
+	return testUser(username), nil
+}
+
+func TestPassCommand_masterLogin(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	var audit bytes.Buffer
+	listener := newPipeListener()
+	server := NewServer(masterAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.MasterUserSeparator = "*"
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(&syncWriter{w: &audit}, "", 0)
+	go server.Serve(listener)
+
+	session := func(commands string) []string {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "%sQUIT\r\n", commands)
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+			if strings.HasPrefix(line, "+OK Goodbye") {
+				return lines
+			}
+		}
+	}
+
+	lines := session("USER alice*bob\r\nPASS admin-secret\r\n")
+	if !strings.HasPrefix(lines[2], "-ERR Invalid username or password") {
+		t.Errorf("Expected login of non-master user to fail, but got %q", lines[2])
+	}
+	lines = session("USER alice*admin\r\nPASS admin-secret\r\nDELE 1\r\nRETR 1\r\n")
+	if lines[2] != "+OK User Successfully Logged on" || lines[3] != "-ERR DELE is not allowed for this account" {
+		t.Errorf("Expected read-only master session, but got %q", lines)
+	}
+	// nothing was removed by the master session
+	lines = session("USER alice\r\nPASS secret\r\nSTAT\r\n")
+	if lines[3] != "+OK 1 20" {
+		t.Errorf("Expected maildrop unchanged, but got %q", lines[3])
+	}
+	logged := audit.String()
+	if !strings.Contains(logged, "Master user bob failed to log in as alice from pipe") || !strings.Contains(logged, "Master user admin logged in as alice from pipe") {
+		t.Errorf("Expected master logins to be logged, but got %q", logged)
+	}
+}
+
+// bannerBackend summarizes maildrops with a fixed banner.
+type bannerBackend struct {
+	*memory.Backend
+	banner string
+}
+
+func (b bannerBackend) Banner(user backends.User) (string, error) {
+	return b.banner, nil
+}
+
+func TestPassCommand_banner(t *testing.T) {
+	tables := map[string]string{
+		"2 messages (40 octets), 1 new since last login": "+OK 2 messages (40 octets), 1 new since last login\r\n",
+		"two\r\nlines":           "+OK two  lines\r\n",
+		"":                       "+OK User Successfully Logged on\r\n",
+		strings.Repeat("x", 300): "+OK " + strings.Repeat("x", 200) + "\r\n",
+	}
+	for banner, expected := range tables {
+		listener := newPipeListener()
+		server := NewServer(userAuthorizator{}, bannerBackend{Backend: memory.New(), banner: banner})
+		server.AllowInsecureAuth = true
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\n")
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		if line, _ := reader.ReadString('\n'); line != expected {
+			t.Errorf("Expected %q for banner %q, but got %q", expected, banner, line)
+		}
+		conn.Close()
+	}
+}
+
+// noticeAuthorizator has a notice for alice.
+type noticeAuthorizator struct {
+	userAuthorizator
+}
+
+func (noticeAuthorizator) LoginNotice(user backends.User) (string, error) {
+	if user.Username() != "alice" {
+		return "", nil
+	}
+	return "Kontingent zu 80% voll", nil
+}
+
+// noticeBackend has a notice for every user.
+type noticeBackend struct {
+	*memory.Backend
+	notice string
+}
+
+func (b noticeBackend) LoginNotice(user backends.User) (string, error) {
+	return b.notice, nil
+}
+
+func TestPassCommand_loginNotice(t *testing.T) {
+	tables := []struct {
+		username, notice string
+		expected         string
+	}{
+		{"alice", "", "+OK User Successfully Logged on (Kontingent zu 80% voll)\r\n"},
+		{"alice", "maintenance at 02:00", "+OK User Successfully Logged on (Kontingent zu 80% voll; maintenance at 02:00)\r\n"},
+		{"bob", strings.Repeat("x", 150), "+OK User Successfully Logged on (" + strings.Repeat("x", 100) + ")\r\n"},
+		{"bob", "", "+OK User Successfully Logged on\r\n"},
+	}
+	for _, table := range tables {
+		listener := newPipeListener()
+		server := NewServer(noticeAuthorizator{}, noticeBackend{Backend: memory.New(), notice: table.notice})
+		server.AllowInsecureAuth = true
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "USER %s\r\nPASS secret\r\n", table.username)
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		if line, _ := reader.ReadString('\n'); line != table.expected {
+			t.Errorf("Expected %q for %s, but got %q", table.expected, table.username, line)
+		}
+		conn.Close()
+	}
+}
+
+// countCommand answers with the number of messages in the maildrop.
+type countCommand struct{}
+
+func (countCommand) Run(c *Client, args []string) (int, error) {
+	if c.State() != STATE_TRANSACTION {
+		return c.State(), ErrInvalidState
+	}
+	messages, _, err := c.Backend().Stat(c.User())
+	if err != nil {
+		return c.State(), err
+	}
+	c.Response().Ok("%d messages of %s", messages, c.User().Username())
+	return c.State(), nil
+}
+
+func TestServer_Commands(t *testing.T) {
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.AllowInsecureAuth = true
+	server.Commands = map[string]Executable{"xcount": countCommand{}}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER john\r\nPASS secret\r\nXCOUNT\r\n")
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+	if line, _ := reader.ReadString('\n'); line != "+OK 5 messages of user\r\n" {
+		t.Errorf("Expected response of the added command, but got %q", line)
+	}
+}
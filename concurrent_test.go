@@ -0,0 +1,204 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// userAuthorizator accepts any password, authenticating the given user.
+type userAuthorizator struct{}
+
+func (a userAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	return testUser(username), nil
+}
+
+// countingMetrics counts Inc calls and collects observations by name and
+// labels.
+type countingMetrics struct {
+	mu           sync.Mutex
+	counts       map[string]int
+	observations map[string][]float64
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{counts: make(map[string]int), observations: make(map[string][]float64)}
+}
+
+func (m *countingMetrics) Inc(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[strings.Join(append([]string{name}, labels...), ":")]++
+}
+
+func (m *countingMetrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.Join(append([]string{name}, labels...), ":")
+	m.observations[key] = append(m.observations[key], value)
+}
+
+func (m *countingMetrics) Set(name string, value float64, labels ...string) {}
+
+func (m *countingMetrics) count(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[key]
+}
+
+func (m *countingMetrics) observed(key string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64(nil), m.observations[key]...)
+}
+
+// stressSession logs in as username, retrieves and deletes the first
+// message and quits. It returns whether the maildrop could be locked.
+func stressSession(listener *pipeListener, username string) (bool, error) {
+	conn, err := listener.Dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command := func(cmd string, multiLine bool) (string, error) {
+		if cmd != "" {
+			if _, err := fmt.Fprintf(conn, "%s\r\n", cmd); err != nil {
+				return "", err
+			}
+		}
+		status, err := reader.ReadString('\n')
+		if err != nil || !multiLine || !strings.HasPrefix(status, "+OK") {
+			return status, err
+		}
+		for line := ""; line != ".\r\n"; {
+			if line, err = reader.ReadString('\n'); err != nil {
+				return status, err
+			}
+		}
+		return status, nil
+	}
+
+	if _, err := command("", false); err != nil {
+		return false, err
+	}
+	command("USER "+username, false)
+	status, err := command("PASS secret", false)
+	if err != nil {
+		return false, err
+	}
+	locked := strings.HasPrefix(status, "+OK")
+	if locked {
+		for _, cmd := range []string{"STAT", "LIST", "UIDL", "RETR 1", "DELE 1"} {
+			status, err := command(cmd, multiLine(cmd))
+			if err != nil {
+				return locked, err
+			}
+			if !strings.HasPrefix(status, "+OK") {
+				return locked, fmt.Errorf("Unexpected response to %s: %q", cmd, status)
+			}
+		}
+	}
+	if _, err := command("QUIT", false); err != nil {
+		return locked, err
+	}
+	return locked, nil
+}
+
+func TestServer_ConcurrentSessions(t *testing.T) {
+	const (
+		users    = 20
+		messages = 20
+		sessions = 200
+	)
+	backend := memory.New()
+	for u := 0; u < users; u++ {
+		for m := 0; m < messages; m++ {
+			backend.Deliver(fmt.Sprintf("user%d", u), fmt.Sprintf("%d", m), fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", m))
+		}
+	}
+	metrics := newCountingMetrics()
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	// the registry is read by the admin endpoint while sessions come and go
+	stop := make(chan struct{})
+	var pollers sync.WaitGroup
+	pollers.Add(1)
+	go func() {
+		defer pollers.Done()
+		handler := server.AdminHandler()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+			for _, c := range server.Sessions() {
+				c.SetTrace(false)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	lockedSessions := 0
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			locked, err := stressSession(listener, fmt.Sprintf("user%d", i%users))
+			if err != nil {
+				t.Errorf("Session %d: %v", i, err)
+			}
+			if locked {
+				mu.Lock()
+				lockedSessions++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	pollers.Wait()
+
+	// sessions are deregistered after the client sees the connection close
+	for i := 0; i < 1000 && len(server.Sessions()) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if live := len(server.Sessions()); live != 0 {
+		t.Errorf("Expected no live sessions, but got %d", live)
+	}
+	if closed := metrics.count("session.closed:quit"); closed != sessions {
+		t.Errorf("Expected %d sessions closed on QUIT, but got %d", sessions, closed)
+	}
+	// every session which locked its maildrop deleted exactly one message
+	remaining := 0
+	for u := 0; u < users; u++ {
+		remaining += len(backend.Messages(fmt.Sprintf("user%d", u)))
+	}
+	if remaining != users*messages-lockedSessions {
+		t.Errorf("Expected %d messages left, but got %d", users*messages-lockedSessions, remaining)
+	}
+	if lockedSessions == 0 {
+		t.Error("Expected some sessions to lock their maildrop")
+	}
+}
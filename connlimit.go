@@ -0,0 +1,68 @@
+package popgun
+
+// responses of connections refused by admit, by metric label
+var connectionRefusals = map[string]string{
+	"max_connections":        "[SYS/TEMP] too many connections",
+	"max_connections_per_ip": "[SYS/TEMP] too many connections from your address",
+}
+
+// admit counts c against MaxConnections and MaxConnectionsPerIP, or flags
+// it to be refused if a limit is reached. It must be called with s.mu held.
+func (s *Server) admit(c *Client) {
+	ip := remoteIP(c.conn)
+	switch {
+	case s.MaxConnections > 0 && s.connections >= s.MaxConnections:
+		c.overLimit = "max_connections"
+		return
+	case s.MaxConnectionsPerIP > 0 && s.ipConnections[ip] >= s.MaxConnectionsPerIP:
+		c.overLimit = "max_connections_per_ip"
+		return
+	}
+	s.connections++
+	s.ipConnections[ip]++
+	c.admitted = true
+}
+
+// releaseSlot frees the connection slot of c and wakes up listeners waiting
+// for one. It must be called with s.mu held.
+func (s *Server) releaseSlot(c *Client) {
+	if !c.admitted {
+		return
+	}
+	c.admitted = false
+	s.connections--
+	ip := remoteIP(c.conn)
+	if s.ipConnections[ip]--; s.ipConnections[ip] <= 0 {
+		delete(s.ipConnections, ip)
+	}
+	if s.slotFreed != nil {
+		close(s.slotFreed)
+		s.slotFreed = nil
+	}
+}
+
+// waitForSlot blocks while MaxConnections sessions are live and
+// PauseAcceptWhenFull is set. It returns false after Shutdown.
+func (s *Server) waitForSlot() bool {
+	for {
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			return false
+		}
+		if !s.PauseAcceptWhenFull || s.MaxConnections <= 0 || s.connections < s.MaxConnections {
+			s.mu.Unlock()
+			return true
+		}
+		if s.slotFreed == nil {
+			s.slotFreed = make(chan struct{})
+		}
+		freed := s.slotFreed
+		s.mu.Unlock()
+		select {
+		case <-freed:
+		case <-s.done:
+			return false
+		}
+	}
+}
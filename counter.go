@@ -0,0 +1,185 @@
+package popgun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ETCD_TXN_ATTEMPTS limits the transactions of EtcdUidCounter.Next
+// conflicting with allocations of other servers.
+const ETCD_TXN_ATTEMPTS = 10
+
+// RedisUidCounter is a backends.UidCounter keeping the counters in Redis,
+// incremented with INCRBY. Numbers are only monotonic across restarts of
+// Redis if it persists every write, i.e. with appendfsync always.
+type RedisUidCounter struct {
+	// address of the Redis server, e.g. "localhost:6379"
+	Addr     string
+	Password string
+	// prefix of the keys, "popgun:uid:" by default
+	Prefix string
+	// timeout of a single request, 1s by default
+	Timeout time.Duration
+	// Dialer, if set, connects to Redis instead of a net.Dialer
+	Dialer Dialer
+
+	redis redisConn
+}
+
+func (c *RedisUidCounter) Next(ctx context.Context, username string, n int) (uint64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("Invalid number of UIDs: %d", n)
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "popgun:uid:"
+	}
+	opts := redisOptions{Addr: c.Addr, Password: c.Password, Timeout: c.Timeout, Dialer: c.Dialer}
+	reply, err := c.redis.command(ctx, opts, "INCRBY", prefix+username, strconv.Itoa(n))
+	if err != nil {
+		return 0, err
+	}
+	last, err := strconv.ParseUint(reply, 10, 64)
+	if err != nil || last < uint64(n) {
+		return 0, fmt.Errorf("Invalid UID counter of %s: %q", username, reply)
+	}
+	return last - uint64(n) + 1, nil
+}
+
+// EtcdUidCounter is a backends.UidCounter keeping the counters in etcd,
+// incremented with compare-and-swap transactions through the JSON gateway
+// of etcd v3. Unlike Redis, etcd doesn't lose acknowledged writes when a
+// member fails.
+type EtcdUidCounter struct {
+	// URL of an etcd member, e.g. "https://etcd1:2379"
+	Endpoint string
+	// prefix of the keys, "popgun/uid/" by default
+	Prefix string
+	// Client, if set, replaces http.DefaultClient, e.g. for client
+	// certificates
+	Client *http.Client
+	// Header is added to every request, e.g. the Authorization token of
+	// an etcd user
+	Header http.Header
+	// timeout of a single request, 1s by default
+	Timeout time.Duration
+}
+
+// etcdKeyValue is a key of the etcd v3 JSON API. Keys and values are
+// base64 encoded and revisions are strings.
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision,omitempty"`
+}
+
+// etcdCompare is the condition of a transaction, with one of the
+// revisions set according to Target.
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	ModRevision    string `json:"mod_revision,omitempty"`
+	CreateRevision string `json:"create_revision,omitempty"`
+}
+
+type etcdRequestOp struct {
+	RequestPut etcdKeyValue `json:"request_put"`
+}
+
+func (c *EtcdUidCounter) Next(ctx context.Context, username string, n int) (uint64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("Invalid number of UIDs: %d", n)
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "popgun/uid/"
+	}
+	key := []byte(prefix + username)
+	for attempt := 0; attempt < ETCD_TXN_ATTEMPTS; attempt++ {
+		var ranged struct {
+			Kvs []etcdKeyValue `json:"kvs"`
+		}
+		if err := c.call(ctx, "/v3/kv/range", map[string][]byte{"key": key}, &ranged); err != nil {
+			return 0, err
+		}
+		var last uint64
+		// an absent key was never created
+		compare := etcdCompare{Key: key, Result: "EQUAL", Target: "CREATE", CreateRevision: "0"}
+		if len(ranged.Kvs) > 0 {
+			value := string(ranged.Kvs[0].Value)
+			var err error
+			if last, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return 0, fmt.Errorf("Invalid UID counter of %s: %q", username, value)
+			}
+			compare = etcdCompare{Key: key, Result: "EQUAL", Target: "MOD", ModRevision: ranged.Kvs[0].ModRevision}
+		}
+		next := last + uint64(n)
+		txn := struct {
+			Compare []etcdCompare   `json:"compare"`
+			Success []etcdRequestOp `json:"success"`
+		}{
+			Compare: []etcdCompare{compare},
+			Success: []etcdRequestOp{{etcdKeyValue{Key: key, Value: []byte(strconv.FormatUint(next, 10))}}},
+		}
+		var result struct {
+			Succeeded bool `json:"succeeded"`
+		}
+		if err := c.call(ctx, "/v3/kv/txn", txn, &result); err != nil {
+			return 0, err
+		}
+		if result.Succeeded {
+			return last + 1, nil
+		}
+		// another server allocated numbers in between
+	}
+	return 0, fmt.Errorf("Conflicting UID allocations for %s, giving up after %d attempts", username, ETCD_TXN_ATTEMPTS)
+}
+
+// call posts request to path of the JSON gateway and decodes the response
+// into response.
+func (c *EtcdUidCounter) call(ctx context.Context, path string, request, response interface{}) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error connecting to etcd: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Error from etcd: %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("Invalid etcd response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package popgun
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+func TestRedisUidCounter(t *testing.T) {
+	counter := &RedisUidCounter{Addr: fakeRedis(t)}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		username string
+		n        int
+		first    uint64
+	}{
+		{"alice", 1, 1},
+		{"alice", 3, 2},
+		{"bob", 1, 1},
+		{"alice", 1, 5},
+	} {
+		first, err := counter.Next(ctx, tc.username, tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != tc.first {
+			t.Errorf("Expected %d for %d UIDs of %s, but got %d", tc.first, tc.n, tc.username, first)
+		}
+	}
+}
+
+// fakeEtcd serves the range and txn calls of the etcd v3 JSON gateway used
+// by EtcdUidCounter. Every txn first fails if conflict is set.
+func fakeEtcd(t *testing.T, conflict bool) string {
+	var mu sync.Mutex
+	values := make(map[string][]byte)
+	revisions := make(map[string]int64)
+	var revision int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var req struct {
+				Key []byte `json:"key"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp struct {
+				Kvs []etcdKeyValue `json:"kvs,omitempty"`
+			}
+			if value, ok := values[string(req.Key)]; ok {
+				resp.Kvs = append(resp.Kvs, etcdKeyValue{Key: req.Key, Value: value, ModRevision: strconv.FormatInt(revisions[string(req.Key)], 10)})
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v3/kv/txn":
+			var req struct {
+				Compare []etcdCompare   `json:"compare"`
+				Success []etcdRequestOp `json:"success"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			compare := req.Compare[0]
+			key := string(compare.Key)
+			_, exists := values[key]
+			succeeded := !conflict
+			switch compare.Target {
+			case "CREATE":
+				succeeded = succeeded && !exists && compare.CreateRevision == "0"
+			case "MOD":
+				succeeded = succeeded && exists && compare.ModRevision == strconv.FormatInt(revisions[key], 10)
+			default:
+				http.Error(w, "unknown target", http.StatusBadRequest)
+				return
+			}
+			conflict = false
+			if succeeded {
+				revision++
+				put := req.Success[0].RequestPut
+				values[string(put.Key)] = put.Value
+				revisions[string(put.Key)] = revision
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"succeeded": succeeded})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestEtcdUidCounter(t *testing.T) {
+	endpoint := fakeEtcd(t, true)
+	ctx := context.Background()
+	// two servers allocating concurrently never get the same numbers
+	counters := []backends.UidCounter{&EtcdUidCounter{Endpoint: endpoint}, &EtcdUidCounter{Endpoint: endpoint}}
+	var mu sync.Mutex
+	allocated := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(counter backends.UidCounter) {
+			defer wg.Done()
+			first, err := counter.Next(ctx, "alice", 2)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for uid := first; uid < first+2; uid++ {
+				if allocated[uid] {
+					t.Errorf("Expected UID %d allocated once", uid)
+				}
+				allocated[uid] = true
+			}
+		}(counters[i%2])
+	}
+	wg.Wait()
+	for uid := uint64(1); uid <= 16; uid++ {
+		if !allocated[uid] {
+			t.Errorf("Expected UID %d allocated, but got %v", uid, allocated)
+		}
+	}
+	if first, err := counters[0].Next(ctx, "bob", 1); err != nil || first != 1 {
+		t.Errorf("Expected first UID of bob, but got %d, %v", first, err)
+	}
+}
@@ -0,0 +1,63 @@
+package popgun
+
+import (
+	"crypto/tls"
+)
+
+// Downgrade patterns reported by the downgrade detector.
+const (
+	// the client sent commands before the greeting, see Server.PregreetDelay
+	DOWNGRADE_PREGREET = "pregreet"
+	// the client authenticates in cleartext although the server offers TLS
+	DOWNGRADE_CLEARTEXT_AUTH = "cleartext_auth"
+)
+
+// downgrade reports a client behaving like a downgrade attack or a client
+// talking to the server through one, e.g. a man in the middle stripping
+// TLS. It is logged and counted as "security.downgrade". It returns true
+// if the client must be refused, see Server.RefuseDowngrade.
+func (c *Client) downgrade(pattern string) bool {
+	c.ErrorLog.Printf("Possible protocol downgrade (%s) by %s", pattern, c.RemoteAddr())
+	c.server.Metrics.Inc("security.downgrade", pattern)
+	return c.server.RefuseDowngrade
+}
+
+// checkCleartextAuth is called when a client starts authentication. It
+// returns false if the client must be refused.
+func (c *Client) checkCleartextAuth() bool {
+	if _, ok := c.conn.(*tls.Conn); ok {
+		return true
+	}
+	if c.requireTLS {
+		return false
+	}
+	if c.server == nil || c.server.TLSConfig == nil {
+		return true
+	}
+	return !c.downgrade(DOWNGRADE_CLEARTEXT_AUTH)
+}
+
+// awaitPregreet waits PregreetDelay before the greeting. Legitimate clients
+// wait for it, so input arriving meanwhile is reported. The input is
+// returned to be executed after the greeting, unless the client is refused.
+func (c *Client) awaitPregreet(inputs <-chan readResult) (pending *readResult, refuse bool) {
+	delay := c.server.PregreetDelay
+	if delay <= 0 {
+		return nil, false
+	}
+	timer := c.server.clock().NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case result := <-inputs:
+		if result.err != nil {
+			return &result, false
+		}
+		c.violation(c.earlyViolation(result.line))
+		if c.downgrade(DOWNGRADE_PREGREET) {
+			return nil, true
+		}
+		return &result, false
+	case <-timer.C():
+		return nil, false
+	}
+}
@@ -0,0 +1,266 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of exported events.
+const (
+	EVENT_LOGIN          = "login"
+	EVENT_LOGIN_FAILED   = "login_failed"
+	EVENT_UPDATE         = "update"
+	EVENT_UPDATE_FAILED  = "update_failed"
+	EVENT_SESSION_CLOSED = "session_closed"
+	EVENT_RECOVERED      = "recovered"
+)
+
+// Event describes something that happened in a session, see EventExporter.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Session uint64    `json:"session"`
+	Remote  string    `json:"remote"`
+	User    string    `json:"user,omitempty"`
+	// Actor is the identity acting on behalf of User, i.e. the master
+	// user of the session or the admin recovering a message
+	Actor string `json:"actor,omitempty"`
+	// close reason of EVENT_SESSION_CLOSED, and the admin who kicked the
+	// session
+	CloseReason string `json:"close_reason,omitempty"`
+	KickedBy    string `json:"kicked_by,omitempty"`
+	// uid of EVENT_RECOVERED
+	Uid string `json:"uid,omitempty"`
+	// result of EVENT_UPDATE and EVENT_UPDATE_FAILED
+	Removed    int      `json:"removed,omitempty"`
+	FailedUids []string `json:"failed_uids,omitempty"`
+}
+
+// Producer publishes messages to a streaming platform, e.g. Kafka or NATS.
+// NATSProducer is bundled, Kafka clients are easily adapted.
+type Producer interface {
+	// Publish sends value with key, which is the user of the event or
+	// empty, to subject, i.e. a Kafka topic or NATS subject.
+	Publish(ctx context.Context, subject string, key, value []byte) error
+}
+
+// EventExporter streams the events of sessions as JSON to a Producer, so
+// POP3 activity can be fed to data platforms in real time. Events are
+// queued and published in the background; when the queue is full they are
+// dropped and counted as "events.dropped", so a slow platform never
+// blocks sessions.
+type EventExporter struct {
+	Producer Producer
+	// subject events are published to, "popgun.events" by default
+	Subject string
+	// QueueSize is the number of events queued, 1024 by default
+	QueueSize int
+	// Timeout bounds publishing a single event, 5 seconds by default
+	Timeout  time.Duration
+	ErrorLog Logger
+	Metrics  Metrics
+
+	once  sync.Once
+	queue chan Event
+	done  chan struct{}
+}
+
+func NewEventExporter(producer Producer) *EventExporter {
+	return &EventExporter{Producer: producer}
+}
+
+func (e *EventExporter) init() {
+	e.once.Do(func() {
+		size := e.QueueSize
+		if size <= 0 {
+			size = 1024
+		}
+		e.queue = make(chan Event, size)
+		e.done = make(chan struct{})
+		go e.run()
+	})
+}
+
+// Export queues an event for publishing.
+func (e *EventExporter) Export(event Event) {
+	e.init()
+	select {
+	case e.queue <- event:
+	default:
+		if e.Metrics != nil {
+			e.Metrics.Inc("events.dropped", event.Type)
+		}
+	}
+}
+
+// Close publishes the queued events and stops the exporter. Export must
+// not be called afterwards.
+func (e *EventExporter) Close() {
+	e.init()
+	close(e.queue)
+	<-e.done
+}
+
+func (e *EventExporter) run() {
+	defer close(e.done)
+	subject := e.Subject
+	if subject == "" {
+		subject = "popgun.events"
+	}
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	for event := range e.queue {
+		value, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = e.Producer.Publish(ctx, subject, []byte(event.User), value)
+		cancel()
+		if err != nil {
+			if e.ErrorLog != nil {
+				e.ErrorLog.Printf("Error publishing %s event: %v", event.Type, err)
+			}
+			if e.Metrics != nil {
+				e.Metrics.Inc("events.failed", event.Type)
+			}
+		}
+	}
+}
+
+// exportEvent exports an event of the session, if the server has an
+// EventExporter.
+func (c *Client) exportEvent(event Event) {
+	if c.server == nil || c.server.Events == nil {
+		return
+	}
+	event.Time = c.server.clock().Now().UTC()
+	event.Session = c.id
+	event.Remote = c.RemoteAddr().String()
+	if event.User == "" {
+		event.User = c.loggedIn
+	}
+	if event.Actor == "" {
+		event.Actor = c.Actor()
+	}
+	c.server.exportEvent(event)
+}
+
+// exportEvent exports event, if the server has an EventExporter.
+func (s *Server) exportEvent(event Event) {
+	if s.Events == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = s.clock().Now().UTC()
+	}
+	s.Events.Export(event)
+}
+
+// NATSProducer publishes to a NATS server using its text protocol. Every
+// publish is confirmed with a PING, so errors of the server are reported.
+// The key is not used.
+type NATSProducer struct {
+	// address of the NATS server, e.g. "localhost:4222"
+	Addr     string
+	User     string
+	Password string
+	// Dialer, if set, connects to NATS instead of a net.Dialer
+	Dialer Dialer
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (p *NATSProducer) Publish(ctx context.Context, subject string, key, value []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	err := p.roundTrip(ctx, fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(value), value))
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *NATSProducer) connect(ctx context.Context) error {
+	var dialer Dialer = &net.Dialer{}
+	if p.Dialer != nil {
+		dialer = p.Dialer
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return fmt.Errorf("Error connecting to NATS: %v", err)
+	}
+	p.conn, p.rd = conn, bufio.NewReader(conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	info, err := p.rd.ReadString('\n')
+	if err == nil && !strings.HasPrefix(info, "INFO ") {
+		err = fmt.Errorf("Unexpected NATS greeting: %q", strings.TrimSpace(info))
+	}
+	if err == nil {
+		options, _ := json.Marshal(map[string]interface{}{
+			"verbose":  false,
+			"pedantic": false,
+			"name":     "popgun",
+			"user":     p.User,
+			"pass":     p.Password,
+		})
+		err = p.roundTrip(ctx, fmt.Sprintf("CONNECT %s\r\nPING\r\n", options))
+	}
+	if err != nil {
+		conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// roundTrip sends request, which must end with PING, and waits for the
+// PONG, answering PINGs of the server meanwhile.
+func (p *NATSProducer) roundTrip(ctx context.Context, request string) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	p.conn.SetDeadline(deadline)
+	if _, err := p.conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	for {
+		line, err := p.rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(line[len("-ERR"):]))
+		case line == "+OK", strings.HasPrefix(line, "INFO "):
+		default:
+			return fmt.Errorf("Unexpected NATS reply: %q", line)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+type channelProducer chan Event
+
+func (p channelProducer) Publish(ctx context.Context, subject string, key, value []byte) error {
+	var event Event
+	if err := json.Unmarshal(value, &event); err != nil {
+		return err
+	}
+	if subject != "popgun.events" || string(key) != event.User {
+		return fmt.Errorf("Unexpected subject %s or key %s", subject, key)
+	}
+	p <- event
+	return nil
+}
+
+// secretAuthorizator accepts any user with password "secret".
+type secretAuthorizator struct{}
+
+func (a secretAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	if password != "secret" {
+		return nil, fmt.Errorf("Invalid password")
+	}
+	return testUser(username), nil
+}
+
+func TestEventExporter(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	events := make(channelProducer, 10)
+	listener := newPipeListener()
+	server := NewServer(secretAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.Events = NewEventExporter(events)
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "USER alice\r\nPASS wrong\r\nUSER alice\r\nPASS secret\r\nDELE 1\r\nQUIT\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "+OK Goodbye") {
+			break
+		}
+	}
+
+	for _, expected := range []Event{
+		{Type: EVENT_LOGIN_FAILED, User: "alice"},
+		{Type: EVENT_LOGIN, User: "alice"},
+		{Type: EVENT_UPDATE, User: "alice", Removed: 1},
+		{Type: EVENT_SESSION_CLOSED, User: "alice", CloseReason: "quit"},
+	} {
+		select {
+		case event := <-events:
+			if event.Type != expected.Type || event.User != expected.User || event.Removed != expected.Removed || event.CloseReason != expected.CloseReason || event.Remote != "pipe" || event.Session != 1 {
+				t.Errorf("Expected event %+v, but got %+v", expected, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s event", expected.Type)
+		}
+	}
+}
+
+func TestEventExporter_Export_dropped(t *testing.T) {
+	metrics := newCountingMetrics()
+	blocked := make(channelProducer)
+	exporter := NewEventExporter(blocked)
+	exporter.QueueSize = 1
+	exporter.Metrics = metrics
+	// the first event is taken by the publisher, the second one queued
+	for i := 0; i < 5; i++ {
+		exporter.Export(Event{Type: EVENT_LOGIN})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := metrics.count("events.dropped:login"); dropped != 3 {
+		t.Errorf("Expected 3 dropped events, but got %d", dropped)
+	}
+	go func() {
+		for range blocked {
+		}
+	}()
+	exporter.Close()
+	close(blocked)
+}
+
+func TestNATSProducer_Publish(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	published := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "CONNECT "):
+				if !strings.Contains(line, `"user":"popgun"`) {
+					fmt.Fprintf(conn, "-ERR 'Authorization Violation'\r\n")
+					return
+				}
+			case line == "PING\r\n":
+				// the server may ping the client before answering
+				fmt.Fprintf(conn, "PING\r\nPONG\r\n")
+			case line == "PONG\r\n":
+			case strings.HasPrefix(line, "PUB "):
+				var subject string
+				var size int
+				fmt.Sscanf(line, "PUB %s %d", &subject, &size)
+				payload := make([]byte, size+2)
+				if _, err := io.ReadFull(reader, payload); err != nil {
+					return
+				}
+				if subject == "forbidden" {
+					fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to forbidden'\r\n")
+					return
+				}
+				published <- subject + " " + string(payload[:size])
+			}
+		}
+	}()
+
+	producer := &NATSProducer{Addr: listener.Addr().String(), User: "popgun"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := producer.Publish(ctx, "popgun.events", nil, []byte(`{"type":"login"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if message := <-published; message != `popgun.events {"type":"login"}` {
+		t.Errorf("Unexpected message %q", message)
+	}
+	err = producer.Publish(ctx, "forbidden", nil, []byte("x"))
+	if err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Errorf("Expected permissions error, but got %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package popgun
+
+import "syscall"
+
+// TCP_FASTOPEN of linux/tcp.h, which package syscall lacks
+const tcpFastOpen = 0x17
+
+// setFastOpen enables TCP Fast Open on the listening socket fd.
+func setFastOpen(fd uintptr, queue int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, queue)
+}
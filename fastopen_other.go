@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package popgun
+
+// setFastOpen does nothing, TCP Fast Open is only enabled on Linux.
+func setFastOpen(fd uintptr, queue int) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package popgun
+
+import (
+	"net"
+	"strings"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Features are feature flags of a session, resolved after authentication,
+// so users of different hosting plans can be served by a single server.
+type Features struct {
+	AllowTop  bool `json:"allow_top"`
+	AllowDele bool `json:"allow_dele"`
+	// RequireTLS refuses logins over connections without TLS
+	RequireTLS bool `json:"require_tls"`
+	// messages larger than MaxMessageSize octets can't be retrieved, 0
+	// means no limit
+	MaxMessageSize int `json:"max_message_size"`
+}
+
+// DefaultFeatures are the features of sessions without a FeatureResolver.
+var DefaultFeatures = Features{AllowTop: true, AllowDele: true}
+
+// FeatureResolver resolves the features of a session of user.
+type FeatureResolver interface {
+	Features(conn net.Conn, user backends.User) (Features, error)
+}
+
+// FeaturesUser can be implemented by users returned by the Authorizator to
+// provide their features, e.g. from the account database. It is used if
+// the server has no FeatureResolver.
+type FeaturesUser interface {
+	Features() Features
+}
+
+// ConfigFeatures resolves features from static configuration, by username
+// first, then by domain of the username, falling back to Default.
+type ConfigFeatures struct {
+	Default Features
+	Domains map[string]Features
+	Users   map[string]Features
+}
+
+func (f ConfigFeatures) Features(conn net.Conn, user backends.User) (Features, error) {
+	username := user.Username()
+	if features, ok := f.Users[username]; ok {
+		return features, nil
+	}
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		if features, ok := f.Domains[strings.ToLower(username[i+1:])]; ok {
+			return features, nil
+		}
+	}
+	return f.Default, nil
+}
+
+// resolveFeatures returns the features of a session of user.
+func (s *Server) resolveFeatures(conn net.Conn, user backends.User) (Features, error) {
+	if s.Features != nil {
+		return s.Features.Features(conn, user)
+	}
+	if u, ok := user.(actingUser); ok {
+		user = u.User
+	}
+	if u, ok := user.(FeaturesUser); ok {
+		return u.Features(), nil
+	}
+	return DefaultFeatures, nil
+}
@@ -0,0 +1,250 @@
+package popgun
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// ListFilter decides which messages of a maildrop are visible to the client.
+// It is consulted by FilteredBackend when the maildrop is locked, so message
+// numbers stay stable for the rest of the session.
+type ListFilter interface {
+	Visible(user backends.User, uid string) bool
+}
+
+// SeenStore records which messages (by unique ID) each user has already
+// downloaded. Implementations must be safe for concurrent use.
+type SeenStore interface {
+	IsSeen(user backends.User, uid string) bool
+	MarkSeen(user backends.User, uid string) error
+}
+
+// MemorySeenStore is an in-memory SeenStore, its content is lost on restart.
+type MemorySeenStore struct {
+	mu   sync.Mutex
+	seen map[string]map[string]bool
+}
+
+func NewMemorySeenStore() *MemorySeenStore {
+	return &MemorySeenStore{seen: make(map[string]map[string]bool)}
+}
+
+func (s *MemorySeenStore) IsSeen(user backends.User, uid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seen[user.Username()][uid]
+}
+
+func (s *MemorySeenStore) MarkSeen(user backends.User, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uids, ok := s.seen[user.Username()]
+	if !ok {
+		uids = make(map[string]bool)
+		s.seen[user.Username()] = uids
+	}
+	uids[uid] = true
+	return nil
+}
+
+// UnseenFilter hides messages already downloaded by users for which NewOnly
+// returns true, i.e. clients configured in "only new mail" mode. If NewOnly
+// is nil, the filter applies to all users.
+type UnseenFilter struct {
+	Store   SeenStore
+	NewOnly func(user backends.User) bool
+}
+
+func (f UnseenFilter) Visible(user backends.User, uid string) bool {
+	if f.NewOnly != nil && !f.NewOnly(user) {
+		return true
+	}
+	return !f.Store.IsSeen(user, uid)
+}
+
+// FilteredBackend wraps a Backend and exposes only the messages accepted by
+// Filter, renumbering them for the client. If Seen is set, every message
+// successfully retrieved with RETR is recorded there.
+type FilteredBackend struct {
+	Backend
+	Filter ListFilter
+	Seen   SeenStore
+
+	mu    sync.Mutex
+	views map[string]filteredView
+}
+
+// filteredView maps client message numbers to the wrapped backend's ones.
+type filteredView struct {
+	msgIds []int
+	uids   []string
+}
+
+func NewFilteredBackend(backend Backend, filter ListFilter) *FilteredBackend {
+	return &FilteredBackend{
+		Backend: backend,
+		Filter:  filter,
+		views:   make(map[string]filteredView),
+	}
+}
+
+// Lock locks the wrapped maildrop and builds the list of visible messages.
+func (b *FilteredBackend) Lock(user backends.User) error {
+	err := b.Backend.Lock(user)
+	if err != nil {
+		return err
+	}
+	uids, err := b.Backend.Uidl(user)
+	if err != nil {
+		b.Backend.Unlock(user)
+		return err
+	}
+	b.buildView(user, uids, b.Filter)
+	return nil
+}
+
+// buildView stores the messages out of uids accepted by filter as the
+// visible ones for the current session of user.
+func (b *FilteredBackend) buildView(user backends.User, uids []string, filter ListFilter) {
+	view := filteredView{}
+	for i, uid := range uids {
+		if filter == nil || filter.Visible(user, uid) {
+			view.msgIds = append(view.msgIds, i+1)
+			view.uids = append(view.uids, uid)
+		}
+	}
+	b.mu.Lock()
+	b.views[user.Username()] = view
+	b.mu.Unlock()
+}
+
+func (b *FilteredBackend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	delete(b.views, user.Username())
+	b.mu.Unlock()
+	return b.Backend.Unlock(user)
+}
+
+func (b *FilteredBackend) view(user backends.User) filteredView {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.views[user.Username()]
+}
+
+// translate returns the wrapped backend's ID of a visible message.
+func (b *FilteredBackend) translate(user backends.User, msgId int) (int, bool) {
+	view := b.view(user)
+	if msgId < 1 || msgId > len(view.msgIds) {
+		return 0, false
+	}
+	return view.msgIds[msgId-1], true
+}
+
+func (b *FilteredBackend) Stat(user backends.User) (messages, octets int, err error) {
+	sizes, err := b.List(user)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, size := range sizes {
+		octets += size
+	}
+	return len(sizes), octets, nil
+}
+
+// messages returns the visible messages not marked as deleted, numbered
+// for the client.
+func (b *FilteredBackend) messages(user backends.User) ([]backends.MessageInfo, error) {
+	view := b.view(user)
+	var infos []backends.MessageInfo
+	for i, id := range view.msgIds {
+		exists, octets, err := b.Backend.ListMessage(user, id)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			infos = append(infos, backends.MessageInfo{MsgId: i + 1, Octets: octets, Uid: view.uids[i]})
+		}
+	}
+	return infos, nil
+}
+
+func (b *FilteredBackend) List(user backends.User) (octets []int, err error) {
+	infos, err := b.messages(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		octets = append(octets, info.Octets)
+	}
+	return octets, nil
+}
+
+// ListIter lists the visible messages not marked as deleted with their
+// client message numbers, which List and Uidl can't convey.
+func (b *FilteredBackend) ListIter(user backends.User) (MessageIterator, error) {
+	infos, err := b.messages(user)
+	if err != nil {
+		return nil, err
+	}
+	return backends.NewSliceIterator(infos), nil
+}
+
+func (b *FilteredBackend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	id, ok := b.translate(user, msgId)
+	if !ok {
+		return false, 0, nil
+	}
+	return b.Backend.ListMessage(user, id)
+}
+
+func (b *FilteredBackend) Retr(user backends.User, msgId int) (message string, err error) {
+	id, ok := b.translate(user, msgId)
+	if !ok {
+		return "", fmt.Errorf("No such message: %d", msgId)
+	}
+	message, err = b.Backend.Retr(user, id)
+	if err != nil {
+		return "", err
+	}
+	if b.Seen != nil {
+		err = b.Seen.MarkSeen(user, b.view(user).uids[msgId-1])
+	}
+	return message, err
+}
+
+func (b *FilteredBackend) Dele(user backends.User, msgId int) error {
+	id, ok := b.translate(user, msgId)
+	if !ok {
+		return fmt.Errorf("No such message: %d", msgId)
+	}
+	return b.Backend.Dele(user, id)
+}
+
+func (b *FilteredBackend) Uidl(user backends.User) (uids []string, err error) {
+	infos, err := b.messages(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		uids = append(uids, info.Uid)
+	}
+	return uids, nil
+}
+
+func (b *FilteredBackend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	id, ok := b.translate(user, msgId)
+	if !ok {
+		return false, "", nil
+	}
+	return b.Backend.UidlMessage(user, id)
+}
+
+func (b *FilteredBackend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	id, ok := b.translate(user, msgId)
+	if !ok {
+		return nil, fmt.Errorf("No such message: %d", msgId)
+	}
+	return b.Backend.Top(user, id, n)
+}
@@ -0,0 +1,99 @@
+package popgun
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// newFilterMaildrop returns a memory backend with five messages of 10 octets
+// for user, with the unique IDs "1" to "5".
+func newFilterMaildrop(user string) *memory.Backend {
+	backend := memory.New()
+	for i := 1; i <= 5; i++ {
+		backend.Deliver(user, fmt.Sprint(i), fmt.Sprintf("message%d\r\n", i))
+	}
+	return backend
+}
+
+func TestFilteredBackend_UnseenFilter(t *testing.T) {
+	user := testUser("alice")
+	store := NewMemorySeenStore()
+	backend := NewFilteredBackend(newFilterMaildrop("alice"), UnseenFilter{Store: store})
+	backend.Seen = store
+
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Retr(user, 2); err != nil {
+		t.Fatal(err)
+	}
+	backend.Unlock(user)
+
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock(user)
+
+	uids, _ := backend.Uidl(user)
+	expectedUids := []string{"1", "3", "4", "5"}
+	if !reflect.DeepEqual(uids, expectedUids) {
+		t.Errorf("Expected '%v', but got '%v'", expectedUids, uids)
+	}
+	messages, octets, _ := backend.Stat(user)
+	if messages != 4 || octets != 40 {
+		t.Errorf("Expected '4 40', but got '%d %d'", messages, octets)
+	}
+	exists, uid, _ := backend.UidlMessage(user, 2)
+	if !exists || uid != "3" {
+		t.Errorf("Expected message 2 to have uid '3', but got '%s'", uid)
+	}
+	exists, _, _ = backend.ListMessage(user, 5)
+	if exists {
+		t.Error("Expected message 5 to be hidden")
+	}
+}
+
+func TestFilteredBackend_Dele(t *testing.T) {
+	user := testUser("alice")
+	store := NewMemorySeenStore()
+	store.MarkSeen(user, "2")
+	backend := NewFilteredBackend(newFilterMaildrop("alice"), UnseenFilter{Store: store})
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock(user)
+
+	// message 2 of the client is the message with uid "3"
+	if err := backend.Dele(user, 2); err != nil {
+		t.Fatal(err)
+	}
+	uids, _ := backend.Uidl(user)
+	if expected := []string{"1", "4", "5"}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("Expected '%v', but got '%v'", expected, uids)
+	}
+	if exists, _, _ := backend.UidlMessage(user, 2); exists {
+		t.Error("Expected deleted message not to have a uid")
+	}
+	if exists, _, _ := backend.ListMessage(user, 2); exists {
+		t.Error("Expected deleted message not to be listed")
+	}
+	messages, octets, _ := backend.Stat(user)
+	if messages != 3 || octets != 30 {
+		t.Errorf("Expected '3 30', but got '%d %d'", messages, octets)
+	}
+	it, err := backend.ListIter(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for it.Next() {
+		ids = append(ids, it.Message().MsgId)
+	}
+	it.Close()
+	if expected := []int{1, 3, 4}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected message numbers '%v', but got '%v'", expected, ids)
+	}
+}
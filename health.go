@@ -0,0 +1,85 @@
+package popgun
+
+import (
+	"context"
+	"time"
+)
+
+// HealthProbe checks whether the backend is able to serve sessions. It is
+// called periodically by the server, see Server.HealthProbe.
+type HealthProbe interface {
+	Probe(ctx context.Context) error
+}
+
+// HealthProbeFunc adapts a function to the HealthProbe interface.
+type HealthProbeFunc func(ctx context.Context) error
+
+func (f HealthProbeFunc) Probe(ctx context.Context) error {
+	return f(ctx)
+}
+
+// healthState is the result of the last health probe.
+type healthState struct {
+	err     error
+	checked time.Time
+}
+
+// Healthy reports whether the last backend health probe succeeded, along with
+// its error. Without a HealthProbe the backend is always healthy.
+func (s *Server) Healthy() (bool, error) {
+	state, _ := s.health.Load().(healthState)
+	return state.err == nil, state.err
+}
+
+// startHealthCheck runs the health probe every HealthInterval, it does
+// nothing if no probe is configured or it is already running.
+func (s *Server) startHealthCheck() {
+	if s.HealthProbe == nil {
+		return
+	}
+	s.healthOnce.Do(func() {
+		interval := s.HealthInterval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		s.probeHealth(interval)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.probeHealth(interval)
+				case <-s.done:
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (s *Server) probeHealth(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := s.HealthProbe.Probe(ctx)
+
+	prev, _ := s.health.Load().(healthState)
+	s.health.Store(healthState{err: err, checked: s.clock().Now()})
+	if err != nil {
+		s.Metrics.Set("backend.healthy", 0)
+		if prev.err == nil {
+			s.ErrorLog.Println("Backend is unhealthy: ", err)
+		}
+	} else {
+		s.Metrics.Set("backend.healthy", 1)
+		if prev.err != nil {
+			s.ErrorLog.Println("Backend is healthy again")
+		}
+	}
+}
+
+// isHealthy is a shortcut for the session loop.
+func (s *Server) isHealthy() bool {
+	healthy, _ := s.Healthy()
+	return healthy
+}
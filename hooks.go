@@ -0,0 +1,86 @@
+package popgun
+
+import (
+	"github.com/kiwiz/popgun/backends"
+)
+
+// CloseReason classifies why a client session ended.
+type CloseReason int
+
+const (
+	// client issued QUIT
+	CLOSE_QUIT CloseReason = iota + 1
+	// client closed the connection without QUIT
+	CLOSE_CLIENT_GONE
+	// client did not send anything before the read deadline
+	CLOSE_IDLE_TIMEOUT
+	// reading from the connection failed
+	CLOSE_READ_ERROR
+	// session was terminated by a server-side policy (e.g. an admin kick)
+	CLOSE_POLICY
+	// server is shutting down
+	CLOSE_SHUTDOWN
+	// client violated the protocol badly enough to be disconnected
+	CLOSE_PROTOCOL_ABUSE
+	// locked maildrop was changed by another process, see ChangeNotifier
+	CLOSE_MAILDROP_CHANGED
+	// reading the maildrop from the backend failed mid-response
+	CLOSE_BACKEND_ERROR
+)
+
+var closeReasonNames = map[CloseReason]string{
+	CLOSE_QUIT:             "quit",
+	CLOSE_CLIENT_GONE:      "client_gone",
+	CLOSE_IDLE_TIMEOUT:     "idle_timeout",
+	CLOSE_READ_ERROR:       "read_error",
+	CLOSE_POLICY:           "policy",
+	CLOSE_SHUTDOWN:         "shutdown",
+	CLOSE_PROTOCOL_ABUSE:   "protocol_abuse",
+	CLOSE_MAILDROP_CHANGED: "maildrop_changed",
+	CLOSE_BACKEND_ERROR:    "backend_error",
+}
+
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Hooks are optional callbacks invoked by the server during a client session.
+// A single instance is shared across all client connections, so hooks must be
+// safe for concurrent use. Nil hooks are ignored.
+type Hooks struct {
+	// OnDisconnect is called after the client connection has been closed.
+	OnDisconnect func(c *Client, reason CloseReason)
+	// OnUpdate is called after the maildrop of user has been updated on
+	// QUIT, with the result reported by the backend.
+	OnUpdate func(c *Client, user backends.User, result backends.UpdateResult)
+	// OnUpdateFailure is called after OnUpdate if some messages marked as
+	// deleted were not removed, with the policy applied, see
+	// Server.UpdateFailurePolicy.
+	OnUpdateFailure func(c *Client, user backends.User, result backends.UpdateResult, policy UpdateFailurePolicy)
+	// OnProgress is called while streaming a multi-line response with the
+	// number of bytes sent so far, about every 64 KiB and at its end. It may
+	// sleep to throttle the client, returning an error aborts the response
+	// and terminates the session.
+	OnProgress func(c *Client, sent int) error
+	// OnCapa returns extra capabilities advertised by CAPA, one per line.
+	// Lines must not contain line breaks.
+	OnCapa func(c *Client) []string
+}
+
+// Metrics receives counters and observations from the server. Names are
+// dot-separated identifiers (e.g. "session.closed") and labels are the
+// values distinguishing series of the same name (e.g. a close reason).
+type Metrics interface {
+	Inc(name string, labels ...string)
+	Observe(name string, value float64, labels ...string)
+	Set(name string, value float64, labels ...string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Inc(name string, labels ...string)                    {}
+func (nopMetrics) Observe(name string, value float64, labels ...string) {}
+func (nopMetrics) Set(name string, value float64, labels ...string)     {}
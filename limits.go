@@ -0,0 +1,30 @@
+package popgun
+
+import (
+	"fmt"
+)
+
+// limits returns the limits of the session as parameters of the XLIMITS
+// capability, see Server.AdvertiseLimits. The quota of the maildrop is
+// only known after login.
+func (c *Client) limits() []string {
+	var limits []string
+	add := func(name string, value int64) {
+		if value > 0 {
+			limits = append(limits, fmt.Sprintf("%s=%d", name, value))
+		}
+	}
+	add("RETR", int64(c.server.MaxRetrievedMessages))
+	add("DELE", int64(c.server.MaxDeletedMessages))
+	add("SIZE", int64(c.features.MaxMessageSize))
+	if qb, ok := c.backend.(QuotaBackend); ok && c.user != nil {
+		quota, err := qb.Quota(c.user)
+		if err != nil {
+			c.DebugLog.Printf("Error getting quota of user %s: %v", c.user.Username(), err)
+		} else {
+			add("QUOTA-OCTETS", quota.LimitOctets)
+			add("QUOTA-MESSAGES", quota.LimitMessages)
+		}
+	}
+	return limits
+}
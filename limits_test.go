@@ -0,0 +1,165 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// quotaBackend limits every maildrop to 1000 octets in 10 messages.
+type quotaBackend struct {
+	*memory.Backend
+}
+
+func (b quotaBackend) Quota(user backends.User) (backends.Quota, error) {
+	return backends.Quota{LimitOctets: 1000, LimitMessages: 10, FreeOctets: -1}, nil
+}
+
+func TestAdvertiseLimits(t *testing.T) {
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, quotaBackend{memory.New()})
+	server.AllowInsecureAuth = true
+	server.MaxRetrievedMessages = 100
+	server.Features = ConfigFeatures{Default: Features{AllowTop: true, AllowDele: true, MaxMessageSize: 2048}}
+	server.AdvertiseLimits = true
+	server.LimitsInGreeting = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if line, _ := reader.ReadString('\n'); line != "+OK POPgun POP3 server ready (RETR=100)\r\n" {
+		t.Errorf("Expected limits in greeting, but got %q", line)
+	}
+	// capa returns the XLIMITS capability
+	capa := func() string {
+		fmt.Fprintf(conn, "CAPA\r\n")
+		limits := ""
+		for line, _ := reader.ReadString('\n'); line != ".\r\n" && line != ""; line, _ = reader.ReadString('\n') {
+			if strings.HasPrefix(line, "XLIMITS ") {
+				limits = line
+			}
+		}
+		return limits
+	}
+	if limits := capa(); limits != "XLIMITS RETR=100\r\n" {
+		t.Errorf("Expected limits known before login, but got %q", limits)
+	}
+	fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\n")
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+	if limits := capa(); limits != "XLIMITS RETR=100 SIZE=2048 QUOTA-OCTETS=1000 QUOTA-MESSAGES=10\r\n" {
+		t.Errorf("Expected limits of the session, but got %q", limits)
+	}
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	for _, pause := range []bool{false, true} {
+		listener := newPipeListener()
+		metrics := newCountingMetrics()
+		server := NewServer(userAuthorizator{}, memory.New())
+		server.MaxConnections = 1
+		server.PauseAcceptWhenFull = pause
+		server.Metrics = metrics
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+
+		first, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(first)
+		if line, _ := reader.ReadString('\n'); line != "+OK POPgun POP3 server ready\r\n" {
+			t.Fatalf("Expected greeting, but got %q", line)
+		}
+
+		dialed := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Dial()
+			if err != nil {
+				t.Error(err)
+			}
+			dialed <- conn
+		}()
+		var second net.Conn
+		if pause {
+			select {
+			case <-dialed:
+				t.Fatal("Expected no connection accepted while full")
+			case <-time.After(50 * time.Millisecond):
+			}
+			fmt.Fprintf(first, "QUIT\r\n")
+			reader.ReadString('\n')
+			second = <-dialed
+			if line, _ := bufio.NewReader(second).ReadString('\n'); line != "+OK POPgun POP3 server ready\r\n" {
+				t.Errorf("Expected greeting once a session ended, but got %q", line)
+			}
+		} else {
+			second = <-dialed
+			if line, _ := bufio.NewReader(second).ReadString('\n'); line != "-ERR [SYS/TEMP] too many connections\r\n" {
+				t.Errorf("Expected connection refused, but got %q", line)
+			}
+			if n := metrics.count("session.refused:max_connections"); n != 1 {
+				t.Errorf("Expected refused connection counted, but got %d", n)
+			}
+			first.Close()
+		}
+		second.Close()
+		listener.Close()
+	}
+}
+
+func TestServer_MaxConnectionsPerIP(t *testing.T) {
+	metrics := newCountingMetrics()
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.MaxConnections = 10
+	server.MaxConnectionsPerIP = 2
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	// pipes share the remote address "pipe"
+	greeting := func() (net.Conn, string) {
+		s, c := net.Pipe()
+		go server.ServeConn(s)
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		return c, line
+	}
+	first, line := greeting()
+	if line != "+OK POPgun POP3 server ready\r\n" {
+		t.Fatalf("Expected greeting, but got %q", line)
+	}
+	second, line := greeting()
+	if line != "+OK POPgun POP3 server ready\r\n" {
+		t.Fatalf("Expected greeting, but got %q", line)
+	}
+	refused, line := greeting()
+	if line != "-ERR [SYS/TEMP] too many connections from your address\r\n" {
+		t.Errorf("Expected connection refused, but got %q", line)
+	}
+	refused.Close()
+	if n := metrics.count("session.refused:max_connections_per_ip"); n != 1 {
+		t.Errorf("Expected refused connection counted, but got %d", n)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(server.Sessions()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	third, line := greeting()
+	if line != "+OK POPgun POP3 server ready\r\n" {
+		t.Errorf("Expected greeting once a session ended, but got %q", line)
+	}
+	second.Close()
+	third.Close()
+}
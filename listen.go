@@ -0,0 +1,207 @@
+package popgun
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FAST_OPEN_QUEUE is the default queue length of TCP Fast Open requests not
+// yet accepted, see ListenOptions.
+const FAST_OPEN_QUEUE = 256
+
+// AcceptBackoff paces accept loops retrying temporary errors, e.g. running
+// out of file descriptors (EMFILE) or aborted connections (ECONNABORTED),
+// like net/http: the delay starts at 5 milliseconds and doubles with every
+// error up to Max, with jitter so listeners sharing the limit don't retry
+// in lockstep. The zero value is ready to use.
+type AcceptBackoff struct {
+	// Max is the longest delay, one second by default.
+	Max time.Duration
+
+	delay time.Duration
+}
+
+// Next returns the delay to wait before accepting again after err, and
+// whether err is temporary. Permanent errors must be returned to the
+// caller. A nil err, i.e. a successful Accept, resets the delay.
+func (b *AcceptBackoff) Next(err error) (time.Duration, bool) {
+	if err == nil {
+		b.delay = 0
+		return 0, true
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		return 0, false
+	}
+	max := b.Max
+	if max <= 0 {
+		max = time.Second
+	}
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else if b.delay *= 2; b.delay > max {
+		b.delay = max
+	}
+	// between half and the full delay
+	return b.delay/2 + time.Duration(rand.Int63n(int64(b.delay/2)+1)), true
+}
+
+// ListenOptions configures the listeners of Listen.
+type ListenOptions struct {
+	// FastOpen enables TCP Fast Open (RFC 7413) where the platform
+	// supports it, so clients reconnecting frequently send their first
+	// command with the SYN. It is ignored elsewhere or if the kernel
+	// refuses it.
+	FastOpen bool
+	// FastOpenQueue is the queue length of Fast Open requests,
+	// FAST_OPEN_QUEUE by default.
+	FastOpenQueue int
+}
+
+// Listen listens for TCP connections on addr on all address families
+// available. Without a host, e.g. ":110", it binds a dual-stack socket,
+// falling back to IPv4 or IPv6 only where the other family is disabled.
+// A hostname resolving to addresses of both families, e.g. "localhost",
+// is bound on all of them, as long as one succeeds. The addresses share
+// the port, if addr has port 0 the one chosen for the first.
+func Listen(addr string, opts ListenOptions) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{}
+	if opts.FastOpen {
+		queue := opts.FastOpenQueue
+		if queue <= 0 {
+			queue = FAST_OPEN_QUEUE
+		}
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			// opportunistic, failing to enable it is not an error
+			c.Control(func(fd uintptr) {
+				setFastOpen(fd, queue)
+			})
+			return nil
+		}
+	}
+	ctx := context.Background()
+
+	if host == "" {
+		l, err := lc.Listen(ctx, "tcp", addr)
+		if err == nil {
+			return l, nil
+		}
+		for _, network := range []string{"tcp4", "tcp6"} {
+			if l, err := lc.Listen(ctx, network, addr); err == nil {
+				return l, nil
+			}
+		}
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return lc.Listen(ctx, "tcp", addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	var firstErr error
+	for _, ip := range ips {
+		l, err := lc.Listen(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if len(listeners) == 0 {
+			port = strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		}
+		listeners = append(listeners, l)
+	}
+	switch len(listeners) {
+	case 0:
+		if firstErr == nil {
+			firstErr = fmt.Errorf("No addresses of %s", host)
+		}
+		return nil, firstErr
+	case 1:
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// multiListener accepts connections of several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	once      sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case m.accepted <- acceptResult{conn, err}:
+		case <-m.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Temporary()) {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepted:
+		return r.conn, r.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all listeners.
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.closed)
+		for _, l := range m.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,89 @@
+package popgun
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListen(t *testing.T) {
+	for _, addr := range []string{"localhost:0", "127.0.0.1:0", ":0"} {
+		l, err := Listen(addr, ListenOptions{FastOpen: true})
+		if err != nil {
+			t.Fatalf("Error listening on %s: %v", addr, err)
+		}
+		port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		dialed := 0
+		for _, ip := range []string{"127.0.0.1", "::1"} {
+			conn, err := net.Dial("tcp", net.JoinHostPort(ip, port))
+			if err != nil {
+				// IPv6 may be unavailable, or not bound for 127.0.0.1
+				continue
+			}
+			accepted, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted.Close()
+			conn.Close()
+			dialed++
+		}
+		if dialed == 0 {
+			t.Errorf("Expected connections accepted on %s", addr)
+		}
+		if err := l.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+	m := newMultiListener(listeners)
+	for _, l := range listeners {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		accepted, err := m.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+	}
+	m.Close()
+	if _, err := m.Accept(); err != net.ErrClosed {
+		t.Errorf("Expected closed listener, but got %v", err)
+	}
+	if _, err := net.Dial("tcp", listeners[1].Addr().String()); err == nil {
+		t.Errorf("Expected listeners closed")
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	backoff := AcceptBackoff{Max: 40 * time.Millisecond}
+	if _, temporary := backoff.Next(fmt.Errorf("Listener closed")); temporary {
+		t.Errorf("Expected permanent error")
+	}
+	for _, max := range []time.Duration{5, 10, 20, 40, 40} {
+		max *= time.Millisecond
+		delay, temporary := backoff.Next(temporaryError{})
+		if !temporary || delay < max/2 || delay > max {
+			t.Errorf("Expected delay between %v and %v, but got %v, %v", max/2, max, delay, temporary)
+		}
+	}
+	backoff.Next(nil)
+	if delay, _ := backoff.Next(temporaryError{}); delay > 5*time.Millisecond {
+		t.Errorf("Expected delay reset after success, but got %v", delay)
+	}
+}
@@ -0,0 +1,73 @@
+package popgun
+
+import (
+	"bytes"
+	"strings"
+)
+
+// maximum size of a rendered listing kept for repeated LIST and UIDL
+const maxCachedListing = 64 * 1024
+
+// renderedListing is the response to LIST or UIDL without arguments.
+// Clients often repeat them in a session, while the listing only changes
+// with DELE, RSET and XUNDELE.
+type renderedListing struct {
+	status string
+	lines  []string
+	// lines rendered for the wire, byte-stuffed and CRLF terminated
+	block []byte
+}
+
+// renderLines renders the lines of a multi-line response like Printer.Line.
+func renderLines(lines []string) []byte {
+	var b bytes.Buffer
+	for _, line := range lines {
+		line = strings.Trim(line, "\r")
+		if strings.HasPrefix(line, ".") {
+			b.WriteByte('.')
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return b.Bytes()
+}
+
+// writeListing responds to cmd with status and lines, keeping the rendered
+// response for repeated commands unless it is too large.
+func (c *Client) writeListing(cmd, status string, lines []string) {
+	listing := &renderedListing{status: status, lines: lines, block: renderLines(lines)}
+	if len(listing.block) <= maxCachedListing {
+		if c.listings == nil {
+			c.listings = make(map[string]*renderedListing)
+		}
+		c.listings[cmd] = listing
+	}
+	c.printListing(listing)
+}
+
+// writeCachedListing responds to cmd with the listing kept by writeListing,
+// it returns false if there is none.
+func (c *Client) writeCachedListing(cmd string) bool {
+	listing, ok := c.listings[cmd]
+	if ok {
+		c.printListing(listing)
+	}
+	return ok
+}
+
+// printListing writes listing, rendered with a single write to the client.
+func (c *Client) printListing(listing *renderedListing) {
+	c.printer.Ok("%s", listing.status)
+	if p, ok := c.printer.(*Printer); ok {
+		p.block(listing.block)
+		p.End()
+		return
+	}
+	c.printer.MultiLine(listing.lines)
+}
+
+// listingChanged drops the listings kept by writeListing, the messages
+// marked as deleted changed.
+func (c *Client) listingChanged() {
+	c.listings = nil
+}
@@ -0,0 +1,94 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// listCountingBackend counts calls of List and Uidl, hiding the optional
+// interfaces of the memory backend.
+type listCountingBackend struct {
+	Backend
+	calls int32
+}
+
+func (b *listCountingBackend) List(user backends.User) ([]int, error) {
+	atomic.AddInt32(&b.calls, 1)
+	return b.Backend.List(user)
+}
+
+func (b *listCountingBackend) Uidl(user backends.User) ([]string, error) {
+	atomic.AddInt32(&b.calls, 1)
+	return b.Backend.Uidl(user)
+}
+
+func TestListCommand_cached(t *testing.T) {
+	maildrop := memory.New()
+	maildrop.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	maildrop.Deliver("alice", ".b", "Subject: b\r\n\r\nbody\r\n")
+	backend := &listCountingBackend{Backend: maildrop}
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER alice\r\nPASS x\r\n")
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+
+	// listing sends cmd and returns its response
+	listing := func(cmd string) string {
+		fmt.Fprintf(conn, "%s\r\n", cmd)
+		var response []string
+		for {
+			line, err := reader.ReadString('\n')
+			response = append(response, line)
+			if err != nil || line == ".\r\n" || strings.Contains(cmd, " ") {
+				return strings.Join(response, "")
+			}
+		}
+	}
+	tables := []struct {
+		cmd      string
+		expected string
+		calls    int32
+	}{
+		{"UIDL", "+OK 2 messages\r\n1 a\r\n2 .b\r\n.\r\n", 1},
+		{"UIDL", "+OK 2 messages\r\n1 a\r\n2 .b\r\n.\r\n", 1},
+		{"LIST", "+OK 2 messages\r\n1 20\r\n2 20\r\n.\r\n", 2},
+		{"LIST", "+OK 2 messages\r\n1 20\r\n2 20\r\n.\r\n", 2},
+		{"DELE 1", "+OK Message 1 deleted\r\n", 2},
+		// the listing is requested again, the memory backend keeps
+		// deleted messages in it
+		{"UIDL", "+OK 2 messages\r\n1 a\r\n2 .b\r\n.\r\n", 3},
+	}
+	for _, table := range tables {
+		if response := listing(table.cmd); response != table.expected {
+			t.Errorf("Expected %q for %s, but got %q", table.expected, table.cmd, response)
+		}
+		if calls := atomic.LoadInt32(&backend.calls); calls != table.calls {
+			t.Errorf("Expected %d backend calls after %s, but got %d", table.calls, table.cmd, calls)
+		}
+	}
+}
+
+func TestRenderLines(t *testing.T) {
+	if block := string(renderLines([]string{"1 a", ".b", "c\r"})); block != "1 a\r\n..b\r\nc\r\n" {
+		t.Errorf("Expected byte-stuffed lines, but got %q", block)
+	}
+}
@@ -0,0 +1,313 @@
+package popgun
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// MigrationBackend serves a maildrop while it is being copied from an Old
+// to a New backend, e.g. by a background job. Messages are identified by
+// their UID: those present in New are served from New, falling back to
+// Old if reading fails, those not copied yet from Old. Deletions are
+// written to both stores, so deleted messages don't reappear once the
+// migration is finished. Both maildrops must exist and be lockable.
+type MigrationBackend struct {
+	Old Backend
+	New Backend
+
+	mu    sync.Mutex
+	views map[string]*migrationView
+}
+
+// migrationEntry is a message of the merged listing, with its message
+// numbers in both stores, 0 if it isn't present in one of them.
+type migrationEntry struct {
+	uid     string
+	octets  int
+	newId   int
+	oldId   int
+	deleted bool
+}
+
+type migrationView struct {
+	entries []migrationEntry
+}
+
+func NewMigrationBackend(old, new Backend) *MigrationBackend {
+	return &MigrationBackend{
+		Old:   old,
+		New:   new,
+		views: make(map[string]*migrationView),
+	}
+}
+
+// Lock locks both maildrops and merges their listings, messages of New
+// first.
+func (b *MigrationBackend) Lock(user backends.User) error {
+	err := b.New.Lock(user)
+	if err != nil {
+		return err
+	}
+	err = b.Old.Lock(user)
+	if err != nil {
+		b.New.Unlock(user)
+		return err
+	}
+	view, err := b.merge(user)
+	if err != nil {
+		b.Old.Unlock(user)
+		b.New.Unlock(user)
+		return err
+	}
+	b.mu.Lock()
+	b.views[user.Username()] = view
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *MigrationBackend) merge(user backends.User) (*migrationView, error) {
+	view := &migrationView{}
+	index := make(map[string]int)
+	for _, store := range []struct {
+		backend Backend
+		isNew   bool
+	}{{b.New, true}, {b.Old, false}} {
+		uids, err := store.backend.Uidl(user)
+		if err != nil {
+			return nil, err
+		}
+		octets, err := store.backend.List(user)
+		if err != nil {
+			return nil, err
+		}
+		if len(octets) != len(uids) {
+			return nil, fmt.Errorf("Listing and UIDs of maildrop differ in length")
+		}
+		for i, uid := range uids {
+			if j, ok := index[uid]; ok {
+				// already copied to New
+				view.entries[j].oldId = i + 1
+				continue
+			}
+			entry := migrationEntry{uid: uid, octets: octets[i]}
+			if store.isNew {
+				entry.newId = i + 1
+			} else {
+				entry.oldId = i + 1
+			}
+			index[uid] = len(view.entries)
+			view.entries = append(view.entries, entry)
+		}
+	}
+	return view, nil
+}
+
+func (b *MigrationBackend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	delete(b.views, user.Username())
+	b.mu.Unlock()
+	errOld := b.Old.Unlock(user)
+	errNew := b.New.Unlock(user)
+	if errNew != nil {
+		return errNew
+	}
+	return errOld
+}
+
+// entry returns a message not marked as deleted by its number.
+func (b *MigrationBackend) entry(user backends.User, msgId int) (*migrationEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	view := b.views[user.Username()]
+	if view == nil || msgId < 1 || msgId > len(view.entries) || view.entries[msgId-1].deleted {
+		return nil, false
+	}
+	return &view.entries[msgId-1], true
+}
+
+// entries returns a copy of the merged listing.
+func (b *MigrationBackend) entries(user backends.User) []migrationEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	view := b.views[user.Username()]
+	if view == nil {
+		return nil
+	}
+	return append([]migrationEntry(nil), view.entries...)
+}
+
+// Moved returns the UIDs of messages found in both stores.
+func (b *MigrationBackend) Moved(user backends.User) []string {
+	var uids []string
+	for _, entry := range b.entries(user) {
+		if entry.newId > 0 && entry.oldId > 0 {
+			uids = append(uids, entry.uid)
+		}
+	}
+	return uids
+}
+
+func (b *MigrationBackend) Stat(user backends.User) (messages, octets int, err error) {
+	for _, entry := range b.entries(user) {
+		if !entry.deleted {
+			messages++
+			octets += entry.octets
+		}
+	}
+	return messages, octets, nil
+}
+
+// List returns sizes of all messages, including those marked as deleted so
+// message numbers stay stable. LIST uses ListIter instead.
+func (b *MigrationBackend) List(user backends.User) (octets []int, err error) {
+	for _, entry := range b.entries(user) {
+		octets = append(octets, entry.octets)
+	}
+	return octets, nil
+}
+
+// ListIter lists messages not marked as deleted.
+func (b *MigrationBackend) ListIter(user backends.User) (MessageIterator, error) {
+	var infos []backends.MessageInfo
+	for i, entry := range b.entries(user) {
+		if !entry.deleted {
+			infos = append(infos, backends.MessageInfo{MsgId: i + 1, Octets: entry.octets, Uid: entry.uid})
+		}
+	}
+	return backends.NewSliceIterator(infos), nil
+}
+
+func (b *MigrationBackend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	entry, ok := b.entry(user, msgId)
+	if !ok {
+		return false, 0, nil
+	}
+	return true, entry.octets, nil
+}
+
+func (b *MigrationBackend) Retr(user backends.User, msgId int) (message string, err error) {
+	entry, ok := b.entry(user, msgId)
+	if !ok {
+		return "", fmt.Errorf("No such message: %d", msgId)
+	}
+	if entry.newId > 0 {
+		message, err = b.New.Retr(user, entry.newId)
+		if err == nil || entry.oldId == 0 {
+			return message, err
+		}
+	}
+	return b.Old.Retr(user, entry.oldId)
+}
+
+func (b *MigrationBackend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	entry, ok := b.entry(user, msgId)
+	if !ok {
+		return nil, fmt.Errorf("No such message: %d", msgId)
+	}
+	if entry.newId > 0 {
+		lines, err = b.New.Top(user, entry.newId, n)
+		if err == nil || entry.oldId == 0 {
+			return lines, err
+		}
+	}
+	return b.Old.Top(user, entry.oldId, n)
+}
+
+// Dele marks the message as deleted in both stores.
+func (b *MigrationBackend) Dele(user backends.User, msgId int) error {
+	entry, ok := b.entry(user, msgId)
+	if !ok {
+		return fmt.Errorf("No such message: %d", msgId)
+	}
+	if entry.newId > 0 {
+		if err := b.New.Dele(user, entry.newId); err != nil {
+			return err
+		}
+	}
+	if entry.oldId > 0 {
+		if err := b.Old.Dele(user, entry.oldId); err != nil {
+			if entry.newId > 0 {
+				b.New.Rset(user)
+				b.redele(user, entry)
+			}
+			return err
+		}
+	}
+	b.mu.Lock()
+	entry.deleted = true
+	b.mu.Unlock()
+	return nil
+}
+
+// redele marks the messages deleted so far, except skip, as deleted in New
+// again after it has been reset.
+func (b *MigrationBackend) redele(user backends.User, skip *migrationEntry) {
+	for _, entry := range b.entries(user) {
+		if entry.deleted && entry.newId > 0 && entry.newId != skip.newId {
+			b.New.Dele(user, entry.newId)
+		}
+	}
+}
+
+func (b *MigrationBackend) Rset(user backends.User) error {
+	errNew := b.New.Rset(user)
+	errOld := b.Old.Rset(user)
+	b.mu.Lock()
+	if view := b.views[user.Username()]; view != nil {
+		for i := range view.entries {
+			view.entries[i].deleted = false
+		}
+	}
+	b.mu.Unlock()
+	if errNew != nil {
+		return errNew
+	}
+	return errOld
+}
+
+func (b *MigrationBackend) Uidl(user backends.User) (uids []string, err error) {
+	for _, entry := range b.entries(user) {
+		uids = append(uids, entry.uid)
+	}
+	return uids, nil
+}
+
+func (b *MigrationBackend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	entry, ok := b.entry(user, msgId)
+	if !ok {
+		return false, "", nil
+	}
+	return true, entry.uid, nil
+}
+
+// Update commits deletions to New and then to Old. Messages which could
+// not be removed from either store are reported as failed.
+func (b *MigrationBackend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	resultNew, err := b.New.Update(user)
+	if err != nil {
+		return result, err
+	}
+	resultOld, err := b.Old.Update(user)
+	if err != nil {
+		return result, err
+	}
+
+	failed := make(map[string]bool)
+	for _, uid := range append(resultNew.FailedUids, resultOld.FailedUids...) {
+		if !failed[uid] {
+			failed[uid] = true
+			result.FailedUids = append(result.FailedUids, uid)
+		}
+	}
+	for _, entry := range b.entries(user) {
+		if entry.deleted && !failed[entry.uid] {
+			result.Removed++
+		} else {
+			result.RemainingMessages++
+			result.RemainingOctets += entry.octets
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package popgun
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/maildir"
+)
+
+func TestMigrationBackend(t *testing.T) {
+	oldRoot, newRoot := t.TempDir(), t.TempDir()
+	for _, root := range []string{oldRoot, newRoot} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(root, "user", sub), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write := func(root, name, content string) {
+		ioutil.WriteFile(filepath.Join(root, "user", "cur", name), []byte(content), 0600)
+	}
+	write(oldRoot, "1.a:2,", "Subject: copied\n\nold copy\n")
+	write(oldRoot, "2.b:2,", "Subject: pending\n\nonly old\n")
+	write(newRoot, "1.a:2,", "Subject: copied\n\nnew copy\n")
+
+	b := NewMigrationBackend(maildir.New(oldRoot), maildir.New(newRoot))
+	user := backends.DummyUser{}
+	if err := b.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	uids, _ := b.Uidl(user)
+	if !reflect.DeepEqual(uids, []string{"1.a", "2.b"}) {
+		t.Errorf("Unexpected uids '%v'", uids)
+	}
+	if moved := b.Moved(user); !reflect.DeepEqual(moved, []string{"1.a"}) {
+		t.Errorf("Expected '[1.a]' moved, but got '%v'", moved)
+	}
+	if message, _ := b.Retr(user, 1); message != "Subject: copied\n\nnew copy\n" {
+		t.Errorf("Expected message from new store, but got '%s'", message)
+	}
+	if message, _ := b.Retr(user, 2); message != "Subject: pending\n\nonly old\n" {
+		t.Errorf("Expected message from old store, but got '%s'", message)
+	}
+
+	if err := b.Dele(user, 1); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 || result.RemainingMessages != 1 {
+		t.Errorf("Unexpected update result '%+v'", result)
+	}
+	b.Unlock(user)
+	for _, root := range []string{oldRoot, newRoot} {
+		if _, err := os.Stat(filepath.Join(root, "user", "cur", "1.a:2,")); !os.IsNotExist(err) {
+			t.Errorf("Expected deleted message removed from %s", root)
+		}
+	}
+}
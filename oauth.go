@@ -0,0 +1,119 @@
+package popgun
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// TokenAuthorizator is implemented by authorizators accepting OAuth 2.0
+// bearer tokens with the SASLXOAuth2 and SASLOAuthBearer mechanisms.
+type TokenAuthorizator interface {
+	// AuthorizeToken checks that token grants access to the maildrop of
+	// username, e.g. by introspecting it at the authorization server, and
+	// returns the user.
+	AuthorizeToken(conn net.Conn, username, token string) (backends.User, error)
+}
+
+// SASLXOAuth2 is the XOAUTH2 mechanism of Gmail and Office 365, sending
+// the username and a bearer token as
+//
+//	user=alice@example.com^Aauth=Bearer <token>^A^A
+//
+// The authorizator must implement TokenAuthorizator.
+func SASLXOAuth2(conn net.Conn, auth Authorizator) SASLServer {
+	return &tokenServer{conn: conn, auth: auth, parse: parseXOAuth2}
+}
+
+// SASLOAuthBearer is the OAUTHBEARER mechanism (RFC 7628). The client must
+// send the username as authorization identity. The authorizator must
+// implement TokenAuthorizator.
+func SASLOAuthBearer(conn net.Conn, auth Authorizator) SASLServer {
+	return &tokenServer{conn: conn, auth: auth, parse: parseOAuthBearer}
+}
+
+type tokenServer struct {
+	conn     net.Conn
+	auth     Authorizator
+	parse    func(response string) (username, token string, err error)
+	username string
+	token    string
+}
+
+func (s *tokenServer) Next(response []byte) ([]byte, bool, error) {
+	if _, ok := s.auth.(TokenAuthorizator); !ok {
+		return nil, false, fmt.Errorf("Token authentication not supported")
+	}
+	if response == nil {
+		// ask for the token
+		return nil, false, nil
+	}
+	username, token, err := s.parse(string(response))
+	if err != nil {
+		return nil, false, err
+	}
+	s.username, s.token = username, token
+	return nil, true, nil
+}
+
+func (s *tokenServer) Username() string {
+	return s.username
+}
+
+func (s *tokenServer) Authorize(username string) (backends.User, error) {
+	return s.auth.(TokenAuthorizator).AuthorizeToken(s.conn, username, s.token)
+}
+
+func parseXOAuth2(response string) (username, token string, err error) {
+	for _, field := range strings.Split(response, "\x01") {
+		switch {
+		case strings.HasPrefix(field, "user="):
+			username = field[len("user="):]
+		case strings.HasPrefix(field, "auth="):
+			token, err = bearerToken(field[len("auth="):])
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	if username == "" || token == "" {
+		return "", "", fmt.Errorf("Invalid XOAUTH2 response")
+	}
+	return username, token, nil
+}
+
+func parseOAuthBearer(response string) (username, token string, err error) {
+	fields := strings.Split(response, "\x01")
+	// the GS2 header, e.g. "n,a=alice@example.com,"
+	header := strings.Split(fields[0], ",")
+	if len(header) < 3 || (header[0] != "n" && header[0] != "y") {
+		return "", "", fmt.Errorf("Invalid OAUTHBEARER response")
+	}
+	if !strings.HasPrefix(header[1], "a=") || len(header[1]) == 2 {
+		return "", "", fmt.Errorf("Missing authorization identity")
+	}
+	username = decodeSASLName(header[1][2:])
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "auth=") {
+			token, err = bearerToken(field[len("auth="):])
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	if token == "" {
+		return "", "", fmt.Errorf("Invalid OAUTHBEARER response")
+	}
+	return username, token, nil
+}
+
+// bearerToken returns the token of an Authorization header value.
+func bearerToken(value string) (string, error) {
+	i := strings.Index(value, " ")
+	if i < 0 || !strings.EqualFold(value[:i], "Bearer") || strings.TrimSpace(value[i+1:]) == "" {
+		return "", fmt.Errorf("Unsupported authorization scheme")
+	}
+	return strings.TrimSpace(value[i+1:]), nil
+}
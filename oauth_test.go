@@ -0,0 +1,72 @@
+package popgun
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// tokenAuthorizator accepts the token "t0ken" for alice.
+type tokenAuthorizator struct {
+	secretAuthorizator
+}
+
+func (a tokenAuthorizator) AuthorizeToken(conn net.Conn, username, token string) (backends.User, error) {
+	if username != "alice" || token != "t0ken" {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	return testUser(username), nil
+}
+
+func TestAuthCommand_token(t *testing.T) {
+	encode := func(response string) string {
+		return base64.StdEncoding.EncodeToString([]byte(response))
+	}
+	tables := []struct {
+		auth     Authorizator
+		line     string
+		expected string
+	}{
+		{tokenAuthorizator{}, "AUTH XOAUTH2 " + encode("user=alice\x01auth=Bearer t0ken\x01\x01"), "+OK User Successfully Logged on"},
+		{tokenAuthorizator{}, "AUTH XOAUTH2 " + encode("user=alice\x01auth=Bearer wrong\x01\x01"), "-ERR [AUTH] Invalid username or password: Invalid token"},
+		{tokenAuthorizator{}, "AUTH XOAUTH2 " + encode("user=alice\x01auth=Basic YWxpY2U=\x01\x01"), "-ERR [AUTH] Authentication failed: Unsupported authorization scheme"},
+		{tokenAuthorizator{}, "AUTH OAUTHBEARER " + encode("n,a=alice,\x01host=mail.example.com\x01port=110\x01auth=bearer t0ken\x01\x01"), "+OK User Successfully Logged on"},
+		{tokenAuthorizator{}, "AUTH OAUTHBEARER " + encode("n,,\x01auth=Bearer t0ken\x01\x01"), "-ERR [AUTH] Authentication failed: Missing authorization identity"},
+		{tokenAuthorizator{}, "AUTH OAUTHBEARER " + encode("garbage"), "-ERR [AUTH] Authentication failed: Invalid OAUTHBEARER response"},
+		{secretAuthorizator{}, "AUTH XOAUTH2 " + encode("user=alice\x01auth=Bearer t0ken\x01\x01"), "-ERR [AUTH] Authentication failed: Token authentication not supported"},
+	}
+	for _, table := range tables {
+		listener := newPipeListener()
+		server := NewServer(table.auth, memory.New())
+		server.AllowInsecureAuth = true
+		server.SASL["XOAUTH2"] = SASLXOAuth2
+		server.SASL["OAUTHBEARER"] = SASLOAuthBearer
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		fmt.Fprintf(conn, "%s\r\n", table.line)
+		if line, _ := reader.ReadString('\n'); line != table.expected+"\r\n" {
+			t.Errorf("Expected %q for %q, but got %q", table.expected, table.line, line)
+		}
+		conn.Close()
+	}
+}
+
+func TestParseOAuthBearer_escaped(t *testing.T) {
+	username, token, err := parseOAuthBearer("y,a=odd=2Cname=3D,\x01auth=Bearer abc\x01\x01")
+	if err != nil || username != "odd,name=" || token != "abc" {
+		t.Errorf("Expected unescaped username and token, but got %q, %q, %v", username, token, err)
+	}
+}
@@ -0,0 +1,85 @@
+package popgun
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Option configures a Server when it is created, see NewServer.
+type Option func(s *Server)
+
+// Timeouts of sessions, see WithTimeouts. Zero values keep the defaults.
+type Timeouts struct {
+	// see Server.SessionTimeout
+	Session time.Duration
+	// see Server.WriteTimeout
+	Write time.Duration
+	// see Server.IdleTimeout
+	Idle time.Duration
+}
+
+// WithLogger logs errors to errorLog and debug messages to debugLog.
+// A nil logger keeps the default, which logs to stderr.
+func WithLogger(errorLog, debugLog Logger) Option {
+	return func(s *Server) {
+		if errorLog != nil {
+			s.ErrorLog = errorLog
+		}
+		if debugLog != nil {
+			s.DebugLog = debugLog
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used by ServeTLS.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.TLSConfig = config
+	}
+}
+
+// WithTimeouts sets the timeouts of sessions.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *Server) {
+		if timeouts.Session > 0 {
+			s.SessionTimeout = timeouts.Session
+		}
+		if timeouts.Write > 0 {
+			s.WriteTimeout = timeouts.Write
+		}
+		if timeouts.Idle > 0 {
+			s.IdleTimeout = timeouts.Idle
+		}
+	}
+}
+
+// WithGreeting sets the hostname and text of the greeting, see
+// Server.Hostname and Server.Greeting.
+func WithGreeting(hostname, greeting string) Option {
+	return func(s *Server) {
+		s.Hostname = hostname
+		s.Greeting = greeting
+	}
+}
+
+// WithMetrics reports metrics to m.
+func WithMetrics(m Metrics) Option {
+	return func(s *Server) {
+		s.Metrics = m
+	}
+}
+
+// WithHooks installs hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(s *Server) {
+		s.Hooks = hooks
+	}
+}
+
+// sessionTimeout returns the SessionTimeout, or its default.
+func (s *Server) sessionTimeout() time.Duration {
+	if s.SessionTimeout > 0 {
+		return s.SessionTimeout
+	}
+	return sessionTimeout
+}
@@ -0,0 +1,54 @@
+package popgun
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+func TestNewServer_options(t *testing.T) {
+	errorLog := log.New(ioutil.Discard, "error", 0)
+	debugLog := log.New(ioutil.Discard, "debug", 0)
+	config := &tls.Config{}
+	metrics := newCountingMetrics()
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{},
+		WithLogger(errorLog, debugLog),
+		WithTLSConfig(config),
+		WithTimeouts(Timeouts{Session: 5 * time.Minute, Idle: time.Minute}),
+		WithGreeting("pop.example.test", "Welcome to example.test"),
+		WithMetrics(metrics),
+	)
+	if server.ErrorLog != errorLog || server.DebugLog != debugLog {
+		t.Errorf("Expected loggers set")
+	}
+	if server.TLSConfig != config || server.Metrics != metrics {
+		t.Errorf("Expected TLS config and metrics set")
+	}
+	if server.sessionTimeout() != 5*time.Minute || server.IdleTimeout != time.Minute || server.WriteTimeout != 0 {
+		t.Errorf("Expected timeouts set, but got %v, %v, %v", server.sessionTimeout(), server.IdleTimeout, server.WriteTimeout)
+	}
+
+	listener := newPipeListener()
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "+OK pop.example.test Welcome to example.test\r\n" {
+		t.Errorf("Expected custom greeting, but got %q", line)
+	}
+
+	server = NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{}, WithLogger(nil, debugLog))
+	if server.ErrorLog == nil || server.DebugLog != debugLog {
+		t.Errorf("Expected default error log kept")
+	}
+	if server.sessionTimeout() != sessionTimeout {
+		t.Errorf("Expected default session timeout, but got %v", server.sessionTimeout())
+	}
+}
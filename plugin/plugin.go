@@ -0,0 +1,331 @@
+// Package plugin attaches Authorizator, Backend and ListFilter
+// implementations running in external processes, in the style of
+// hashicorp/go-plugin, so a packaged popgun binary can be extended without
+// recompiling it:
+//
+//	p, err := plugin.Start(exec.Command("/usr/lib/popgun/ldap-auth"))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer p.Close()
+//	server := popgun.NewServer(p.Authorizator(), backend)
+//
+// A plugin written in Go passes its implementations to Serve from its main
+// function. Plugins in other languages implement the handshake and the
+// JSON-RPC 1.0 services described below.
+//
+// Handshake: popgun starts the plugin with COOKIE_KEY=COOKIE_VALUE in its
+// environment. The plugin listens on a local socket and writes one line to
+// its standard output:
+//
+//	<PROTOCOL_VERSION>|<network>|<address>|<services>
+//
+// e.g. "1|unix|/tmp/popgun-plugin123/plugin.sock|Authorizator,ListFilter",
+// where network is "unix" or "tcp" (loopback only) and services lists the
+// services it serves, see Services. The plugin exits once its standard
+// input is closed. Further output is discarded, plugins should log to
+// standard error.
+//
+// Services are called with net/rpc/jsonrpc over connections to that
+// address, the methods are named after the interface methods, e.g.
+// "Backend.Retr", and take the argument and reply types of this package.
+//
+// The same services can be served on the network with ServeListener, e.g.
+// by a maildrop backend written in another language running on its own
+// hosts, and used through Dial instead of Start.
+//
+// This package is experimental, its protocol may change between releases.
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiwiz/popgun"
+)
+
+const (
+	// PROTOCOL_VERSION is the version of the handshake and services.
+	PROTOCOL_VERSION = 1
+	// COOKIE_KEY and COOKIE_VALUE are set in the environment of plugins,
+	// so they can tell they were started by popgun.
+	COOKIE_KEY   = "POPGUN_PLUGIN_COOKIE"
+	COOKIE_VALUE = "c1f4e0a2b7d94e6f8a3b5d2e9f7c6a01"
+	// START_TIMEOUT limits the time a plugin takes to write its handshake.
+	START_TIMEOUT = 10 * time.Second
+	// STOP_TIMEOUT is the time a plugin gets to exit after its standard
+	// input was closed, before it is killed.
+	STOP_TIMEOUT = 5 * time.Second
+)
+
+// Plugin is a started plugin process.
+type Plugin struct {
+	endpoint
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	client *rpc.Client
+	exited chan struct{}
+}
+
+// endpoint gives access to the services served by a plugin.
+type endpoint struct {
+	caller   caller
+	services map[string]bool
+}
+
+func newEndpoint(c caller, names []string) endpoint {
+	services := make(map[string]bool)
+	for _, name := range names {
+		services[name] = true
+	}
+	return endpoint{caller: c, services: services}
+}
+
+// Start starts the plugin cmd and connects to it. Stdin and Stdout of cmd
+// must not be set, they are used for the handshake.
+func Start(cmd *exec.Cmd) (*Plugin, error) {
+	if cmd.Stdin != nil || cmd.Stdout != nil {
+		return nil, fmt.Errorf("Stdin and Stdout of plugin %s are used by popgun", cmd.Path)
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, COOKIE_KEY+"="+COOKIE_VALUE)
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		stdinReader.Close()
+		stdinWriter.Close()
+		return nil, err
+	}
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	err = cmd.Start()
+	// the child holds its own copies
+	stdinReader.Close()
+	stdoutWriter.Close()
+	if err != nil {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		return nil, err
+	}
+	p := &Plugin{cmd: cmd, stdin: stdinWriter, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(p.exited)
+	}()
+
+	handshake := make(chan string, 1)
+	go func() {
+		defer stdoutReader.Close()
+		reader := bufio.NewReader(stdoutReader)
+		line, _ := reader.ReadString('\n')
+		handshake <- line
+		io.Copy(ioutil.Discard, reader)
+	}()
+	timer := time.NewTimer(START_TIMEOUT)
+	defer timer.Stop()
+	var line string
+	select {
+	case line = <-handshake:
+	case <-timer.C:
+		p.kill()
+		return nil, fmt.Errorf("Plugin %s did not start within %v", cmd.Path, START_TIMEOUT)
+	}
+	if err := p.connect(line); err != nil {
+		p.kill()
+		return nil, fmt.Errorf("Error starting plugin %s: %v", cmd.Path, err)
+	}
+	return p, nil
+}
+
+// connect parses the handshake line of the plugin and connects to it.
+func (p *Plugin) connect(line string) error {
+	if line == "" {
+		return fmt.Errorf("Plugin exited without handshake")
+	}
+	fields := strings.Split(strings.TrimSpace(line), "|")
+	if len(fields) != 4 {
+		return fmt.Errorf("Invalid handshake %q", line)
+	}
+	if version, err := strconv.Atoi(fields[0]); err != nil || version != PROTOCOL_VERSION {
+		return fmt.Errorf("Unsupported protocol version %s", fields[0])
+	}
+	network, address := fields[1], fields[2]
+	switch network {
+	case "unix":
+	case "tcp":
+		host, _, err := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("Plugin address %s is not a loopback address", address)
+		}
+	default:
+		return fmt.Errorf("Unsupported network %s", network)
+	}
+	conn, err := net.DialTimeout(network, address, START_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	p.client = jsonrpc.NewClient(conn)
+	p.endpoint = newEndpoint(p.client, strings.Split(fields[3], ","))
+	return nil
+}
+
+// kill kills the plugin process and waits for it to exit.
+func (p *Plugin) kill() {
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	<-p.exited
+}
+
+// Exited returns a channel which is closed when the plugin process exited.
+func (p *Plugin) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Close closes the connection to the plugin and waits for it to exit,
+// killing it after STOP_TIMEOUT.
+func (p *Plugin) Close() error {
+	err := p.client.Close()
+	p.stdin.Close()
+	timer := time.NewTimer(STOP_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+	case <-timer.C:
+		p.kill()
+	}
+	return err
+}
+
+// Authorizator returns the Authorizator served by the plugin, nil if it
+// serves none.
+func (e endpoint) Authorizator() popgun.Authorizator {
+	if !e.services[SERVICE_AUTHORIZATOR] {
+		return nil
+	}
+	return &authorizator{client: e.caller}
+}
+
+// Backend returns the Backend served by the plugin, nil if it serves none.
+func (e endpoint) Backend() popgun.Backend {
+	if !e.services[SERVICE_BACKEND] {
+		return nil
+	}
+	return &backend{client: e.caller}
+}
+
+// ListFilter returns the ListFilter served by the plugin, nil if it serves
+// none.
+func (e endpoint) ListFilter() popgun.ListFilter {
+	if !e.services[SERVICE_LIST_FILTER] {
+		return nil
+	}
+	return &listFilter{client: e.caller}
+}
+
+// Services are the implementations served by a plugin, nil ones are not
+// served.
+type Services struct {
+	Authorizator popgun.Authorizator
+	Backend      popgun.Backend
+	ListFilter   popgun.ListFilter
+}
+
+// Serve serves services to the popgun process which started the plugin.
+// It is called from the main function of plugins written in Go and returns
+// once popgun closed the plugin.
+func Serve(services Services) error {
+	if os.Getenv(COOKIE_KEY) != COOKIE_VALUE {
+		return fmt.Errorf("This is a popgun plugin, it is started by popgun")
+	}
+	server, names, err := newServer(services)
+	if err != nil {
+		return err
+	}
+
+	// the socket is only accessible to the user of the plugin
+	dir, err := ioutil.TempDir("", "popgun-plugin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "plugin.sock"))
+	if err != nil {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	addr := listener.Addr()
+	fmt.Fprintf(os.Stdout, "%d|%s|%s|%s\n", PROTOCOL_VERSION, addr.Network(), addr.String(), strings.Join(names, ","))
+	go serve(listener, server)
+	_, err = io.Copy(ioutil.Discard, os.Stdin)
+	return err
+}
+
+// ServeListener serves services to popgun servers connecting to listener
+// with Dial, e.g. a tls.NewListener, until the listener is closed.
+func ServeListener(listener net.Listener, services Services) error {
+	server, _, err := newServer(services)
+	if err != nil {
+		return err
+	}
+	return serve(listener, server)
+}
+
+// newServer registers services and returns their names.
+func newServer(services Services) (*rpc.Server, []string, error) {
+	server := rpc.NewServer()
+	var names []string
+	register := func(name string, service interface{}) error {
+		names = append(names, name)
+		return server.RegisterName(name, service)
+	}
+	var err error
+	if services.Authorizator != nil {
+		err = register(SERVICE_AUTHORIZATOR, &authorizatorService{services.Authorizator})
+	}
+	if err == nil && services.Backend != nil {
+		err = register(SERVICE_BACKEND, &backendService{services.Backend})
+	}
+	if err == nil && services.ListFilter != nil {
+		err = register(SERVICE_LIST_FILTER, &listFilterService{services.ListFilter})
+	}
+	if err == nil {
+		err = server.RegisterName(SERVICE_PLUGIN, &pluginService{names: names})
+	}
+	return server, names, err
+}
+
+// serve serves connections to listener until it is closed.
+func serve(listener net.Listener, server *rpc.Server) error {
+	var backoff popgun.AcceptBackoff
+	for {
+		conn, err := listener.Accept()
+		if delay, temporary := backoff.Next(err); err != nil {
+			if !temporary {
+				return err
+			}
+			time.Sleep(delay)
+			continue
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
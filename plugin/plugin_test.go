@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// TestMain serves the test plugin if the test binary was started as one.
+func TestMain(m *testing.M) {
+	if os.Getenv(COOKIE_KEY) == COOKIE_VALUE {
+		if os.Getenv("POPGUN_PLUGIN_TEST") == "garbage" {
+			fmt.Println("not a plugin")
+			os.Exit(0)
+		}
+		backend := memory.New()
+		backend.Deliver("alice", "a", "Subject: a\r\n\r\nfirst\r\n")
+		backend.Deliver("alice", "b", "Subject: b\r\n\r\nsecond\r\n")
+		if err := Serve(Services{Authorizator: secretAuthorizator{}, Backend: backend, ListFilter: hideFilter{}}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// secretAuthorizator accepts the password "secret".
+type secretAuthorizator struct{}
+
+func (secretAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	if password != "secret" {
+		return nil, fmt.Errorf("Invalid password for %s from %s", username, conn.RemoteAddr())
+	}
+	return User(username), nil
+}
+
+// hideFilter hides the message "b".
+type hideFilter struct{}
+
+func (hideFilter) Visible(user backends.User, uid string) bool {
+	return uid != "b"
+}
+
+type testConn struct {
+	net.Conn
+}
+
+func (testConn) RemoteAddr() net.Addr {
+	return remoteAddr("192.0.2.1:4711")
+}
+
+func TestStart(t *testing.T) {
+	p, err := Start(exec.Command(os.Args[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := p.Authorizator()
+	if _, err := auth.Authorize(testConn{}, "alice", "wrong"); err == nil || !strings.Contains(err.Error(), "from 192.0.2.1:4711") {
+		t.Errorf("Expected the error of the plugin, but got %v", err)
+	}
+	user, err := auth.Authorize(testConn{}, "alice", "secret")
+	if err != nil || user.Username() != "alice" {
+		t.Fatalf("Expected alice to be authorized, but got %v, %v", user, err)
+	}
+
+	backend := p.Backend()
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if messages, octets, err := backend.Stat(user); err != nil || messages != 2 || octets != 43 {
+		t.Errorf("Expected 2 messages of 43 octets, but got %d, %d, %v", messages, octets, err)
+	}
+	if message, err := backend.Retr(user, 2); err != nil || !strings.Contains(message, "second") {
+		t.Errorf("Expected the second message, but got %q, %v", message, err)
+	}
+	if exists, uid, err := backend.UidlMessage(user, 1); err != nil || !exists || uid != "a" {
+		t.Errorf("Expected UID a, but got %v, %q, %v", exists, uid, err)
+	}
+	if _, err := backend.Retr(user, 3); err == nil {
+		t.Error("Expected an error retrieving a missing message")
+	}
+	if err := backend.Dele(user, 1); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := backend.Update(user); err != nil || result.Removed != 1 {
+		t.Errorf("Expected 1 message removed, but got %+v, %v", result, err)
+	}
+	if err := backend.Unlock(user); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := p.ListFilter()
+	if !filter.Visible(user, "a") || filter.Visible(user, "b") {
+		t.Error("Expected the filter of the plugin to hide b")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-p.Exited():
+	default:
+		t.Error("Expected the plugin to exit when closed")
+	}
+	if filter.Visible(user, "a") {
+		t.Error("Expected a closed filter to hide all messages")
+	}
+}
+
+func TestStart_invalidHandshake(t *testing.T) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "POPGUN_PLUGIN_TEST=garbage")
+	if _, err := Start(cmd); err == nil || !strings.Contains(err.Error(), "Invalid handshake") {
+		t.Errorf("Expected an invalid handshake, but got %v", err)
+	}
+}
+
+func TestServe_notStartedByPopgun(t *testing.T) {
+	if err := Serve(Services{}); err == nil {
+		t.Error("Expected Serve to refuse running outside of popgun")
+	}
+}
@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+)
+
+// DEFAULT_CALL_TIMEOUT is the default of Remote.Timeout.
+const DEFAULT_CALL_TIMEOUT = 30 * time.Second
+
+// Remote is a connection to services served on the network with
+// ServeListener, e.g. a maildrop backend written in another language
+// running on its own hosts. Its methods are the same as the ones of Plugin.
+//
+// A call failing because the connection was lost returns an error, the
+// next call reconnects. Calls are not retried, as the remote service may
+// have executed them.
+type Remote struct {
+	endpoint
+	// Timeout limits every call including connecting, DEFAULT_CALL_TIMEOUT
+	// by default.
+	Timeout time.Duration
+
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	client    *rpc.Client
+	closed    bool
+}
+
+// Dial connects to the services served at address, over TLS if tlsConfig
+// is not nil.
+func Dial(network, address string, tlsConfig *tls.Config) (*Remote, error) {
+	r := &Remote{
+		Timeout:   DEFAULT_CALL_TIMEOUT,
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+	}
+	var names []string
+	if err := r.Call(SERVICE_PLUGIN+".Services", Empty{}, &names); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("Error connecting to %s: %v", address, err)
+	}
+	r.endpoint = newEndpoint(r, names)
+	return r, nil
+}
+
+// connection returns the connection to the remote services, connecting if
+// there is none.
+func (r *Remote) connection() (*rpc.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if r.client != nil {
+		return r.client, nil
+	}
+	dialer := &net.Dialer{Timeout: r.Timeout}
+	var conn net.Conn
+	var err error
+	if r.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, r.network, r.address, r.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(r.network, r.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.client = jsonrpc.NewClient(conn)
+	return r.client, nil
+}
+
+// drop closes client, so the next call reconnects.
+func (r *Remote) drop(client *rpc.Client) {
+	r.mu.Lock()
+	if r.client == client {
+		r.client = nil
+	}
+	r.mu.Unlock()
+	client.Close()
+}
+
+// Call calls serviceMethod of the remote services and waits at most
+// Timeout for its reply.
+func (r *Remote) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	client, err := r.connection()
+	if err != nil {
+		return err
+	}
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(r.Timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error == rpc.ErrShutdown || call.Error == io.ErrUnexpectedEOF {
+			r.drop(client)
+		}
+		return call.Error
+	case <-timer.C:
+		// the reply must not be written once the call returned
+		r.drop(client)
+		<-call.Done
+		return fmt.Errorf("Call %s to %s timed out after %v", serviceMethod, r.address, r.Timeout)
+	}
+}
+
+// Close closes the connection to the remote services.
+func (r *Remote) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// slowBackend blocks Retr until release is closed.
+type slowBackend struct {
+	*memory.Backend
+	release chan struct{}
+}
+
+func (b *slowBackend) Retr(user backends.User, msgId int) (string, error) {
+	<-b.release
+	return b.Backend.Retr(user, msgId)
+}
+
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &slowBackend{Backend: memory.New(), release: make(chan struct{})}
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nfirst\r\n")
+	go ServeListener(listener, Services{Backend: backend})
+
+	remote, err := Dial("tcp", listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if remote.Authorizator() != nil || remote.ListFilter() != nil {
+		t.Error("Expected only the backend to be served")
+	}
+	remote.Timeout = 50 * time.Millisecond
+	bridge := remote.Backend()
+	user := User("alice")
+	if err := bridge.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	if uids, err := bridge.Uidl(user); err != nil || strings.Join(uids, ",") != "a" {
+		t.Errorf("Expected UIDs [a], but got %v, %v", uids, err)
+	}
+	if _, err := bridge.Retr(user, 1); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected Retr to time out, but got %v", err)
+	}
+	close(backend.release)
+
+	// the next call reconnects
+	remote.Timeout = DEFAULT_CALL_TIMEOUT
+	if message, err := bridge.Retr(user, 1); err != nil || !strings.Contains(message, "first") {
+		t.Errorf("Expected the message after reconnecting, but got %q, %v", message, err)
+	}
+	if err := bridge.Unlock(user); err != nil {
+		t.Fatal(err)
+	}
+
+	remote.Close()
+	if _, _, err := bridge.Stat(user); err == nil {
+		t.Error("Expected calls to fail after Close")
+	}
+}
+
+func TestDial_refused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	if _, err := Dial("tcp", addr, nil); err == nil {
+		t.Error("Expected Dial to fail without a server")
+	}
+}
@@ -0,0 +1,291 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Names of the services a plugin can serve. Every plugin also serves
+// SERVICE_PLUGIN, whose method Services replies the names of the others.
+const (
+	SERVICE_PLUGIN       = "Plugin"
+	SERVICE_AUTHORIZATOR = "Authorizator"
+	SERVICE_BACKEND      = "Backend"
+	SERVICE_LIST_FILTER  = "ListFilter"
+)
+
+// User is a user known to a plugin by name.
+type User string
+
+func (u User) Username() string {
+	return string(u)
+}
+
+// AuthorizeArgs are the arguments of Authorizator.Authorize. The reply is
+// the username of the authorized user, failures are returned as errors.
+type AuthorizeArgs struct {
+	Username   string
+	Password   string
+	RemoteAddr string
+}
+
+// UserArgs are the arguments of methods taking a user, a message number
+// and a number of lines, unused ones are zero.
+type UserArgs struct {
+	User  string
+	MsgId int
+	N     int
+}
+
+// VisibleArgs are the arguments of ListFilter.Visible.
+type VisibleArgs struct {
+	User string
+	Uid  string
+}
+
+// Empty is the reply of methods returning only an error.
+type Empty struct{}
+
+// StatReply is the reply of Backend.Stat.
+type StatReply struct {
+	Messages int
+	Octets   int
+}
+
+// MessageReply is the reply of Backend.ListMessage and
+// Backend.UidlMessage.
+type MessageReply struct {
+	Exists bool
+	Octets int
+	Uid    string
+}
+
+// caller calls methods of services, *rpc.Client or *Remote.
+type caller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+}
+
+type authorizator struct {
+	client caller
+}
+
+func (a *authorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	args := AuthorizeArgs{Username: username, Password: password}
+	if conn != nil {
+		args.RemoteAddr = conn.RemoteAddr().String()
+	}
+	var reply string
+	if err := a.client.Call("Authorizator.Authorize", args, &reply); err != nil {
+		return nil, err
+	}
+	return User(reply), nil
+}
+
+type listFilter struct {
+	client caller
+}
+
+// Visible hides messages if the plugin fails, so a broken filter does not
+// expose what it should hide.
+func (f *listFilter) Visible(user backends.User, uid string) bool {
+	var visible bool
+	err := f.client.Call("ListFilter.Visible", VisibleArgs{User: user.Username(), Uid: uid}, &visible)
+	return err == nil && visible
+}
+
+type backend struct {
+	client caller
+}
+
+func (b *backend) call(method string, user backends.User, msgId, n int, reply interface{}) error {
+	return b.client.Call("Backend."+method, UserArgs{User: user.Username(), MsgId: msgId, N: n}, reply)
+}
+
+func (b *backend) Stat(user backends.User) (messages, octets int, err error) {
+	var reply StatReply
+	err = b.call("Stat", user, 0, 0, &reply)
+	return reply.Messages, reply.Octets, err
+}
+
+func (b *backend) List(user backends.User) (octets []int, err error) {
+	err = b.call("List", user, 0, 0, &octets)
+	return octets, err
+}
+
+func (b *backend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	var reply MessageReply
+	err = b.call("ListMessage", user, msgId, 0, &reply)
+	return reply.Exists, reply.Octets, err
+}
+
+func (b *backend) Retr(user backends.User, msgId int) (message string, err error) {
+	err = b.call("Retr", user, msgId, 0, &message)
+	return message, err
+}
+
+func (b *backend) Dele(user backends.User, msgId int) error {
+	return b.call("Dele", user, msgId, 0, &Empty{})
+}
+
+func (b *backend) Rset(user backends.User) error {
+	return b.call("Rset", user, 0, 0, &Empty{})
+}
+
+func (b *backend) Uidl(user backends.User) (uids []string, err error) {
+	err = b.call("Uidl", user, 0, 0, &uids)
+	return uids, err
+}
+
+func (b *backend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	var reply MessageReply
+	err = b.call("UidlMessage", user, msgId, 0, &reply)
+	return reply.Exists, reply.Uid, err
+}
+
+func (b *backend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	err = b.call("Top", user, msgId, n, &lines)
+	return lines, err
+}
+
+func (b *backend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	err = b.call("Update", user, 0, 0, &result)
+	return result, err
+}
+
+func (b *backend) Lock(user backends.User) error {
+	return b.call("Lock", user, 0, 0, &Empty{})
+}
+
+func (b *backend) Unlock(user backends.User) error {
+	return b.call("Unlock", user, 0, 0, &Empty{})
+}
+
+// pluginService tells which services are served.
+type pluginService struct {
+	names []string
+}
+
+func (s *pluginService) Services(args Empty, reply *[]string) error {
+	*reply = s.names
+	return nil
+}
+
+// authorizatorService serves an Authorizator to popgun.
+type authorizatorService struct {
+	a popgun.Authorizator
+}
+
+func (s *authorizatorService) Authorize(args AuthorizeArgs, reply *string) error {
+	user, err := s.a.Authorize(remoteConn{addr: remoteAddr(args.RemoteAddr)}, args.Username, args.Password)
+	if err != nil {
+		return err
+	}
+	*reply = user.Username()
+	return nil
+}
+
+// listFilterService serves a ListFilter to popgun.
+type listFilterService struct {
+	f popgun.ListFilter
+}
+
+func (s *listFilterService) Visible(args VisibleArgs, reply *bool) error {
+	*reply = s.f.Visible(User(args.User), args.Uid)
+	return nil
+}
+
+// backendService serves a Backend to popgun.
+type backendService struct {
+	b popgun.Backend
+}
+
+func (s *backendService) Stat(args UserArgs, reply *StatReply) (err error) {
+	reply.Messages, reply.Octets, err = s.b.Stat(User(args.User))
+	return err
+}
+
+func (s *backendService) List(args UserArgs, reply *[]int) (err error) {
+	*reply, err = s.b.List(User(args.User))
+	return err
+}
+
+func (s *backendService) ListMessage(args UserArgs, reply *MessageReply) (err error) {
+	reply.Exists, reply.Octets, err = s.b.ListMessage(User(args.User), args.MsgId)
+	return err
+}
+
+func (s *backendService) Retr(args UserArgs, reply *string) (err error) {
+	*reply, err = s.b.Retr(User(args.User), args.MsgId)
+	return err
+}
+
+func (s *backendService) Dele(args UserArgs, reply *Empty) error {
+	return s.b.Dele(User(args.User), args.MsgId)
+}
+
+func (s *backendService) Rset(args UserArgs, reply *Empty) error {
+	return s.b.Rset(User(args.User))
+}
+
+func (s *backendService) Uidl(args UserArgs, reply *[]string) (err error) {
+	*reply, err = s.b.Uidl(User(args.User))
+	return err
+}
+
+func (s *backendService) UidlMessage(args UserArgs, reply *MessageReply) (err error) {
+	reply.Exists, reply.Uid, err = s.b.UidlMessage(User(args.User), args.MsgId)
+	return err
+}
+
+func (s *backendService) Top(args UserArgs, reply *[]string) (err error) {
+	*reply, err = s.b.Top(User(args.User), args.MsgId, args.N)
+	return err
+}
+
+func (s *backendService) Update(args UserArgs, reply *backends.UpdateResult) (err error) {
+	*reply, err = s.b.Update(User(args.User))
+	return err
+}
+
+func (s *backendService) Lock(args UserArgs, reply *Empty) error {
+	return s.b.Lock(User(args.User))
+}
+
+func (s *backendService) Unlock(args UserArgs, reply *Empty) error {
+	return s.b.Unlock(User(args.User))
+}
+
+// remoteConn stands in for the connection of the client in the plugin,
+// only its remote address is known.
+type remoteConn struct {
+	addr remoteAddr
+}
+
+func (c remoteConn) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("Connection of %s is not available to plugins", c.addr)
+}
+
+func (c remoteConn) Write(b []byte) (int, error) {
+	return 0, fmt.Errorf("Connection of %s is not available to plugins", c.addr)
+}
+
+func (c remoteConn) Close() error                       { return nil }
+func (c remoteConn) LocalAddr() net.Addr                { return remoteAddr("") }
+func (c remoteConn) RemoteAddr() net.Addr               { return c.addr }
+func (c remoteConn) SetDeadline(t time.Time) error      { return nil }
+func (c remoteConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c remoteConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type remoteAddr string
+
+func (a remoteAddr) Network() string {
+	return "tcp"
+}
+
+func (a remoteAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,132 @@
+package popgun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// DEFAULT_POLICY_TIMEOUT is the default of Policy.Timeout.
+const DEFAULT_POLICY_TIMEOUT = 50 * time.Millisecond
+
+// PolicyModule is untrusted code, e.g. a per-tenant customization, running
+// in a sandbox such as a WebAssembly runtime. It has no access to the host
+// besides the JSON encoded input and output of its exported functions.
+type PolicyModule interface {
+	// Call calls the exported function with input and returns its output.
+	// It must return when ctx is done.
+	Call(ctx context.Context, function string, input []byte) ([]byte, error)
+}
+
+// PolicyRuntime instantiates policy modules from their code, e.g. a
+// WebAssembly runtime limiting the memory and CPU time of every module.
+// popgun does not bundle a runtime, so it does not depend on one.
+type PolicyRuntime interface {
+	Instantiate(ctx context.Context, code []byte) (PolicyModule, error)
+}
+
+// Policy implements hooks of the server with the exported functions of a
+// PolicyModule. Every call is limited by Timeout. A failing call hides
+// messages and leaves scores unchanged, and is logged:
+//
+//	visible({"user": "alice", "uid": "1a2b"}) -> {"visible": true}
+//	score({"ip": "192.0.2.1", "user": "alice", "score": 2.5}) -> {"score": 4}
+//
+// A Policy is a ListFilter, see FilteredBackend. Scorer wraps an
+// AbuseScorer with the score function.
+type Policy struct {
+	Module PolicyModule
+	// Timeout limits every call, DEFAULT_POLICY_TIMEOUT by default.
+	Timeout  time.Duration
+	ErrorLog Logger
+}
+
+// NewPolicy creates a policy calling module.
+func NewPolicy(module PolicyModule) *Policy {
+	return &Policy{Module: module, Timeout: DEFAULT_POLICY_TIMEOUT}
+}
+
+// call calls function with input encoded as JSON and decodes its output
+// into output. Panics of the module are returned as errors.
+func (p *Policy) call(function string, input, output interface{}) (err error) {
+	in, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Policy function %s panicked: %v", function, r)
+		}
+	}()
+	out, err := p.Module.Call(ctx, function, in)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("Policy function %s failed: %v", function, err)
+	}
+	if err := json.Unmarshal(out, output); err != nil {
+		return fmt.Errorf("Invalid output of policy function %s: %v", function, err)
+	}
+	return nil
+}
+
+func (p *Policy) logError(err error) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf("%v", err)
+	}
+}
+
+// Visible calls the visible function of the module.
+func (p *Policy) Visible(user backends.User, uid string) bool {
+	input := struct {
+		User string `json:"user"`
+		Uid  string `json:"uid"`
+	}{user.Username(), uid}
+	var output struct {
+		Visible bool `json:"visible"`
+	}
+	if err := p.call("visible", input, &output); err != nil {
+		p.logError(err)
+		return false
+	}
+	return output.Visible
+}
+
+// Scorer returns scorer with its scores adjusted by the score function of
+// the module. The returned scorer does not implement AbuseCounter, so a
+// SessionBudget needs its own Counter.
+func (p *Policy) Scorer(scorer AbuseScorer) AbuseScorer {
+	return &policyScorer{AbuseScorer: scorer, policy: p}
+}
+
+type policyScorer struct {
+	AbuseScorer
+	policy *Policy
+}
+
+func (s *policyScorer) Score(ip, username string) float64 {
+	score := s.AbuseScorer.Score(ip, username)
+	input := struct {
+		Ip    string  `json:"ip"`
+		User  string  `json:"user"`
+		Score float64 `json:"score"`
+	}{ip, username, score}
+	var output struct {
+		Score *float64 `json:"score"`
+	}
+	err := s.policy.call("score", input, &output)
+	if err == nil && output.Score == nil {
+		err = fmt.Errorf("Policy function score returned no score")
+	}
+	if err != nil {
+		s.policy.logError(err)
+		return score
+	}
+	return *output.Score
+}
@@ -0,0 +1,91 @@
+package popgun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+// funcModule runs Go functions in place of the exported functions of a
+// sandboxed module.
+type funcModule map[string]func(ctx context.Context, input map[string]interface{}) (interface{}, error)
+
+func (m funcModule) Call(ctx context.Context, function string, input []byte) ([]byte, error) {
+	f, ok := m[function]
+	if !ok {
+		return nil, fmt.Errorf("No such function: %s", function)
+	}
+	var in map[string]interface{}
+	if err := json.Unmarshal(input, &in); err != nil {
+		return nil, err
+	}
+	out, err := f(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
+type fixedScorer float64
+
+func (s fixedScorer) Record(ip, username, signal string) {}
+
+func (s fixedScorer) Score(ip, username string) float64 {
+	return float64(s)
+}
+
+func TestPolicy_Visible(t *testing.T) {
+	var logged bytes.Buffer
+	policy := NewPolicy(funcModule{
+		"visible": func(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+			switch input["uid"] {
+			case "slow":
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case "panic":
+				panic("out of bounds")
+			case "garbage":
+				return "not an object", nil
+			}
+			return map[string]bool{"visible": input["user"] == "alice" && input["uid"] == "a"}, nil
+		},
+	})
+	policy.ErrorLog = log.New(&logged, "", 0)
+
+	tables := map[string]bool{"a": true, "b": false, "slow": false, "panic": false, "garbage": false}
+	for uid, expected := range tables {
+		if visible := policy.Visible(testUser("alice"), uid); visible != expected {
+			t.Errorf("Expected visible %v for %s, but got %v", expected, uid, visible)
+		}
+	}
+	for _, expected := range []string{"deadline exceeded", "panicked: out of bounds", "Invalid output of policy function visible"} {
+		if !strings.Contains(logged.String(), expected) {
+			t.Errorf("Expected %q to be logged, but got %q", expected, logged.String())
+		}
+	}
+}
+
+func TestPolicy_Scorer(t *testing.T) {
+	policy := NewPolicy(funcModule{
+		"score": func(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+			if input["user"] == "trusted" {
+				return map[string]float64{"score": 0}, nil
+			}
+			if input["user"] == "broken" {
+				return map[string]string{}, nil
+			}
+			return map[string]float64{"score": input["score"].(float64) * 2}, nil
+		},
+	})
+	scorer := policy.Scorer(fixedScorer(1.5))
+	tables := map[string]float64{"alice": 3, "trusted": 0, "broken": 1.5}
+	for username, expected := range tables {
+		if score := scorer.Score("192.0.2.1", username); score != expected {
+			t.Errorf("Expected score %v for %s, but got %v", expected, username, score)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package popgun
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/kiwiz/popgun/backends"
@@ -14,6 +15,8 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,11 +47,123 @@ type Backend interface {
 	Uidl(user backends.User) (uids []string, err error)
 	UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error)
 	Top(user backends.User, msgId int, n int) (lines []string, err error)
-	Update(user backends.User) error
+	Update(user backends.User) (result backends.UpdateResult, err error)
 	Lock(user backends.User) error
 	Unlock(user backends.User) error
 }
 
+// MessageIterator iterates over a maildrop listing, see ListIterBackend.
+type MessageIterator = backends.MessageIterator
+
+// ContextRetrBackend can be implemented by backends supporting cancellation of
+// message retrieval, RETR then passes the session context which is cancelled
+// as soon as the client connection is lost.
+type ContextRetrBackend interface {
+	RetrContext(ctx context.Context, user backends.User, msgId int) (message string, err error)
+}
+
+// MessageBackend can be implemented by backends giving access to messages
+// through backends.Message. RETR and TOP then read only the parts of the
+// message they send, instead of loading it whole with Retr or Top.
+// The context is cancelled as soon as a read from or write to the client
+// fails, so streaming backends can stop pulling the message from upstream.
+type MessageBackend interface {
+	Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error)
+}
+
+// ListIterBackend can be implemented by backends with very large maildrops,
+// LIST and UIDL are then streamed to the client from the iterator instead
+// of materializing the whole listing with List and Uidl.
+type ListIterBackend interface {
+	ListIter(user backends.User) (MessageIterator, error)
+}
+
+// ChangeNotifier can be implemented by backends detecting changes of a
+// locked maildrop by other processes, e.g. an external expunge. The
+// session then ends with -ERR [SYS/TEMP] on the next command instead of
+// serving stale message numbers, and deletions are not committed.
+type ChangeNotifier interface {
+	// Changed returns a channel which is closed when the maildrop of user
+	// changes while it is locked.
+	Changed(user backends.User) <-chan struct{}
+}
+
+// NewMailNotifier can be implemented by backends able to signal deliveries
+// to a maildrop, the XIDLE command then lets clients wait for new mail
+// instead of polling, see Server.AllowIdle.
+type NewMailNotifier interface {
+	// NewMail returns a channel which is closed when a message is
+	// delivered to the maildrop of user, and a function releasing it.
+	NewMail(user backends.User) (<-chan struct{}, func())
+}
+
+// UndeleBackend can be implemented by backends able to unmark a single
+// message marked as deleted, the XUNDELE command is then available.
+type UndeleBackend interface {
+	// Undele unmarks message msgId. It returns false if the message isn't
+	// marked as deleted.
+	Undele(user backends.User, msgId int) (bool, error)
+}
+
+// RecoveryBackend can be implemented by backends keeping expunged messages
+// for a grace period. Operators can then list and recover them through
+// the AdminHandler.
+type RecoveryBackend interface {
+	// Expunged lists the recoverable messages of username.
+	Expunged(username string) ([]backends.ExpungedMessage, error)
+	// Recover puts the expunged message uid back into the maildrop of
+	// username.
+	Recover(username, uid string) error
+}
+
+// TrashBackend can be implemented by backends moving messages removed on
+// Update to a trash instead of deleting them. PurgeTrash deletes those
+// kept for longer than the retention of the user and should be run
+// periodically.
+type TrashBackend interface {
+	PurgeTrash(user backends.User) (purged int, err error)
+}
+
+// QuotaBackend can be implemented by backends knowing the storage quota of
+// a maildrop. The usage is then reported to the client after login.
+type QuotaBackend interface {
+	Quota(user backends.User) (backends.Quota, error)
+}
+
+// NewUidlBackend can be implemented by backends finding the messages
+// following a message without listing the whole maildrop, e.g. from an
+// index. XNEWUIDL otherwise filters the UIDL listing.
+type NewUidlBackend interface {
+	// UidlAfter returns the messages not marked as deleted following the
+	// message with uid, found is false if there is no such message.
+	UidlAfter(user backends.User, uid string) (messages []backends.MessageInfo, found bool, err error)
+}
+
+// BannerBackend can be implemented by backends summarizing a maildrop,
+// e.g. "12 messages (4034 octets), 2 new since last login". The summary
+// replaces the text of the +OK response to a successful login.
+type BannerBackend interface {
+	Banner(user backends.User) (string, error)
+}
+
+// LoginNotifier can be implemented by backends and authorizators with a
+// short notice for a user, e.g. "quota 80% full" or a localized message of
+// the day. Notices are cut to 100 octets and added in parentheses to the
+// +OK response to a successful login, as POP3 has no other way to tell the
+// user.
+type LoginNotifier interface {
+	LoginNotice(user backends.User) (string, error)
+}
+
+const (
+	// size of the buffer used to read client commands
+	readBufferSize = 4096
+	// number of pipelined commands read ahead of execution
+	inputQueueSize = 16
+	// time after which a session is closed, see Server.SessionTimeout
+	sessionTimeout = 1 * time.Minute
+)
+
 var (
 	ErrInvalidState = fmt.Errorf("Invalid state")
 )
@@ -56,23 +171,66 @@ var (
 //---------------CLIENT
 
 type Client struct {
+	id                uint64
+	server            *Server
 	conn              net.Conn
 	commands          map[string]Executable
-	printer           *Printer
+	printer           ResponseWriter
+	out               *Printer // of the connection, also printer unless tests replace it
 	isAlive           bool
 	currentState      int
 	authorizator      Authorizator
 	backend           Backend
 	user              backends.User
 	username          string
+	loggedIn          string
+	master            string
+	readOnly          bool
+	listings          map[string]*renderedListing
+	listener          string
+	accepted          time.Time
+	kickedBy          string
+	hostname          string
+	timestamp         string
+	routedToken       string
 	lastCommand       string
 	allowInsecureAuth bool
+	retrCount         int
+	deleCount         int
+	memory            int
+	memoryPeak        int
+	started           time.Time
+	commandCount      int
+	sentOctets        int64
+	features          Features
+	changed           <-chan struct{}
+	// client input, and input read ahead by a command to be handled next
+	inputs  <-chan readResult
+	pending *readResult
+	// set when the abuse score requires TLS for authentication
+	requireTLS bool
+	// counted against MaxConnections and MaxConnectionsPerIP, or the
+	// limit it is refused for, see admit
+	admitted  bool
+	overLimit string
+	// whether a session was counted against the budget of the user, see
+	// spendBudget
+	budgetSpent bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	closeReason CloseReason
+	tlsState    *tls.ConnectionState
+	tenant      *tenantGroup
+	trace       int32
 
 	ErrorLog Logger
 	DebugLog Logger
 }
 
-func newClient(conn net.Conn, authorizator Authorizator, backend Backend, allowInsecureAuth bool) *Client {
+func newClient(s *Server, conn net.Conn) *Client {
 	commands := make(map[string]Executable)
 
 	commands["QUIT"] = QuitCommand{}
@@ -87,68 +245,555 @@ func newClient(conn net.Conn, authorizator Authorizator, backend Backend, allowI
 	commands["UIDL"] = UidlCommand{}
 	commands["CAPA"] = CapaCommand{}
 	commands["TOP"] = TopCommand{}
+	commands["APOP"] = ApopCommand{}
+	commands["AUTH"] = AuthCommand{}
+	commands["XIDLE"] = XIdleCommand{}
+	commands["XUNDELE"] = XUndeleCommand{}
+	commands["XPASSWD"] = XPasswdCommand{}
+	commands["XNEWUIDL"] = XNewUidlCommand{}
+	for name, cmd := range s.Commands {
+		commands[strings.ToUpper(name)] = cmd
+	}
 
 	return &Client{
+		id:                atomic.AddUint64(&s.lastId, 1),
+		server:            s,
 		conn:              conn,
 		commands:          commands,
 		currentState:      STATE_AUTHORIZATION,
-		authorizator:      authorizator,
-		backend:           backend,
-		allowInsecureAuth: allowInsecureAuth,
+		authorizator:      s.auth,
+		backend:           s.backend,
+		allowInsecureAuth: s.AllowInsecureAuth,
+		hostname:          s.Hostname,
+		features:          DefaultFeatures,
+		ErrorLog:          s.ErrorLog,
+		DebugLog:          s.DebugLog,
 	}
 }
 
-func (c Client) AllowAuth() bool {
+func (c *Client) AllowAuth() bool {
 	tlsConn, _ := c.conn.(*tls.Conn)
 	return c.allowInsecureAuth || tlsConn != nil
 }
 
-func (c Client) handle() {
-	defer c.conn.Close()
-	c.conn.SetReadDeadline(time.Now().Add(1 * time.Minute))
-	c.printer = NewPrinter(c.conn)
+// Hostname returns the hostname advertised to the client, empty if none.
+func (c *Client) Hostname() string {
+	return c.hostname
+}
+
+// ID returns the identifier of the session, unique within the server.
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+// SetTrace turns protocol tracing to DebugLog on or off for this session.
+// It is safe to call from any goroutine.
+func (c *Client) SetTrace(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.trace, v)
+}
+
+func (c *Client) Tracing() bool {
+	return atomic.LoadInt32(&c.trace) == 1
+}
+
+// NewDetachedClient returns a session of s on conn, which is not read from
+// or written to, in state with user logged in, unless nil. Commands run on
+// it respond to w. It lets commands be unit tested without a connection,
+// see package poptest.
+func NewDetachedClient(s *Server, conn net.Conn, w ResponseWriter, state int, user backends.User) *Client {
+	c := newClient(s, conn)
+	c.out = NewPrinter(conn)
+	c.printer = w
+	c.currentState = state
+	if user != nil {
+		c.user = user
+		c.username = user.Username()
+		c.loggedIn = user.Username()
+	}
+	return c
+}
+
+// Response returns the writer commands respond to.
+func (c *Client) Response() ResponseWriter {
+	return c.printer
+}
+
+// State returns the state of the session, e.g. STATE_TRANSACTION.
+func (c *Client) State() int {
+	return c.currentState
+}
+
+// User returns the logged in user, nil before login.
+func (c *Client) User() backends.User {
+	return c.user
+}
+
+// Backend returns the backend of the maildrop of the session.
+func (c *Client) Backend() Backend {
+	return c.backend
+}
+
+// traceInput logs a line received from the client, hiding passwords.
+func (c *Client) traceInput(input string) {
+	line := strings.TrimRight(input, "\r\n")
+	fields := strings.SplitN(line, " ", 3)
+	if cmd := strings.ToUpper(fields[0]); cmd == "PASS" || cmd == "XPASSWD" {
+		line = cmd + " ***"
+	} else if cmd == "AUTH" && len(fields) == 3 {
+		// the initial response of the SASL exchange
+		line = cmd + " " + fields[1] + " ***"
+	}
+	c.DebugLog.Printf("[%d] C: %s", c.id, line)
+}
+
+// traceConn logs everything written to the connection while tracing is on.
+type traceConn struct {
+	net.Conn
+	client *Client
+}
+
+func (t traceConn) Write(b []byte) (int, error) {
+	t.client.throttle(len(b))
+	t.client.sentOctets += int64(len(b))
+	if t.client.Tracing() {
+		for _, line := range strings.SplitAfter(string(b), "\r\n") {
+			if line != "" {
+				t.client.DebugLog.Printf("[%d] S: %s", t.client.id, strings.TrimRight(line, "\r\n"))
+			}
+		}
+	}
+	n, err := t.Conn.Write(b)
+	if err != nil && t.client.cancel != nil {
+		// the client is gone, stop backend calls on its behalf like
+		// after a failed read
+		t.client.cancel()
+	}
+	return n, err
+}
+
+// RemoteAddr returns the network address of the connected client.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close terminates the session from outside of the command loop, e.g. when
+// kicking a client by policy or shutting the server down. The given reason
+// is reported to OnDisconnect instead of the resulting read error.
+func (c *Client) Close(reason CloseReason) error {
+	c.mu.Lock()
+	if c.closeReason == 0 {
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// Kick closes the session on behalf of actor, e.g. an admin, with
+// CLOSE_POLICY. The actor is required, so sessions can't be terminated
+// anonymously; it is logged and reported with the session_closed event.
+func (c *Client) Kick(actor string) error {
+	if actor == "" {
+		return fmt.Errorf("Kicking a session requires an actor")
+	}
+	c.mu.Lock()
+	c.kickedBy = actor
+	username := c.loggedIn
+	c.mu.Unlock()
+	c.ErrorLog.Printf("Session %d of user %q kicked by %s", c.id, username, actor)
+	return c.Close(CLOSE_POLICY)
+}
+
+// kicker returns the actor who kicked the session, see Kick.
+func (c *Client) kicker() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kickedBy
+}
+
+// readErrorReason classifies the error which ended the read loop.
+func (c *Client) readErrorReason(err error) CloseReason {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason != 0 {
+		return c.closeReason
+	}
+	if err == io.EOF {
+		return CLOSE_CLIENT_GONE
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return CLOSE_IDLE_TIMEOUT
+	}
+	return CLOSE_READ_ERROR
+}
+
+func (c *Client) handle() {
+	reason := CLOSE_QUIT
+	c.started = c.server.clock().Now()
+	defer func() {
+		c.conn.Close()
+		if c.user != nil {
+			c.DebugLog.Printf("Unlocking user %s due to %s", c.user.Username(), reason)
+			c.backend.Unlock(c.user)
+			c.user = nil
+		}
+		c.leaveTenant()
+		c.chargeBudget()
+		c.server.Metrics.Observe("session.memory.peak", float64(c.memoryPeak))
+		if c.server.AccessLog != nil {
+			c.server.AccessLog.logSession(c, reason)
+		}
+		c.exportEvent(Event{Type: EVENT_SESSION_CLOSED, CloseReason: reason.String(), KickedBy: c.kicker()})
+		c.server.sessionClosed(c, reason)
+	}()
+	// the session times out on the server's clock rather than with a read
+	// deadline, so tests can control it
+	timeout := c.server.clock().NewTimer(c.server.sessionTimeout())
+	defer timeout.Stop()
+	c.out = NewPrinter(traceConn{Conn: c.conn, client: c})
+	c.printer = c.out
+	c.out.WriteTimeout = c.server.WriteTimeout
+	c.out.Progress = func(sent int) error {
+		if c.server.Hooks.OnProgress != nil {
+			return c.server.Hooks.OnProgress(c, sent)
+		}
+		return nil
+	}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		start := c.server.clock().Now()
+		err := c.handshake(tlsConn)
+		c.server.Metrics.Observe("tls.handshake.duration", c.server.clock().Now().Sub(start).Seconds(), c.listener)
+		if err != nil {
+			c.DebugLog.Printf("[%d] TLS handshake failed: %v", c.id, err)
+			reason = CLOSE_READ_ERROR
+			return
+		}
+		c.out.Padding = c.server.ResponsePadding
+	}
+	defer c.printer.Flush()
 
 	c.isAlive = true
-	reader := bufio.NewReader(c.conn)
+	reader := bufio.NewReaderSize(c.conn, readBufferSize)
+	c.reserve(readBufferSize)
 
-	c.printer.Welcome()
+	// Commands are executed on this goroutine while a separate one reads
+	// input, so a vanished client cancels the session context right away,
+	// even in the middle of a long-running backend call.
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+	inputs := make(chan readResult, inputQueueSize)
+	done := make(chan struct{})
+	defer close(done)
+
+	if c.overLimit != "" {
+		c.server.Metrics.Inc("session.refused", c.overLimit)
+		c.printer.Err("%s", connectionRefusals[c.overLimit])
+		reason = CLOSE_POLICY
+		return
+	}
+	if c.banned() {
+		c.printer.Err("[SYS/TEMP] Too many errors, try again later")
+		reason = CLOSE_PROTOCOL_ABUSE
+		return
+	}
+	if on, message := c.server.Maintenance(); on {
+		c.printer.Err("[SYS/TEMP] %s", message)
+		reason = CLOSE_POLICY
+		return
+	}
+	if c.server.RefuseWhenUnhealthy && !c.server.isHealthy() {
+		c.printer.Err("[SYS/TEMP] Service temporarily unavailable")
+		reason = CLOSE_POLICY
+		return
+	}
+	go c.readLoop(reader, inputs, done)
+	c.inputs = inputs
+	var refuse bool
+	pregreet := c.server.clock().Now()
+	c.pending, refuse = c.awaitPregreet(inputs)
+	if refuse {
+		c.printer.Err("Protocol violation, command sent before greeting")
+		reason = CLOSE_PROTOCOL_ABUSE
+		return
+	}
+	delayed := c.server.clock().Now().Sub(pregreet)
+	c.welcome()
+	c.observeGreeting(delayed)
+	c.printer.Flush()
 
 	for c.isAlive {
 		// according to RFC commands are terminated by CRLF, but we are removing \r in parseInput
-		input, err := reader.ReadString('\n')
+		var result readResult
+		if c.pending != nil {
+			result, c.pending = *c.pending, nil
+		} else {
+			select {
+			case result = <-inputs:
+			case <-timeout.C():
+				result = readResult{err: os.ErrDeadlineExceeded}
+			}
+		}
+		input, err := result.line, result.err
 		if err != nil {
+			reason = c.readErrorReason(err)
 			if err == io.EOF {
-				c.DebugLog.Println("Connection closed by client")
+				c.DebugLog.Printf("Connection closed by client (%s)", reason)
 			} else {
-				c.DebugLog.Println("Error reading input: ", err)
-			}
-			if c.user != nil {
-				c.DebugLog.Println("Unlocking user %s due to connection error ", c.user.Username())
-				c.backend.Unlock(c.user)
-				c.user = nil
+				c.DebugLog.Printf("Error reading input (%s): %v", reason, err)
 			}
 			break
 		}
 
-		cmd, args := c.parseInput(input)
-		exec, ok := c.commands[cmd]
+		if c.Tracing() {
+			c.traceInput(input)
+		}
+		start := c.server.clock().Now()
+		aborted := c.execute(input)
+		// responses to pipelined commands are sent together
+		if len(inputs) == 0 && c.pending == nil {
+			c.printer.Flush()
+		}
+		c.observeCommand(input, c.server.clock().Now().Sub(start))
+		if aborted {
+			break
+		}
+	}
+	c.mu.Lock()
+	if c.closeReason != 0 {
+		reason = c.closeReason
+	}
+	c.mu.Unlock()
+}
+
+// observeGreeting reports the time from accepting the connection to
+// writing the greeting, except the delay of PregreetDelay, so operators can
+// tell when the server is slow to take on connections. Sending it is not
+// included, slow clients don't count.
+func (c *Client) observeGreeting(delayed time.Duration) {
+	if c.accepted.IsZero() {
+		return
+	}
+	wait := c.server.clock().Now().Sub(c.accepted) - delayed
+	c.server.Metrics.Observe("session.greeting.wait", wait.Seconds(), c.listener)
+}
+
+// maildropChanged reports whether the locked maildrop changed, see
+// ChangeNotifier.
+func (c *Client) maildropChanged() bool {
+	select {
+	case <-c.changed:
+		return true
+	default:
+		return false
+	}
+}
+
+// observeCommand reports the time spent handling a command, including
+// writing the response, and logs it if it is slow.
+func (c *Client) observeCommand(input string, elapsed time.Duration) {
+	cmd, _ := c.parseInput(input)
+	if _, ok := c.commands[cmd]; !ok {
+		cmd = "UNKNOWN"
+	}
+	c.commandCount++
+	c.server.Metrics.Observe("command.duration", elapsed.Seconds(), cmd)
+	if c.server.AccessLog != nil {
+		c.server.AccessLog.logCommand(c, cmd, elapsed)
+	}
+	threshold := c.server.SlowCommandThreshold
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	username := c.username
+	if c.user != nil {
+		username = c.user.Username()
+	}
+	c.ErrorLog.Printf("[%d] Slow command %s took %v (user %q, remote %s)", c.id, cmd, elapsed, username, c.conn.RemoteAddr())
+}
+
+// execute runs a single command line. It returns true if the response was
+// aborted and the session can't continue.
+func (c *Client) execute(input string) bool {
+	if c.maildropChanged() {
+		c.printer.Err("[SYS/TEMP] Maildrop changed by another process, please reconnect")
+		c.mu.Lock()
+		c.closeReason = CLOSE_MAILDROP_CHANGED
+		c.mu.Unlock()
+		return true
+	}
+	cmd, args := c.parseInput(input)
+	// clients send long initial responses of AUTH inline, which is
+	// accepted
+	if len(input) > MAX_COMMAND_LINE && cmd != "AUTH" {
+		c.violation(VIOLATION_OVERSIZED_LINE)
+	}
+	if c.honeytoken(cmd) {
+		c.tripHoneytoken(cmd)
+		return true
+	}
+	exec, ok := c.commands[cmd]
+	signal := SIGNAL_COMMAND
+	if !ok {
+		signal = SIGNAL_INVALID_COMMAND
+	}
+	if !c.ReportAbuse(signal) {
+		c.printer.Err("[SYS/TEMP] Too many errors, try again later")
+		c.mu.Lock()
+		c.closeReason = CLOSE_PROTOCOL_ABUSE
+		c.mu.Unlock()
+		return true
+	}
+	if !ok {
+		c.violation(VIOLATION_UNKNOWN_COMMAND)
+		c.printer.Err("Invalid command %s", cmd)
+		c.DebugLog.Printf("Invalid command: %s", cmd)
+		return false
+	}
+	// idling sessions don't hold a backend call slot
+	if c.currentState == STATE_TRANSACTION && cmd != "XIDLE" {
+		release, ok := c.backendCall()
 		if !ok {
-			c.printer.Err("Invalid command %s", cmd)
-			c.DebugLog.Printf("Invalid command: %s", cmd)
-			continue
+			return true
 		}
-		state, err := exec.Run(&c, args)
-		if err != nil {
+		defer release()
+	}
+	responses := c.out.responses
+	state, err := exec.Run(c, args)
+	if err != nil {
+		// commands may have answered with a specific error already
+		if c.out.responses == responses {
 			c.printer.Err("Error executing command %s", cmd)
-			c.DebugLog.Println("Error executing command: ", err)
-			continue
 		}
-		c.lastCommand = cmd
-		c.currentState = state
+		c.DebugLog.Println("Error executing command: ", err)
+		return false
+	}
+	if err := c.printer.StreamErr(); err != nil {
+		c.DebugLog.Printf("Response to %s aborted: %v", cmd, err)
+		c.mu.Lock()
+		if c.closeReason == 0 && !c.out.writeFailed {
+			c.closeReason = CLOSE_POLICY
+		} else if c.closeReason == 0 {
+			c.closeReason = CLOSE_CLIENT_GONE
+		}
+		c.mu.Unlock()
+		return true
+	}
+	c.lastCommand = cmd
+	c.currentState = state
+	return false
+}
+
+type readResult struct {
+	line string
+	err  error
+}
+
+// readLoop reads commands from the client and queues them for execution. The
+// session context is cancelled as soon as reading fails.
+func (c *Client) readLoop(reader *bufio.Reader, inputs chan<- readResult, done <-chan struct{}) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.cancel()
+		}
+		select {
+		case inputs <- readResult{line, err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Context returns the session context, it is cancelled when the client
+// connection is lost or the session ends.
+func (c *Client) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
 	}
+	return c.ctx
 }
 
-func (c Client) parseInput(input string) (string, []string) {
+// abort ends the session after the current command with an error response.
+func (c *Client) abort(reason CloseReason, msg string, a ...interface{}) {
+	c.printer.Err(msg, a...)
+	c.mu.Lock()
+	if c.closeReason == 0 {
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+	c.isAlive = false
+}
+
+// end ends the session after the current command, for when the response
+// has already been sent and abort can't add an error to it.
+func (c *Client) end(reason CloseReason) {
+	c.mu.Lock()
+	if c.closeReason == 0 {
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+	c.isAlive = false
+}
+
+// reserve accounts n bytes of memory held by the session. If that exceeds
+// the server's MaxSessionMemory, the session is aborted and false returned,
+// the caller must then stop processing the command.
+func (c *Client) reserve(n int) bool {
+	c.memory += n
+	if c.memory > c.memoryPeak {
+		c.memoryPeak = c.memory
+	}
+	if max := c.server.MaxSessionMemory; max > 0 && c.memory > max {
+		c.ErrorLog.Printf("Session %d exceeded memory limit: %d > %d bytes", c.id, c.memory, max)
+		c.abort(CLOSE_POLICY, "[SYS/TEMP] Session memory limit exceeded")
+		return false
+	}
+	return true
+}
+
+// release returns memory accounted with reserve.
+func (c *Client) release(n int) {
+	c.memory -= n
+}
+
+func (c *Client) welcome() {
+	if _, ok := c.authorizator.(APOPAuthorizator); ok {
+		c.timestamp = c.apopTimestamp()
+	}
+	c.checkAffinity()
+	ready := "POPgun POP3 server ready"
+	if greeting := sanitizeBanner(c.server.Greeting); greeting != "" {
+		ready = greeting
+	}
+	if token := c.server.AffinityToken; token != "" {
+		ready += " affinity=" + token
+	}
+	if c.server.LimitsInGreeting {
+		if limits := c.limits(); len(limits) > 0 {
+			ready += " (" + strings.Join(limits, " ") + ")"
+		}
+	}
+	switch {
+	case c.hostname == "" && c.timestamp == "" && ready == "POPgun POP3 server ready":
+		c.out.Welcome()
+	case c.hostname == "" && c.timestamp == "":
+		c.printer.Ok("%s", ready)
+	case c.timestamp == "":
+		c.printer.Ok("%s %s", c.hostname, ready)
+	case c.hostname == "":
+		c.printer.Ok("%s %s", ready, c.timestamp)
+	default:
+		c.printer.Ok("%s %s %s", c.hostname, ready, c.timestamp)
+	}
+}
+
+func (c *Client) parseInput(input string) (string, []string) {
 	input = strings.Trim(input, "\r \n")
 	cmd := strings.Split(input, " ")
 	return strings.ToUpper(cmd[0]), cmd[1:]
@@ -160,71 +805,643 @@ type Server struct {
 	auth    Authorizator
 	backend Backend
 
+	lastId    uint64
+	mu        sync.Mutex
+	sessions  map[uint64]*Client
+	traceNext map[string]bool
+	// serving listeners and sessions, see Shutdown
+	listeners map[net.Listener]struct{}
+	active    sync.WaitGroup
+	closing   bool
+	done      chan struct{}
+	// closed when the last session ended after Drain
+	drained chan struct{}
+	// messages not removed on UPDATE by username, see UpdateFailurePolicy
+	retries map[string][]string
+	reviews map[string][]string
+	// sessions counted against MaxConnections, in total and by remote IP,
+	// and closed when one ends while listeners wait for a slot
+	connections   int
+	ipConnections map[string]int
+	slotFreed     chan struct{}
+
+	health atomic.Value
+	// maintenance message, empty when not in maintenance mode
+	maintenance atomic.Value
+	healthOnce  sync.Once
+
 	AllowInsecureAuth bool
-	DebugLog          Logger
-	ErrorLog          Logger
+	// Hostname is advertised in the greeting and CAPA IMPLEMENTATION line,
+	// it can be overridden per listener with ServeListener.
+	Hostname string
+	// Greeting, if set, replaces "POPgun POP3 server ready" in the
+	// greeting.
+	Greeting string
+	// MaxRetrievedMessages limits how many messages may be retrieved in a
+	// single session, 0 means no limit.
+	MaxRetrievedMessages int
+	// MaxDeletedMessages limits how many messages may be marked as deleted
+	// in a single session, 0 means no limit. RSET resets the counter.
+	MaxDeletedMessages int
+	// HealthProbe is run every HealthInterval (default 10 seconds) once the
+	// server starts serving. While it fails, PASS is answered with
+	// -ERR [SYS/TEMP], or new sessions are refused in the greeting if
+	// RefuseWhenUnhealthy is set.
+	HealthProbe         HealthProbe
+	HealthInterval      time.Duration
+	RefuseWhenUnhealthy bool
+	// MaxSessionMemory is an approximate ceiling in bytes for buffers and
+	// listings held by a single session, 0 means no limit. Sessions
+	// exceeding it are aborted with -ERR [SYS/TEMP].
+	MaxSessionMemory int
+	// MaxConnections limits the number of simultaneous sessions, 0 means
+	// no limit. Connections beyond it are answered with
+	// -ERR [SYS/TEMP] and closed, or, if PauseAcceptWhenFull is set,
+	// listeners stop accepting until a session ends, leaving new
+	// connections in the backlog of the operating system. Connections
+	// passed to ServeConn are always refused when the limit is reached.
+	MaxConnections      int
+	PauseAcceptWhenFull bool
+	// MaxConnectionsPerIP limits the number of simultaneous sessions from
+	// a single remote IP address, 0 means no limit. Connections beyond it
+	// are answered with -ERR [SYS/TEMP] and closed.
+	MaxConnectionsPerIP int
+	// SessionTimeout ends sessions lasting longer, one minute by default.
+	// It also bounds the TLS handshake and every step of a SASL exchange.
+	SessionTimeout time.Duration
+	// WriteTimeout, if set, bounds writing each chunk of a multi-line
+	// response, so a slow but progressing client isn't cut off.
+	WriteTimeout time.Duration
+	// AllowIdle enables the XIDLE extension for backends implementing
+	// NewMailNotifier. A client may wait up to IdleTimeout, one minute by
+	// default, for new mail.
+	AllowIdle   bool
+	IdleTimeout time.Duration
+	// MasterUserSeparator, if set, e.g. to "*", enables master logins of
+	// the form "user*master" with the password of master, for
+	// authorizators implementing MasterAuthorizator. Sessions of master
+	// users are read-only and every login is logged to the ErrorLog.
+	MasterUserSeparator string
+	// AllowPasswordChange enables the XPASSWD extension over TLS for
+	// authorizators implementing PasswordChanger.
+	AllowPasswordChange bool
+	// SlowCommandThreshold, if set, logs commands whose handling, i.e.
+	// backend calls and writing the response, takes at least this long.
+	// The duration of every command is observed as "command.duration".
+	SlowCommandThreshold time.Duration
+	// AuthFailureDelay is waited before every negative authentication
+	// response, plus a random duration up to AuthFailureJitter, to slow
+	// down online password guessing.
+	AuthFailureDelay  time.Duration
+	AuthFailureJitter time.Duration
+	// AbuseScorer, if set, scores clients by abuse signals, which is acted
+	// upon according to AbuseThresholds.
+	AbuseScorer     AbuseScorer
+	AbuseThresholds AbuseThresholds
+	// Honeytokens are commands no legitimate client sends, e.g.
+	// "XADMIN". Clients using one are reported with SIGNAL_HONEYTOKEN,
+	// which gets their IP address banned by the default weights, and
+	// disconnected.
+	Honeytokens []string
+	// Features, if set, resolves the feature flags of every session after
+	// authentication, see Features.
+	Features FeatureResolver
+	// Canonicalizer, if set, maps usernames to the canonical usernames
+	// of accounts before authentication, see UsernameCanonicalizer.
+	Canonicalizer Canonicalizer
+	// AccountPolicy, if set, decides about account lockout instead of the
+	// authorizator alone.
+	AccountPolicy AccountPolicy
+	// ResponsePadding, if set, pads every status line on TLS connections to
+	// a multiple of this many octets by adding spaces, so passive observers
+	// can't infer message counts and sizes from status lines such as the
+	// responses to STAT or LIST n. Status lines are limited to 512 octets,
+	// longer ones are padded to that. Multi-line bodies are streamed
+	// unpadded, so the length of a LIST or UIDL listing still reveals the
+	// number of messages.
+	ResponsePadding int
+	// PregreetDelay, if set, delays the greeting to detect clients sending
+	// commands before it, see RefuseDowngrade.
+	PregreetDelay time.Duration
+	// RefuseDowngrade refuses clients detected attempting a protocol
+	// downgrade, i.e. sending commands before the greeting or
+	// authenticating in cleartext while TLSConfig is set. Otherwise they
+	// are only logged and counted.
+	RefuseDowngrade bool
+	// SessionBudget, if set, limits the sessions of every user per day.
+	SessionBudget *SessionBudget
+	// NonceStore, if set, records APOP digests and SASL nonces for
+	// NonceTTL (default 24 hours) to reject replayed authentication. Use a
+	// shared store like RedisNonceStore to detect replays across servers.
+	NonceStore NonceStore
+	NonceTTL   time.Duration
+	// AccessLog, if set, receives a JSON line for every session, and
+	// every command if enabled.
+	AccessLog *AccessLog
+	// Events, if set, streams logins, updates and closed sessions to a
+	// platform like Kafka or NATS.
+	Events *EventExporter
+	// Tenants, if set, limits the resources of every tenant, i.e. domain,
+	// so noisy ones can't starve the others.
+	Tenants *Tenants
+	// AdvertiseLimits advertises the limits of sessions, i.e.
+	// MaxRetrievedMessages, MaxDeletedMessages, the MaxMessageSize of
+	// their features and the quota of a QuotaBackend, with the
+	// non-standard CAPA capability XLIMITS, e.g. "XLIMITS RETR=100
+	// SIZE=10485760", so automated clients can adapt their batch sizes.
+	// LimitsInGreeting adds the limits known before login to the
+	// greeting, e.g. "+OK POPgun POP3 server ready (RETR=100)".
+	AdvertiseLimits  bool
+	LimitsInGreeting bool
+	// SASL maps the names of the mechanisms of the AUTH command to their
+	// implementation, {"PLAIN": SASLPlain} by default. Add SASLXOAuth2
+	// and SASLOAuthBearer for a TokenAuthorizator, SASLScramSHA1 and
+	// SASLScramSHA256 for a SCRAMAuthorizator, SASLAnonymous for guest
+	// access to a public maildrop, own mechanisms with
+	// RegisterSASL. They are offered where USER and PASS are allowed, see
+	// AllowInsecureAuth.
+	SASL map[string]SASLMechanism
+	// Commands adds commands to the built-in ones, keyed by their upper
+	// case names. A command replaces the built-in one of the same name.
+	// Use package poptest to unit test them.
+	Commands map[string]Executable
+	// AffinityToken, if set, identifies this instance to a fronting proxy
+	// in the greeting, e.g. "+OK POPgun POP3 server ready affinity=1a2b",
+	// so it can route reconnects of a user to the instance holding the
+	// lock of their maildrop. The proxy may pass the token it routed a
+	// connection for in a PROXY protocol TLV, see ProxyListener. It
+	// should consist of letters and digits.
+	AffinityToken string
+	// ArchivedResponse is sent with -ERR for RETR and TOP of messages
+	// archived by a TieredBackend, "[SYS/TEMP] Message is archived" by
+	// default.
+	ArchivedResponse string
+	// RecallArchived recalls archived messages on RETR and TOP instead, if
+	// the backend implements RecallBackend, and tells the client to retry.
+	// Recalls may be billed by the storage provider.
+	RecallArchived bool
+	// UpdateFailurePolicy decides what happens when the backend fails to
+	// remove some messages marked as deleted on QUIT, they are only logged
+	// by default.
+	UpdateFailurePolicy UpdateFailurePolicy
+	// Clock, if set, replaces the system clock for timers and expiry.
+	Clock Clock
+	// TLSConfig is used by ServeTLS. Session resumption is configured by its
+	// session ticket settings, see TicketKeyRotator for fleets sharing keys.
+	TLSConfig *tls.Config
+	DebugLog  Logger
+	ErrorLog  Logger
+	Hooks     Hooks
+	Metrics   Metrics
 }
 
-func NewServer(auth Authorizator, backend Backend) *Server {
-	return &Server{
-		auth:    auth,
-		backend: backend,
+// NewServer creates a server authenticating users with auth and serving
+// their maildrops from backend, configured by opts. Configure it before
+// serving, its fields must not be changed afterwards.
+func NewServer(auth Authorizator, backend Backend, opts ...Option) *Server {
+	s := &Server{
+		auth:          auth,
+		backend:       backend,
+		sessions:      make(map[uint64]*Client),
+		traceNext:     make(map[string]bool),
+		ipConnections: make(map[string]int),
+		listeners:     make(map[net.Listener]struct{}),
+		done:          make(chan struct{}),
 
 		AllowInsecureAuth: false,
+		SASL:              map[string]SASLMechanism{"PLAIN": SASLPlain},
 		DebugLog:          log.New(os.Stderr, "pop3/debug: ", 0),
 		ErrorLog:          log.New(os.Stderr, "pop3/error: ", 0),
+		Metrics:           nopMetrics{},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func (s Server) Serve(l net.Listener) error {
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				s.ErrorLog.Println("Error: could not accept connection: ", err)
-				continue
-			}
+// SetMaintenance switches maintenance mode on or off. In maintenance mode,
+// new connections are greeted with -ERR [SYS/TEMP] and message, or a
+// generic one if it is empty, while existing sessions continue.
+func (s *Server) SetMaintenance(enabled bool, message string) {
+	if !enabled {
+		s.maintenance.Store("")
+		return
+	}
+	if message == "" {
+		message = "Service temporarily unavailable"
+	}
+	s.maintenance.Store(message)
+}
+
+// Maintenance reports whether the server is in maintenance mode and the
+// message new connections are refused with.
+func (s *Server) Maintenance() (bool, string) {
+	message, _ := s.maintenance.Load().(string)
+	return message != "", message
+}
 
-			c := newClient(conn, s.auth, s.backend, s.AllowInsecureAuth)
-			c.ErrorLog = s.ErrorLog
-			c.DebugLog = s.DebugLog
-			go c.handle()
+// ListenerConfig overrides server settings for connections accepted on a
+// single listener, e.g. when serving multiple brands from one box.
+type ListenerConfig struct {
+	Hostname string
+	// Name labels the metrics of connections accepted on the listener,
+	// its address by default: "session.greeting.wait", the seconds from
+	// accepting a connection to writing the greeting, excluding
+	// PregreetDelay, and "tls.handshake.duration".
+	Name string
+
+	// set by ServeTLS
+	tlsConfig *tls.Config
+}
+
+// Serve accepts connections on l, see ServeListener.
+func (s *Server) Serve(l net.Listener) error {
+	return s.ServeListener(l, ListenerConfig{})
+}
+
+// ServeListener accepts connections on l, applying cfg to each of them,
+// and serves each in a new goroutine. It blocks until accepting fails for
+// good, closes l and returns the error, ErrServerClosed after Shutdown.
+// Temporary errors, e.g. running out of file descriptors, are retried
+// after a delay on Clock, see AcceptBackoff, and counted as
+// "accept.retried". Only the first of a series is logged.
+func (s *Server) ServeListener(l net.Listener, cfg ListenerConfig) error {
+	defer l.Close()
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	s.startHealthCheck()
+	name := cfg.Name
+	if name == "" {
+		name = l.Addr().String()
+	}
+	var backoff AcceptBackoff
+	// temporary errors in a row, only the first is logged
+	retries := 0
+	for {
+		if !s.waitForSlot() {
+			return ErrServerClosed
 		}
-	}()
+		conn, err := l.Accept()
+		delay, temporary := backoff.Next(err)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if !temporary {
+				return err
+			}
+			if retries == 0 {
+				s.ErrorLog.Printf("Error accepting connection on %s, retrying with backoff: %v", name, err)
+			}
+			retries++
+			s.Metrics.Inc("accept.retried", name)
+			timer := s.clock().NewTimer(delay)
+			select {
+			case <-timer.C():
+			case <-s.done:
+				timer.Stop()
+				return ErrServerClosed
+			}
+			continue
+		}
+		if retries > 0 {
+			s.ErrorLog.Printf("Accepting connections on %s again after %d retries", name, retries)
+			retries = 0
+		}
+		c, ok := s.accept(conn, cfg, name)
+		if !ok {
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.active.Done()
+			c.handle()
+		}()
+	}
+}
 
+// ServeConn serves a POP3 session on conn, which was accepted by the
+// caller, e.g. with an own accept loop applying socket options and
+// filters. It blocks until the session ends and conn is closed. After
+// Shutdown, conn is closed without serving and ErrServerClosed returned.
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.startHealthCheck()
+	c, ok := s.accept(conn, ListenerConfig{}, conn.LocalAddr().String())
+	if !ok {
+		return ErrServerClosed
+	}
+	defer s.active.Done()
+	c.handle()
 	return nil
 }
 
+// accept creates and registers the client of conn, accepted on the
+// listener name. It closes conn and returns false after Shutdown.
+func (s *Server) accept(conn net.Conn, cfg ListenerConfig, name string) (*Client, bool) {
+	accepted := s.clock().Now()
+	var routed string
+	if a, ok := conn.(AffinityConn); ok {
+		routed = a.AffinityToken()
+	}
+	if cfg.tlsConfig != nil {
+		conn = tls.Server(conn, cfg.tlsConfig)
+	}
+	c := newClient(s, conn)
+	c.routedToken = routed
+	c.listener, c.accepted = name, accepted
+	if cfg.Hostname != "" {
+		c.hostname = cfg.Hostname
+	}
+	if !s.register(c) {
+		conn.Close()
+		return nil, false
+	}
+	return c, true
+}
+
+// ServeTLS accepts TLS connections on l using TLSConfig. If its NextProtos
+// are empty, they are set to ALPN_POP3, so TLSConfig shouldn't be in use
+// by other servers yet. It blocks like ServeListener.
+func (s *Server) ServeTLS(l net.Listener) error {
+	if s.TLSConfig == nil {
+		return fmt.Errorf("TLSConfig is not set")
+	}
+	if len(s.TLSConfig.NextProtos) == 0 {
+		s.TLSConfig.NextProtos = []string{ALPN_POP3}
+	}
+	return s.ServeListener(l, ListenerConfig{tlsConfig: s.TLSConfig})
+}
+
+// register adds a client to the live sessions and enables tracing if it was
+// requested for the client's IP address. It returns false after Shutdown.
+func (s *Server) register(c *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.active.Add(1)
+	s.sessions[c.id] = c
+	s.admit(c)
+	ip := remoteIP(c.conn)
+	if s.traceNext[ip] {
+		delete(s.traceNext, ip)
+		c.SetTrace(true)
+	}
+	return true
+}
+
+// Session returns a live session by its ID.
+func (s *Server) Session(id uint64) (*Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.sessions[id]
+	return c, ok
+}
+
+// Sessions returns all live sessions.
+func (s *Server) Sessions() []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := make([]*Client, 0, len(s.sessions))
+	for _, c := range s.sessions {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// TraceNext enables protocol tracing for the next connection from ip.
+func (s *Server) TraceNext(ip string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enabled {
+		s.traceNext[ip] = true
+	} else {
+		delete(s.traceNext, ip)
+	}
+}
+
+// remoteIP returns the IP address of the remote end of conn without port.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// sessionClosed reports the end of a session to metrics and hooks.
+func (s *Server) sessionClosed(c *Client, reason CloseReason) {
+	s.mu.Lock()
+	delete(s.sessions, c.id)
+	s.releaseSlot(c)
+	s.mu.Unlock()
+	s.Metrics.Inc("session.closed", reason.String())
+	if s.Hooks.OnDisconnect != nil {
+		s.Hooks.OnDisconnect(c, reason)
+	}
+}
+
+// updated reports the outcome of an UPDATE to metrics and hooks.
+func (s *Server) updated(c *Client, user backends.User, result backends.UpdateResult) {
+	s.Metrics.Observe("update.removed", float64(result.Removed))
+	if len(result.FailedUids) > 0 {
+		s.Metrics.Inc("update.partial")
+	}
+	c.exportEvent(Event{Type: EVENT_UPDATE, Removed: result.Removed, FailedUids: result.FailedUids})
+	if s.Hooks.OnUpdate != nil {
+		s.Hooks.OnUpdate(c, user, result)
+	}
+}
+
 //---------------PRINTER
 
+const (
+	// size of the buffer coalescing responses, see Printer.Flush
+	writeBufferSize = 16 * 1024
+	// number of bytes of a multi-line response between progress reports
+	progressInterval = 64 * 1024
+	// maximum length of a status line including CRLF, see RFC 2449
+	maxStatusLine = 512
+)
+
 type Printer struct {
 	conn net.Conn
+
+	// WriteTimeout, if set, is the write deadline extended periodically
+	// while streaming a multi-line response.
+	WriteTimeout time.Duration
+	// Padding, if set, pads every status line to a multiple of Padding
+	// octets with spaces before its CRLF, or to the maximum length of a
+	// status line if it doesn't fit. Multi-line bodies aren't padded.
+	Padding int
+	// Progress, if set, is called with the number of bytes of the current
+	// multi-line response sent so far, about every 64 KiB. Returning an
+	// error aborts the response, see StreamErr.
+	Progress func(sent int) error
+
+	buf         *bufio.Writer
+	sent        int
+	reported    int
+	streamErr   error
+	writeFailed bool
+	// number of status lines written
+	responses int
+	// whether the last status line was negative
+	failed bool
+}
+
+// ResponseWriter writes the responses of commands. The Printer writes them
+// to the client, test doubles can record them to assert the responses of
+// commands without parsing the wire format.
+type ResponseWriter interface {
+	// Ok and Err write a positive or negative status line.
+	Ok(msg string, a ...interface{})
+	Err(msg string, a ...interface{})
+	// MultiLine writes the lines of a multi-line response and ends it.
+	MultiLine(lines []string)
+	// Line streams a line of a multi-line response, which End
+	// terminates, unless it was aborted. StreamErr returns the error
+	// which aborted it.
+	Line(line string)
+	End()
+	Abort(err error)
+	StreamErr() error
+	// Flush writes out buffered responses.
+	Flush() error
 }
 
 func NewPrinter(conn net.Conn) *Printer {
-	return &Printer{conn}
+	return &Printer{conn: conn, buf: bufio.NewWriterSize(conn, writeBufferSize)}
 }
 
-func (p Printer) Welcome() {
-	fmt.Fprintf(p.conn, "+OK POPgun POP3 server ready\r\n")
+// Flush writes out buffered responses. Responses are buffered until Flush,
+// or until the buffer is full while streaming, so a status line and a short
+// multi-line body, as well as the responses to pipelined commands, are sent
+// with a single write.
+func (p *Printer) Flush() error {
+	return p.buf.Flush()
 }
 
-func (p Printer) Ok(msg string, a ...interface{}) {
-	fmt.Fprintf(p.conn, "+OK %s\r\n", fmt.Sprintf(msg, a...))
+// status writes a status line, padded as configured by Padding.
+func (p *Printer) status(line string) {
+	if p.Padding > 0 {
+		length := len(line) + 2
+		padded := (length + p.Padding - 1) / p.Padding * p.Padding
+		if padded > maxStatusLine {
+			padded = maxStatusLine
+		}
+		if padded > length {
+			line += strings.Repeat(" ", padded-length)
+		}
+	}
+	fmt.Fprintf(p.buf, "%s\r\n", line)
+}
+
+func (p *Printer) Welcome() {
+	p.status("+OK POPgun POP3 server ready")
 }
 
-func (p Printer) Err(msg string, a ...interface{}) {
-	fmt.Fprintf(p.conn, "-ERR %s\r\n", fmt.Sprintf(msg, a...))
+func (p *Printer) Ok(msg string, a ...interface{}) {
+	p.responses++
+	p.failed = false
+	p.status("+OK " + fmt.Sprintf(msg, a...))
 }
 
-func (p Printer) MultiLine(msgs []string) {
+func (p *Printer) Err(msg string, a ...interface{}) {
+	p.responses++
+	p.failed = true
+	p.status("-ERR " + fmt.Sprintf(msg, a...))
+}
+
+func (p *Printer) MultiLine(msgs []string) {
 	for _, line := range msgs {
-		line := strings.Trim(line, "\r")
-		if strings.HasPrefix(line, ".") {
-			fmt.Fprintf(p.conn, ".%s\r\n", line)
-		} else {
-			fmt.Fprintf(p.conn, "%s\r\n", line)
+		p.Line(line)
+	}
+	p.End()
+}
+
+// Line writes a single line of a multi-line response, byte-stuffing the
+// termination character. Use End to finish the response.
+func (p *Printer) Line(line string) {
+	if p.streamErr != nil {
+		return
+	}
+	if p.sent == 0 {
+		p.extendDeadline()
+	}
+	line = strings.Trim(line, "\r")
+	var n int
+	var err error
+	if strings.HasPrefix(line, ".") {
+		n, err = fmt.Fprintf(p.buf, ".%s\r\n", line)
+	} else {
+		n, err = fmt.Fprintf(p.buf, "%s\r\n", line)
+	}
+	p.wrote(n, err)
+}
+
+// block writes lines of a multi-line response rendered by renderLines at
+// once. Use End to finish the response.
+func (p *Printer) block(b []byte) {
+	if p.streamErr != nil {
+		return
+	}
+	if p.sent == 0 {
+		p.extendDeadline()
+	}
+	p.wrote(p.buf.Write(b))
+}
+
+// wrote accounts n bytes of a multi-line response written with err.
+func (p *Printer) wrote(n int, err error) {
+	if err != nil {
+		p.streamErr = err
+		p.writeFailed = true
+		return
+	}
+	p.sent += n
+	if p.sent-p.reported >= progressInterval {
+		p.reported = p.sent
+		p.extendDeadline()
+		if p.Progress != nil {
+			p.streamErr = p.Progress(p.sent)
+		}
+	}
+}
+
+// End terminates a multi-line response. Nothing is written if the response
+// was aborted, as the client must not take it for a complete one.
+func (p *Printer) End() {
+	if p.streamErr == nil {
+		fmt.Fprint(p.buf, ".\r\n")
+		if p.Progress != nil && p.sent > p.reported {
+			p.Progress(p.sent)
 		}
 	}
-	fmt.Fprint(p.conn, ".\r\n")
+	p.sent = 0
+	p.reported = 0
+}
+
+// Abort aborts the current multi-line response with err, e.g. because the
+// client is gone. Nothing more is written for it.
+func (p *Printer) Abort(err error) {
+	if p.streamErr == nil {
+		p.streamErr = err
+	}
+}
+
+// StreamErr returns the error which aborted the last multi-line response,
+// the session can't continue after that.
+func (p *Printer) StreamErr() error {
+	return p.streamErr
+}
+
+func (p *Printer) extendDeadline() {
+	if p.WriteTimeout > 0 {
+		p.conn.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+	}
 }
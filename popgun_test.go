@@ -2,15 +2,21 @@ package popgun
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/faulty"
+	"github.com/kiwiz/popgun/backends/memory"
 )
 
 func TestClient_handle(t *testing.T) {
@@ -20,10 +26,11 @@ func TestClient_handle(t *testing.T) {
 
 	backend := backends.DummyBackend{}
 	authorizator := backends.DummyAuthorizator{}
-	insecure := true
-	client := newClient(s, authorizator, backend, insecure)
-	client.ErrorLog = log.Default()
-	client.DebugLog = log.Default()
+	server := NewServer(authorizator, backend)
+	server.AllowInsecureAuth = true
+	server.ErrorLog = log.Default()
+	server.DebugLog = log.Default()
+	client := newClient(server, s)
 
 	go func() {
 		client.handle()
@@ -66,8 +73,9 @@ func TestClient_parseInput(t *testing.T) {
 	conn := &net.IPConn{}
 	backend := backends.DummyBackend{}
 	authorizator := backends.DummyAuthorizator{}
-	insecure := true
-	client := newClient(conn, authorizator, backend, insecure)
+	server := NewServer(authorizator, backend)
+	server.AllowInsecureAuth = true
+	client := newClient(server, conn)
 
 	tables := [][][]string{
 		{{"COMMAND1"}, {"COMMAND1"}},
@@ -101,7 +109,7 @@ func TestServer_Start(t *testing.T) {
 	backend := backends.DummyBackend{}
 	authorizator := backends.DummyAuthorizator{}
 	server := NewServer(authorizator, backend)
-	server.Serve(listener)
+	go server.Serve(listener)
 
 	conn, err := net.DialTimeout("tcp", iface, 3*time.Second)
 	if err != nil {
@@ -111,6 +119,51 @@ func TestServer_Start(t *testing.T) {
 	defer conn.Close()
 }
 
+func TestServer_ServeConn(t *testing.T) {
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	s, c := net.Pipe()
+	defer c.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeConn(s)
+	}()
+
+	reader := bufio.NewReader(c)
+	fmt.Fprintf(c, "USER user\r\nPASS password\r\nQUIT\r\n")
+	for _, expected := range []string{
+		"+OK POPgun POP3 server ready\r\n",
+		"+OK \r\n",
+		"+OK User Successfully Logged on\r\n",
+		"+OK Goodbye (5 messages left)\r\n",
+	} {
+		if line, _ := reader.ReadString('\n'); line != expected {
+			t.Errorf("Expected %q, but got %q", expected, line)
+		}
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected session served, but got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected ServeConn returning after QUIT")
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s, c = net.Pipe()
+	defer c.Close()
+	if err := server.ServeConn(s); err != ErrServerClosed {
+		t.Errorf("Expected closed server, but got %v", err)
+	}
+	if _, err := c.Write([]byte("QUIT\r\n")); err == nil {
+		t.Errorf("Expected connection closed")
+	}
+}
+
 type printerFunc func(conn net.Conn)
 
 func printerTest(t *testing.T, f printerFunc) string {
@@ -135,6 +188,7 @@ func TestPrinter_Welcome(t *testing.T) {
 	msg := printerTest(t, func(conn net.Conn) {
 		p := NewPrinter(conn)
 		p.Welcome()
+		p.Flush()
 	})
 
 	if msg != expected {
@@ -148,6 +202,7 @@ func TestPrinter_Ok(t *testing.T) {
 	msg := printerTest(t, func(conn net.Conn) {
 		p := NewPrinter(conn)
 		p.Ok("%d foxes jumping over lazy dog", 2)
+		p.Flush()
 	})
 
 	if msg != expected {
@@ -161,6 +216,7 @@ func TestPrinter_Err(t *testing.T) {
 	msg := printerTest(t, func(conn net.Conn) {
 		p := NewPrinter(conn)
 		p.Err("everything wrong in %d seconds", 10)
+		p.Flush()
 	})
 
 	if msg != expected {
@@ -174,9 +230,490 @@ func TestPrinter_MultiLine(t *testing.T) {
 	msg := printerTest(t, func(conn net.Conn) {
 		p := NewPrinter(conn)
 		p.MultiLine([]string{"multi", "line"})
+		p.Flush()
 	})
 
 	if msg != expected {
 		t.Errorf("Expected '%s', but got '%s'", expected, msg)
 	}
 }
+
+func TestClient_closeReason(t *testing.T) {
+	tables := []struct {
+		closeFunc func(c net.Conn, client *Client)
+		expected  CloseReason
+	}{
+		{func(c net.Conn, client *Client) { fmt.Fprintf(c, "QUIT\n") }, CLOSE_QUIT},
+		{func(c net.Conn, client *Client) { c.Close() }, CLOSE_CLIENT_GONE},
+		{func(c net.Conn, client *Client) { client.Close(CLOSE_POLICY) }, CLOSE_POLICY},
+	}
+	for _, testCase := range tables {
+		s, c := net.Pipe()
+
+		reasons := make(chan CloseReason, 1)
+		server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		server.Hooks.OnDisconnect = func(client *Client, reason CloseReason) {
+			reasons <- reason
+		}
+		client := newClient(server, s)
+		go client.handle()
+		go ioutil.ReadAll(c)
+
+		testCase.closeFunc(c, client)
+		select {
+		case reason := <-reasons:
+			if reason != testCase.expected {
+				t.Errorf("Expected reason '%s', but got '%s'", testCase.expected, reason)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("Expected OnDisconnect to be called with '%s'", testCase.expected)
+		}
+		c.Close()
+	}
+}
+
+type blockingRetrBackend struct {
+	backends.DummyBackend
+	cancelled chan struct{}
+}
+
+func (b blockingRetrBackend) RetrContext(ctx context.Context, user backends.User, msgId int) (string, error) {
+	<-ctx.Done()
+	close(b.cancelled)
+	return "", ctx.Err()
+}
+
+func TestClient_handleCancelsRetr(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+
+	backend := blockingRetrBackend{cancelled: make(chan struct{})}
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	client := newClient(server, s)
+	go client.handle()
+
+	reader := bufio.NewReader(c)
+	reader.ReadString('\n')
+	for _, cmd := range []string{"USER john", "PASS secret"} {
+		fmt.Fprintf(c, "%s\r\n", cmd)
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fmt.Fprintf(c, "RETR 1\r\n")
+	c.Close()
+
+	select {
+	case <-backend.cancelled:
+	case <-time.After(3 * time.Second):
+		t.Error("Expected RETR to be cancelled when the client disconnects")
+	}
+}
+
+func TestPrinter_Progress(t *testing.T) {
+	line := strings.Repeat("x", 1000)
+	lines := make([]string, 200)
+	for i := range lines {
+		lines[i] = line
+	}
+
+	var reports []int
+	msg := printerTest(t, func(conn net.Conn) {
+		p := NewPrinter(conn)
+		p.Progress = func(sent int) error {
+			reports = append(reports, sent)
+			if len(reports) == 2 {
+				return fmt.Errorf("throttled")
+			}
+			return nil
+		}
+		p.MultiLine(lines)
+		if p.StreamErr() == nil {
+			t.Error("Expected stream error, but got none")
+		}
+	})
+
+	if len(reports) != 2 || reports[0] < progressInterval {
+		t.Errorf("Expected 2 progress reports, but got '%v'", reports)
+	}
+	if strings.HasSuffix(msg, "\r\n.\r\n") {
+		t.Error("Expected aborted response not to be terminated")
+	}
+}
+
+func TestPrinter_Padding(t *testing.T) {
+	msg := printerTest(t, func(conn net.Conn) {
+		p := NewPrinter(conn)
+		p.Padding = 64
+		p.Ok("2 messages")
+		p.MultiLine([]string{"1 120", "2 200"})
+		p.Err("%s", strings.Repeat("x", 600))
+		p.Flush()
+	})
+
+	lines := strings.SplitAfter(msg, "\r\n")
+	if len(lines[0]) != 64 || !strings.HasPrefix(lines[0], "+OK 2 messages ") {
+		t.Errorf("Expected status line padded to 64 octets, but got '%s'", lines[0])
+	}
+	if body := strings.Join(lines[1:4], ""); body != "1 120\r\n2 200\r\n.\r\n" {
+		t.Errorf("Expected unpadded body, but got '%s'", body)
+	}
+	if len(lines[4]) != len("-ERR ")+600+2 || !strings.HasSuffix(lines[4], "x\r\n") {
+		t.Errorf("Expected overlong status line unpadded, but got %d octets", len(lines[4]))
+	}
+}
+
+func TestPrinter_PaddingStreams(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+
+	bodyDone := make(chan struct{})
+	go func() {
+		defer c.Close()
+		p := NewPrinter(c)
+		p.Padding = 64
+		p.Ok("%d octets", 4*writeBufferSize)
+		line := strings.Repeat("x", 1022)
+		for i := 0; i < 4*writeBufferSize/len(line); i++ {
+			p.Line(line)
+		}
+		close(bodyDone)
+		p.End()
+		p.Flush()
+	}()
+
+	status := make([]byte, 64)
+	if _, err := io.ReadFull(s, status); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bodyDone:
+		t.Error("Expected the response to be written before its body ended")
+	default:
+	}
+	if !strings.HasPrefix(string(status), "+OK 65536 octets ") {
+		t.Errorf("Expected padded status line, but got '%s'", status)
+	}
+	ioutil.ReadAll(s)
+}
+
+func TestClient_handlePregreet(t *testing.T) {
+	s, c := net.Pipe()
+	defer c.Close()
+
+	reasons := make(chan CloseReason, 1)
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.PregreetDelay = time.Second
+	server.RefuseDowngrade = true
+	server.Hooks.OnDisconnect = func(client *Client, reason CloseReason) {
+		reasons <- reason
+	}
+	go newClient(server, s).handle()
+
+	fmt.Fprintf(c, "USER john\r\n")
+	response, _ := ioutil.ReadAll(c)
+	if !strings.HasPrefix(string(response), "-ERR") {
+		t.Errorf("Expected client refused, but got '%s'", response)
+	}
+	select {
+	case reason := <-reasons:
+		if reason != CLOSE_PROTOCOL_ABUSE {
+			t.Errorf("Expected reason '%s', but got '%s'", CLOSE_PROTOCOL_ABUSE, reason)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("Expected OnDisconnect to be called")
+	}
+}
+
+func TestClient_handleSlowCommand(t *testing.T) {
+	clock := newFakeClock()
+	backend := faulty.New(backends.DummyBackend{})
+	backend.Sleep = clock.Advance
+	backend.Inject(faulty.OP_RETR, faulty.Fault{Delay: 2 * time.Second})
+	metrics := newCountingMetrics()
+	var logged strings.Builder
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.Clock = clock
+	server.Metrics = metrics
+	server.SlowCommandThreshold = time.Second
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(&syncWriter{w: &logged}, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	for _, cmd := range []string{"USER john", "PASS secret", "RETR 1"} {
+		fmt.Fprintf(conn, "%s\r\n", cmd)
+		reader.ReadString('\n')
+	}
+	for line := ""; line != ".\r\n"; {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fmt.Fprintf(conn, "QUIT\r\n")
+	reader.ReadString('\n')
+
+	if observed := metrics.observed("command.duration:RETR"); !reflect.DeepEqual(observed, []float64{2}) {
+		t.Errorf("Expected RETR observed taking 2s, but got %v", observed)
+	}
+	if observed := metrics.observed("command.duration:PASS"); !reflect.DeepEqual(observed, []float64{0}) {
+		t.Errorf("Expected PASS observed taking no time, but got %v", observed)
+	}
+	if !strings.Contains(logged.String(), `Slow command RETR took 2s (user "user", remote pipe)`) {
+		t.Errorf("Expected slow RETR logged, but got %q", logged.String())
+	}
+	if strings.Contains(logged.String(), "PASS") {
+		t.Errorf("Expected only RETR logged, but got %q", logged.String())
+	}
+}
+
+// syncWriter serializes writes to w.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func TestClient_handleMaildropChanged(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("user", "a", "Subject: a\r\n\r\n")
+	backend.Deliver("user", "b", "Subject: b\r\n\r\n")
+	reasons := make(chan CloseReason, 1)
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.Hooks.OnDisconnect = func(c *Client, reason CloseReason) {
+		reasons <- reason
+	}
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	for _, cmd := range []string{"USER user", "PASS secret", "DELE 1"} {
+		fmt.Fprintf(conn, "%s\r\n", cmd)
+		if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+			t.Fatalf("Unexpected response to %s: %q", cmd, line)
+		}
+	}
+	backend.Expunge("user", "b")
+	fmt.Fprintf(conn, "QUIT\r\n")
+	if line, _ := reader.ReadString('\n'); line != "-ERR [SYS/TEMP] Maildrop changed by another process, please reconnect\r\n" {
+		t.Errorf("Expected session ended, but got %q", line)
+	}
+	if reason := <-reasons; reason != CLOSE_MAILDROP_CHANGED {
+		t.Errorf("Expected close reason %s, but got %s", CLOSE_MAILDROP_CHANGED, reason)
+	}
+	if uids := backend.Messages("user"); !reflect.DeepEqual(uids, []string{"a"}) {
+		t.Errorf("Expected deletion not committed, but got messages %v", uids)
+	}
+}
+
+func TestClient_handleXIdle(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("user", "a", "Subject: a\r\n\r\n")
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.AllowIdle = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	expect := func(expected ...string) {
+		t.Helper()
+		for _, e := range expected {
+			if line, err := reader.ReadString('\n'); line != e+"\r\n" {
+				t.Fatalf("Expected %q, but got %q, %v", e, line, err)
+			}
+		}
+	}
+	expect("+OK POPgun POP3 server ready")
+	fmt.Fprintf(conn, "USER user\r\nPASS secret\r\nCAPA\r\n")
+	expect("+OK ", "+OK User Successfully Logged on", "+OK ", "USER", "UIDL", "TOP", "XIDLE", "XUNDELE", "XNEWUIDL", ".")
+
+	fmt.Fprintf(conn, "XIDLE\r\n")
+	expect("+OK idling, send DONE to stop")
+	backend.Deliver("user", "b", "Subject: b\r\n\r\n")
+	expect("NEWMAIL", ".")
+
+	fmt.Fprintf(conn, "XIDLE\r\n")
+	expect("+OK idling, send DONE to stop")
+	fmt.Fprintf(conn, "DONE\r\n")
+	expect(".")
+
+	// any other input ends idling and is handled as a command
+	fmt.Fprintf(conn, "XIDLE\r\n")
+	expect("+OK idling, send DONE to stop")
+	fmt.Fprintf(conn, "STAT\r\n")
+	expect(".", "+OK 1 14")
+
+	fmt.Fprintf(conn, "QUIT\r\n")
+	expect("+OK Goodbye (2 messages left)")
+}
+
+// endlessBackend streams an endless message and reports the context of
+// the retrieval and when the streamed body is closed.
+type endlessBackend struct {
+	backends.DummyBackend
+	ctx    chan context.Context
+	closed chan struct{}
+}
+
+func (b endlessBackend) Message(ctx context.Context, user backends.User, msgId int) (backends.Message, error) {
+	b.ctx <- ctx
+	opened := 0
+	return backends.NewLazyMessage("1", 1<<40, func() (io.ReadCloser, error) {
+		opened++
+		body := &endlessBody{pending: "Subject: endless\n\n"}
+		if opened == 2 {
+			// the second one is the streamed body
+			body.closed = b.closed
+		}
+		return body, nil
+	}), nil
+}
+
+type endlessBody struct {
+	pending string
+	closed  chan struct{}
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	if b.pending == "" {
+		b.pending = "line\n"
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *endlessBody) Close() error {
+	if b.closed != nil {
+		close(b.closed)
+	}
+	return nil
+}
+
+func TestClient_handleClientGoneMidRetr(t *testing.T) {
+	backend := endlessBackend{ctx: make(chan context.Context, 1), closed: make(chan struct{})}
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "USER john\r\nPASS secret\r\nRETR 1\r\n")
+	for i := 0; i < 10; i++ {
+		reader.ReadString('\n')
+	}
+	conn.Close()
+
+	ctx := <-backend.ctx
+	select {
+	case <-backend.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the message no longer pulled from the backend")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+		t.Error("Expected the context of the retrieval cancelled")
+	}
+}
+
+// writeCountingConn counts the writes to the connection.
+type writeCountingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func TestPrinter_Flush(t *testing.T) {
+	conn := &writeCountingConn{}
+	p := NewPrinter(conn)
+	p.Ok("2 messages")
+	p.MultiLine([]string{"1 120", "2 4711"})
+	if conn.writes != 0 {
+		t.Errorf("Expected response buffered, but got %d writes", conn.writes)
+	}
+	if err := p.Flush(); err != nil || conn.writes != 1 {
+		t.Errorf("Expected a single write, but got %d, %v", conn.writes, err)
+	}
+}
+
+// BenchmarkPrinter compares the writes of a short listing, sent line by
+// line as before coalescing and coalesced by the Printer, and of pipelined
+// commands.
+func BenchmarkPrinter(b *testing.B) {
+	lines := []string{"1 120", "2 4711", "3 815"}
+	b.Run("per-line", func(b *testing.B) {
+		conn := &writeCountingConn{}
+		for i := 0; i < b.N; i++ {
+			fmt.Fprintf(conn, "+OK %d messages\r\n", len(lines))
+			for _, line := range lines {
+				fmt.Fprintf(conn, "%s\r\n", line)
+			}
+			fmt.Fprint(conn, ".\r\n")
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		conn := &writeCountingConn{}
+		p := NewPrinter(conn)
+		for i := 0; i < b.N; i++ {
+			p.Ok("%d messages", len(lines))
+			p.MultiLine(lines)
+			p.Flush()
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("pipelined", func(b *testing.B) {
+		conn := &writeCountingConn{}
+		p := NewPrinter(conn)
+		for i := 0; i < b.N; i++ {
+			// RETR 1, DELE 1 and NOOP sent at once
+			p.Ok("120 octets")
+			p.MultiLine(lines)
+			p.Ok("Message 1 deleted")
+			p.Ok("")
+			p.Flush()
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N)/3, "writes/cmd")
+	})
+}
@@ -0,0 +1,212 @@
+package poptest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/kiwiz/popgun/client"
+)
+
+// ConformanceResult is the outcome of a step of Conformance.
+type ConformanceResult struct {
+	Name string
+	Err  error
+}
+
+// Conformance runs the conformance suite against the POP3 server at addr,
+// over TLS if config is set, e.g. to check a deployment end to end. It
+// logs in as username, whose maildrop must hold exactly messages, in
+// delivery order and ending with CRLF, and checks the responses of the
+// RFC 1939 commands, and of CAPA and TOP if the server supports them. All
+// messages are removed by the suite.
+//
+// Every step relies on the previous ones, so the suite stops at the first
+// failing step, which is the last result then. ctx bounds the whole suite.
+func Conformance(ctx context.Context, addr string, config *tls.Config, username, password string, messages []string) []ConformanceResult {
+	var results []ConformanceResult
+	step := func(name string, f func() error) bool {
+		err := f()
+		results = append(results, ConformanceResult{Name: name, Err: err})
+		return err == nil
+	}
+	var c *client.Client
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+	login := func() error {
+		var err error
+		if c, err = client.Dial(ctx, addr, config); err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		return c.Authenticate(username, password)
+	}
+
+	_ = step("login", login) &&
+		step("stat", func() error {
+			return expectStat(c, messages)
+		}) &&
+		step("list", func() error {
+			return expectList(c, messages)
+		}) &&
+		step("uidl", func() error {
+			return expectUidl(c, messages)
+		}) &&
+		step("retr", func() error {
+			return expectRetr(c, messages)
+		}) &&
+		step("top", func() error {
+			return expectTop(c, messages)
+		}) &&
+		step("noop", func() error {
+			return c.Noop()
+		}) &&
+		step("dele", func() error {
+			return expectDele(c, messages)
+		}) &&
+		step("update", func() error {
+			if err := login(); err != nil {
+				return err
+			}
+			if err := expectStat(c, nil); err != nil {
+				return fmt.Errorf("Deleted messages not removed: %v", err)
+			}
+			return c.Quit()
+		})
+	return results
+}
+
+func expectStat(c *client.Client, messages []string) error {
+	count, octets, err := c.Stat()
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, message := range messages {
+		total += len(message)
+	}
+	if count != len(messages) || octets != total {
+		return fmt.Errorf("Expected %d messages of %d octets, but got %d of %d", len(messages), total, count, octets)
+	}
+	return nil
+}
+
+func expectList(c *client.Client, messages []string) error {
+	infos, err := c.List()
+	if err != nil {
+		return err
+	}
+	if len(infos) != len(messages) {
+		return fmt.Errorf("Expected %d messages, but got %d", len(messages), len(infos))
+	}
+	for i, info := range infos {
+		if info.ID != i+1 || info.Octets != len(messages[i]) {
+			return fmt.Errorf("Expected message %d of %d octets, but got %d of %d", i+1, len(messages[i]), info.ID, info.Octets)
+		}
+	}
+	return nil
+}
+
+// expectUidl checks that the UIDs are unique and consist of 1 to 70
+// printable characters, see RFC 1939.
+func expectUidl(c *client.Client, messages []string) error {
+	infos, err := c.Uidl()
+	if err != nil {
+		return err
+	}
+	if len(infos) != len(messages) {
+		return fmt.Errorf("Expected %d messages, but got %d", len(messages), len(infos))
+	}
+	seen := make(map[string]bool)
+	for i, info := range infos {
+		if info.ID != i+1 {
+			return fmt.Errorf("Expected message %d, but got %d", i+1, info.ID)
+		}
+		if len(info.UID) < 1 || len(info.UID) > 70 {
+			return fmt.Errorf("Invalid UID of message %d: %q", info.ID, info.UID)
+		}
+		for _, r := range info.UID {
+			if r < 0x21 || r > 0x7e {
+				return fmt.Errorf("Invalid UID of message %d: %q", info.ID, info.UID)
+			}
+		}
+		if seen[info.UID] {
+			return fmt.Errorf("Duplicate UID of message %d: %q", info.ID, info.UID)
+		}
+		seen[info.UID] = true
+	}
+	return nil
+}
+
+func expectRetr(c *client.Client, messages []string) error {
+	for i, message := range messages {
+		var b strings.Builder
+		if _, err := c.Retr(i+1, &b); err != nil {
+			return err
+		}
+		if b.String() != message {
+			return fmt.Errorf("Message %d differs from the one delivered", i+1)
+		}
+	}
+	return nil
+}
+
+// expectTop checks that TOP with no lines returns the headers of the first
+// message and the empty line following them.
+func expectTop(c *client.Client, messages []string) error {
+	caps, err := c.Capa()
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 || (caps != nil && !caps.Has("TOP")) {
+		return nil
+	}
+	headers := messages[0]
+	if i := strings.Index(headers, "\r\n\r\n"); i >= 0 {
+		headers = headers[:i+4]
+	}
+	var b strings.Builder
+	if _, err := c.Top(1, 0, &b); err != nil {
+		return err
+	}
+	if b.String() != headers {
+		return fmt.Errorf("Expected headers of message 1, but got %q", b.String())
+	}
+	return nil
+}
+
+// expectDele marks all messages as deleted, checks that RSET unmarks them
+// and marks them again before QUIT.
+func expectDele(c *client.Client, messages []string) error {
+	for i := range messages {
+		if err := c.Dele(i + 1); err != nil {
+			return err
+		}
+	}
+	if len(messages) > 0 {
+		if _, ok := c.Dele(1).(*client.Error); !ok {
+			return fmt.Errorf("Expected -ERR deleting message 1 twice")
+		}
+	}
+	if err := expectStat(c, nil); err != nil {
+		return fmt.Errorf("Deleted messages still listed: %v", err)
+	}
+	if err := c.Rset(); err != nil {
+		return err
+	}
+	if err := expectStat(c, messages); err != nil {
+		return fmt.Errorf("Deleted messages not restored by RSET: %v", err)
+	}
+	for i := range messages {
+		if err := c.Dele(i + 1); err != nil {
+			return err
+		}
+	}
+	return c.Quit()
+}
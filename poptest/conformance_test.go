@@ -0,0 +1,64 @@
+package poptest_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+	"github.com/kiwiz/popgun/poptest"
+)
+
+// passwordAuthorizator accepts any user with password "secret".
+type passwordAuthorizator struct{}
+
+func (passwordAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	if password != "secret" {
+		return nil, fmt.Errorf("Invalid password")
+	}
+	return poptest.User(username), nil
+}
+
+func TestConformance(t *testing.T) {
+	messages := []string{
+		"Subject: a\r\n\r\nbody\r\n",
+		"Subject: b\r\n\r\n.dot\r\n",
+	}
+	maildrop := memory.New()
+	for i, message := range messages {
+		maildrop.Deliver("alice", string(rune('a'+i)), message)
+	}
+	server := popgun.NewServer(passwordAuthorizator{}, maildrop)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+
+	results := poptest.Conformance(context.Background(), l.Addr().String(), nil, "alice", "secret", messages)
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("Expected step %s to pass, but got %v", result.Name, result.Err)
+		}
+	}
+	if last := results[len(results)-1]; last.Name != "update" {
+		t.Errorf("Expected all steps run, but stopped after %s", last.Name)
+	}
+	if remaining := maildrop.Messages("alice"); len(remaining) != 0 {
+		t.Errorf("Expected messages removed, but got %v", remaining)
+	}
+
+	maildrop.Deliver("alice", "c", "Subject: c\r\n\r\nbody\r\n")
+	results = poptest.Conformance(context.Background(), l.Addr().String(), nil, "alice", "secret", messages)
+	if last := results[len(results)-1]; last.Name != "stat" || last.Err == nil {
+		t.Errorf("Expected stat to fail for a different maildrop, but got %+v", last)
+	}
+}
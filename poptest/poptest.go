@@ -0,0 +1,178 @@
+// Package poptest provides fake sessions for unit testing commands, i.e.
+// implementations of popgun.Executable added with Server.Commands,
+// without opening sockets:
+//
+//	s := poptest.NewSession(popgun.STATE_TRANSACTION, "alice")
+//	defer s.Close()
+//	s.Maildrop.Deliver("alice", "1", "Subject: hello\r\n\r\nbody\r\n")
+//	s.Backend.Inject(faulty.OP_RETR, faulty.Fault{Err: faulty.ErrInjected})
+//	state, err := s.Run(countCommand{}, "1")
+//	// s.Recorder.Responses holds the responses of the command
+//
+// The maildrop is kept by a memory backend, which a faulty backend wraps
+// so failures can be scripted.
+package poptest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/faulty"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// User is a backends.User of the given name.
+type User string
+
+func (u User) Username() string {
+	return string(u)
+}
+
+// Response is a response recorded by Recorder.
+type Response struct {
+	OK   bool
+	Text string
+	// Lines of a multi-line response, Terminated unless it was aborted
+	Lines      []string
+	Terminated bool
+}
+
+// Recorder is a popgun.ResponseWriter recording the responses of
+// commands.
+type Recorder struct {
+	Responses []Response
+	// Aborted is the error a multi-line response was aborted with.
+	Aborted error
+}
+
+func (r *Recorder) Ok(msg string, a ...interface{}) {
+	r.Responses = append(r.Responses, Response{OK: true, Text: fmt.Sprintf(msg, a...)})
+}
+
+func (r *Recorder) Err(msg string, a ...interface{}) {
+	r.Responses = append(r.Responses, Response{Text: fmt.Sprintf(msg, a...)})
+}
+
+func (r *Recorder) MultiLine(lines []string) {
+	for _, line := range lines {
+		r.Line(line)
+	}
+	r.End()
+}
+
+func (r *Recorder) Line(line string) {
+	last := r.last()
+	last.Lines = append(last.Lines, line)
+}
+
+func (r *Recorder) End() {
+	if r.Aborted == nil {
+		r.last().Terminated = true
+	}
+}
+
+func (r *Recorder) Abort(err error) {
+	r.Aborted = err
+}
+
+func (r *Recorder) StreamErr() error {
+	return r.Aborted
+}
+
+func (r *Recorder) Flush() error {
+	return nil
+}
+
+// last returns the response lines are added to, commands writing lines
+// without a status line get an empty one.
+func (r *Recorder) last() *Response {
+	if len(r.Responses) == 0 {
+		r.Responses = append(r.Responses, Response{})
+	}
+	return &r.Responses[len(r.Responses)-1]
+}
+
+// Last returns the last recorded response, the zero Response if none.
+func (r *Recorder) Last() Response {
+	if len(r.Responses) == 0 {
+		return Response{}
+	}
+	return r.Responses[len(r.Responses)-1]
+}
+
+// Session is a fake session commands can be run on.
+type Session struct {
+	Server *popgun.Server
+	Client *popgun.Client
+	// Recorder records the responses of the commands run.
+	Recorder *Recorder
+	// Maildrop keeps the messages, deliver them with Maildrop.Deliver.
+	Maildrop *memory.Backend
+	// Backend is the backend of the session, inject failures with
+	// Backend.Inject.
+	Backend *faulty.Backend
+	user    backends.User
+	locked  bool
+}
+
+// NewSession returns a session in state, e.g. popgun.STATE_TRANSACTION,
+// with username logged in, unless empty. In the TRANSACTION state the
+// maildrop is locked by the first Run until Close, so messages must be
+// delivered before.
+func NewSession(state int, username string) *Session {
+	maildrop := memory.New()
+	backend := faulty.New(maildrop)
+	server := popgun.NewServer(backends.DummyAuthorizator{}, backend)
+	s := &Session{
+		Server:   server,
+		Recorder: &Recorder{},
+		Maildrop: maildrop,
+		Backend:  backend,
+	}
+	if username != "" {
+		s.user = User(username)
+	}
+	s.Client = popgun.NewDetachedClient(server, conn{}, s.Recorder, state, s.user)
+	return s
+}
+
+// Run runs cmd with args on the session and returns its results. Unlike in
+// a real session, the state returned is not applied to the session.
+func (s *Session) Run(cmd popgun.Executable, args ...string) (int, error) {
+	if s.Client.State() == popgun.STATE_TRANSACTION && s.user != nil && !s.locked {
+		if err := s.Maildrop.Lock(s.user); err != nil {
+			return s.Client.State(), err
+		}
+		s.locked = true
+	}
+	return cmd.Run(s.Client, args)
+}
+
+// Close unlocks the maildrop.
+func (s *Session) Close() {
+	if s.locked {
+		s.Maildrop.Unlock(s.user)
+		s.locked = false
+	}
+}
+
+// conn is the connection of sessions, with the remote address 192.0.2.1:4711.
+type conn struct{}
+
+var (
+	localAddr  = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 110}
+	remoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4711}
+)
+
+func (conn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (conn) Write(b []byte) (int, error)        { return len(b), nil }
+func (conn) Close() error                       { return nil }
+func (conn) LocalAddr() net.Addr                { return localAddr }
+func (conn) RemoteAddr() net.Addr               { return remoteAddr }
+func (conn) SetDeadline(t time.Time) error      { return nil }
+func (conn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn) SetWriteDeadline(t time.Time) error { return nil }
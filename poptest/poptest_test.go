@@ -0,0 +1,66 @@
+package poptest_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends/faulty"
+	"github.com/kiwiz/popgun/poptest"
+)
+
+// sizeCommand answers with the size of a message.
+type sizeCommand struct{}
+
+func (sizeCommand) Run(c *popgun.Client, args []string) (int, error) {
+	if c.State() != popgun.STATE_TRANSACTION {
+		return c.State(), popgun.ErrInvalidState
+	}
+	message, err := c.Backend().Retr(c.User(), 1)
+	if err != nil {
+		return c.State(), err
+	}
+	c.Response().Ok("%d octets", len(message))
+	return c.State(), nil
+}
+
+func TestSession(t *testing.T) {
+	s := poptest.NewSession(popgun.STATE_TRANSACTION, "alice")
+	defer s.Close()
+	s.Maildrop.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	s.Maildrop.Deliver("alice", "b", "Subject: b\r\n\r\nbody\r\n")
+
+	state, err := s.Run(sizeCommand{})
+	if err != nil || state != popgun.STATE_TRANSACTION {
+		t.Fatalf("Expected TRANSACTION state, but got %d, %v", state, err)
+	}
+	if last := s.Recorder.Last(); !last.OK || last.Text != "20 octets" {
+		t.Errorf("Expected size of the message, but got %+v", last)
+	}
+	if _, err := s.Run(popgun.UidlCommand{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := poptest.Response{OK: true, Text: "2 messages", Lines: []string{"1 a", "2 b"}, Terminated: true}
+	if last := s.Recorder.Last(); !reflect.DeepEqual(last, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, last)
+	}
+	if s.Client.Username() != "alice" || s.Client.RemoteAddr().String() != "192.0.2.1:4711" {
+		t.Errorf("Expected session of alice, but got %s from %s", s.Client.Username(), s.Client.RemoteAddr())
+	}
+
+	s.Backend.Inject(faulty.OP_RETR, faulty.Fault{Err: faulty.ErrInjected})
+	if _, err := s.Run(sizeCommand{}); err != faulty.ErrInjected {
+		t.Errorf("Expected injected failure, but got %v", err)
+	}
+}
+
+func TestSession_authorization(t *testing.T) {
+	s := poptest.NewSession(popgun.STATE_AUTHORIZATION, "")
+	defer s.Close()
+	if state, err := s.Run(sizeCommand{}); err != popgun.ErrInvalidState || state != popgun.STATE_AUTHORIZATION {
+		t.Errorf("Expected invalid state, but got %d, %v", state, err)
+	}
+	if len(s.Recorder.Responses) != 0 {
+		t.Errorf("Expected no responses, but got %+v", s.Recorder.Responses)
+	}
+}
@@ -0,0 +1,263 @@
+package popgun
+
+import (
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// PrefetchBackend wraps a Backend and, right after Lock, asynchronously loads
+// the maildrop listing and optionally the first Messages messages not larger
+// than MaxSize octets into memory, while the client issues STAT/UIDL. Calls
+// to the wrapped backend are serialized per user, so it doesn't have to
+// support concurrent access to a single maildrop.
+type PrefetchBackend struct {
+	Backend
+	Messages int
+	MaxSize  int
+
+	mu     sync.Mutex
+	caches map[string]*prefetchCache
+}
+
+type prefetchCache struct {
+	// mu serializes calls to the wrapped backend and guards the fields below
+	mu       sync.Mutex
+	ready    chan struct{}
+	cancel   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	listed   bool
+	octets   []int
+	uids     []string
+	messages map[int]string
+}
+
+func NewPrefetchBackend(backend Backend, messages, maxSize int) *PrefetchBackend {
+	return &PrefetchBackend{
+		Backend:  backend,
+		Messages: messages,
+		MaxSize:  maxSize,
+		caches:   make(map[string]*prefetchCache),
+	}
+}
+
+func (b *PrefetchBackend) Lock(user backends.User) error {
+	err := b.Backend.Lock(user)
+	if err != nil {
+		return err
+	}
+	cache := &prefetchCache{
+		ready:    make(chan struct{}),
+		cancel:   make(chan struct{}),
+		done:     make(chan struct{}),
+		messages: make(map[int]string),
+	}
+	b.mu.Lock()
+	b.caches[user.Username()] = cache
+	b.mu.Unlock()
+	go b.prefetch(user, cache)
+	return nil
+}
+
+// prefetch loads the listing and then small messages into cache.
+func (b *PrefetchBackend) prefetch(user backends.User, cache *prefetchCache) {
+	defer close(cache.done)
+
+	cache.mu.Lock()
+	octets, err := b.Backend.List(user)
+	if err == nil {
+		var uids []string
+		uids, err = b.Backend.Uidl(user)
+		if err == nil {
+			cache.listed = true
+			cache.octets = octets
+			cache.uids = uids
+		}
+	}
+	cache.mu.Unlock()
+	close(cache.ready)
+	if err != nil {
+		return
+	}
+
+	for i, size := range octets {
+		if i >= b.Messages {
+			return
+		}
+		if b.MaxSize > 0 && size > b.MaxSize {
+			continue
+		}
+		select {
+		case <-cache.cancel:
+			return
+		default:
+		}
+		cache.mu.Lock()
+		if cache.listed {
+			message, err := b.Backend.Retr(user, i+1)
+			if err == nil {
+				cache.messages[i+1] = message
+			}
+		}
+		cache.mu.Unlock()
+	}
+}
+
+// cache returns the cache of user once its listing has been loaded. It
+// returns nil if the maildrop wasn't locked through this backend.
+func (b *PrefetchBackend) cache(user backends.User) *prefetchCache {
+	b.mu.Lock()
+	cache := b.caches[user.Username()]
+	b.mu.Unlock()
+	if cache != nil {
+		<-cache.ready
+	}
+	return cache
+}
+
+func (b *PrefetchBackend) Stat(user backends.User) (messages, octets int, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Stat(user)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !cache.listed {
+		return b.Backend.Stat(user)
+	}
+	for _, size := range cache.octets {
+		octets += size
+	}
+	return len(cache.octets), octets, nil
+}
+
+func (b *PrefetchBackend) List(user backends.User) (octets []int, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.List(user)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !cache.listed {
+		return b.Backend.List(user)
+	}
+	return append([]int(nil), cache.octets...), nil
+}
+
+func (b *PrefetchBackend) Uidl(user backends.User) (uids []string, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Uidl(user)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !cache.listed {
+		return b.Backend.Uidl(user)
+	}
+	return append([]string(nil), cache.uids...), nil
+}
+
+func (b *PrefetchBackend) Retr(user backends.User, msgId int) (message string, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Retr(user, msgId)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if message, ok := cache.messages[msgId]; ok {
+		return message, nil
+	}
+	return b.Backend.Retr(user, msgId)
+}
+
+// Dele invalidates the cached listing and evicts the cached message, as
+// deleted messages must be neither listed nor retrieved.
+func (b *PrefetchBackend) Dele(user backends.User, msgId int) error {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Dele(user, msgId)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.listed = false
+	delete(cache.messages, msgId)
+	return b.Backend.Dele(user, msgId)
+}
+
+func (b *PrefetchBackend) Rset(user backends.User) error {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Rset(user)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.listed = false
+	return b.Backend.Rset(user)
+}
+
+func (b *PrefetchBackend) ListMessage(user backends.User, msgId int) (exists bool, octets int, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.ListMessage(user, msgId)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return b.Backend.ListMessage(user, msgId)
+}
+
+func (b *PrefetchBackend) UidlMessage(user backends.User, msgId int) (exists bool, uid string, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.UidlMessage(user, msgId)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return b.Backend.UidlMessage(user, msgId)
+}
+
+func (b *PrefetchBackend) Top(user backends.User, msgId int, n int) (lines []string, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Top(user, msgId, n)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return b.Backend.Top(user, msgId, n)
+}
+
+// Update stops prefetching before committing the deletions, the messages
+// are gone afterwards.
+func (b *PrefetchBackend) Update(user backends.User) (result backends.UpdateResult, err error) {
+	cache := b.cache(user)
+	if cache == nil {
+		return b.Backend.Update(user)
+	}
+	cache.stop()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.listed = false
+	cache.messages = make(map[int]string)
+	return b.Backend.Update(user)
+}
+
+// stop cancels prefetching and waits for it to end.
+func (cache *prefetchCache) stop() {
+	cache.stopOnce.Do(func() {
+		close(cache.cancel)
+	})
+	<-cache.done
+}
+
+// Unlock stops prefetching and drops the cache before unlocking the maildrop.
+func (b *PrefetchBackend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	cache := b.caches[user.Username()]
+	delete(b.caches, user.Username())
+	b.mu.Unlock()
+	if cache != nil {
+		cache.stop()
+	}
+	return b.Backend.Unlock(user)
+}
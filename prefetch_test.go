@@ -0,0 +1,136 @@
+package popgun
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+type countingBackend struct {
+	backends.DummyBackend
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (b *countingBackend) count(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls[name]++
+}
+
+func (b *countingBackend) List(user backends.User) ([]int, error) {
+	b.count("List")
+	return b.DummyBackend.List(user)
+}
+
+func (b *countingBackend) Retr(user backends.User, msgId int) (string, error) {
+	b.count("Retr")
+	return b.DummyBackend.Retr(user, msgId)
+}
+
+func TestPrefetchBackend(t *testing.T) {
+	user := &backends.DummyUser{}
+	inner := &countingBackend{calls: make(map[string]int)}
+	backend := NewPrefetchBackend(inner, 2, 100)
+
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	messages, octets, _ := backend.Stat(user)
+	if messages != 5 || octets != 50 {
+		t.Errorf("Expected '5 50', but got '%d %d'", messages, octets)
+	}
+	backend.List(user)
+	backend.Unlock(user)
+
+	if inner.calls["List"] != 1 {
+		t.Errorf("Expected List to be called once, but got %d", inner.calls["List"])
+	}
+	if retr := inner.calls["Retr"]; retr > 2 {
+		t.Errorf("Expected at most 2 prefetched messages, but got %d", retr)
+	}
+}
+
+func TestPrefetchBackend_Dele(t *testing.T) {
+	user := testUser("alice")
+	inner := memory.New()
+	inner.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	backend := NewPrefetchBackend(inner, 1, 100)
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock(user)
+	cache := backend.cache(user)
+	<-cache.done
+	if _, ok := cache.messages[1]; !ok {
+		t.Fatal("Expected message 1 to be prefetched")
+	}
+
+	if err := backend.Dele(user, 1); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := backend.Retr(user, 1); err == nil {
+		t.Errorf("Expected deleted message not to be retrieved, but got %q", message)
+	}
+}
+
+// serialBackend fails the test when it is called concurrently. Its calls
+// are recorded without locking, so the race detector reports them as well.
+type serialBackend struct {
+	backends.DummyBackend
+	t      *testing.T
+	active int32
+	calls  []string
+}
+
+func (b *serialBackend) enter(name string) func() {
+	if atomic.AddInt32(&b.active, 1) != 1 {
+		b.t.Errorf("Expected calls to be serialized, but %s overlapped", name)
+	}
+	b.calls = append(b.calls, name)
+	// give a concurrent call the chance to overlap
+	time.Sleep(time.Millisecond)
+	return func() { atomic.AddInt32(&b.active, -1) }
+}
+
+func (b *serialBackend) Retr(user backends.User, msgId int) (string, error) {
+	defer b.enter("Retr")()
+	return b.DummyBackend.Retr(user, msgId)
+}
+
+func (b *serialBackend) Top(user backends.User, msgId int, n int) ([]string, error) {
+	defer b.enter("Top")()
+	return []string{"Subject: test", ""}, nil
+}
+
+func (b *serialBackend) Update(user backends.User) (backends.UpdateResult, error) {
+	defer b.enter("Update")()
+	return b.DummyBackend.Update(user)
+}
+
+func TestPrefetchBackend_serialized(t *testing.T) {
+	user := &backends.DummyUser{}
+	inner := &serialBackend{t: t}
+	backend := NewPrefetchBackend(inner, 5, 0)
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	// TOP while the messages are prefetched
+	for i := 1; i <= 5; i++ {
+		if _, err := backend.Top(user, i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	backend.Unlock(user)
+
+	if last := inner.calls[len(inner.calls)-1]; last != "Update" {
+		t.Errorf("Expected prefetching to stop before Update, but got calls %v", inner.calls)
+	}
+}
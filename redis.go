@@ -0,0 +1,118 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisOptions configures the connection of a redisConn.
+type redisOptions struct {
+	Addr     string
+	Password string
+	// timeout of a single request, 1s by default
+	Timeout time.Duration
+	Dialer  Dialer
+}
+
+// redisConn is a minimal Redis client shared by the Redis stores. It
+// connects lazily and reconnects after errors.
+type redisConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// command sends a command and returns its simple string, integer or bulk
+// reply. The connection is dropped on errors.
+func (r *redisConn) command(ctx context.Context, opts redisOptions, args ...string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.connect(ctx, opts); err != nil {
+			return "", err
+		}
+	}
+	reply, err := r.roundTrip(ctx, opts, args)
+	if err != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+func (r *redisConn) connect(ctx context.Context, opts redisOptions) error {
+	var dialer Dialer = &net.Dialer{}
+	if opts.Dialer != nil {
+		dialer = opts.Dialer
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", opts.Addr)
+	if err != nil {
+		return fmt.Errorf("Error connecting to Redis: %v", err)
+	}
+	r.conn, r.rd = conn, bufio.NewReader(conn)
+	if opts.Password != "" {
+		if _, err := r.roundTrip(ctx, opts, []string{"AUTH", opts.Password}); err != nil {
+			conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisConn) roundTrip(ctx context.Context, opts redisOptions, args []string) (string, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	r.conn.SetDeadline(deadline)
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := r.conn.Write([]byte(request.String())); err != nil {
+		return "", err
+	}
+
+	line, err := r.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("Empty Redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("Redis error: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("Invalid Redis reply: %q", line)
+		}
+		if n < 0 {
+			return "", nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r.rd, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	}
+	return "", fmt.Errorf("Unexpected Redis reply: %q", line)
+}
@@ -0,0 +1,109 @@
+package popgun
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NonceStore detects replayed authentication data, like APOP digests and
+// SASL nonces. A store shared by all servers of a fleet, e.g.
+// RedisNonceStore, detects replays across them.
+type NonceStore interface {
+	// Use records nonce for ttl. It returns false if it was recorded before
+	// and hasn't expired yet, i.e. it is replayed.
+	Use(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+// MemoryNonceStore is a NonceStore local to the process.
+type MemoryNonceStore struct {
+	// Clock, if set, replaces the system clock
+	Clock Clock
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+	uses    int
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{expires: make(map[string]time.Time)}
+}
+
+func (s *MemoryNonceStore) Use(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	now := clockOrSystem(s.Clock).Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expires, ok := s.expires[nonce]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.expires[nonce] = now.Add(ttl)
+	// drop expired nonces once in a while
+	s.uses++
+	if s.uses%1024 == 0 {
+		for nonce, expires := range s.expires {
+			if !now.Before(expires) {
+				delete(s.expires, nonce)
+			}
+		}
+	}
+	return true, nil
+}
+
+// RedisNonceStore records nonces in Redis with SET NX, so replays are
+// detected across all servers using the same Redis instance.
+type RedisNonceStore struct {
+	// address of the Redis server, e.g. "localhost:6379"
+	Addr     string
+	Password string
+	// prefix of the keys, "popgun:nonce:" by default
+	Prefix string
+	// timeout of a single request, 1s by default
+	Timeout time.Duration
+	// Dialer, if set, connects to Redis instead of a net.Dialer
+	Dialer Dialer
+
+	redis redisConn
+}
+
+func (s *RedisNonceStore) Use(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = "popgun:nonce:"
+	}
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	opts := redisOptions{Addr: s.Addr, Password: s.Password, Timeout: s.Timeout, Dialer: s.Dialer}
+	reply, err := s.redis.command(ctx, opts, "SET", prefix+nonce, "1", "NX", "PX", strconv.FormatInt(ms, 10))
+	if err != nil {
+		return false, err
+	}
+	// a nil reply means the key exists
+	return reply == "OK", nil
+}
+
+// checkReplay records nonce in the server's NonceStore. It returns false
+// if the nonce was replayed, logging the event. Errors of the store are
+// logged and don't reject the client.
+func (c *Client) checkReplay(mechanism, nonce string) bool {
+	store := c.server.NonceStore
+	if store == nil {
+		return true
+	}
+	ttl := c.server.NonceTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+	fresh, err := store.Use(c.Context(), mechanism+":"+nonce, ttl)
+	if err != nil {
+		c.ErrorLog.Printf("Error checking %s nonce: %v", mechanism, err)
+		return true
+	}
+	if !fresh {
+		c.ErrorLog.Printf("Replayed %s authentication from %s", mechanism, c.RemoteAddr())
+		c.server.Metrics.Inc("security.replay", mechanism)
+	}
+	return fresh
+}
@@ -0,0 +1,178 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore()
+	ctx := context.Background()
+	for _, tc := range []struct {
+		nonce string
+		ttl   time.Duration
+		fresh bool
+	}{
+		{"a", time.Hour, true},
+		{"a", time.Hour, false},
+		{"b", -time.Second, true},
+		// expired already
+		{"b", time.Hour, true},
+		{"b", time.Hour, false},
+	} {
+		fresh, err := store.Use(ctx, tc.nonce, tc.ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh != tc.fresh {
+			t.Errorf("Expected nonce '%s' fresh %v, but got %v", tc.nonce, tc.fresh, fresh)
+		}
+	}
+}
+
+// fakeRedis answers SET NX and INCRBY commands like Redis, ignoring expiry.
+func fakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	keys := make(map[string]int)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		for {
+			var n int
+			if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+				return
+			}
+			args := make([]string, n)
+			for i := range args {
+				var size int
+				fmt.Fscanf(rd, "$%d\r\n", &size)
+				buf := make([]byte, size+2)
+				if _, err := rd.Read(buf); err != nil {
+					return
+				}
+				args[i] = string(buf[:size])
+			}
+			_, exists := keys[args[1]]
+			switch command := strings.ToUpper(args[0]); {
+			case command == "INCRBY":
+				n, _ := strconv.Atoi(args[2])
+				keys[args[1]] += n
+				fmt.Fprintf(conn, ":%d\r\n", keys[args[1]])
+			case command != "SET":
+				conn.Write([]byte("-ERR unknown command\r\n"))
+			case exists:
+				conn.Write([]byte("$-1\r\n"))
+			default:
+				keys[args[1]] = 1
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRedisNonceStore(t *testing.T) {
+	store := &RedisNonceStore{Addr: fakeRedis(t)}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		nonce string
+		fresh bool
+	}{
+		{"a", true},
+		{"b", true},
+		{"a", false},
+	} {
+		fresh, err := store.Use(ctx, tc.nonce, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh != tc.fresh {
+			t.Errorf("Expected nonce '%s' fresh %v, but got %v", tc.nonce, tc.fresh, fresh)
+		}
+	}
+}
+
+type apopAuthorizator struct{}
+
+func (a apopAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	return nil, fmt.Errorf("bad password")
+}
+
+func (a apopAuthorizator) AuthorizeAPOP(conn net.Conn, username, timestamp, digest string) (backends.User, error) {
+	if digest != APOPDigest(timestamp, "tanstaaf") {
+		return nil, fmt.Errorf("bad digest")
+	}
+	return testUser(username), nil
+}
+
+func TestApopCommand_Run(t *testing.T) {
+	const timestamp = "<1896.697170952@dbc.mtview.ca.us>"
+	if digest := APOPDigest(timestamp, "tanstaaf"); digest != "c4c9334bac560ecc979e58001b3e22fb" {
+		t.Errorf("Expected RFC 1939 example digest, but got '%s'", digest)
+	}
+	store := NewMemoryNonceStore()
+	setup := func(c *Client) {
+		c.authorizator = apopAuthorizator{}
+		c.timestamp = timestamp
+		c.server.NonceStore = store
+	}
+	testCases := []cmdTestCase{
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedOutput: "^\\-ERR APOP is not supported\r\n$",
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "00000000000000000000000000000000"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedOutput: "^\\-ERR Invalid username or password: bad digest\r\n$",
+			setup:          setup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState:  STATE_TRANSACTION,
+			expectedOutput: "^\\+OK User Successfully Logged on\r\n$",
+			setup:          setup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "C4C9334BAC560ECC979E58001B3E22FB"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Replayed authentication rejected\r\n$",
+			setup:          setup,
+		},
+		{
+			cmd:           ApopCommand{},
+			initialState:  STATE_TRANSACTION,
+			args:          []string{"mrose", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState: 0,
+			expectedErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		commandTest(t, tc)
+	}
+}
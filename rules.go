@@ -0,0 +1,252 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+const (
+	// hide the message from the client for this session
+	RULE_HIDE = iota + 1
+	// mark the message as deleted, it is removed on UPDATE
+	RULE_DELETE
+	// attach a tag to the message, see RulesBackend.Tags
+	RULE_TAG
+)
+
+// Rule matches messages whose header contains a substring (case
+// insensitive) and applies an action to them.
+type Rule struct {
+	Action   int
+	Tag      string
+	Header   string
+	Contains string
+}
+
+func (r Rule) Match(headers map[string][]string) bool {
+	for _, value := range headers[strings.ToLower(r.Header)] {
+		if strings.Contains(strings.ToLower(value), strings.ToLower(r.Contains)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSource loads the rules of a user, e.g. from a per-user config file.
+type RuleSource interface {
+	Rules(user backends.User) ([]Rule, error)
+}
+
+// ParseRules reads rules, one per line, in the form:
+//
+//	<action> <header> <substring>
+//
+// where action is one of "hide", "delete" or "tag:<name>" and substring may
+// be double-quoted. Empty lines and lines starting with # are ignored.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid rule on line %d: %s", lineNo, line)
+		}
+		action := fields[0]
+		fields = strings.SplitN(strings.TrimSpace(fields[1]), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid rule on line %d: %s", lineNo, line)
+		}
+		rule := Rule{Header: fields[0], Contains: strings.TrimSpace(fields[1])}
+		if strings.HasPrefix(rule.Contains, "\"") {
+			contains, err := strconv.Unquote(rule.Contains)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid substring on line %d: %v", lineNo, err)
+			}
+			rule.Contains = contains
+		}
+		switch {
+		case action == "hide":
+			rule.Action = RULE_HIDE
+		case action == "delete":
+			rule.Action = RULE_DELETE
+		case strings.HasPrefix(action, "tag:") && len(action) > 4:
+			rule.Action = RULE_TAG
+			rule.Tag = action[4:]
+		default:
+			return nil, fmt.Errorf("Invalid action on line %d: %s", lineNo, action)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// parseHeaders parses message header lines as returned by Top, header names
+// are lowercased.
+func parseHeaders(lines []string) map[string][]string {
+	headers := make(map[string][]string)
+	last := ""
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && last != "" {
+			values := headers[last]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			continue
+		}
+		last = strings.ToLower(strings.TrimSpace(line[:i]))
+		headers[last] = append(headers[last], strings.TrimSpace(line[i+1:]))
+	}
+	return headers
+}
+
+// RulesBackend evaluates the rules of a user when the maildrop is locked.
+// Hidden and deleted messages are not visible to the client, tags can be
+// read by hooks with Tags. Messages deleted by rules stay deleted when the
+// client issues RSET.
+type RulesBackend struct {
+	*FilteredBackend
+	Source RuleSource
+
+	mu     sync.Mutex
+	hidden map[string]map[string]bool
+	tags   map[string]map[string][]string
+	// IDs of the wrapped backend of messages deleted by rules
+	deleted map[string][]int
+}
+
+func NewRulesBackend(backend Backend, source RuleSource) *RulesBackend {
+	b := &RulesBackend{
+		Source:  source,
+		hidden:  make(map[string]map[string]bool),
+		tags:    make(map[string]map[string][]string),
+		deleted: make(map[string][]int),
+	}
+	b.FilteredBackend = NewFilteredBackend(backend, nil)
+	return b
+}
+
+func (b *RulesBackend) Lock(user backends.User) error {
+	inner := b.FilteredBackend.Backend
+	err := inner.Lock(user)
+	if err != nil {
+		return err
+	}
+	uids, err := b.apply(user)
+	if err != nil {
+		inner.Unlock(user)
+		return err
+	}
+	b.buildView(user, uids, b)
+	return nil
+}
+
+// apply evaluates the rules against every message of the locked maildrop.
+func (b *RulesBackend) apply(user backends.User) ([]string, error) {
+	inner := b.FilteredBackend.Backend
+	uids, err := inner.Uidl(user)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := b.Source.Rules(user)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading rules for user %s: %v", user.Username(), err)
+	}
+	hidden := make(map[string]bool)
+	tags := make(map[string][]string)
+	var deleted []int
+	if len(rules) > 0 {
+		for i, uid := range uids {
+			lines, err := inner.Top(user, i+1, 0)
+			if err != nil {
+				return nil, err
+			}
+			headers := parseHeaders(lines)
+			for _, rule := range rules {
+				if !rule.Match(headers) {
+					continue
+				}
+				switch rule.Action {
+				case RULE_HIDE:
+					hidden[uid] = true
+				case RULE_DELETE:
+					// already deleted by a previous rule
+					if len(deleted) > 0 && deleted[len(deleted)-1] == i+1 {
+						continue
+					}
+					if err := inner.Dele(user, i+1); err != nil {
+						return nil, err
+					}
+					deleted = append(deleted, i+1)
+					hidden[uid] = true
+				case RULE_TAG:
+					tags[uid] = append(tags[uid], rule.Tag)
+				}
+			}
+		}
+	}
+	b.mu.Lock()
+	b.hidden[user.Username()] = hidden
+	b.tags[user.Username()] = tags
+	b.deleted[user.Username()] = deleted
+	b.mu.Unlock()
+	return uids, nil
+}
+
+// Rset undeletes the messages deleted by the client, but deletes the ones
+// deleted by rules again, as they are hidden from it.
+func (b *RulesBackend) Rset(user backends.User) error {
+	inner := b.FilteredBackend.Backend
+	if err := inner.Rset(user); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	deleted := b.deleted[user.Username()]
+	b.mu.Unlock()
+	for _, msgId := range deleted {
+		if err := inner.Dele(user, msgId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *RulesBackend) Unlock(user backends.User) error {
+	b.mu.Lock()
+	delete(b.hidden, user.Username())
+	delete(b.tags, user.Username())
+	delete(b.deleted, user.Username())
+	b.mu.Unlock()
+	return b.FilteredBackend.Unlock(user)
+}
+
+// Visible implements ListFilter for messages not hidden by rules.
+func (b *RulesBackend) Visible(user backends.User, uid string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.hidden[user.Username()][uid]
+}
+
+// Tags returns the tags attached to a message by rules in the current session.
+func (b *RulesBackend) Tags(user backends.User, uid string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tags[user.Username()][uid]
+}
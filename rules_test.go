@@ -0,0 +1,94 @@
+package popgun
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+func TestParseRules(t *testing.T) {
+	input := `# comment
+hide Subject "[SPAM]"
+delete From ads@example.com
+tag:news List-Id news
+`
+	rules, err := ParseRules(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Rule{
+		{Action: RULE_HIDE, Header: "Subject", Contains: "[SPAM]"},
+		{Action: RULE_DELETE, Header: "From", Contains: "ads@example.com"},
+		{Action: RULE_TAG, Tag: "news", Header: "List-Id", Contains: "news"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected '%v', but got '%v'", expected, rules)
+	}
+
+	_, err = ParseRules(strings.NewReader("archive Subject foo"))
+	if err == nil {
+		t.Error("Expected error, but got none")
+	}
+}
+
+type rulesTestSource []Rule
+
+func (s rulesTestSource) Rules(user backends.User) ([]Rule, error) {
+	return s, nil
+}
+
+type headersBackend struct {
+	backends.DummyBackend
+	deleted []int
+}
+
+func (b *headersBackend) Top(user backends.User, msgId int, n int) ([]string, error) {
+	subjects := []string{"hello", "[SPAM] buy now", "weekly", "news", "bye"}
+	return []string{"Subject: " + subjects[msgId-1], "List-Id: <" + subjects[msgId-1] + ">", ""}, nil
+}
+
+func (b *headersBackend) Dele(user backends.User, msgId int) error {
+	b.deleted = append(b.deleted, msgId)
+	return nil
+}
+
+func (b *headersBackend) Rset(user backends.User) error {
+	b.deleted = nil
+	return nil
+}
+
+func TestRulesBackend_Lock(t *testing.T) {
+	user := &backends.DummyUser{}
+	inner := &headersBackend{}
+	backend := NewRulesBackend(inner, rulesTestSource{
+		{Action: RULE_HIDE, Header: "subject", Contains: "spam"},
+		{Action: RULE_DELETE, Header: "Subject", Contains: "bye"},
+		{Action: RULE_TAG, Tag: "news", Header: "List-Id", Contains: "news"},
+	})
+	if err := backend.Lock(user); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock(user)
+
+	uids, _ := backend.Uidl(user)
+	expectedUids := []string{"1", "3", "4"}
+	if !reflect.DeepEqual(uids, expectedUids) {
+		t.Errorf("Expected '%v', but got '%v'", expectedUids, uids)
+	}
+	if !reflect.DeepEqual(inner.deleted, []int{5}) {
+		t.Errorf("Expected message 5 to be deleted, but got '%v'", inner.deleted)
+	}
+	if tags := backend.Tags(user, "4"); !reflect.DeepEqual(tags, []string{"news"}) {
+		t.Errorf("Expected tag 'news', but got '%v'", tags)
+	}
+
+	backend.Dele(user, 1)
+	if err := backend.Rset(user); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inner.deleted, []int{5}) {
+		t.Errorf("Expected message 5 to stay deleted after RSET, but got '%v'", inner.deleted)
+	}
+}
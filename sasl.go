@@ -0,0 +1,172 @@
+package popgun
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// SASLServer is the server side of a single SASL exchange (RFC 4422) of
+// the AUTH command.
+type SASLServer interface {
+	// Next is passed the response of the client, nil if the client sent
+	// no initial response, and returns the next challenge. Once done, the
+	// client is authenticated as Username with Authorize.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Username returns the authentication identity of a done exchange.
+	Username() string
+	// Authorize checks the credentials of the exchange for username, the
+	// canonical form of Username, and returns the user.
+	Authorize(username string) (backends.User, error)
+}
+
+// SASLMechanism starts an exchange of a SASL mechanism for a client, see
+// Server.SASL.
+type SASLMechanism func(conn net.Conn, auth Authorizator) SASLServer
+
+// SASLPlain is the PLAIN mechanism (RFC 4616), checking the password with
+// the Authorizator like PASS. The authorization identity must be empty or
+// equal the authentication identity.
+func SASLPlain(conn net.Conn, auth Authorizator) SASLServer {
+	return &plainServer{conn: conn, auth: auth}
+}
+
+type plainServer struct {
+	conn     net.Conn
+	auth     Authorizator
+	username string
+	password string
+}
+
+func (s *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		// ask for the credentials
+		return nil, false, nil
+	}
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, false, fmt.Errorf("Invalid PLAIN response")
+	}
+	if len(parts[0]) > 0 && !bytes.Equal(parts[0], parts[1]) {
+		return nil, false, fmt.Errorf("Authorization identity not supported")
+	}
+	s.username, s.password = string(parts[1]), string(parts[2])
+	return nil, true, nil
+}
+
+func (s *plainServer) Username() string {
+	return s.username
+}
+
+func (s *plainServer) Authorize(username string) (backends.User, error) {
+	return s.auth.Authorize(s.conn, username, s.password)
+}
+
+// saslMechanisms returns the names of the mechanisms offered to the
+// client, empty if it may not authenticate (anymore).
+func (c *Client) saslMechanisms() []string {
+	if c.currentState != STATE_AUTHORIZATION || !c.AllowAuth() {
+		return nil
+	}
+	var names []string
+	for name := range c.server.SASL {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// errSASLCanceled is returned by saslResponse if the client canceled the
+// exchange.
+var errSASLCanceled = fmt.Errorf("Authentication canceled")
+
+// saslResponse sends challenge and reads the base64 encoded response of
+// the client. If reading fails, the session ends.
+func (c *Client) saslResponse(challenge []byte) ([]byte, error) {
+	// continuations are not status lines, so they are not padded
+	c.printer.Flush()
+	fmt.Fprintf(c.out.conn, "+ %s\r\n", base64.StdEncoding.EncodeToString(challenge))
+
+	timer := c.server.clock().NewTimer(c.server.sessionTimeout())
+	defer timer.Stop()
+	var result readResult
+	select {
+	case result = <-c.inputs:
+	case <-timer.C():
+		result = readResult{err: os.ErrDeadlineExceeded}
+	}
+	if result.err != nil {
+		// let the session end as if the command completed
+		c.pending = &result
+		return nil, result.err
+	}
+	line := strings.TrimRight(result.line, "\r\n")
+	if line == "*" {
+		return nil, errSASLCanceled
+	}
+	return decodeSASL(line)
+}
+
+// decodeSASL decodes a base64 encoded response, "=" being an empty one.
+func decodeSASL(response string) ([]byte, error) {
+	if response == "=" {
+		return []byte{}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base64 response")
+	}
+	return decoded, nil
+}
+
+// decodeSASLName decodes a username of the GS2 header of OAUTHBEARER and
+// SCRAM, which escapes "," and "=".
+func decodeSASLName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+// SASLExtension is a SASL mechanism added to a server by name, e.g. a
+// wrapper of a company-internal Kerberos setup, see Server.RegisterSASL.
+type SASLExtension interface {
+	// Name returns the name of the mechanism, e.g. "GSSAPI".
+	Name() string
+	// Start starts an exchange for a client, like a SASLMechanism.
+	Start(conn net.Conn, auth Authorizator) SASLServer
+}
+
+// RegisterSASL adds mechanisms to the ones offered by AUTH, replacing those
+// of the same name. Names consist of up to 20 upper case letters, digits,
+// "-" and "_" (RFC 4422). It must be called before serving.
+func (s *Server) RegisterSASL(mechanisms ...SASLExtension) error {
+	for _, mechanism := range mechanisms {
+		if !validSASLName(mechanism.Name()) {
+			return fmt.Errorf("Invalid SASL mechanism name %q", mechanism.Name())
+		}
+	}
+	if s.SASL == nil {
+		s.SASL = make(map[string]SASLMechanism)
+	}
+	for _, mechanism := range mechanisms {
+		s.SASL[mechanism.Name()] = mechanism.Start
+	}
+	return nil
+}
+
+// validSASLName reports whether name is a valid name of a SASL mechanism.
+func validSASLName(name string) bool {
+	if name == "" || len(name) > 20 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
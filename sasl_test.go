@@ -0,0 +1,189 @@
+package popgun
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestAuthCommand(t *testing.T) {
+	plain := func(authzid, authcid, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(authzid + "\x00" + authcid + "\x00" + password))
+	}
+	tables := []struct {
+		lines    []string
+		expected []string
+	}{
+		{[]string{"AUTH PLAIN " + plain("", "alice", "secret")}, []string{"+OK User Successfully Logged on"}},
+		{[]string{"AUTH plain", plain("alice", "alice", "secret")}, []string{"+ ", "+OK User Successfully Logged on"}},
+		{[]string{"AUTH PLAIN " + plain("", "alice", "wrong")}, []string{"-ERR [AUTH] Invalid username or password: Invalid password"}},
+		{[]string{"AUTH PLAIN " + plain("bob", "alice", "secret")}, []string{"-ERR [AUTH] Authentication failed: Authorization identity not supported"}},
+		{[]string{"AUTH PLAIN =", "STAT"}, []string{"-ERR [AUTH] Authentication failed: Invalid PLAIN response", "-ERR Error executing command STAT"}},
+		{[]string{"AUTH PLAIN", "*"}, []string{"+ ", "-ERR Authentication canceled"}},
+		{[]string{"AUTH PLAIN", "not base64"}, []string{"+ ", "-ERR Invalid base64 response"}},
+		{[]string{"AUTH CRAM-MD5"}, []string{"-ERR Unsupported authentication mechanism CRAM-MD5"}},
+	}
+	for _, table := range tables {
+		listener := newPipeListener()
+		server := NewServer(secretAuthorizator{}, memory.New())
+		server.AllowInsecureAuth = true
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		for _, line := range table.lines {
+			fmt.Fprintf(conn, "%s\r\n", line)
+		}
+		for _, expected := range table.expected {
+			if line, _ := reader.ReadString('\n'); line != expected+"\r\n" {
+				t.Errorf("Expected %q for %q, but got %q", expected, table.lines, line)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestAuthCommand_longInitialResponse(t *testing.T) {
+	metrics := newCountingMetrics()
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.AllowInsecureAuth = true
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	password := strings.Repeat("x", MAX_COMMAND_LINE)
+	fmt.Fprintf(conn, "AUTH PLAIN %s\r\n", base64.StdEncoding.EncodeToString([]byte("\x00alice\x00"+password)))
+	if line, _ := reader.ReadString('\n'); line != "+OK User Successfully Logged on\r\n" {
+		t.Errorf("Expected login with long initial response, but got %q", line)
+	}
+	if n := metrics.count("protocol.violation:" + VIOLATION_OVERSIZED_LINE); n != 0 {
+		t.Errorf("Expected no violation, but got %d", n)
+	}
+}
+
+func TestAuthCommand_capa(t *testing.T) {
+	for _, allowInsecure := range []bool{false, true} {
+		listener := newPipeListener()
+		server := NewServer(secretAuthorizator{}, memory.New())
+		server.AllowInsecureAuth = allowInsecure
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		fmt.Fprintf(conn, "CAPA\r\n")
+		advertised := false
+		for line, _ := reader.ReadString('\n'); line != ".\r\n" && line != ""; line, _ = reader.ReadString('\n') {
+			advertised = advertised || line == "SASL PLAIN\r\n"
+		}
+		if advertised != allowInsecure {
+			t.Errorf("Expected SASL advertised %v without TLS if insecure authentication is allowed %v", advertised, allowInsecure)
+		}
+		conn.Close()
+	}
+}
+
+// ticketMechanism asks for a ticket, which is "ticket of" and the username.
+type ticketMechanism struct{}
+
+func (ticketMechanism) Name() string {
+	return "X-TICKET"
+}
+
+func (ticketMechanism) Start(conn net.Conn, auth Authorizator) SASLServer {
+	return &ticketServer{}
+}
+
+type ticketServer struct {
+	username string
+}
+
+func (s *ticketServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte("ticket?"), false, nil
+	}
+	if !bytes.HasPrefix(response, []byte("ticket of ")) {
+		return nil, false, fmt.Errorf("Invalid ticket")
+	}
+	s.username = string(response[len("ticket of "):])
+	return nil, true, nil
+}
+
+func (s *ticketServer) Username() string {
+	return s.username
+}
+
+func (s *ticketServer) Authorize(username string) (backends.User, error) {
+	return testUser(username), nil
+}
+
+func TestServer_RegisterSASL(t *testing.T) {
+	listener := newPipeListener()
+	server := NewServer(secretAuthorizator{}, memory.New())
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	if err := server.RegisterSASL(ticketMechanism{}); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "CAPA\r\n")
+	advertised := false
+	for line, _ := reader.ReadString('\n'); line != ".\r\n" && line != ""; line, _ = reader.ReadString('\n') {
+		advertised = advertised || line == "SASL PLAIN X-TICKET\r\n"
+	}
+	if !advertised {
+		t.Errorf("Expected registered mechanism advertised")
+	}
+	fmt.Fprintf(conn, "AUTH x-ticket\r\n%s\r\n", base64.StdEncoding.EncodeToString([]byte("ticket of alice")))
+	for _, expected := range []string{"+ " + base64.StdEncoding.EncodeToString([]byte("ticket?")), "+OK User Successfully Logged on"} {
+		if line, _ := reader.ReadString('\n'); line != expected+"\r\n" {
+			t.Errorf("Expected %q, but got %q", expected, line)
+		}
+	}
+
+	for _, name := range []string{"", "x-ticket", "TICKET OF", strings.Repeat("X", 21)} {
+		if err := server.RegisterSASL(namedMechanism(name)); err == nil {
+			t.Errorf("Expected invalid name %q rejected", name)
+		}
+	}
+}
+
+type namedMechanism string
+
+func (m namedMechanism) Name() string {
+	return string(m)
+}
+
+func (m namedMechanism) Start(conn net.Conn, auth Authorizator) SASLServer {
+	return nil
+}
@@ -0,0 +1,261 @@
+package popgun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// SCRAM hash functions, passed to SCRAMAuthorizator.
+const (
+	SCRAM_SHA_1   = "SHA-1"
+	SCRAM_SHA_256 = "SHA-256"
+)
+
+// SCRAMCredentials are the credentials of a user stored for a SCRAM
+// mechanism (RFC 5802), derived from the password with
+// NewSCRAMCredentials.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMAuthorizator is implemented by authorizators supplying stored
+// SCRAM credentials to the SASLScramSHA1 and SASLScramSHA256 mechanisms,
+// which verify the proof of the client themselves.
+type SCRAMAuthorizator interface {
+	// SCRAMCredentials returns the credentials of username for the hash
+	// function, SCRAM_SHA_1 or SCRAM_SHA_256, and the user they
+	// authenticate.
+	SCRAMCredentials(conn net.Conn, username, hash string) (SCRAMCredentials, backends.User, error)
+}
+
+// NewSCRAMCredentials derives the credentials of password for the hash
+// function, e.g. to provision users.
+func NewSCRAMCredentials(hash, password string, salt []byte, iterations int) (SCRAMCredentials, error) {
+	h := scramHashes[hash]
+	if h == nil {
+		return SCRAMCredentials{}, fmt.Errorf("Unsupported SCRAM hash %s", hash)
+	}
+	salted := pbkdf2(h, []byte(password), salt, iterations)
+	storedKey := h()
+	storedKey.Write(scramHMAC(h, salted, "Client Key"))
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHMAC(h, salted, "Server Key"),
+	}, nil
+}
+
+var scramHashes = map[string]func() hash.Hash{
+	SCRAM_SHA_1:   sha1.New,
+	SCRAM_SHA_256: sha256.New,
+}
+
+// SASLScramSHA1 is the SCRAM-SHA-1 mechanism (RFC 5802) without channel
+// binding. The authorizator must implement SCRAMAuthorizator.
+func SASLScramSHA1(conn net.Conn, auth Authorizator) SASLServer {
+	return &scramServer{conn: conn, auth: auth, hash: SCRAM_SHA_1}
+}
+
+// SASLScramSHA256 is the SCRAM-SHA-256 mechanism (RFC 7677) without
+// channel binding. The authorizator must implement SCRAMAuthorizator.
+func SASLScramSHA256(conn net.Conn, auth Authorizator) SASLServer {
+	return &scramServer{conn: conn, auth: auth, hash: SCRAM_SHA_256}
+}
+
+// scramServer is a SCRAM exchange, which takes three rounds: the client's
+// first message, its proof and the acknowledgement of the server's
+// signature.
+type scramServer struct {
+	conn net.Conn
+	auth Authorizator
+	hash string
+
+	username    string
+	credentials SCRAMCredentials
+	user        backends.User
+	err         error
+	// GS2 header, bare first message of the client and first message of
+	// the server, which are signed
+	header      string
+	clientFirst string
+	serverFirst string
+	nonce       string
+	verified    bool
+	done        bool
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	switch {
+	case s.done:
+		// the client acknowledged the server's signature
+		return nil, true, nil
+	case s.nonce != "":
+		return s.final(string(response))
+	case response == nil:
+		// ask for the client's first message
+		return nil, false, nil
+	}
+	return s.first(string(response))
+}
+
+func (s *scramServer) first(response string) ([]byte, bool, error) {
+	scram, ok := s.auth.(SCRAMAuthorizator)
+	if !ok {
+		return nil, false, fmt.Errorf("SCRAM authentication not supported")
+	}
+	// e.g. "n,,n=alice,r=fyko+d2lbbFgONRv9qkxdawL"
+	parts := strings.SplitN(response, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, false, fmt.Errorf("Invalid SCRAM message or channel binding not supported")
+	}
+	s.header = parts[0] + "," + parts[1] + ","
+	s.clientFirst = parts[2]
+	attrs := scramAttributes(s.clientFirst)
+	username, clientNonce := decodeSASLName(attrs["n"]), attrs["r"]
+	if username == "" || clientNonce == "" || strings.HasPrefix(s.clientFirst, "m=") {
+		return nil, false, fmt.Errorf("Invalid SCRAM message")
+	}
+	if authzid := parts[1]; authzid != "" && decodeSASLName(strings.TrimPrefix(authzid, "a=")) != username {
+		return nil, false, fmt.Errorf("Authorization identity not supported")
+	}
+	s.username = username
+	s.credentials, s.user, s.err = scram.SCRAMCredentials(s.conn, username, s.hash)
+	if s.err != nil {
+		// continue with made up credentials, so the client can't tell
+		// unknown users apart
+		s.credentials = SCRAMCredentials{Salt: fakeSCRAMSalt(s.hash, username), Iterations: 4096}
+	}
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, false, err
+	}
+	s.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.credentials.Salt), s.credentials.Iterations)
+	return []byte(s.serverFirst), false, nil
+}
+
+// scramSaltKey keys the made up salts of unknown users.
+var scramSaltKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// fakeSCRAMSalt returns the salt of an unknown user, which is the same in
+// every exchange like the salt of a stored user, so repeated attempts
+// don't reveal which users exist.
+func fakeSCRAMSalt(hash, username string) []byte {
+	return scramHMAC(sha256.New, scramSaltKey, hash+"\x00"+username)[:16]
+}
+
+func (s *scramServer) final(response string) ([]byte, bool, error) {
+	// e.g. "c=biws,r=<nonce>,p=<proof>"
+	i := strings.LastIndex(response, ",p=")
+	if i < 0 {
+		return nil, false, fmt.Errorf("Invalid SCRAM message")
+	}
+	withoutProof := response[:i]
+	attrs := scramAttributes(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.header)) || attrs["r"] != s.nonce {
+		return nil, false, fmt.Errorf("Invalid SCRAM message")
+	}
+	proof, err := base64.StdEncoding.DecodeString(response[i+len(",p="):])
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid SCRAM proof")
+	}
+	s.done = true
+	if s.err != nil {
+		// Authorize returns the error
+		return nil, true, nil
+	}
+	h := scramHashes[s.hash]
+	authMessage := s.clientFirst + "," + s.serverFirst + "," + withoutProof
+	signature := scramHMAC(h, s.credentials.StoredKey, authMessage)
+	if len(proof) != len(signature) {
+		s.err = fmt.Errorf("Invalid SCRAM proof")
+		return nil, true, nil
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if subtle.ConstantTimeCompare(storedKey.Sum(nil), s.credentials.StoredKey) != 1 {
+		s.err = fmt.Errorf("Invalid SCRAM proof")
+		return nil, true, nil
+	}
+	s.verified = true
+	serverSignature := scramHMAC(h, s.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
+
+func (s *scramServer) Username() string {
+	return s.username
+}
+
+// Authorize returns the user whose credentials the client proved, failed
+// proofs are reported here to go through the account policy.
+func (s *scramServer) Authorize(username string) (backends.User, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if !s.verified {
+		return nil, fmt.Errorf("Invalid SCRAM proof")
+	}
+	return s.user, nil
+}
+
+// scramAttributes parses the comma separated attributes of a SCRAM
+// message.
+func scramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, message string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key as long as the output of h from password (RFC
+// 8018), which is the SaltedPassword of SCRAM.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	block := make([]byte, 4)
+	binary.BigEndian.PutUint32(block, 1)
+	mac.Write(block)
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
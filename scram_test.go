@@ -0,0 +1,167 @@
+package popgun
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// scramAuthorizator stores the SCRAM credentials of alice with the
+// password "pencil".
+type scramAuthorizator struct {
+	secretAuthorizator
+}
+
+func (a scramAuthorizator) SCRAMCredentials(conn net.Conn, username, hash string) (SCRAMCredentials, backends.User, error) {
+	if username != "alice" {
+		return SCRAMCredentials{}, nil, fmt.Errorf("Unknown user")
+	}
+	credentials, err := NewSCRAMCredentials(hash, "pencil", []byte("salt of alice"), 4096)
+	return credentials, testUser(username), err
+}
+
+func TestPbkdf2(t *testing.T) {
+	// RFC 6070
+	for iterations, expected := range map[int]string{
+		1:    "0c60c80f961f0e71f3a9b524af6012062fe037a6",
+		4096: "4b007901b765489abead49d926f721d065a429c1",
+	} {
+		key := pbkdf2(scramHashes[SCRAM_SHA_1], []byte("password"), []byte("salt"), iterations)
+		if hex.EncodeToString(key) != expected {
+			t.Errorf("Expected %s for %d iterations, but got %x", expected, iterations, key)
+		}
+	}
+}
+
+// scramLogin runs a SCRAM exchange as a client and returns the final
+// response of the server.
+func scramLogin(t *testing.T, mechanism, hash, username, password string) string {
+	listener := newPipeListener()
+	server := NewServer(scramAuthorizator{}, memory.New())
+	server.AllowInsecureAuth = true
+	server.SASL[mechanism] = SASLScramSHA256
+	if hash == SCRAM_SHA_1 {
+		server.SASL[mechanism] = SASLScramSHA1
+	}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	// challenge returns the decoded challenge of the server
+	challenge := func() string {
+		line, _ := reader.ReadString('\n')
+		if !strings.HasPrefix(line, "+ ") {
+			t.Fatalf("Expected challenge, but got %q", line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[2:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(decoded)
+	}
+	encode := func(message string) string {
+		return base64.StdEncoding.EncodeToString([]byte(message))
+	}
+
+	clientFirst := "n=" + username + ",r=rOprNGfwEbeRWgbNEkqO"
+	fmt.Fprintf(conn, "AUTH %s %s\r\n", mechanism, encode("n,,"+clientFirst))
+	serverFirst := challenge()
+	attrs := scramAttributes(serverFirst)
+	if !strings.HasPrefix(attrs["r"], "rOprNGfwEbeRWgbNEkqO") || len(attrs["r"]) <= 20 {
+		t.Fatalf("Expected nonce extending the client nonce, but got %q", serverFirst)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	var iterations int
+	fmt.Sscan(attrs["i"], &iterations)
+
+	h := scramHashes[hash]
+	salted := pbkdf2(h, []byte(password), salt, iterations)
+	clientKey := scramHMAC(h, salted, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirst + "," + serverFirst + "," + withoutProof
+	signature := scramHMAC(h, storedKey.Sum(nil), authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	fmt.Fprintf(conn, "%s\r\n", encode(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+	line, _ := reader.ReadString('\n')
+	if !strings.HasPrefix(line, "+ ") {
+		return line
+	}
+	serverFinal, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line[2:]))
+	serverSignature := scramHMAC(h, scramHMAC(h, salted, "Server Key"), authMessage)
+	if string(serverFinal) != "v="+base64.StdEncoding.EncodeToString(serverSignature) {
+		t.Errorf("Expected server signature, but got %q", serverFinal)
+	}
+	fmt.Fprintf(conn, "\r\n")
+	line, _ = reader.ReadString('\n')
+	return line
+}
+
+func TestAuthCommand_scram(t *testing.T) {
+	tables := []struct {
+		mechanism, hash, username, password string
+		expected                            string
+	}{
+		{"SCRAM-SHA-256", SCRAM_SHA_256, "alice", "pencil", "+OK User Successfully Logged on\r\n"},
+		{"SCRAM-SHA-1", SCRAM_SHA_1, "alice", "pencil", "+OK User Successfully Logged on\r\n"},
+		{"SCRAM-SHA-256", SCRAM_SHA_256, "alice", "crayon", "-ERR [AUTH] Invalid username or password: Invalid SCRAM proof\r\n"},
+		{"SCRAM-SHA-256", SCRAM_SHA_256, "bob", "pencil", "-ERR [AUTH] Invalid username or password: Unknown user\r\n"},
+	}
+	for _, table := range tables {
+		if line := scramLogin(t, table.mechanism, table.hash, table.username, table.password); line != table.expected {
+			t.Errorf("Expected %q for %s of %s with %s, but got %q", table.expected, table.mechanism, table.username, table.password, line)
+		}
+	}
+}
+
+func TestScramServer_unknownUserSalt(t *testing.T) {
+	salt := func(username string) string {
+		s := SASLScramSHA256(nil, scramAuthorizator{})
+		challenge, _, err := s.Next([]byte("n,,n=" + username + ",r=rOprNGfwEbeRWgbNEkqO"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return scramAttributes(string(challenge))["s"]
+	}
+
+	if first, second := salt("bob"), salt("bob"); first != second {
+		t.Errorf("Expected the same salt for an unknown user, but got %q and %q", first, second)
+	}
+	if salt("bob") == salt("carol") {
+		t.Error("Expected different salts for different unknown users")
+	}
+}
+
+func TestNewSCRAMCredentials(t *testing.T) {
+	credentials, err := NewSCRAMCredentials(SCRAM_SHA_256, "pencil", []byte("salt"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := scramHashes[SCRAM_SHA_256]
+	salted := pbkdf2(h, []byte("pencil"), []byte("salt"), 2)
+	if !hmac.Equal(credentials.ServerKey, scramHMAC(h, salted, "Server Key")) || len(credentials.StoredKey) != 32 {
+		t.Errorf("Expected keys derived from the salted password, but got %+v", credentials)
+	}
+	if _, err := NewSCRAMCredentials("MD5", "pencil", nil, 1); err == nil {
+		t.Errorf("Expected unsupported hash rejected")
+	}
+}
@@ -0,0 +1,183 @@
+// Package sdk is the surface third-party popgun plugins are built on. It
+// hands plugins typed views of sessions and results instead of server
+// internals, and installs any number of plugins into the hooks of a
+// server:
+//
+//	type greeter struct{}
+//
+//	func (greeter) Name() string { return "greeter" }
+//
+//	func (greeter) Capabilities(s sdk.Session) []string {
+//		return []string{"X-GREETER " + s.User()}
+//	}
+//
+//	sdk.Install(server, greeter{})
+//
+// A plugin implements Plugin and any of DisconnectPlugin, UpdatePlugin,
+// ProgressPlugin and CapaPlugin. Plugins are shared by all sessions, so
+// they must be safe for concurrent use.
+package sdk
+
+import (
+	"crypto/tls"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+)
+
+// MAX_LINE is the maximum length of a line written by plugins, excluding
+// CRLF, see RFC 2449.
+const MAX_LINE = 510
+
+// Plugin is a reusable extension of popgun.
+type Plugin interface {
+	Name() string
+}
+
+// DisconnectPlugin is notified after a session ended, with the name of the
+// close reason, e.g. "quit".
+type DisconnectPlugin interface {
+	OnDisconnect(s Session, reason string)
+}
+
+// UpdatePlugin is notified after the maildrop of a session was updated on
+// QUIT.
+type UpdatePlugin interface {
+	OnUpdate(s Session, result UpdateResult)
+}
+
+// ProgressPlugin is notified while a multi-line response is sent, see
+// popgun.Hooks.OnProgress. Returning an error aborts the session.
+type ProgressPlugin interface {
+	OnProgress(s Session, sent int) error
+}
+
+// CapaPlugin advertises extra capabilities in response to CAPA. The lines
+// are made safe with SafeLine.
+type CapaPlugin interface {
+	Capabilities(s Session) []string
+}
+
+// Session is a read-only view of a client session.
+type Session struct {
+	c *popgun.Client
+}
+
+// SessionOf returns the view of a session passed to popgun.Hooks.
+func SessionOf(c *popgun.Client) Session {
+	return Session{c: c}
+}
+
+// ID returns the unique ID of the session.
+func (s Session) ID() uint64 {
+	return s.c.ID()
+}
+
+// RemoteAddr returns the address of the client.
+func (s Session) RemoteAddr() string {
+	return s.c.RemoteAddr().String()
+}
+
+// User returns the name of the logged in user, empty before login.
+func (s Session) User() string {
+	return s.c.Username()
+}
+
+// Actor returns the master user acting on behalf of User, if any.
+func (s Session) Actor() string {
+	return s.c.Actor()
+}
+
+// TLS returns the state of the TLS connection, false without TLS.
+func (s Session) TLS() (tls.ConnectionState, bool) {
+	return s.c.TLSState()
+}
+
+// UpdateResult is the outcome of the update of a maildrop.
+type UpdateResult struct {
+	// number of messages removed
+	Removed int
+	// unique IDs of messages marked as deleted which could not be removed
+	FailedUids []string
+	// messages and octets left in the maildrop
+	RemainingMessages int
+	RemainingOctets   int
+}
+
+// SafeLine makes text safe to write as a line of a response: line breaks
+// and other control characters are replaced by spaces and the line is cut
+// at MAX_LINE octets.
+func SafeLine(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, text)
+	if len(text) > MAX_LINE {
+		text = text[:MAX_LINE]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text
+}
+
+// Install adds plugins to the hooks of server. Hooks already set are kept
+// and called first, plugins are called in order.
+func Install(server *popgun.Server, plugins ...Plugin) {
+	hooks := &server.Hooks
+	for _, plugin := range plugins {
+		if p, ok := plugin.(DisconnectPlugin); ok {
+			next := hooks.OnDisconnect
+			hooks.OnDisconnect = func(c *popgun.Client, reason popgun.CloseReason) {
+				if next != nil {
+					next(c, reason)
+				}
+				p.OnDisconnect(SessionOf(c), reason.String())
+			}
+		}
+		if p, ok := plugin.(UpdatePlugin); ok {
+			next := hooks.OnUpdate
+			hooks.OnUpdate = func(c *popgun.Client, user backends.User, result backends.UpdateResult) {
+				if next != nil {
+					next(c, user, result)
+				}
+				p.OnUpdate(SessionOf(c), UpdateResult{
+					Removed:           result.Removed,
+					FailedUids:        result.FailedUids,
+					RemainingMessages: result.RemainingMessages,
+					RemainingOctets:   result.RemainingOctets,
+				})
+			}
+		}
+		if p, ok := plugin.(ProgressPlugin); ok {
+			next := hooks.OnProgress
+			hooks.OnProgress = func(c *popgun.Client, sent int) error {
+				if next != nil {
+					if err := next(c, sent); err != nil {
+						return err
+					}
+				}
+				return p.OnProgress(SessionOf(c), sent)
+			}
+		}
+		if p, ok := plugin.(CapaPlugin); ok {
+			next := hooks.OnCapa
+			hooks.OnCapa = func(c *popgun.Client) []string {
+				var lines []string
+				if next != nil {
+					lines = next(c)
+				}
+				for _, line := range p.Capabilities(SessionOf(c)) {
+					if line = strings.TrimSpace(SafeLine(line)); line != "" {
+						lines = append(lines, line)
+					}
+				}
+				return lines
+			}
+		}
+	}
+}
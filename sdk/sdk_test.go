@@ -0,0 +1,137 @@
+package sdk
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+type recordingPlugin struct {
+	mu     sync.Mutex
+	calls  []string
+	closed chan struct{}
+}
+
+func (p *recordingPlugin) Name() string {
+	return "recording"
+}
+
+func (p *recordingPlugin) record(call string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, call)
+}
+
+func (p *recordingPlugin) OnDisconnect(s Session, reason string) {
+	p.record(fmt.Sprintf("disconnect %s %s", s.User(), reason))
+	close(p.closed)
+}
+
+func (p *recordingPlugin) OnUpdate(s Session, result UpdateResult) {
+	p.record(fmt.Sprintf("update %s %d", s.User(), result.Removed))
+}
+
+func (p *recordingPlugin) Capabilities(s Session) []string {
+	return []string{"X-RECORDING " + s.User(), "X-INJECTED\r\n+OK", ""}
+}
+
+type counterPlugin struct{}
+
+func (counterPlugin) Name() string {
+	return "counter"
+}
+
+func (counterPlugin) Capabilities(s Session) []string {
+	return []string{"X-COUNTER"}
+}
+
+// authorizator authorizes every user.
+type authorizator struct{}
+
+func (authorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	return testUser(username), nil
+}
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+func TestInstall(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	server := popgun.NewServer(authorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	var hooked bool
+	server.Hooks.OnUpdate = func(c *popgun.Client, user backends.User, result backends.UpdateResult) {
+		hooked = true
+	}
+	plugin := &recordingPlugin{closed: make(chan struct{})}
+	Install(server, plugin, counterPlugin{})
+	go server.Serve(listener)
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\nCAPA\r\nDELE 1\r\nQUIT\r\n")
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+		if strings.HasPrefix(line, "+OK Goodbye") {
+			break
+		}
+	}
+	capa := strings.Join(lines, "\n")
+	if !strings.Contains(capa, "\nX-RECORDING alice\nX-INJECTED  +OK\nX-COUNTER\n.\n") {
+		t.Errorf("Expected safe plugin capabilities, but got %q", capa)
+	}
+
+	<-plugin.closed
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	expected := []string{"update alice 1", "disconnect alice quit"}
+	if strings.Join(plugin.calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected calls %v, but got %v", expected, plugin.calls)
+	}
+	if !hooked {
+		t.Error("Expected hook set before Install to be kept")
+	}
+}
+
+func TestSafeLine(t *testing.T) {
+	tables := map[string]string{
+		"plain":                  "plain",
+		"two\r\nlines":           "two  lines",
+		strings.Repeat("é", 300): strings.Repeat("é", 255),
+		strings.Repeat("x", 600): strings.Repeat("x", MAX_LINE),
+	}
+	for text, expected := range tables {
+		if line := SafeLine(text); line != expected {
+			t.Errorf("Expected %q, but got %q", expected, line)
+		}
+	}
+}
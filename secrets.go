@@ -0,0 +1,217 @@
+package popgun
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// SecretsProvider loads secrets such as TLS private keys and credentials by
+// name, so they don't have to be stored unencrypted next to the server.
+// FileSecrets, EnvSecrets and VaultSecrets are provided, other stores like
+// a KMS can be plugged in by implementing the interface or
+// SecretsProviderFunc.
+type SecretsProvider interface {
+	Secret(ctx context.Context, name string) ([]byte, error)
+}
+
+// SecretsProviderFunc adapts a function to the SecretsProvider interface.
+type SecretsProviderFunc func(ctx context.Context, name string) ([]byte, error)
+
+func (f SecretsProviderFunc) Secret(ctx context.Context, name string) ([]byte, error) {
+	return f(ctx, name)
+}
+
+// FileSecrets reads every secret from a file named after it in Dir, e.g. a
+// tmpfs mounted by the secrets manager of the platform.
+type FileSecrets struct {
+	Dir string
+}
+
+func (s FileSecrets) Secret(ctx context.Context, name string) ([]byte, error) {
+	if err := checkSecretName(name); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(s.Dir, name))
+}
+
+// checkSecretName rejects names which would escape the directory or path
+// secrets are looked up in.
+func checkSecretName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("Invalid secret name: %q", name)
+	}
+	return nil
+}
+
+// EnvSecrets reads every secret from the environment variable Prefix+name,
+// with name upper-cased and dashes and dots replaced by underscores.
+type EnvSecrets struct {
+	Prefix string
+}
+
+func (s EnvSecrets) Secret(ctx context.Context, name string) ([]byte, error) {
+	key := s.Prefix + strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(name))
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil, fmt.Errorf("Secret %s not set", key)
+	}
+	return []byte(value), nil
+}
+
+// LoadKeyPair loads a PEM encoded certificate and its private key from the
+// secrets provider.
+func LoadKeyPair(ctx context.Context, secrets SecretsProvider, certName, keyName string) (tls.Certificate, error) {
+	cert, err := secrets.Secret(ctx, certName)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error loading certificate %s: %v", certName, err)
+	}
+	key, err := secrets.Secret(ctx, keyName)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error loading private key %s: %v", keyName, err)
+	}
+	return tls.X509KeyPair(cert, key)
+}
+
+// VaultSecrets reads every secret from a HashiCorp Vault server, as the
+// field Field ("value" by default) of the secret Path/name in the KV
+// version 2 engine mounted at Mount ("secret" by default).
+type VaultSecrets struct {
+	// Address of the server, e.g. "https://vault.example.com:8200"
+	Address string
+	Token   string
+	Mount   string
+	Path    string
+	Field   string
+	// Client, if set, sends the requests instead of http.DefaultClient.
+	Client *http.Client
+}
+
+func (s VaultSecrets) Secret(ctx context.Context, name string) ([]byte, error) {
+	if err := checkSecretName(name); err != nil {
+		return nil, err
+	}
+	mount, field := s.Mount, s.Field
+	if mount == "" {
+		mount = "secret"
+	}
+	if field == "" {
+		field = "value"
+	}
+	secretPath := url.PathEscape(name)
+	if p := strings.Trim(s.Path, "/"); p != "" {
+		secretPath = p + "/" + secretPath
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(s.Address, "/")+"/v1/"+strings.Trim(mount, "/")+"/data/"+secretPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", s.Token)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault returned %s for secret %s", resp.Status, name)
+	}
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Error decoding secret %s: %v", name, err)
+	}
+	value, ok := body.Data.Data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("Secret %s has no field %s", name, field)
+	}
+	return []byte(value), nil
+}
+
+// SecretsAuthorizator authorizes users with passwords loaded from Secrets,
+// named by Name, "password-<username>" by default. The password is also
+// the shared secret of APOP and the password SCRAM credentials are
+// derived from, with a salt derived from the username.
+type SecretsAuthorizator struct {
+	Secrets SecretsProvider
+	Name    func(username string) string
+	// Timeout limits loading a secret, 10 seconds by default.
+	Timeout time.Duration
+}
+
+type secretsUser string
+
+func (u secretsUser) Username() string {
+	return string(u)
+}
+
+// password loads the password of username.
+func (a *SecretsAuthorizator) password(username string) (string, error) {
+	name := "password-" + username
+	if a.Name != nil {
+		name = a.Name(username)
+	}
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	password, err := a.Secrets.Secret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("Unknown user")
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+func (a *SecretsAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	stored, err := a.password(username)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+		return nil, fmt.Errorf("Wrong password")
+	}
+	return secretsUser(username), nil
+}
+
+func (a *SecretsAuthorizator) AuthorizeAPOP(conn net.Conn, username, timestamp, digest string) (backends.User, error) {
+	stored, err := a.password(username)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(APOPDigest(timestamp, stored)), []byte(strings.ToLower(digest))) != 1 {
+		return nil, fmt.Errorf("Wrong digest")
+	}
+	return secretsUser(username), nil
+}
+
+func (a *SecretsAuthorizator) SCRAMCredentials(conn net.Conn, username, hash string) (SCRAMCredentials, backends.User, error) {
+	stored, err := a.password(username)
+	if err != nil {
+		return SCRAMCredentials{}, nil, err
+	}
+	salt := sha256.Sum256([]byte("popgun scram salt\x00" + username))
+	credentials, err := NewSCRAMCredentials(hash, stored, salt[:16], 4096)
+	return credentials, secretsUser(username), err
+}
@@ -0,0 +1,114 @@
+package popgun
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/kiwiz/popgun/testcert"
+)
+
+func TestLoadKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "popgun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := testcert.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cert.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadKeyPair(context.Background(), FileSecrets{Dir: dir}, "cert.pem", "key.pem")
+	if err != nil {
+		t.Errorf("Expected key pair loaded, but got '%v'", err)
+	}
+
+	_, err = FileSecrets{Dir: dir}.Secret(context.Background(), "../go.mod")
+	if err == nil {
+		t.Error("Expected secret name with path rejected")
+	}
+}
+
+func TestEnvSecrets_Secret(t *testing.T) {
+	os.Setenv("POPGUN_TEST_APOP_SECRET", "s3cret")
+	defer os.Unsetenv("POPGUN_TEST_APOP_SECRET")
+
+	secret, err := EnvSecrets{Prefix: "POPGUN_TEST_"}.Secret(context.Background(), "apop-secret")
+	if err != nil || string(secret) != "s3cret" {
+		t.Errorf("Expected 's3cret', but got '%s' (%v)", secret, err)
+	}
+	_, err = EnvSecrets{Prefix: "POPGUN_TEST_"}.Secret(context.Background(), "missing")
+	if err == nil {
+		t.Error("Expected error for missing secret")
+	}
+}
+
+func TestVaultSecrets_Secret(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "t0ken" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/popgun/apop-secret" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"data": {"data": {"value": "s3cret"}, "metadata": {"version": 1}}}`)
+	}))
+	defer vault.Close()
+
+	secrets := VaultSecrets{Address: vault.URL, Token: "t0ken", Mount: "kv", Path: "popgun"}
+	secret, err := secrets.Secret(context.Background(), "apop-secret")
+	if err != nil || string(secret) != "s3cret" {
+		t.Errorf("Expected 's3cret', but got '%s' (%v)", secret, err)
+	}
+	if _, err := secrets.Secret(context.Background(), "missing"); err == nil {
+		t.Error("Expected error for missing secret")
+	}
+	secrets.Token = "wrong"
+	if _, err := secrets.Secret(context.Background(), "apop-secret"); err == nil {
+		t.Error("Expected error for denied secret")
+	}
+}
+
+func TestSecretsAuthorizator(t *testing.T) {
+	secrets := SecretsProviderFunc(func(ctx context.Context, name string) ([]byte, error) {
+		if name != "password-alice" {
+			return nil, fmt.Errorf("No secret %s", name)
+		}
+		return []byte("pencil\n"), nil
+	})
+	auth := &SecretsAuthorizator{Secrets: secrets}
+
+	if _, err := auth.Authorize(nil, "alice", "pencil"); err != nil {
+		t.Errorf("Expected alice authorized, but got '%v'", err)
+	}
+	if _, err := auth.Authorize(nil, "alice", "crayon"); err == nil {
+		t.Error("Expected wrong password rejected")
+	}
+	if _, err := auth.Authorize(nil, "bob", "pencil"); err == nil {
+		t.Error("Expected unknown user rejected")
+	}
+	timestamp := "<1896.697170952@dbc.mtview.ca.us>"
+	if _, err := auth.AuthorizeAPOP(nil, "alice", timestamp, APOPDigest(timestamp, "pencil")); err != nil {
+		t.Errorf("Expected APOP of alice authorized, but got '%v'", err)
+	}
+	first, _, err := auth.SCRAMCredentials(nil, "alice", SCRAM_SHA_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, _ := auth.SCRAMCredentials(nil, "alice", SCRAM_SHA_256)
+	expected, _ := NewSCRAMCredentials(SCRAM_SHA_256, "pencil", first.Salt, first.Iterations)
+	if !bytes.Equal(first.Salt, second.Salt) || !bytes.Equal(first.StoredKey, expected.StoredKey) {
+		t.Errorf("Expected SCRAM credentials derived from the password with a stable salt, but got %+v", first)
+	}
+}
@@ -0,0 +1,110 @@
+package popgun
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ErrServerClosed is returned by the Serve methods after Shutdown.
+var ErrServerClosed = fmt.Errorf("Server closed")
+
+// track adds l to the listeners closed by Shutdown, it returns false after
+// Shutdown.
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// untrack removes l from the listeners closed by Shutdown.
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Shutdown stops the server gracefully. It closes the listeners, so no new
+// sessions are accepted, and waits for the sessions to end, i.e. for their
+// clients to QUIT, which commits deletions in the UPDATE state, or to go
+// away. If ctx is done first, the remaining sessions are closed with
+// CLOSE_SHUTDOWN, which releases their maildrops without committing
+// deletions, and ctx.Err() is returned. The server can't be used again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.Drain():
+		return nil
+	case <-ctx.Done():
+	}
+	for _, c := range s.Sessions() {
+		c.Close(CLOSE_SHUTDOWN)
+	}
+	return ctx.Err()
+}
+
+// Drain stops accepting connections like Shutdown, but lets the sessions
+// end on their own however long they take, e.g. to restart behind a load
+// balancer without aborting downloads. It returns a channel which is
+// closed when the last session ended. Shutdown can still be called to
+// bound the wait. The server can't be used again.
+func (s *Server) Drain() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closing {
+		s.closing = true
+		close(s.done)
+	}
+	for l := range s.listeners {
+		l.Close()
+		delete(s.listeners, l)
+	}
+	if s.drained == nil {
+		s.drained = make(chan struct{})
+		go func(drained chan struct{}) {
+			s.active.Wait()
+			close(drained)
+		}(s.drained)
+	}
+	return s.drained
+}
+
+// draining reports whether the server stopped accepting connections, see
+// Drain.
+func (s *Server) draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drained != nil
+}
+
+// ServeContext serves l like Serve until ctx is done, which shuts the
+// server down at once: the listeners are closed and the sessions are
+// closed with CLOSE_SHUTDOWN, without committing deletions. It then waits
+// for the sessions to end and returns ctx.Err(), so it fits service
+// runners like errgroup.
+func (s *Server) ServeContext(ctx context.Context, l net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown(ctx)
+		case <-stop:
+		}
+	}()
+	err := s.Serve(l)
+	if ctx.Err() != nil {
+		s.active.Wait()
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,337 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	backend.Deliver("alice", "b", "Subject: b\r\n\r\nbody\r\n")
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER alice\r\nPASS x\r\nDELE 1\r\n")
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown waiting for the session, but got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected closed server, but got %v", err)
+	}
+	if _, err := listener.Dial(); err == nil {
+		t.Errorf("Expected listener closed")
+	}
+	fmt.Fprintf(conn, "QUIT\r\n")
+	if line, _ := reader.ReadString('\n'); line != "+OK Goodbye (1 messages left)\r\n" {
+		t.Errorf("Expected session continued, but got %q", line)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Expected graceful shutdown, but got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected Shutdown returning after the session ended")
+	}
+	if err := server.Serve(newPipeListener()); err != ErrServerClosed {
+		t.Errorf("Expected closed server, but got %v", err)
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	closed := make(chan CloseReason, 1)
+	server.Hooks.OnDisconnect = func(c *Client, reason CloseReason) {
+		closed <- reason
+	}
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER alice\r\nPASS x\r\nDELE 1\r\n")
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, but got %v", err)
+	}
+	select {
+	case reason := <-closed:
+		if reason != CLOSE_SHUTDOWN {
+			t.Errorf("Expected session closed by shutdown, but got %s", reason)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected session closed")
+	}
+	if messages := backend.Messages("alice"); len(messages) != 1 {
+		t.Errorf("Expected deletion not committed, but got %v", messages)
+	}
+}
+
+func TestServer_ShutdownListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected closed server, but got %v", err)
+	}
+	if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Expected listener closed")
+	}
+}
+
+// temporaryError is a temporary net.Error.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "Too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails Accept with its errors in turn.
+type failingListener struct {
+	*pipeListener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestServer_ServeAcceptError(t *testing.T) {
+	permanent := fmt.Errorf("Listener broken")
+	l := &failingListener{pipeListener: newPipeListener(), errs: []error{temporaryError{}, temporaryError{}, permanent}}
+	metrics := newCountingMetrics()
+	var logged strings.Builder
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.ErrorLog = log.New(&logged, "", 0)
+	server.Metrics = metrics
+	if err := server.Serve(l); err != permanent {
+		t.Errorf("Expected the permanent error, but got %v", err)
+	}
+	if n := metrics.count("accept.retried:pipe"); n != 2 {
+		t.Errorf("Expected 2 retries counted, but got %d", n)
+	}
+	if n := strings.Count(logged.String(), "\n"); n != 1 {
+		t.Errorf("Expected only the first temporary error logged, but got %q", logged.String())
+	}
+	if _, err := l.Dial(); err == nil {
+		t.Errorf("Expected listener closed")
+	}
+}
+
+func TestServer_ServeAcceptBackoff(t *testing.T) {
+	permanent := fmt.Errorf("Listener broken")
+	serve := func(errs ...error) (*Server, *fakeClock, chan error) {
+		clock := newFakeClock()
+		server := NewServer(userAuthorizator{}, memory.New())
+		server.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.Clock = clock
+		served := make(chan error, 1)
+		go func() {
+			served <- server.Serve(&failingListener{pipeListener: newPipeListener(), errs: errs})
+		}()
+		// the backoff waits on the clock
+		clock.waitTimers(t, 1)
+		return server, clock, served
+	}
+
+	_, clock, served := serve(temporaryError{}, permanent)
+	clock.Advance(time.Second)
+	select {
+	case err := <-served:
+		if err != permanent {
+			t.Errorf("Expected the permanent error, but got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected accepting to be retried when the clock advanced")
+	}
+
+	server, _, served := serve(temporaryError{}, permanent)
+	go server.Shutdown(context.Background())
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, but got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected Shutdown to interrupt the backoff")
+	}
+}
+
+func TestServer_ServeContext(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	closed := make(chan CloseReason, 1)
+	server.Hooks.OnDisconnect = func(c *Client, reason CloseReason) {
+		closed <- reason
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeContext(ctx, listener)
+	}()
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER alice\r\nPASS x\r\nDELE 1\r\n")
+	for i := 0; i < 3; i++ {
+		reader.ReadString('\n')
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("Expected cancelled, but got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected ServeContext returning after cancel")
+	}
+	// the session has ended when ServeContext returns
+	select {
+	case reason := <-closed:
+		if reason != CLOSE_SHUTDOWN {
+			t.Errorf("Expected session closed by shutdown, but got %s", reason)
+		}
+	default:
+		t.Errorf("Expected session closed")
+	}
+	if _, err := listener.Dial(); err == nil {
+		t.Errorf("Expected listener closed")
+	}
+	if messages := backend.Messages("alice"); len(messages) != 1 {
+		t.Errorf("Expected deletion not committed, but got %v", messages)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER alice\r\nPASS x\r\n")
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+
+	recorder := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/drain", nil))
+	if recorder.Code != http.StatusForbidden || server.draining() {
+		t.Fatalf("Expected anonymous drain to be refused, but got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/drain", nil)
+	request.Header.Set("X-Admin-User", "root")
+	server.AdminHandler().ServeHTTP(recorder, request)
+	if body := strings.TrimSpace(recorder.Body.String()); body != `{"draining":true,"sessions":1}` {
+		t.Errorf("Expected draining with one session, but got %s", body)
+	}
+	drained := server.Drain()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected closed server, but got %v", err)
+	}
+	if _, err := listener.Dial(); err == nil {
+		t.Errorf("Expected listener closed")
+	}
+	select {
+	case <-drained:
+		t.Fatal("Expected Drain waiting for the session")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fmt.Fprintf(conn, "RETR 1\r\n")
+	for line, _ := reader.ReadString('\n'); line != ".\r\n"; line, _ = reader.ReadString('\n') {
+		if line == "" {
+			t.Fatal("Expected message retrieved while draining")
+		}
+	}
+	fmt.Fprintf(conn, "QUIT\r\n")
+	reader.ReadString('\n')
+	select {
+	case <-drained:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected drained after the last session ended")
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected Shutdown of a drained server, but got %v", err)
+	}
+}
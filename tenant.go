@@ -0,0 +1,181 @@
+package popgun
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantLimits are the resources all sessions of a tenant may use
+// together. Zero values mean no limit.
+type TenantLimits struct {
+	// MaxSessions limits the authenticated sessions of the tenant. Logins
+	// beyond it are refused with -ERR [SYS/TEMP].
+	MaxSessions int `json:"max_sessions"`
+	// BytesPerSecond limits the rate responses are sent at.
+	BytesPerSecond int `json:"bytes_per_second"`
+	// MaxBackendCalls limits the commands executed against the backend at
+	// the same time, further ones wait for their turn.
+	MaxBackendCalls int `json:"max_backend_calls"`
+}
+
+// Tenants isolates tenants sharing a server, so a noisy one can't starve
+// the others. The tenant of a session is the domain of its username, users
+// without a domain belong to the tenant "". Domains holds the limits by
+// lowercase domain, other tenants have the Default limits, each on their
+// own.
+//
+// The sessions of every tenant are reported as "tenant.sessions", refused
+// logins counted as "tenant.refused", both labeled with the tenant.
+type Tenants struct {
+	Default TenantLimits
+	Domains map[string]TenantLimits
+
+	mu     sync.Mutex
+	groups map[string]*tenantGroup
+}
+
+// tenantGroup holds the resources in use by a tenant.
+type tenantGroup struct {
+	name   string
+	limits TenantLimits
+	calls  chan struct{}
+
+	mu       sync.Mutex
+	sessions int
+	// time the bandwidth budget is spent until
+	sentUntil time.Time
+}
+
+// TenantOf returns the tenant of username.
+func TenantOf(username string) string {
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		return strings.ToLower(username[i+1:])
+	}
+	return ""
+}
+
+// group returns the resource group of tenant.
+func (t *Tenants) group(tenant string) *tenantGroup {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if g, ok := t.groups[tenant]; ok {
+		return g
+	}
+	limits, ok := t.Domains[tenant]
+	if !ok {
+		limits = t.Default
+	}
+	g := &tenantGroup{name: tenant, limits: limits}
+	if limits.MaxBackendCalls > 0 {
+		g.calls = make(chan struct{}, limits.MaxBackendCalls)
+	}
+	if t.groups == nil {
+		t.groups = make(map[string]*tenantGroup)
+	}
+	t.groups[tenant] = g
+	return g
+}
+
+// acquireSession reserves a session of the tenant and returns the number
+// of sessions, or false if it has too many.
+func (g *tenantGroup) acquireSession() (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.limits.MaxSessions > 0 && g.sessions >= g.limits.MaxSessions {
+		return g.sessions, false
+	}
+	g.sessions++
+	return g.sessions, true
+}
+
+// releaseSession releases a session of the tenant and returns the number
+// of sessions left.
+func (g *tenantGroup) releaseSession() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sessions--
+	return g.sessions
+}
+
+// reserveBandwidth spends n octets of the bandwidth budget and returns how
+// long to wait before sending them.
+func (g *tenantGroup) reserveBandwidth(n int, now time.Time) time.Duration {
+	if g.limits.BytesPerSecond <= 0 {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sentUntil.Before(now) {
+		g.sentUntil = now
+	}
+	wait := g.sentUntil.Sub(now)
+	g.sentUntil = g.sentUntil.Add(time.Duration(n) * time.Second / time.Duration(g.limits.BytesPerSecond))
+	return wait
+}
+
+// joinTenant adds the session to the resource group of the tenant of
+// username. It returns false if the tenant has too many sessions.
+func (c *Client) joinTenant(username string) bool {
+	if c.server.Tenants == nil {
+		return true
+	}
+	g := c.server.Tenants.group(TenantOf(username))
+	sessions, ok := g.acquireSession()
+	if !ok {
+		c.ErrorLog.Printf("Refusing login of user %s, too many sessions of tenant %q", username, g.name)
+		c.server.Metrics.Inc("tenant.refused", g.name)
+		return false
+	}
+	c.server.Metrics.Set("tenant.sessions", float64(sessions), g.name)
+	c.mu.Lock()
+	c.tenant = g
+	c.mu.Unlock()
+	return true
+}
+
+// leaveTenant releases the session of the tenant.
+func (c *Client) leaveTenant() {
+	c.mu.Lock()
+	g := c.tenant
+	c.tenant = nil
+	c.mu.Unlock()
+	if g != nil {
+		c.server.Metrics.Set("tenant.sessions", float64(g.releaseSession()), g.name)
+	}
+}
+
+// currentTenant returns the resource group of the session, nil before
+// login or without Server.Tenants.
+func (c *Client) currentTenant() *tenantGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tenant
+}
+
+// backendCall waits for a backend call slot of the tenant and returns a
+// function releasing it. It returns false if the session ends meanwhile.
+func (c *Client) backendCall() (func(), bool) {
+	g := c.currentTenant()
+	if g == nil || g.calls == nil {
+		return func() {}, true
+	}
+	select {
+	case g.calls <- struct{}{}:
+		return func() { <-g.calls }, true
+	case <-c.Context().Done():
+		return nil, false
+	}
+}
+
+// throttle waits until n octets may be sent within the bandwidth budget of
+// the tenant.
+func (c *Client) throttle(n int) {
+	g := c.currentTenant()
+	if g == nil {
+		return
+	}
+	if wait := g.reserveBandwidth(n, c.server.clock().Now()); wait > 0 {
+		c.wait(wait)
+	}
+}
@@ -0,0 +1,109 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+func TestTenantOf(t *testing.T) {
+	tables := map[string]string{
+		"alice@Example.org":   "example.org",
+		"bob":                 "",
+		"a@b@mail.example.io": "mail.example.io",
+	}
+	for username, expected := range tables {
+		if tenant := TenantOf(username); tenant != expected {
+			t.Errorf("Expected tenant %q of %s, but got %q", expected, username, tenant)
+		}
+	}
+}
+
+func TestClient_handleTenantSessions(t *testing.T) {
+	metrics := newCountingMetrics()
+	listener := newPipeListener()
+	server := NewServer(userAuthorizator{}, memory.New())
+	server.AllowInsecureAuth = true
+	server.Metrics = metrics
+	server.Tenants = &Tenants{
+		Default: TenantLimits{MaxSessions: 2},
+		Domains: map[string]TenantLimits{"example.org": {MaxSessions: 1}},
+	}
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	login := func(username string) (net.Conn, string) {
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		fmt.Fprintf(conn, "USER %s\r\nPASS secret\r\n", username)
+		reader.ReadString('\n')
+		line, _ := reader.ReadString('\n')
+		return conn, line
+	}
+	alice, line := login("alice@example.org")
+	if line != "+OK User Successfully Logged on\r\n" {
+		t.Fatalf("Expected login of alice, but got %q", line)
+	}
+	bob, line := login("bob@Example.org")
+	if line != "-ERR [SYS/TEMP] Too many sessions for your domain, try again later\r\n" {
+		t.Errorf("Expected login of bob to be refused, but got %q", line)
+	}
+	bob.Close()
+	// other tenants have their own limits
+	carol, line := login("carol@example.com")
+	if line != "+OK User Successfully Logged on\r\n" {
+		t.Errorf("Expected login of carol, but got %q", line)
+	}
+	carol.Close()
+
+	fmt.Fprintf(alice, "QUIT\r\n")
+	bufio.NewReader(alice).ReadString('\n')
+	alice.Close()
+	// the session is released after the connection is closed
+	for deadline := time.Now().Add(time.Second); ; {
+		conn, line := login("bob@example.org")
+		conn.Close()
+		if line == "+OK User Successfully Logged on\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected login of bob after alice left, but got %q", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if refused := metrics.count("tenant.refused:example.org"); refused < 1 {
+		t.Errorf("Expected refused logins counted, but got %d", refused)
+	}
+}
+
+func TestTenantGroup_reserveBandwidth(t *testing.T) {
+	g := &tenantGroup{limits: TenantLimits{BytesPerSecond: 1000}}
+	now := time.Unix(1000, 0)
+	for _, table := range []struct {
+		n        int
+		expected time.Duration
+	}{
+		{500, 0},
+		{1000, 500 * time.Millisecond},
+		{10, 1500 * time.Millisecond},
+	} {
+		if wait := g.reserveBandwidth(table.n, now); wait != table.expected {
+			t.Errorf("Expected to wait %v for %d octets, but got %v", table.expected, table.n, wait)
+		}
+	}
+	// the budget refills over time
+	if wait := g.reserveBandwidth(100, now.Add(10*time.Second)); wait != 0 {
+		t.Errorf("Expected no wait after idling, but got %v", wait)
+	}
+}
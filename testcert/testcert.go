@@ -0,0 +1,141 @@
+// Package testcert generates ephemeral self-signed certificates for tests
+// and examples, so no key material has to be checked in or renewed:
+//
+//	cert, err := testcert.New("localhost", "pop.example.test")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	server.TLSConfig = cert.ServerConfig()
+//	client := tls.Client(conn, cert.ClientConfig())
+//
+// The certificates are valid for VALIDITY and must never be used in
+// production.
+package testcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// VALIDITY is how long generated certificates are valid, starting an hour
+// ago to tolerate clock skew.
+const VALIDITY = 24 * time.Hour
+
+// Cert is a generated certificate and its private key.
+type Cert struct {
+	Certificate tls.Certificate
+	Leaf        *x509.Certificate
+	// PEM encoded certificate and private key
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// New generates a self-signed certificate with an ECDSA P-256 key for hosts,
+// which are DNS names or IP addresses. Without hosts, it is issued for
+// localhost, 127.0.0.1 and ::1.
+func New(hosts ...string) (*Cert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return generate(key, &key.PublicKey, hosts)
+}
+
+// NewRSA is like New with a 2048 bit RSA key, e.g. to test cipher suites
+// of RSA certificates.
+func NewRSA(hosts ...string) (*Cert, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return generate(key, &key.PublicKey, hosts)
+}
+
+func generate(key crypto.Signer, public crypto.PublicKey, hosts []string) (*Cert, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"popgun test"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Cert{
+		Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf},
+		Leaf:        leaf,
+		CertPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// ServerConfig returns a TLS configuration serving the certificate.
+func (c *Cert) ServerConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{c.Certificate}}
+}
+
+// ClientConfig returns a TLS configuration trusting only the certificate.
+// Its ServerName is the first host of the certificate.
+func (c *Cert) ClientConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.Leaf)
+	return &tls.Config{RootCAs: pool, ServerName: c.Leaf.Subject.CommonName}
+}
+
+// WriteFiles writes the certificate and private key to cert.pem and
+// key.pem in dir, e.g. for configurations taking file names, and returns
+// their paths.
+func (c *Cert) WriteFiles(dir string) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, c.CertPEM, 0644); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyFile, c.KeyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
@@ -0,0 +1,51 @@
+package testcert
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	cert, err := New("pop.example.test", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"pop.example.test", "192.0.2.1"} {
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			t.Errorf("Expected certificate valid for %s, but got %v", host, err)
+		}
+	}
+	if err := cert.Leaf.VerifyHostname("localhost"); err == nil {
+		t.Error("Expected certificate not valid for localhost")
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go tls.Server(server, cert.ServerConfig()).Handshake()
+	if err := tls.Client(client, cert.ClientConfig()).Handshake(); err != nil {
+		t.Errorf("Expected the client to trust the certificate, but got %v", err)
+	}
+}
+
+func TestCert_WriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := NewRSA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, err := cert.WriteFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("Expected the written key pair to load, but got %v", err)
+	}
+}
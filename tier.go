@@ -0,0 +1,55 @@
+package popgun
+
+import (
+	"github.com/kiwiz/popgun/backends"
+)
+
+// TieredBackend can be implemented by backends keeping messages in storage
+// tiers which can't be read immediately, e.g. S3 Glacier. RETR and TOP of
+// archived messages are then answered with -ERR and
+// Server.ArchivedResponse, or the message is recalled and the client told
+// to retry later, see Server.RecallArchived.
+type TieredBackend interface {
+	// Archived reports whether message msgId is offline.
+	Archived(user backends.User, msgId int) (bool, error)
+}
+
+// RecallBackend can be implemented by a TieredBackend able to bring
+// archived messages back online.
+type RecallBackend interface {
+	// Recall starts a job bringing message msgId online and returns
+	// without waiting for it. Recalling a message already being recalled
+	// should do nothing.
+	Recall(user backends.User, msgId int) error
+}
+
+// checkArchived answers a command retrieving message msgId if the message
+// is archived, counting "message.archived" labeled "deferred" or
+// "recalled". It returns true if the command was answered.
+func (c *Client) checkArchived(msgId int) (bool, error) {
+	tb, ok := c.backend.(TieredBackend)
+	if !ok {
+		return false, nil
+	}
+	archived, err := tb.Archived(c.user, msgId)
+	if err != nil || !archived {
+		return false, err
+	}
+	if rb, ok := c.backend.(RecallBackend); ok && c.server.RecallArchived {
+		if err := rb.Recall(c.user, msgId); err != nil {
+			// defer the client like without recall
+			c.ErrorLog.Printf("[%d] Error recalling message %d of %s: %v", c.id, msgId, c.user.Username(), err)
+		} else {
+			c.server.Metrics.Inc("message.archived", "recalled")
+			c.printer.Err("[SYS/TEMP] Message is being restored from archive, try again later")
+			return true, nil
+		}
+	}
+	c.server.Metrics.Inc("message.archived", "deferred")
+	response := c.server.ArchivedResponse
+	if response == "" {
+		response = "[SYS/TEMP] Message is archived"
+	}
+	c.printer.Err("%s", response)
+	return true, nil
+}
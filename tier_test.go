@@ -0,0 +1,76 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// glacierBackend archives the first message of every maildrop.
+type glacierBackend struct {
+	*memory.Backend
+	recalls int
+}
+
+func (b *glacierBackend) Archived(user backends.User, msgId int) (bool, error) {
+	return msgId == 1, nil
+}
+
+func (b *glacierBackend) Recall(user backends.User, msgId int) error {
+	b.recalls++
+	return nil
+}
+
+func TestCheckArchived(t *testing.T) {
+	for _, recall := range []bool{false, true} {
+		backend := &glacierBackend{Backend: memory.New()}
+		backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+		backend.Deliver("alice", "b", "Subject: b\r\n\r\nbody\r\n")
+		metrics := newCountingMetrics()
+		listener := newPipeListener()
+		server := NewServer(userAuthorizator{}, backend)
+		server.AllowInsecureAuth = true
+		server.ArchivedResponse = "[SYS/TEMP] Message is in cold storage, ask support"
+		server.RecallArchived = recall
+		server.Metrics = metrics
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		go server.Serve(listener)
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\nRETR 1\r\nTOP 1 0\r\nRETR 2\r\n")
+		for i := 0; i < 3; i++ {
+			reader.ReadString('\n')
+		}
+		expected := "-ERR [SYS/TEMP] Message is in cold storage, ask support\r\n"
+		label := "deferred"
+		if recall {
+			expected = "-ERR [SYS/TEMP] Message is being restored from archive, try again later\r\n"
+			label = "recalled"
+		}
+		for _, command := range []string{"RETR", "TOP"} {
+			if line, _ := reader.ReadString('\n'); line != expected {
+				t.Errorf("Expected %q for %s of archived message with recall %v, but got %q", expected, command, recall, line)
+			}
+		}
+		if line, _ := reader.ReadString('\n'); line != "+OK 20 octets\r\n" {
+			t.Errorf("Expected message online, but got %q", line)
+		}
+		conn.Close()
+
+		recalls := 0
+		if recall {
+			recalls = 2
+		}
+		if backend.recalls != recalls || metrics.count("message.archived:"+label) != 2 {
+			t.Errorf("Expected %d recalls and 2 %s messages, but got %d and %d", recalls, label, backend.recalls, metrics.count("message.archived:"+label))
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package popgun
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TicketKeyStore provides TLS session ticket keys. The first key is used to
+// encrypt new tickets, all keys are accepted for resumption. Servers behind a
+// load balancer sharing one store can resume each other's sessions.
+//
+// Note that crypto/tls does not implement TLS 1.3 0-RTT data, so resumption
+// always takes a full round trip.
+type TicketKeyStore interface {
+	TicketKeys() ([][32]byte, error)
+}
+
+// MemoryTicketKeyStore is a TicketKeyStore local to the process. Rotate
+// generates a new encryption key and keeps up to Keep previous keys for
+// decryption of tickets issued before.
+type MemoryTicketKeyStore struct {
+	Keep int
+
+	mu   sync.Mutex
+	keys [][32]byte
+}
+
+func NewMemoryTicketKeyStore(keep int) (*MemoryTicketKeyStore, error) {
+	s := &MemoryTicketKeyStore{Keep: keep}
+	return s, s.Rotate()
+}
+
+func (s *MemoryTicketKeyStore) Rotate() error {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return fmt.Errorf("Error generating session ticket key: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([][32]byte{key}, s.keys...)
+	if len(s.keys) > s.Keep+1 {
+		s.keys = s.keys[:s.Keep+1]
+	}
+	return nil
+}
+
+func (s *MemoryTicketKeyStore) TicketKeys() ([][32]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][32]byte(nil), s.keys...), nil
+}
+
+// TicketKeyRotator periodically loads keys from a TicketKeyStore and installs
+// them into a tls.Config. If the store is a MemoryTicketKeyStore, it is
+// rotated first.
+type TicketKeyRotator struct {
+	Config   *tls.Config
+	Store    TicketKeyStore
+	Interval time.Duration
+	ErrorLog Logger
+	// Clock, if set, replaces the system clock for the rotation interval.
+	Clock Clock
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewTicketKeyRotator(config *tls.Config, store TicketKeyStore, interval time.Duration) *TicketKeyRotator {
+	return &TicketKeyRotator{
+		Config:   config,
+		Store:    store,
+		Interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Rotate installs the current keys of the store into the config.
+func (r *TicketKeyRotator) Rotate() error {
+	if memStore, ok := r.Store.(*MemoryTicketKeyStore); ok {
+		err := memStore.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+	return r.install()
+}
+
+// install installs the keys of the store into the config without rotating
+// it.
+func (r *TicketKeyRotator) install() error {
+	keys, err := r.Store.TicketKeys()
+	if err != nil {
+		return fmt.Errorf("Error loading session ticket keys: %v", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("No session ticket keys in store")
+	}
+	r.Config.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// Start installs the current keys of the store and rotates them every
+// Interval until Stop is called.
+func (r *TicketKeyRotator) Start() error {
+	err := r.install()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			timer := clockOrSystem(r.Clock).NewTimer(r.Interval)
+			select {
+			case <-timer.C():
+				err := r.Rotate()
+				if err != nil && r.ErrorLog != nil {
+					r.ErrorLog.Println("Error rotating session ticket keys: ", err)
+				}
+			case <-r.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *TicketKeyRotator) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// CertExpiryMonitor periodically inspects the certificates of a tls.Config
+// and reports those expiring within Window, so they can be renewed before
+// clients start failing. Certificates provided by GetCertificate are not
+// seen by the monitor.
+type CertExpiryMonitor struct {
+	Config   *tls.Config
+	Window   time.Duration
+	Interval time.Duration
+	// OnExpiring is called for every certificate expiring within Window,
+	// or already expired. If nil, they are logged to ErrorLog.
+	OnExpiring func(cert *x509.Certificate, remaining time.Duration)
+	// Metrics, if set, receives the remaining validity of every certificate
+	// as "tls.cert.expiry_seconds" labeled with its subject.
+	Metrics  Metrics
+	ErrorLog Logger
+	// Clock, if set, replaces the system clock for the check interval and
+	// the remaining validity.
+	Clock Clock
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewCertExpiryMonitor(config *tls.Config, window, interval time.Duration) *CertExpiryMonitor {
+	return &CertExpiryMonitor{
+		Config:   config,
+		Window:   window,
+		Interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Check inspects the certificates once.
+func (m *CertExpiryMonitor) Check() error {
+	for _, certificate := range m.Config.Certificates {
+		cert := certificate.Leaf
+		if cert == nil {
+			if len(certificate.Certificate) == 0 {
+				continue
+			}
+			var err error
+			cert, err = x509.ParseCertificate(certificate.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("Error parsing certificate: %v", err)
+			}
+		}
+		remaining := cert.NotAfter.Sub(clockOrSystem(m.Clock).Now())
+		if m.Metrics != nil {
+			m.Metrics.Set("tls.cert.expiry_seconds", remaining.Seconds(), cert.Subject.String())
+		}
+		if remaining > m.Window {
+			continue
+		}
+		if m.OnExpiring != nil {
+			m.OnExpiring(cert, remaining)
+		} else if m.ErrorLog != nil {
+			m.ErrorLog.Printf("Certificate %s expires in %v (%v)", cert.Subject, remaining.Round(time.Hour), cert.NotAfter)
+		}
+	}
+	return nil
+}
+
+// Start checks the certificates and keeps checking them every Interval
+// until Stop is called.
+func (m *CertExpiryMonitor) Start() error {
+	err := m.Check()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			timer := clockOrSystem(m.Clock).NewTimer(m.Interval)
+			select {
+			case <-timer.C():
+				err := m.Check()
+				if err != nil && m.ErrorLog != nil {
+					m.ErrorLog.Println("Error checking certificate expiry: ", err)
+				}
+			case <-m.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *CertExpiryMonitor) Stop() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+// ALPN_POP3 is the ALPN protocol ID of POP3 over TLS.
+const ALPN_POP3 = "pop3"
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// TLSState returns the state of the TLS connection of the session, false if
+// the client isn't connected over TLS or the handshake isn't complete.
+func (c *Client) TLSState() (tls.ConnectionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tlsState == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *c.tlsState, true
+}
+
+// handshake completes the TLS handshake before the greeting and reports the
+// negotiated version, cipher suite and ALPN protocol, so operators can track
+// their use.
+func (c *Client) handshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(c.server.sessionTimeout()))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	state := conn.ConnectionState()
+	c.mu.Lock()
+	c.tlsState = &state
+	c.mu.Unlock()
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	version, cipher := tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+	c.DebugLog.Printf("[%d] TLS %s, cipher %s, ALPN %s", c.id, version, cipher, alpn)
+	c.server.Metrics.Inc("tls.session", version, cipher, alpn)
+	if legacyTLS(state) {
+		c.ErrorLog.Printf("[%d] Client %s needed legacy TLS: %s, cipher %s", c.id, c.RemoteAddr(), version, cipher)
+		c.server.Metrics.Inc("tls.legacy", version, cipher)
+	}
+	return nil
+}
+
+// TLS policy presets after Mozilla's server side TLS recommendations, see
+// ApplyTLSPolicy.
+const (
+	// TLS 1.3 only
+	TLS_POLICY_MODERN = "modern"
+	// TLS 1.2 with forward secret AEAD cipher suites, and TLS 1.3
+	TLS_POLICY_INTERMEDIATE = "intermediate"
+	// TLS 1.0 and later with CBC and RSA key exchange cipher suites, for
+	// old clients only
+	TLS_POLICY_LEGACY = "legacy"
+)
+
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var legacyCipherSuites = append(append([]uint16(nil), intermediateCipherSuites...),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+)
+
+// ApplyTLSPolicy configures the protocol versions, cipher suites and curves
+// of config according to a named policy preset. Sessions which negotiate
+// parameters outside of the intermediate policy are logged and counted as
+// "tls.legacy", so the legacy policy can be retired once unused.
+func ApplyTLSPolicy(config *tls.Config, policy string) error {
+	config.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	config.MaxVersion = 0
+	switch policy {
+	case TLS_POLICY_MODERN:
+		config.MinVersion = tls.VersionTLS13
+		config.CipherSuites = nil
+	case TLS_POLICY_INTERMEDIATE:
+		config.MinVersion = tls.VersionTLS12
+		config.CipherSuites = append([]uint16(nil), intermediateCipherSuites...)
+	case TLS_POLICY_LEGACY:
+		config.MinVersion = tls.VersionTLS10
+		config.CipherSuites = append([]uint16(nil), legacyCipherSuites...)
+		config.CurvePreferences = append(config.CurvePreferences, tls.CurveP521)
+	default:
+		return fmt.Errorf("Unknown TLS policy: %q", policy)
+	}
+	return nil
+}
+
+// legacyTLS reports whether a connection needed the legacy policy.
+func legacyTLS(state tls.ConnectionState) bool {
+	if state.Version >= tls.VersionTLS13 {
+		return false
+	}
+	if state.Version < tls.VersionTLS12 {
+		return true
+	}
+	for _, suite := range intermediateCipherSuites {
+		if state.CipherSuite == suite {
+			return false
+		}
+	}
+	return true
+}
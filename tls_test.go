@@ -0,0 +1,239 @@
+package popgun
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/testcert"
+)
+
+func TestMemoryTicketKeyStore_Rotate(t *testing.T) {
+	store, err := NewMemoryTicketKeyStore(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := store.TicketKeys()
+	for i := 0; i < 3; i++ {
+		if err := store.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, _ := store.TicketKeys()
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 keys, but got %d", len(keys))
+	}
+	for _, key := range keys {
+		if key == first[0] {
+			t.Error("Expected the oldest key to be dropped")
+		}
+	}
+}
+
+type emptyTicketKeyStore struct{}
+
+func (emptyTicketKeyStore) TicketKeys() ([][32]byte, error) {
+	return nil, nil
+}
+
+func TestTicketKeyRotator_Rotate(t *testing.T) {
+	rotator := NewTicketKeyRotator(&tls.Config{}, emptyTicketKeyStore{}, time.Hour)
+	if err := rotator.Rotate(); err == nil {
+		t.Error("Expected error, but got none")
+	}
+
+	store, _ := NewMemoryTicketKeyStore(1)
+	clock := newFakeClock()
+	rotator = NewTicketKeyRotator(&tls.Config{}, store, time.Hour)
+	rotator.Clock = clock
+	if err := rotator.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rotator.Stop()
+	if keys, _ := store.TicketKeys(); len(keys) != 1 {
+		t.Errorf("Expected 1 key after start, but got %d", len(keys))
+	}
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Hour)
+	clock.waitTimers(t, 1)
+	if keys, _ := store.TicketKeys(); len(keys) != 2 {
+		t.Errorf("Expected 2 keys after an interval, but got %d", len(keys))
+	}
+}
+
+// newTestCert returns an ephemeral RSA certificate for localhost.
+func newTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := testcert.NewRSA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Certificate
+}
+
+func TestCertExpiryMonitor_Check(t *testing.T) {
+	cert := newTestCert(t)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	var expiring []time.Duration
+	monitor := NewCertExpiryMonitor(config, 100*365*24*time.Hour, time.Hour)
+	monitor.OnExpiring = func(cert *x509.Certificate, remaining time.Duration) {
+		expiring = append(expiring, remaining)
+	}
+	if err := monitor.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(expiring) != 1 {
+		t.Errorf("Expected 1 expiring certificate, but got %d", len(expiring))
+	}
+
+	expiring = nil
+	monitor.Window = -100 * 365 * 24 * time.Hour
+	monitor.Check()
+	if len(expiring) != 0 {
+		t.Errorf("Expected no expiring certificate, but got %d", len(expiring))
+	}
+}
+
+func TestCertExpiryMonitor_Start(t *testing.T) {
+	cert := newTestCert(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	clock := newFakeClock()
+	clock.now = leaf.NotAfter.Add(-72 * time.Hour)
+	expiring := make(chan time.Duration, 2)
+	monitor := NewCertExpiryMonitor(config, 24*time.Hour, 24*time.Hour)
+	monitor.Clock = clock
+	monitor.OnExpiring = func(cert *x509.Certificate, remaining time.Duration) {
+		expiring <- remaining
+	}
+	if err := monitor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Stop()
+	if len(expiring) != 0 {
+		t.Errorf("Expected no expiring certificate, but got %d", len(expiring))
+	}
+	clock.waitTimers(t, 1)
+	clock.Advance(48 * time.Hour)
+	select {
+	case remaining := <-expiring:
+		if remaining != 24*time.Hour {
+			t.Errorf("Expected 24h remaining, but got %v", remaining)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the certificate to be reported")
+	}
+}
+
+func TestServer_ServeTLSALPN(t *testing.T) {
+	cert := newTestCert(t)
+	metrics := newCountingMetrics()
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.Metrics = metrics
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}
+	go server.ServeTLS(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"imap", ALPN_POP3}})
+	defer client.Close()
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if protocol := client.ConnectionState().NegotiatedProtocol; protocol != ALPN_POP3 {
+		t.Errorf("Expected ALPN %s negotiated, but got %q", ALPN_POP3, protocol)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, but got %d", len(sessions))
+	}
+	state, ok := sessions[0].TLSState()
+	if !ok || state.NegotiatedProtocol != ALPN_POP3 || state.Version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3 session with ALPN, but got %v, %+v", ok, state)
+	}
+	key := "tls.session:TLS 1.3:" + tls.CipherSuiteName(state.CipherSuite) + ":pop3"
+	if count := metrics.count(key); count != 1 {
+		t.Errorf("Expected %s counted once, but got %d", key, count)
+	}
+	for _, key := range []string{"tls.handshake.duration:pipe", "session.greeting.wait:pipe"} {
+		if observed := metrics.observed(key); len(observed) != 1 {
+			t.Errorf("Expected %s observed once, but got %v", key, observed)
+		}
+	}
+}
+
+func TestApplyTLSPolicy(t *testing.T) {
+	cert := newTestCert(t)
+	if err := ApplyTLSPolicy(&tls.Config{}, "paranoid"); err == nil {
+		t.Error("Expected unknown policy to be rejected")
+	}
+
+	testCases := []struct {
+		policy    string
+		client    *tls.Config
+		connected bool
+		legacy    bool
+	}{
+		{TLS_POLICY_MODERN, &tls.Config{MaxVersion: tls.VersionTLS12}, false, false},
+		{TLS_POLICY_MODERN, &tls.Config{}, true, false},
+		{TLS_POLICY_INTERMEDIATE, &tls.Config{MaxVersion: tls.VersionTLS12}, true, false},
+		{TLS_POLICY_INTERMEDIATE, &tls.Config{
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		}, false, false},
+		{TLS_POLICY_LEGACY, &tls.Config{
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		}, true, true},
+		{TLS_POLICY_LEGACY, &tls.Config{}, true, false},
+	}
+	for _, tc := range testCases {
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if err := ApplyTLSPolicy(config, tc.policy); err != nil {
+			t.Fatal(err)
+		}
+		metrics := newCountingMetrics()
+		listener := newPipeListener()
+		server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+		server.DebugLog = log.New(ioutil.Discard, "", 0)
+		server.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.Metrics = metrics
+		server.TLSConfig = config
+		go server.ServeTLS(listener)
+
+		conn, err := listener.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.client.InsecureSkipVerify = true
+		client := tls.Client(conn, tc.client)
+		_, err = bufio.NewReader(client).ReadString('\n')
+		client.Close()
+		if connected := err == nil; connected != tc.connected {
+			t.Errorf("%s: expected connected %v, but got %v", tc.policy, tc.connected, err)
+			continue
+		}
+		if !tc.connected {
+			continue
+		}
+		key := "tls.legacy:TLS 1.2:TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"
+		if legacy := metrics.count(key) == 1; legacy != tc.legacy {
+			t.Errorf("%s: expected legacy %v, but got %v", tc.policy, tc.legacy, legacy)
+		}
+	}
+}
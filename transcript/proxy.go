@@ -0,0 +1,283 @@
+package transcript
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+)
+
+// Proxy relays POP3 sessions to an upstream server and saves their
+// transcripts. Credentials are replaced by REDACTED, and the content of
+// messages retrieved with RETR and TOP by a line counting it unless
+// KeepMessages is set. Sessions upgraded with STLS are recorded up to the
+// upgrade only.
+type Proxy struct {
+	// Upstream is the address of the POP3 server sessions are relayed to.
+	Upstream string
+	// Dialer, if set, connects to Upstream instead of a net.Dialer.
+	Dialer backends.Dialer
+	// Dir is the directory transcripts are saved to, one file per session.
+	Dir string
+	// RecordAll saves the transcripts of all sessions, not only of failing
+	// ones.
+	RecordAll bool
+	// KeepMessages records the content of messages.
+	KeepMessages bool
+	ErrorLog     popgun.Logger
+
+	seq uint64
+}
+
+// Serve accepts connections on l and relays each in a new goroutine. It
+// blocks until accepting fails for good and returns the error, temporary
+// errors are retried, see popgun.AcceptBackoff.
+func (p *Proxy) Serve(l net.Listener) error {
+	var backoff popgun.AcceptBackoff
+	for {
+		conn, err := l.Accept()
+		if delay, temporary := backoff.Next(err); err != nil {
+			if !temporary {
+				return err
+			}
+			time.Sleep(delay)
+			continue
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn relays the session of conn until either side closes the
+// connection, and saves its transcript.
+func (p *Proxy) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 30 * time.Second}
+	}
+	upstream, err := dialer.DialContext(context.Background(), "tcp", p.Upstream)
+	if err != nil {
+		p.logf("Error connecting to %s: %v", p.Upstream, err)
+		return err
+	}
+	defer upstream.Close()
+
+	s := &recording{keepMessages: p.KeepMessages}
+	done := make(chan struct{}, 2)
+	go func() {
+		s.relayClient(conn, upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		s.relayServer(upstream, conn)
+		done <- struct{}{}
+	}()
+	// either side closing ends the session
+	<-done
+	conn.Close()
+	upstream.Close()
+	<-done
+
+	if !p.RecordAll && !s.failing() {
+		return nil
+	}
+	if err := p.save(s.transcript); err != nil {
+		p.logf("Error saving transcript: %v", err)
+		return err
+	}
+	return nil
+}
+
+// save writes t to a new file in Dir.
+func (p *Proxy) save(t Transcript) error {
+	name := fmt.Sprintf("%s-%d.transcript", time.Now().UTC().Format("20060102T150405"), atomic.AddUint64(&p.seq, 1))
+	f, err := os.OpenFile(filepath.Join(p.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := t.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (p *Proxy) logf(format string, a ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, a...)
+	} else {
+		log.Printf(format, a...)
+	}
+}
+
+// recording is the transcript of a relayed session, which the relays of
+// both directions append to.
+type recording struct {
+	keepMessages bool
+
+	mu         sync.Mutex
+	transcript Transcript
+	// commands awaiting their status line
+	pending []string
+	// in a SASL exchange, whose client lines are redacted
+	sasl bool
+	// in a multi-line response, and the lines and octets of a message
+	// which is redacted
+	body          bool
+	redact        bool
+	redactedLines int
+	redactedBytes int
+
+	quit, failed, tls bool
+	// set once STLS was answered, the rest isn't recorded
+	stopped bool
+}
+
+// failing reports whether the session saw an -ERR response or ended
+// without QUIT.
+func (s *recording) failing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed || (!s.quit && !s.tls)
+}
+
+// relayClient copies the commands of the client to the upstream server.
+func (s *recording) relayClient(client, upstream net.Conn) {
+	reader := bufio.NewReader(client)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			// recorded before it is relayed, so the response can't be
+			// recorded first
+			tls := s.command(line)
+			if _, err := io.WriteString(upstream, line); err != nil {
+				return
+			}
+			if tls {
+				// the TLS handshake follows, which isn't recorded
+				io.Copy(upstream, reader)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// relayServer copies the responses of the upstream server to the client.
+func (s *recording) relayServer(upstream, client net.Conn) {
+	reader := bufio.NewReader(upstream)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			tls := s.response(line)
+			if _, err := io.WriteString(client, line); err != nil {
+				return
+			}
+			if tls {
+				io.Copy(client, reader)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// command records a line of the client. It returns true for STLS, after
+// which the session is no longer recorded.
+func (s *recording) command(line string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	cmd := strings.ToUpper(fields[0])
+	recorded := line
+	switch {
+	case s.sasl:
+		// a response of the SASL exchange, unless it is cancelled
+		if line != "*\r\n" {
+			recorded = REDACTED + "\r\n"
+		}
+	case cmd == "USER" || cmd == "PASS" || cmd == "XPASSWD":
+		recorded = cmd + " " + REDACTED + "\r\n"
+	case cmd == "APOP":
+		recorded = cmd + " " + REDACTED + " " + REDACTED + "\r\n"
+	case cmd == "AUTH":
+		s.sasl = len(fields) > 1
+		if len(fields) == 3 {
+			recorded = cmd + " " + fields[1] + " " + REDACTED + "\r\n"
+		}
+	case cmd == "QUIT":
+		s.quit = true
+	case cmd == "STLS":
+		s.tls = true
+	}
+	s.transcript = append(s.transcript, Line{Client: true, Text: recorded})
+	s.pending = append(s.pending, recorded)
+	return cmd == "STLS"
+}
+
+// response records a line of the upstream server. It returns true once
+// STLS was accepted.
+func (s *recording) response(line string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	if s.body {
+		if isTerminator(line) {
+			if s.redactedLines > 0 {
+				s.transcript = append(s.transcript, Line{Text: fmt.Sprintf("[%d lines, %d octets]\r\n", s.redactedLines, s.redactedBytes)})
+			}
+			s.transcript = append(s.transcript, Line{Text: line})
+			s.body, s.redact = false, false
+			s.redactedLines, s.redactedBytes = 0, 0
+		} else if s.redact {
+			s.redactedLines++
+			s.redactedBytes += len(line)
+		} else {
+			s.transcript = append(s.transcript, Line{Text: line})
+		}
+		return false
+	}
+	s.transcript = append(s.transcript, Line{Text: line})
+	if len(s.pending) == 0 {
+		// the greeting
+		return false
+	}
+	command := s.pending[0]
+	s.pending = s.pending[1:]
+	if isContinuation(line) {
+		return false
+	}
+	if verb(command) == "AUTH" || command == REDACTED+"\r\n" || command == "*\r\n" {
+		s.sasl = false
+	}
+	if isErr(line) {
+		s.failed = true
+	}
+	if isOk(line) && multiLine(command) {
+		s.body = true
+		cmd := verb(command)
+		s.redact = !s.keepMessages && (cmd == "RETR" || cmd == "TOP")
+	}
+	if verb(command) == "STLS" {
+		s.stopped = true
+		return isOk(line)
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package transcript
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Mismatch is a command whose response differs from the recorded one.
+type Mismatch struct {
+	// Command as recorded
+	Command string
+	// status lines of the recorded and the replayed response
+	Recorded string
+	Replayed string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s: recorded %s, replayed %s", strings.TrimRight(m.Command, "\r\n"), strings.TrimRight(m.Recorded, "\r\n"), strings.TrimRight(m.Replayed, "\r\n"))
+}
+
+// apopTimestamp matches the timestamp of a greeting for APOP.
+var apopTimestamp = regexp.MustCompile(`<[^<>]+@[^<>]+>`)
+
+// Replay sends the commands of t one by one to the POP3 server at addr,
+// which has to serve username with password, and returns the commands
+// answered differently than recorded, i.e. with +OK instead of -ERR or the
+// other way round. Redacted credentials are replaced by username and
+// password, the responses of SASL exchanges only for PLAIN; others are
+// cancelled. The server should serve the maildrop the session was recorded
+// with, or a similar one, for the results to be meaningful.
+func Replay(ctx context.Context, addr string, t Transcript, username, password string) ([]Mismatch, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	recordedGreeting, exchanges := t.exchanges()
+	var mismatches []Mismatch
+	if recordedGreeting != "" && kind(recordedGreeting) != kind(greeting) {
+		mismatches = append(mismatches, Mismatch{Recorded: recordedGreeting, Replayed: greeting})
+	}
+	// mechanism of the current SASL exchange
+	mechanism := ""
+	for _, e := range exchanges {
+		command := e.command
+		fields := strings.Fields(command)
+		switch cmd := verb(command); {
+		case command == REDACTED+"\r\n":
+			command = "*\r\n"
+			if mechanism == "PLAIN" {
+				command = saslPlain(username, password) + "\r\n"
+			}
+		case len(fields) == 2 && fields[1] == REDACTED && (cmd == "USER" || cmd == "PASS"):
+			credential := username
+			if cmd == "PASS" {
+				credential = password
+			}
+			command = cmd + " " + credential + "\r\n"
+		case cmd == "APOP" && len(fields) == 3 && fields[1] == REDACTED:
+			sum := md5.Sum([]byte(apopTimestamp.FindString(greeting) + password))
+			command = cmd + " " + username + " " + hex.EncodeToString(sum[:]) + "\r\n"
+		case cmd == "AUTH" && len(fields) >= 2:
+			mechanism = strings.ToUpper(fields[1])
+			if len(fields) == 3 && fields[2] == REDACTED {
+				response := "*"
+				if mechanism == "PLAIN" {
+					response = saslPlain(username, password)
+				}
+				command = cmd + " " + fields[1] + " " + response + "\r\n"
+			}
+		}
+		if _, err := conn.Write([]byte(command)); err != nil {
+			return mismatches, err
+		}
+		status, err := reader.ReadString('\n')
+		if err != nil {
+			return mismatches, err
+		}
+		if !isContinuation(status) {
+			mechanism = ""
+		}
+		if isOk(status) && multiLine(command) {
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return mismatches, err
+				}
+				if isTerminator(line) {
+					break
+				}
+			}
+		}
+		if kind(status) != kind(e.status) {
+			mismatches = append(mismatches, Mismatch{Command: e.command, Recorded: e.status, Replayed: status})
+		}
+		// the rest of the session is encrypted or over
+		if verb(command) == "QUIT" || (verb(command) == "STLS" && isOk(status)) {
+			break
+		}
+	}
+	return mismatches, nil
+}
+
+// saslPlain returns the initial response of PLAIN, see RFC 4616.
+func saslPlain(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
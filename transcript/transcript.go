@@ -0,0 +1,181 @@
+// Package transcript records POP3 sessions and replays them, to debug
+// incompatibilities of clients with popgun.
+//
+// Proxy sits in front of another POP3 server and saves sanitized
+// transcripts of the sessions which fail with it, i.e. which see an -ERR
+// response or end without QUIT. Replay sends the commands of a transcript
+// to a popgun server and reports the responses which differ:
+//
+//	t, err := transcript.Load("20260101T120000-1.transcript")
+//	if err != nil {
+//		return err
+//	}
+//	mismatches, err := transcript.Replay(ctx, "localhost:1100", t, "alice", "secret")
+//
+// Transcripts have the format of the golden transcripts of popgun's own
+// tests: every line is quoted with strconv.Quote and prefixed by "C: " if
+// it was sent by the client or "S: " if it was sent by the server.
+package transcript
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// REDACTED replaces credentials in transcripts, which Replay substitutes.
+const REDACTED = "***"
+
+// Line is a line of a session, with its line ending.
+type Line struct {
+	// Client is set for lines sent by the client
+	Client bool
+	Text   string
+}
+
+// Transcript is the exchange of a session, in the order it was seen.
+type Transcript []Line
+
+// Parse reads a transcript. Empty lines are skipped, as is the line "EOF"
+// with which golden transcripts note that the server closed the
+// connection.
+func Parse(r io.Reader) (Transcript, error) {
+	var t Transcript
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if text == "" || text == "EOF" {
+			continue
+		}
+		var line Line
+		switch {
+		case strings.HasPrefix(text, "C: "):
+			line.Client = true
+		case strings.HasPrefix(text, "S: "):
+		default:
+			return nil, fmt.Errorf("Line %d: expected C: or S: prefix", n)
+		}
+		unquoted, err := strconv.Unquote(text[3:])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		line.Text = unquoted
+		t = append(t, line)
+	}
+	return t, scanner.Err()
+}
+
+// Load reads the transcript file path.
+func Load(path string) (Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// WriteTo writes the transcript in the format read by Parse.
+func (t Transcript) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, line := range t {
+		prefix := "S: "
+		if line.Client {
+			prefix = "C: "
+		}
+		m, err := fmt.Fprintf(w, "%s%q\n", prefix, line.Text)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// exchange is a command and the status line of its response.
+type exchange struct {
+	command string
+	status  string
+}
+
+// exchanges pairs the commands of t with their responses, also if they
+// were pipelined. Every client line is answered by a status line, which
+// for the lines of SASL exchanges may be a continuation. Multi-line
+// responses are skipped. The greeting is returned separately.
+func (t Transcript) exchanges() (greeting string, exchanges []exchange) {
+	var pending []string
+	body := false
+	for _, line := range t {
+		switch {
+		case line.Client:
+			pending = append(pending, line.Text)
+		case body:
+			body = !isTerminator(line.Text)
+		case len(pending) == 0:
+			if greeting == "" && len(exchanges) == 0 {
+				greeting = line.Text
+			}
+		default:
+			command := pending[0]
+			pending = pending[1:]
+			exchanges = append(exchanges, exchange{command: command, status: line.Text})
+			body = isOk(line.Text) && multiLine(command)
+		}
+	}
+	return greeting, exchanges
+}
+
+// verb returns the upper case command name of a command line.
+func verb(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// multiLine reports whether a positive response to command is multi-line.
+func multiLine(command string) bool {
+	fields := strings.Fields(command)
+	switch verb(command) {
+	case "CAPA", "RETR", "TOP":
+		return true
+	case "LIST", "UIDL":
+		return len(fields) == 1
+	}
+	return false
+}
+
+func isOk(status string) bool {
+	return status == "+OK\r\n" || strings.HasPrefix(status, "+OK ")
+}
+
+func isErr(status string) bool {
+	return status == "-ERR\r\n" || strings.HasPrefix(status, "-ERR ")
+}
+
+// isContinuation reports whether status continues a SASL exchange.
+func isContinuation(status string) bool {
+	return strings.HasPrefix(status, "+ ") || status == "+\r\n"
+}
+
+func isTerminator(line string) bool {
+	return line == ".\r\n" || line == ".\n"
+}
+
+// kind returns the kind of a status line: "+OK", "-ERR", "+" for
+// continuations or the line itself.
+func kind(status string) string {
+	switch {
+	case isOk(status):
+		return "+OK"
+	case isErr(status):
+		return "-ERR"
+	case isContinuation(status):
+		return "+"
+	}
+	return strings.TrimRight(status, "\r\n")
+}
@@ -0,0 +1,151 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun"
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+type testUser string
+
+func (u testUser) Username() string {
+	return string(u)
+}
+
+// passwordAuthorizator accepts any user with password "secret".
+type passwordAuthorizator struct{}
+
+func (passwordAuthorizator) Authorize(conn net.Conn, username, password string) (backends.User, error) {
+	if password != "secret" {
+		return nil, fmt.Errorf("Invalid password")
+	}
+	return testUser(username), nil
+}
+
+// serve runs a popgun server for alice with one message and returns its
+// address.
+func serve(t *testing.T) string {
+	backend := memory.New()
+	backend.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	server := popgun.NewServer(passwordAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+	return l.Addr().String()
+}
+
+func TestParse(t *testing.T) {
+	golden, err := ioutil.ReadFile("../testdata/transcripts/authorization.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript, err := Parse(bytes.NewReader(golden))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript) == 0 || transcript[0].Client || !transcript[1].Client {
+		t.Fatalf("Expected greeting and command, but got %v", transcript)
+	}
+	var out bytes.Buffer
+	transcript.WriteTo(&out)
+	if out.String()+"EOF\n" != string(golden) {
+		t.Errorf("Expected transcript written as read, but got %q", out.String())
+	}
+	if _, err := Parse(strings.NewReader("X: \"+OK\\r\\n\"\n")); err == nil {
+		t.Errorf("Expected invalid prefix refused")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proxy := &Proxy{Upstream: serve(t), Dir: dir, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	session := func(commands ...string) []string {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			proxy.ServeConn(server)
+			close(done)
+		}()
+		reader := bufio.NewReader(client)
+		var lines []string
+		read := func(multiLine bool) {
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, line)
+				if !multiLine || line == ".\r\n" || strings.HasPrefix(line, "-ERR") {
+					return
+				}
+			}
+		}
+		read(false)
+		for _, command := range commands {
+			fmt.Fprintf(client, "%s\r\n", command)
+			read(command == "RETR 1")
+		}
+		client.Close()
+		<-done
+		return lines
+	}
+
+	session("USER alice", "PASS secret", "QUIT")
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected successful session not saved, but got %d files", len(files))
+	}
+	lines := session("USER alice", "PASS secret", "RETR 1", "DELE 2", "QUIT")
+	if lines[6] != "body\r\n" || !strings.HasPrefix(lines[8], "-ERR") {
+		t.Fatalf("Expected session relayed, but got %q", lines)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected failing session saved, but got %d files", len(files))
+	}
+	path := filepath.Join(dir, files[0].Name())
+	recorded, _ := ioutil.ReadFile(path)
+	for _, expected := range []string{`C: "USER ***\r\n"`, `C: "PASS ***\r\n"`, `S: "[3 lines, 20 octets]\r\n"`, `C: "DELE 2\r\n"`} {
+		if !strings.Contains(string(recorded), expected+"\n") {
+			t.Errorf("Expected %s recorded, but got\n%s", expected, recorded)
+		}
+	}
+	if strings.Contains(string(recorded), "secret") || strings.Contains(string(recorded), "body") {
+		t.Errorf("Expected sanitized transcript, but got\n%s", recorded)
+	}
+
+	transcript, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err := Replay(context.Background(), serve(t), transcript, "alice", "secret")
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("Expected session reproduced, but got %v, %v", mismatches, err)
+	}
+	mismatches, err = Replay(context.Background(), serve(t), transcript, "alice", "wrong")
+	if err != nil || len(mismatches) == 0 || mismatches[0].Command != "PASS ***\r\n" {
+		t.Errorf("Expected PASS answered differently, but got %v, %v", mismatches, err)
+	}
+}
@@ -0,0 +1,165 @@
+package popgun
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden transcripts in testdata")
+
+type transcriptMessage struct {
+	uid     string
+	content string
+}
+
+type transcriptTestCase struct {
+	name     string
+	messages []transcriptMessage
+	commands []string
+}
+
+// multiLine reports whether a positive response to command is multi-line.
+func multiLine(command string) bool {
+	fields := strings.Fields(strings.ToUpper(command))
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "CAPA", "RETR", "TOP":
+		return true
+	case "LIST", "UIDL":
+		return len(fields) == 1
+	}
+	return false
+}
+
+// transcript runs a session against the memory backend and returns the
+// complete exchange, client lines prefixed by "C: ", server lines by "S: ".
+func transcript(t *testing.T, tc transcriptTestCase) string {
+	backend := memory.New()
+	username := backends.DummyUser{}.Username()
+	for _, msg := range tc.messages {
+		if err := backend.Deliver(username, msg.uid, msg.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var out strings.Builder
+	reader := bufio.NewReader(conn)
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			fmt.Fprintf(&out, "S: %q\n", line)
+		}
+		return line, err
+	}
+	if _, err := readLine(); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range tc.commands {
+		fmt.Fprintf(&out, "C: %q\n", command+"\r\n")
+		fmt.Fprintf(conn, "%s\r\n", command)
+		line, err := readLine()
+		if err != nil {
+			t.Fatalf("Error reading response to %s: %v", command, err)
+		}
+		if !strings.HasPrefix(line, "+OK") || !multiLine(command) {
+			continue
+		}
+		for line != ".\r\n" {
+			if line, err = readLine(); err != nil {
+				t.Fatalf("Error reading response to %s: %v", command, err)
+			}
+		}
+	}
+	// the session must end after QUIT and nothing else must be sent
+	if _, err := readLine(); err != io.EOF {
+		fmt.Fprintf(&out, "E: %v\n", err)
+	} else {
+		fmt.Fprintf(&out, "EOF\n")
+	}
+	return out.String()
+}
+
+func TestTranscripts(t *testing.T) {
+	login := []string{"USER user", "PASS secret"}
+	testCases := []transcriptTestCase{
+		{
+			name:     "empty_maildrop",
+			commands: append(login, "STAT", "LIST", "LIST 1", "UIDL", "UIDL 1", "RETR 1", "TOP 1 0", "DELE 1", "NOOP", "RSET", "QUIT"),
+		},
+		{
+			name: "authorization",
+			commands: []string{
+				"CAPA", "STAT", "PASS secret", "USER", "USER user", "NOOP", "PASS secret", "USER user",
+				"FOO", "PASS secret", "USER user", "QUIT",
+			},
+		},
+		{
+			name: "transaction",
+			messages: []transcriptMessage{
+				{"a1", "From: alice@example.com\r\nSubject: hello\r\n\r\nfirst line\r\nsecond line\r\n"},
+				{"b2", "Subject: unix line endings\n\nbody\n"},
+			},
+			commands: append(login, "CAPA", "STAT", "LIST", "LIST 2", "LIST 3", "LIST x", "UIDL", "UIDL 1",
+				"RETR 1", "TOP 1 1", "TOP 2 0", "TOP 1 -1", "TOP 1", "NOOP", "FOO", "USER user", "QUIT"),
+		},
+		{
+			name: "dot_lines",
+			messages: []transcriptMessage{
+				{"dots", "Subject: dots\r\n\r\n.\r\n..\r\n.leading\r\nend.\r\n.\r\n"},
+			},
+			commands: append(login, "LIST", "RETR 1", "TOP 1 2", "QUIT"),
+		},
+		{
+			name: "deleted_messages",
+			messages: []transcriptMessage{
+				{"m1", "Subject: one\r\n\r\n1\r\n"},
+				{"m2", "Subject: two\r\n\r\n2\r\n"},
+				{"m3", "Subject: three\r\n\r\n3\r\n"},
+			},
+			commands: append(login, "DELE 2", "DELE 2", "STAT", "LIST", "LIST 2", "UIDL", "UIDL 2", "RETR 2",
+				"TOP 2 0", "RSET", "LIST", "DELE 1", "DELE 3", "DELE 4", "DELE 0", "STAT", "QUIT"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := transcript(t, tc)
+			path := filepath.Join("testdata", "transcripts", tc.name+".golden")
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(expected) {
+				t.Errorf("Transcript differs from %s, run with -update to accept:\n%s", path, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package popgun
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+// UpdateFailurePolicy decides what happens when the backend fails to remove
+// some of the messages marked as deleted on QUIT, see
+// Server.UpdateFailurePolicy. The client is told "-ERR some deleted
+// messages not removed" regardless of the policy.
+type UpdateFailurePolicy int
+
+const (
+	// log the messages not removed to the DebugLog only
+	UPDATE_FAILURE_LOG UpdateFailurePolicy = iota
+	// mark the messages not removed as deleted again on the next login of
+	// the user, so they are retried on the next QUIT
+	UPDATE_FAILURE_RETRY
+	// log the failure to the ErrorLog and export an EVENT_UPDATE_FAILED
+	// event, to alert operators
+	UPDATE_FAILURE_ALERT
+	// flag the maildrop for operator review, see Server.Reviews
+	UPDATE_FAILURE_REVIEW
+)
+
+var updateFailurePolicyNames = map[UpdateFailurePolicy]string{
+	UPDATE_FAILURE_LOG:    "log",
+	UPDATE_FAILURE_RETRY:  "retry",
+	UPDATE_FAILURE_ALERT:  "alert",
+	UPDATE_FAILURE_REVIEW: "review",
+}
+
+func (p UpdateFailurePolicy) String() string {
+	if name, ok := updateFailurePolicyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseUpdateFailurePolicy returns the policy named "log", "retry",
+// "alert" or "review".
+func ParseUpdateFailurePolicy(name string) (UpdateFailurePolicy, error) {
+	for policy, policyName := range updateFailurePolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown update failure policy: %q", name)
+}
+
+// updateFailed applies the UpdateFailurePolicy to the messages of user
+// which the backend failed to remove.
+func (s *Server) updateFailed(c *Client, user backends.User, result backends.UpdateResult) {
+	policy := s.UpdateFailurePolicy
+	s.Metrics.Inc("update.failure", policy.String())
+	switch policy {
+	case UPDATE_FAILURE_RETRY:
+		s.mu.Lock()
+		if s.retries == nil {
+			s.retries = make(map[string][]string)
+		}
+		s.retries[user.Username()] = appendUids(s.retries[user.Username()], result.FailedUids)
+		s.mu.Unlock()
+		c.DebugLog.Printf("Messages %v of user %s not removed, retrying on next login", result.FailedUids, user.Username())
+	case UPDATE_FAILURE_ALERT:
+		c.ErrorLog.Printf("Messages %v of user %s not removed", result.FailedUids, user.Username())
+		c.exportEvent(Event{Type: EVENT_UPDATE_FAILED, FailedUids: result.FailedUids})
+	case UPDATE_FAILURE_REVIEW:
+		s.mu.Lock()
+		if s.reviews == nil {
+			s.reviews = make(map[string][]string)
+		}
+		s.reviews[user.Username()] = appendUids(s.reviews[user.Username()], result.FailedUids)
+		s.mu.Unlock()
+		c.ErrorLog.Printf("Messages %v of user %s not removed, maildrop flagged for review", result.FailedUids, user.Username())
+	default:
+		c.DebugLog.Printf("Messages %v of user %s not removed", result.FailedUids, user.Username())
+	}
+	if s.Hooks.OnUpdateFailure != nil {
+		s.Hooks.OnUpdateFailure(c, user, result, policy)
+	}
+}
+
+// appendUids appends the uids not in dst yet.
+func appendUids(dst, uids []string) []string {
+	for _, uid := range uids {
+		found := false
+		for _, d := range dst {
+			if d == uid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, uid)
+		}
+	}
+	return dst
+}
+
+// retryDeletions marks the messages of user, which the backend failed to
+// remove in an earlier session, as deleted, see UPDATE_FAILURE_RETRY.
+func (c *Client) retryDeletions(user backends.User) {
+	if !c.features.AllowDele {
+		return
+	}
+	c.server.mu.Lock()
+	uids, ok := c.server.retries[user.Username()]
+	delete(c.server.retries, user.Username())
+	c.server.mu.Unlock()
+	if !ok {
+		return
+	}
+	all, err := c.backend.Uidl(user)
+	if err != nil {
+		c.DebugLog.Printf("Error listing maildrop of user %s to retry deletions: %v", user.Username(), err)
+		c.server.mu.Lock()
+		c.server.retries[user.Username()] = appendUids(c.server.retries[user.Username()], uids)
+		c.server.mu.Unlock()
+		return
+	}
+	pending := make(map[string]bool)
+	for _, uid := range uids {
+		pending[uid] = true
+	}
+	for i, uid := range all {
+		if !pending[uid] {
+			continue
+		}
+		if err := c.backend.Dele(user, i+1); err != nil {
+			c.DebugLog.Printf("Error retrying deletion of message %s of user %s: %v", uid, user.Username(), err)
+			continue
+		}
+		c.server.Metrics.Inc("update.retried")
+	}
+}
+
+// Reviews returns the maildrops flagged for operator review by
+// UPDATE_FAILURE_REVIEW, mapping usernames to the UIDs of the messages not
+// removed.
+func (s *Server) Reviews() map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reviews := make(map[string][]string, len(s.reviews))
+	for username, uids := range s.reviews {
+		reviews[username] = append([]string(nil), uids...)
+	}
+	return reviews
+}
+
+// ResolveReview removes the review flag of the maildrop of username. It
+// returns false if it wasn't flagged.
+func (s *Server) ResolveReview(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.reviews[username]
+	delete(s.reviews, username)
+	return ok
+}
+
+// reviewUsernames returns the usernames of the flagged maildrops in order.
+func reviewUsernames(reviews map[string][]string) []string {
+	usernames := make([]string, 0, len(reviews))
+	for username := range reviews {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
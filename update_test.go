@@ -0,0 +1,154 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+	"github.com/kiwiz/popgun/backends/faulty"
+	"github.com/kiwiz/popgun/backends/memory"
+)
+
+// updateSession logs alice in, sends commands and returns the response to
+// the final QUIT.
+func updateSession(t *testing.T, listener *pipeListener, commands string) string {
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "USER alice\r\nPASS secret\r\n%sQUIT\r\n", commands)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "+OK Goodbye") || strings.HasPrefix(line, "-ERR some") {
+			return line
+		}
+	}
+}
+
+func newUpdateFailureServer(policy UpdateFailurePolicy) (*Server, *memory.Backend, *countingMetrics) {
+	maildrop := memory.New()
+	maildrop.Deliver("alice", "a", "Subject: a\r\n\r\nbody\r\n")
+	maildrop.Deliver("alice", "b", "Subject: b\r\n\r\nbody\r\n")
+	backend := faulty.New(maildrop)
+	backend.Inject(faulty.OP_UPDATE, faulty.Fault{FailUids: []string{"a"}, Times: 1})
+	metrics := newCountingMetrics()
+	server := NewServer(secretAuthorizator{}, backend)
+	server.AllowInsecureAuth = true
+	server.UpdateFailurePolicy = policy
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	return server, maildrop, metrics
+}
+
+func TestServer_UpdateFailurePolicy(t *testing.T) {
+	for _, policy := range []UpdateFailurePolicy{UPDATE_FAILURE_LOG, UPDATE_FAILURE_RETRY, UPDATE_FAILURE_ALERT, UPDATE_FAILURE_REVIEW} {
+		server, maildrop, metrics := newUpdateFailureServer(policy)
+		failures := make(chan UpdateFailurePolicy, 1)
+		server.Hooks.OnUpdateFailure = func(c *Client, user backends.User, result backends.UpdateResult, policy UpdateFailurePolicy) {
+			failures <- policy
+		}
+		events := make(channelProducer, 10)
+		server.Events = NewEventExporter(events)
+		listener := newPipeListener()
+		go server.Serve(listener)
+
+		if line := updateSession(t, listener, "DELE 1\r\nDELE 2\r\n"); line != "-ERR some deleted messages not removed\r\n" {
+			t.Errorf("Expected partial update with %s policy, but got %q", policy, line)
+		}
+		select {
+		case applied := <-failures:
+			if applied != policy {
+				t.Errorf("Expected %s policy applied, but got %s", policy, applied)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Expected OnUpdateFailure called with %s policy", policy)
+		}
+		if n := metrics.count("update.failure:" + policy.String()); n != 1 {
+			t.Errorf("Expected update failure counted with %s policy, but got %d", policy, n)
+		}
+
+		// the second session removes a with the retry policy only
+		expected := "+OK Goodbye (1 messages left)\r\n"
+		if policy == UPDATE_FAILURE_RETRY {
+			expected = "+OK Goodbye (maildrop empty)\r\n"
+		}
+		if line := updateSession(t, listener, ""); line != expected {
+			t.Errorf("Expected %q with %s policy, but got %q", expected, policy, line)
+		}
+		if uids := maildrop.Messages("alice"); policy == UPDATE_FAILURE_RETRY && len(uids) != 0 {
+			t.Errorf("Expected deletion retried, but got %v", uids)
+		}
+
+		reviews := server.Reviews()
+		if policy == UPDATE_FAILURE_REVIEW {
+			if !reflect.DeepEqual(reviews, map[string][]string{"alice": {"a"}}) {
+				t.Errorf("Expected maildrop of alice flagged, but got %v", reviews)
+			}
+		} else if len(reviews) != 0 {
+			t.Errorf("Expected no review with %s policy, but got %v", policy, reviews)
+		}
+
+		server.Shutdown(context.Background())
+		server.Events.Close()
+		alerted := false
+		for len(events) > 0 {
+			if event := <-events; event.Type == EVENT_UPDATE_FAILED {
+				alerted = true
+				if !reflect.DeepEqual(event.FailedUids, []string{"a"}) {
+					t.Errorf("Expected failed uid a, but got %v", event.FailedUids)
+				}
+			}
+		}
+		if alerted != (policy == UPDATE_FAILURE_ALERT) {
+			t.Errorf("Expected alert %v with %s policy, but got %v", policy == UPDATE_FAILURE_ALERT, policy, alerted)
+		}
+	}
+}
+
+func TestServer_AdminReviews(t *testing.T) {
+	server, _, _ := newUpdateFailureServer(UPDATE_FAILURE_REVIEW)
+	listener := newPipeListener()
+	go server.Serve(listener)
+	updateSession(t, listener, "DELE 1\r\n")
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/reviews")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := `[{"user":"alice","failed_uids":["a"]}]` + "\n"; string(body) != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, body)
+	}
+
+	for _, expected := range []int{http.StatusNoContent, http.StatusNotFound} {
+		resp, err = adminRequest(http.MethodPost, admin.URL+"/reviews/resolve?user=alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status %d, but got %d", expected, resp.StatusCode)
+		}
+	}
+	if reviews := server.Reviews(); len(reviews) != 0 {
+		t.Errorf("Expected review resolved, but got %v", reviews)
+	}
+}
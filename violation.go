@@ -0,0 +1,61 @@
+package popgun
+
+import (
+	"strings"
+)
+
+// Protocol violations, counted as "protocol.violation" labeled with the
+// kind of violation.
+const (
+	// the client sent commands before the greeting, see
+	// Server.PregreetDelay
+	VIOLATION_EARLY_TALKER = "early_talker"
+	// the client sent authentication commands before the greeting
+	VIOLATION_AUTH_BEFORE_GREETING = "auth_before_greeting"
+	VIOLATION_UNKNOWN_COMMAND      = "unknown_command"
+	// the command line exceeds MAX_COMMAND_LINE
+	VIOLATION_OVERSIZED_LINE = "oversized_line"
+)
+
+// MAX_COMMAND_LINE is the maximum length of a command line including CRLF
+// (RFC 2449). Longer lines are still executed, but counted as violations.
+const MAX_COMMAND_LINE = 255
+
+// violation counts a protocol violation of the client.
+func (c *Client) violation(kind string) {
+	c.server.Metrics.Inc("protocol.violation", kind)
+	c.DebugLog.Printf("[%d] Protocol violation (%s) by %s", c.id, kind, c.RemoteAddr())
+}
+
+// earlyViolation classifies input sent before the greeting.
+func (c *Client) earlyViolation(input string) string {
+	switch cmd, _ := c.parseInput(input); cmd {
+	case "USER", "PASS", "APOP", "AUTH":
+		return VIOLATION_AUTH_BEFORE_GREETING
+	}
+	return VIOLATION_EARLY_TALKER
+}
+
+// honeytoken reports whether cmd is one of the Server.Honeytokens.
+func (c *Client) honeytoken(cmd string) bool {
+	for _, token := range c.server.Honeytokens {
+		if strings.EqualFold(token, cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// tripHoneytoken handles the use of a honeytoken command: the source is
+// reported with SIGNAL_HONEYTOKEN, logged and counted as
+// "security.honeytoken", and the session ends like after an unknown
+// command.
+func (c *Client) tripHoneytoken(cmd string) {
+	c.ErrorLog.Printf("Honeytoken command %s used by %s", cmd, c.RemoteAddr())
+	c.server.Metrics.Inc("security.honeytoken", cmd)
+	c.ReportAbuse(SIGNAL_HONEYTOKEN)
+	c.printer.Err("Invalid command %s", cmd)
+	c.mu.Lock()
+	c.closeReason = CLOSE_PROTOCOL_ABUSE
+	c.mu.Unlock()
+}
@@ -0,0 +1,85 @@
+package popgun
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kiwiz/popgun/backends"
+)
+
+func TestClient_violation(t *testing.T) {
+	metrics := newCountingMetrics()
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.AllowInsecureAuth = true
+	server.PregreetDelay = time.Second
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// authentication before the greeting is only counted without
+	// RefuseDowngrade
+	fmt.Fprintf(conn, "USER john\r\n")
+	reader.ReadString('\n')
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "FOO\r\nNOOP %s\r\nQUIT\r\n", strings.Repeat("x", MAX_COMMAND_LINE))
+	ioutil.ReadAll(reader)
+
+	for _, kind := range []string{VIOLATION_AUTH_BEFORE_GREETING, VIOLATION_UNKNOWN_COMMAND, VIOLATION_OVERSIZED_LINE} {
+		if n := metrics.count("protocol.violation:" + kind); n != 1 {
+			t.Errorf("Expected 1 %s violation, but got %d", kind, n)
+		}
+	}
+	if n := metrics.count("protocol.violation:" + VIOLATION_EARLY_TALKER); n != 0 {
+		t.Errorf("Expected no other early talker, but got %d", n)
+	}
+}
+
+func TestClient_honeytoken(t *testing.T) {
+	metrics := newCountingMetrics()
+	listener := newPipeListener()
+	server := NewServer(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.AbuseScorer = NewDecayingScorer(time.Hour)
+	server.AbuseThresholds = AbuseThresholds{Ban: 20}
+	server.Honeytokens = []string{"XADMIN"}
+	server.Metrics = metrics
+	server.DebugLog = log.New(ioutil.Discard, "", 0)
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.Serve(listener)
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "xadmin\r\n")
+	response, _ := ioutil.ReadAll(conn)
+	if !strings.HasSuffix(string(response), "-ERR Invalid command XADMIN\r\n") {
+		t.Errorf("Expected session closed after honeytoken, but got %q", response)
+	}
+	if metrics.count("security.honeytoken:XADMIN") != 1 {
+		t.Errorf("Expected honeytoken counted")
+	}
+
+	// the source is banned
+	again, err := listener.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if greeting, _ := bufio.NewReader(again).ReadString('\n'); !strings.HasPrefix(greeting, "-ERR [SYS/TEMP]") {
+		t.Errorf("Expected banned source refused, but got %q", greeting)
+	}
+}